@@ -0,0 +1,42 @@
+package dkafka
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// isAuthorizationError tells if the kafka error is an ACL refusal
+func isAuthorizationError(err error) bool {
+	var kerr kafka.Error
+	if !errors.As(err, &kerr) {
+		return false
+	}
+	switch kerr.Code() {
+	case kafka.ErrTopicAuthorizationFailed, kafka.ErrClusterAuthorizationFailed, kafka.ErrGroupAuthorizationFailed:
+		return true
+	}
+	return false
+}
+
+// missingACL names the ACL the service account lacks when err is an authorization error,
+// the other errors are returned as is
+func missingACL(err error, operation string, resource string) error {
+	if !isAuthorizationError(err) {
+		return err
+	}
+	return fmt.Errorf("missing the %s ACL on %s: %w", operation, resource, err)
+}
+
+// topicMetadataError returns the error of the topic in the metadata response, the brokers
+// report an authorization failure there rather than failing the whole request
+func topicMetadataError(md *kafka.Metadata, topic string) error {
+	if md == nil {
+		return nil
+	}
+	if tmd, ok := md.Topics[topic]; ok && tmd.Error.Code() != kafka.ErrNoError {
+		return tmd.Error
+	}
+	return nil
+}
@@ -0,0 +1,892 @@
+package dkafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/dfuse-io/dfuse-eosio/filtering"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/interpreter"
+	"go.uber.org/zap"
+)
+
+// newStep is the raw step of the New events, used to reference them from the Undo events
+var newStep = pbbstream.ForkStep_STEP_NEW.String()
+
+// ValueTransformer replaces the standard JSON serialization of the event value, it does not apply
+// to the transaction granularity
+type ValueTransformer func(event *Event) ([]byte, error)
+
+// KeyTransformer replaces the message key, the ce_id header keeps using the logical key, it does not
+// apply to the transaction granularity
+type KeyTransformer func(key string, event *Event) ([]byte, error)
+
+type AdapterOption func(a *adapter)
+
+func WithValueTransformer(transformer ValueTransformer) AdapterOption {
+	return func(a *adapter) {
+		a.valueTransformer = transformer
+	}
+}
+
+func WithKeyTransformer(transformer KeyTransformer) AdapterOption {
+	return func(a *adapter) {
+		a.keyTransformer = transformer
+	}
+}
+
+// withPipeline restricts the adapter to the actions matching the pipeline filter
+func withPipeline(name string, filter cel.Program) AdapterOption {
+	return func(a *adapter) {
+		a.pipeline = name
+		a.filter = filter
+	}
+}
+
+// withErrorPolicy drops the messages whose failure class is skipped by the policy
+func withErrorPolicy(policy errorPolicy) AdapterOption {
+	return func(a *adapter) {
+		a.errorPolicy = policy
+	}
+}
+
+// withRamDeltas includes the RAM usage changes in the action payloads
+func withRamDeltas() AdapterOption {
+	return func(a *adapter) {
+		a.ramDeltas = true
+	}
+}
+
+// withConsole includes the console output of the actions in their payload, truncated to maxBytes
+func withConsole(maxBytes int) AdapterOption {
+	return func(a *adapter) {
+		a.console = true
+		a.consoleMaxBytes = maxBytes
+	}
+}
+
+// withMaxHeaderBytes fails (or skips, depending on the error policy) the messages whose headers
+// exceed the size
+func withMaxHeaderBytes(size int) AdapterOption {
+	return func(a *adapter) {
+		a.maxHeaderBytes = size
+	}
+}
+
+// withProjectedFields copies fields of the action data to the "fields" object of the payload, per
+// action name
+func withProjectedFields(fields map[string][]projectedField) AdapterOption {
+	return func(a *adapter) {
+		a.projectedFields = fields
+	}
+}
+
+// withMemoFields copies keys of the memos of the action data to the "fields" object of the
+// payload, per action name
+func withMemoFields(fields map[string][]memoField) AdapterOption {
+	return func(a *adapter) {
+		a.memoFields = fields
+	}
+}
+
+// withPartitionBy sets the partition key header of the events, evaluated by the program
+func withPartitionBy(prog cel.Program) AdapterOption {
+	return func(a *adapter) {
+		a.partitionBy = prog
+	}
+}
+
+// withTopicRouter sends the events to the topic of their type, the adapter topic if no route matches
+func withTopicRouter(r *topicRouter) AdapterOption {
+	return func(a *adapter) {
+		a.router = r
+	}
+}
+
+// withKeySets sends a copy of every event per key set, keyed by the key set expression
+func withKeySets(sets []*keySet) AdapterOption {
+	return func(a *adapter) {
+		a.keySets = sets
+	}
+}
+
+// withMaxActionDataBytes skips the actions with more data before they are decoded, an
+// OversizeSkipped stub event replaces them if stubs is set
+func withMaxActionDataBytes(size int, stubs bool) AdapterOption {
+	return func(a *adapter) {
+		a.maxActionDataBytes = size
+		a.oversizeStubs = stubs
+	}
+}
+
+// withDBOpSplit removes the db ops from the action events, each db op is sent as its own message
+func withDBOpSplit(split *dbOpSplit) AdapterOption {
+	return func(a *adapter) {
+		a.dbOps = split
+	}
+}
+
+// withSampler drops a share of the events of the actions matching the sampling rules
+func withSampler(s *sampler) AdapterOption {
+	return func(a *adapter) {
+		a.sampler = s
+	}
+}
+
+// withHeaderAllowlist counts only the allowed headers in the max header bytes, they are removed
+// before the sink
+func withHeaderAllowlist(allowlist headerAllowlist) AdapterOption {
+	return func(a *adapter) {
+		a.headerAllowlist = allowlist
+	}
+}
+
+// withPayloadVersion selects the shape of the JSON payloads, announced in the ce_dataschema header
+func withPayloadVersion(version string) AdapterOption {
+	return func(a *adapter) {
+		a.payloadVersion = version
+		a.dataSchemaHeader.Value = []byte(payloadDataSchema(version))
+	}
+}
+
+// withDeferredOrdinal leaves the ce_ordinal header empty, the adapted blocks being sent in another
+// order than adapted it is set by the send stage
+func withDeferredOrdinal() AdapterOption {
+	return func(a *adapter) {
+		a.deferOrdinal = true
+	}
+}
+
+// withEmbeddedKey duplicates the message key in the value, under "_key"
+func withEmbeddedKey() AdapterOption {
+	return func(a *adapter) {
+		a.embedKey = true
+	}
+}
+
+// adapter transforms the blocks received from the firehose into kafka messages
+type adapter struct {
+	topic                string
+	namespace            string // prefixed to the event types
+	programs             *programs
+	pipeline             string
+	filter               cel.Program // nil matches all the actions matched by the firehose
+	systemActionGen      *systemActionGenerator
+	primaryKeyRenderings map[string]string
+	granularity          string // "action" or "transaction"
+	compression          string // "none", "gzip" or "zstd"
+	payloadVersion       string // "v1" (default) or "v2"
+	ordinal              *ordinal
+	deferOrdinal         bool
+	lib                  *libTracker // adds the ce_libnum header if set
+	errorPolicy          errorPolicy
+	embedKey             bool
+	ramDeltas            bool
+	console              bool
+	consoleMaxBytes      int
+	maxHeaderBytes       int                         // keys and values, unbounded if zero
+	projectedFields      map[string][]projectedField // per action name
+	memoFields           map[string][]memoField      // per action name
+	headerAllowlist      headerAllowlist             // only the allowed headers count in the max header bytes
+	sampler              *sampler                    // nil if no event is sampled
+	router               *topicRouter                // routes the events to a topic per type, nil if they all go to topic
+	partitionBy          cel.Program                 // evaluates the partition key of the events, nil if none
+	keySets              []*keySet                   // copies of the events per key set, replacing the event keys if set
+
+	dbOps              *dbOpSplit // the db ops are sent as their own messages if set
+	maxActionDataBytes int        // the actions with more data are skipped before being decoded, unbounded if zero
+	oversizeStubs      bool       // an OversizeSkipped event replaces the skipped actions
+
+	sourceHeader          kafka.Header
+	specHeader            kafka.Header
+	contentTypeHeader     kafka.Header
+	dataContentTypeHeader kafka.Header
+	dataSchemaHeader      kafka.Header
+
+	valueTransformer ValueTransformer
+	keyTransformer   KeyTransformer
+}
+
+func newAdapter(
+	topic string,
+	namespace string,
+	eventSource string,
+	programs *programs,
+	granularity string,
+	compression string,
+	systemActionGen *systemActionGenerator,
+	primaryKeyRenderings map[string]string,
+	ordinal *ordinal,
+	opts ...AdapterOption,
+) *adapter {
+	a := &adapter{
+		topic:                topic,
+		namespace:            namespace,
+		programs:             programs,
+		granularity:          granularity,
+		compression:          compression,
+		systemActionGen:      systemActionGen,
+		primaryKeyRenderings: primaryKeyRenderings,
+		ordinal:              ordinal,
+		sourceHeader: kafka.Header{
+			Key:   "ce_source",
+			Value: []byte(eventSource),
+		},
+		specHeader: kafka.Header{
+			Key:   "ce_specversion",
+			Value: []byte("1.0"),
+		},
+		contentTypeHeader: kafka.Header{
+			Key:   "content-type",
+			Value: []byte(valueContentType(compression)),
+		},
+		dataContentTypeHeader: kafka.Header{
+			Key:   "ce_datacontenttype",
+			Value: []byte(valueContentType(compression)),
+		},
+		dataSchemaHeader: kafka.Header{
+			Key:   "ce_dataschema",
+			Value: []byte(payloadDataSchema(payloadV1)),
+		},
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// setPrograms replaces the expressions programs, it must be called between blocks
+func (a *adapter) setPrograms(programs *programs) {
+	a.programs = programs
+}
+
+// Adapt returns the messages generated by the matching actions of the block, it stops with the
+// context error once it is done
+func (a *adapter) Adapt(ctx context.Context, blk *pbcodec.Block, rawStep string) ([]*kafka.Message, error) {
+	var msgs []*kafka.Message
+	err := a.AdaptStream(ctx, blk, rawStep, func(msg *kafka.Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// AdaptStream passes the messages generated by the matching actions of the block to emit as they
+// are generated, so the block messages are never all held in memory; it stops with the first
+// error of emit or the context error once it is done
+func (a *adapter) AdaptStream(ctx context.Context, blk *pbcodec.Block, rawStep string, emit func(*kafka.Message) error) error {
+	return a.adaptStream(ctx, blk, rawStep, emit, &blockPhases{})
+}
+
+// adaptStream is AdaptStream adding the time spent in each phase to phases
+func (a *adapter) adaptStream(ctx context.Context, blk *pbcodec.Block, rawStep string, emit func(*kafka.Message) error, phases *blockPhases) error {
+	step := sanitizeStep(rawStep)
+	for _, trx := range blk.TransactionTraces() {
+		var err error
+		if a.granularity == "transaction" {
+			err = a.adaptTransaction(ctx, blk, trx, rawStep, step, emit, phases)
+		} else {
+			err = a.adaptActions(ctx, blk, trx, rawStep, step, emit, phases)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *adapter) adaptActions(ctx context.Context, blk *pbcodec.Block, trx *pbcodec.TransactionTrace, rawStep string, step string, emit func(*kafka.Message) error, phases *blockPhases) error {
+	memoizableTrxTrace := &filtering.MemoizableTrxTrace{TrxTrace: trx}
+	for _, act := range trx.ActionTraces {
+		if !act.FilteringMatched {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if act.Action == nil {
+			if err := missingAction(trx, act); !a.errorPolicy.skip(err) {
+				return err
+			}
+			continue
+		}
+		evalStart := time.Now()
+		activation := newEventActivation(blk, trx, act, filtering.NewActionTraceActivation(
+			act,
+			memoizableTrxTrace,
+			rawStep,
+		))
+		if !a.matches(activation) {
+			phases.eval += time.Since(evalStart)
+			continue
+		}
+		phases.eval += time.Since(evalStart)
+		phases.matchedActions++
+		if a.oversize(act) {
+			if a.oversizeStubs {
+				if err := a.oversizeStub(blk, trx, act, rawStep, step, emit); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		decodeStart := time.Now()
+		actionInfo, sysEvent, err := a.actionInfo(trx, act)
+		phases.decode += time.Since(decodeStart)
+		if err != nil {
+			if a.errorPolicy.skip(err) {
+				continue
+			}
+			return err
+		}
+		eosioAction := &Event{
+			BlockNum:      blk.Number,
+			BlockID:       blk.Id,
+			Status:        trxStatus(trx),
+			Executed:      !trx.HasBeenReverted(),
+			Step:          step,
+			TransactionID: trx.Id,
+			ActionInfo:    actionInfo,
+		}
+
+		evalStart = time.Now()
+		eventType, eventKeys, extensionsKV, err := a.eval(activation)
+		phases.eval += time.Since(evalStart)
+		if err != nil {
+			if a.errorPolicy.skip(err) {
+				continue
+			}
+			return err
+		}
+
+		if sysEvent != nil {
+			eventType = sysEvent.eventType
+			eventKeys = []string{sysEvent.key}
+		}
+
+		var value []byte
+		if !a.embedKey {
+			marshalStart := time.Now()
+			if value, err = a.value(eosioAction); err != nil {
+				return err
+			}
+			phases.marshal += time.Since(marshalStart)
+		}
+
+		evalStart = time.Now()
+		keyed, err := a.keyed(activation, eventKeys)
+		phases.eval += time.Since(evalStart)
+		if err != nil {
+			if a.errorPolicy.skip(err) {
+				continue
+			}
+			return err
+		}
+
+		var parent *dbOpParent
+		sampling := a.sampler.rule(activation, act.Action.Name, step)
+		for _, copies := range keyed {
+			for _, eventKey := range dedupeKeys(copies.keys) {
+				if !a.sampler.keep(sampling, eventKey) {
+					continue
+				}
+				if a.embedKey {
+					marshalStart := time.Now()
+					eosioAction.Key = eventKey
+					if value, err = a.value(eosioAction); err != nil {
+						return err
+					}
+					phases.marshal += time.Since(marshalStart)
+				}
+				key, err := a.key(eventKey, eosioAction)
+				if err != nil {
+					return err
+				}
+				ceID := hashString(fmt.Sprintf("%s%s%d%s%s", blk.Id, trx.Id, act.ExecutionIndex, rawStep, eventKey))
+				var undoOf []byte
+				if step == undoStep {
+					undoOf = hashString(fmt.Sprintf("%s%s%d%s%s", blk.Id, trx.Id, act.ExecutionIndex, newStep, eventKey))
+				}
+				msg, err := a.keyedMessage(copies, blk, step, ceID, undoOf, eventType, extensionsKV, key, value)
+				if err != nil {
+					if a.errorPolicy.skip(err) {
+						continue
+					}
+					return err
+				}
+				if parent == nil && a.dbOps != nil {
+					parent = newDBOpParent(msg, withLabel(undoOf, copies.label))
+				}
+				if err := emit(msg); err != nil {
+					return err
+				}
+			}
+		}
+		if parent != nil {
+			if err := a.emitDBOps(activation, blk, trx, step, actionInfo, "", parent, emit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adaptTransaction generates the messages of a single event holding all the matching actions of the
+// transaction, the expressions are evaluated against the first matching action with the union of
+// the authorizations of the matching actions
+func (a *adapter) adaptTransaction(ctx context.Context, blk *pbcodec.Block, trx *pbcodec.TransactionTrace, rawStep string, step string, emit func(*kafka.Message) error, phases *blockPhases) error {
+	var first *pbcodec.ActionTrace
+	var actionInfos []ActionInfo
+	var auths []string
+	seenAuths := make(map[string]bool)
+	memoizableTrxTrace := &filtering.MemoizableTrxTrace{TrxTrace: trx}
+	for _, act := range trx.ActionTraces {
+		if !act.FilteringMatched {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if act.Action == nil {
+			if err := missingAction(trx, act); !a.errorPolicy.skip(err) {
+				return err
+			}
+			continue
+		}
+		evalStart := time.Now()
+		matched := a.matches(newEventActivation(blk, trx, act, filtering.NewActionTraceActivation(act, memoizableTrxTrace, rawStep)))
+		phases.eval += time.Since(evalStart)
+		if !matched {
+			continue
+		}
+		phases.matchedActions++
+		if a.oversize(act) {
+			if a.oversizeStubs {
+				if err := a.oversizeStub(blk, trx, act, rawStep, step, emit); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		decodeStart := time.Now()
+		actionInfo, _, err := a.actionInfo(trx, act)
+		phases.decode += time.Since(decodeStart)
+		if err != nil {
+			if a.errorPolicy.skip(err) {
+				continue // only the failing action is dropped from the transaction
+			}
+			return err
+		}
+		if first == nil {
+			first = act
+		}
+		actionInfos = append(actionInfos, actionInfo)
+		for _, auth := range actionInfo.Authorization {
+			if !seenAuths[auth] {
+				seenAuths[auth] = true
+				auths = append(auths, auth)
+			}
+		}
+	}
+	if first == nil {
+		return nil
+	}
+
+	activation := &transactionActivation{
+		Activation: newEventActivation(blk, trx, first, filtering.NewActionTraceActivation(first, memoizableTrxTrace, rawStep)),
+		auths:      auths,
+	}
+	evalStart := time.Now()
+	eventType, eventKeys, extensionsKV, err := a.eval(activation)
+	phases.eval += time.Since(evalStart)
+	if err != nil {
+		if a.errorPolicy.skip(err) {
+			return nil
+		}
+		return err
+	}
+
+	trxEvent := &TransactionEvent{
+		BlockNum:      blk.Number,
+		BlockID:       blk.Id,
+		Status:        trxStatus(trx),
+		Executed:      !trx.HasBeenReverted(),
+		Step:          step,
+		TransactionID: trx.Id,
+		ActionInfos:   actionInfos,
+	}
+	var value []byte
+	if !a.embedKey {
+		marshalStart := time.Now()
+		if value, err = compressValue(a.compression, a.payload(marshalTransactionEvent(a.payloadVersion, trxEvent))); err != nil {
+			return err
+		}
+		phases.marshal += time.Since(marshalStart)
+	}
+
+	evalStart = time.Now()
+	keyed, err := a.keyed(activation, eventKeys)
+	phases.eval += time.Since(evalStart)
+	if err != nil {
+		if a.errorPolicy.skip(err) {
+			return nil
+		}
+		return err
+	}
+
+	var parent *dbOpParent
+	sampling := a.sampler.rule(activation, first.Action.Name, step)
+	for _, copies := range keyed {
+		for _, eventKey := range dedupeKeys(copies.keys) {
+			if !a.sampler.keep(sampling, eventKey) {
+				continue
+			}
+			if a.embedKey {
+				marshalStart := time.Now()
+				trxEvent.Key = eventKey
+				if value, err = compressValue(a.compression, a.payload(marshalTransactionEvent(a.payloadVersion, trxEvent))); err != nil {
+					return err
+				}
+				phases.marshal += time.Since(marshalStart)
+			}
+			ceID := hashString(fmt.Sprintf("%s%s%s%s", blk.Id, trx.Id, rawStep, eventKey))
+			var undoOf []byte
+			if step == undoStep {
+				undoOf = hashString(fmt.Sprintf("%s%s%s%s", blk.Id, trx.Id, newStep, eventKey))
+			}
+			msg, err := a.keyedMessage(copies, blk, step, ceID, undoOf, eventType, extensionsKV, []byte(eventKey), value)
+			if err != nil {
+				if a.errorPolicy.skip(err) {
+					continue
+				}
+				return err
+			}
+			if parent == nil && a.dbOps != nil {
+				parent = newDBOpParent(msg, withLabel(undoOf, copies.label))
+			}
+			if err := emit(msg); err != nil {
+				return err
+			}
+		}
+	}
+	if parent != nil {
+		for i, info := range actionInfos {
+			if err := a.emitDBOps(activation, blk, trx, step, info, strconv.Itoa(i)+":", parent, emit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// missingAction is the failure of a matching action trace without its action, the firehose
+// sometimes sends partially populated traces
+func missingAction(trx *pbcodec.TransactionTrace, act *pbcodec.ActionTrace) error {
+	return classify(failureIncompleteTrace, fmt.Errorf("action trace %d of transaction %s has no action", act.ExecutionIndex, trx.Id))
+}
+
+// matches evaluates the pipeline filter, like the firehose an evaluation error does not match
+func (a *adapter) matches(activation interpreter.Activation) bool {
+	if a.filter == nil {
+		return true
+	}
+	matched, err := evalBool(a.filter, activation)
+	if err != nil {
+		zlog.Debug("pipeline filter failed", zap.String("pipeline", a.pipeline), zap.Error(err))
+		return false
+	}
+	return matched
+}
+
+// actionInfo returns the payload of the action, and its system event in system actions mode
+func (a *adapter) actionInfo(trx *pbcodec.TransactionTrace, act *pbcodec.ActionTrace) (ActionInfo, *systemEvent, error) {
+	var jsonData json.RawMessage
+	if act.Action.JsonData != "" {
+		jsonData = json.RawMessage(act.Action.JsonData)
+	}
+
+	var auths []string
+	for _, auth := range act.Action.Authorization {
+		auths = append(auths, auth.Authorization())
+	}
+
+	var globalSeq uint64
+	if act.Receipt != nil {
+		globalSeq = act.Receipt.GlobalSequence
+	}
+	dbOps, err := newDBOps(trx.DBOpsForAction(act.ExecutionIndex), a.primaryKeyRenderings)
+	if err != nil {
+		return ActionInfo{}, nil, err
+	}
+	actionInfo := ActionInfo{
+		Account:        act.Account(),
+		Receiver:       act.Receiver,
+		Action:         act.Name(),
+		JSONData:       &jsonData,
+		DBOps:          dbOps,
+		Authorization:  auths,
+		GlobalSequence: globalSeq,
+	}
+	if a.ramDeltas {
+		actionInfo.RamDeltas = newRamDeltas(trx.RAMOpsForAction(act.ExecutionIndex))
+	}
+	if a.console {
+		actionInfo.Console = truncateConsole(actionConsole(act), a.consoleMaxBytes)
+	}
+	if fields, ok := a.projectedFields[act.Name()]; ok {
+		if actionInfo.Fields, err = projectFields(fields, act.Action.JsonData); err != nil {
+			return ActionInfo{}, nil, err
+		}
+	}
+	if fields, ok := a.memoFields[act.Name()]; ok {
+		if actionInfo.Fields == nil {
+			actionInfo.Fields = make(map[string]interface{}, len(fields))
+		}
+		if err = extractMemoFields(actionInfo.Fields, fields, act.Action.JsonData); err != nil {
+			return ActionInfo{}, nil, err
+		}
+	}
+
+	if a.systemActionGen == nil {
+		return actionInfo, nil, nil
+	}
+	sysEvent, err := a.systemActionGen.Apply(act)
+	if err != nil {
+		return ActionInfo{}, nil, err
+	}
+	if sysEvent != nil {
+		actionInfo.CodeHash = sysEvent.codeHash
+	}
+	return actionInfo, sysEvent, nil
+}
+
+// eval returns the event type, keys and extensions of the activation
+func (a *adapter) eval(activation interpreter.Activation) (string, []string, map[string]string, error) {
+	eventType, err := evalString(a.programs.eventType, activation)
+	if err != nil {
+		return "", nil, nil, classify(failureEventType, fmt.Errorf("error eventtype eval: %w", err))
+	}
+
+	extensionsKV := make(map[string]string)
+	for _, ext := range a.programs.extensions {
+		val, err := evalString(ext.prog, activation)
+		if err != nil {
+			return "", nil, nil, classify(failureExtension, fmt.Errorf("program: %w", err))
+		}
+		if val, err = sanitizeExtensionValue(ext.name, val); err != nil {
+			return "", nil, nil, err
+		}
+		extensionsKV[ext.name] = val
+	}
+
+	if a.programs.subject != nil {
+		subject, err := evalString(a.programs.subject, activation)
+		if err != nil {
+			return "", nil, nil, classify(failureSubject, fmt.Errorf("event subject eval: %w", err))
+		}
+		if subject != "" {
+			extensionsKV["ce_subject"] = subject
+		}
+	}
+
+	if a.partitionBy != nil {
+		partitionKey, err := evalString(a.partitionBy, activation)
+		if err != nil {
+			return "", nil, nil, classify(failurePartitionKey, fmt.Errorf("partition by eval: %w", err))
+		}
+		extensionsKV[partitionKeyHeader] = partitionKey
+	}
+
+	eventKeys, err := evalStringArray(a.programs.eventKeys, activation)
+	if err != nil {
+		return "", nil, nil, classify(failureEventKey, fmt.Errorf("event keyeval: %w", err))
+	}
+	return eventType, eventKeys, extensionsKV, nil
+}
+
+// message builds the message of an event, undoOf is the ce_id of the New event reverted by an Undo event.
+// The extensions replace the headers of the same name, and the headers must fit in the max header bytes.
+func (a *adapter) message(blk *pbcodec.Block, step string, ceID []byte, undoOf []byte, eventType string, extensionsKV map[string]string, key []byte, value []byte) (*kafka.Message, error) {
+	blkTime := blockTime(blk)
+	if blkTime.IsZero() {
+		return nil, classify(failureIncompleteTrace, fmt.Errorf("block %d has no time, cannot set the ce_time of event %s", blk.Number, ceID))
+	}
+	var previousID string
+	if blk.Header != nil {
+		previousID = blk.Header.Previous
+	}
+	headers := []kafka.Header{
+		kafka.Header{
+			Key:   "ce_id",
+			Value: ceID,
+		},
+		a.sourceHeader,
+		a.specHeader,
+		kafka.Header{
+			Key:   "ce_type",
+			Value: []byte(namespacedEventType(a.namespace, eventType)),
+		},
+		a.contentTypeHeader,
+		kafka.Header{
+			Key:   "ce_time",
+			Value: []byte(blkTime.Format("2006-01-02T15:04:05.9Z")),
+		},
+		a.dataContentTypeHeader,
+		a.dataSchemaHeader,
+		{
+			Key:   "ce_blkstep",
+			Value: []byte(step),
+		},
+		{
+			Key:   "ce_blkid",
+			Value: []byte(blk.Id),
+		},
+		{
+			Key:   "ce_previousblkid",
+			Value: []byte(previousID),
+		},
+		{
+			Key:   "ce_ordinal",
+			Value: a.nextOrdinal(),
+		},
+	}
+	if undoOf != nil {
+		headers = append(headers, kafka.Header{
+			Key:   "ce_undo_of",
+			Value: undoOf,
+		})
+	}
+	if a.lib != nil {
+		headers = append(headers, libHeader(a.lib))
+	}
+	extensionNames := make([]string, 0, len(extensionsKV))
+	for k := range extensionsKV {
+		extensionNames = append(extensionNames, k)
+	}
+	sort.Strings(extensionNames)
+	for _, k := range extensionNames {
+		headers = setHeader(headers, k, []byte(extensionsKV[k]))
+	}
+	if a.maxHeaderBytes > 0 {
+		size := 0
+		for _, h := range headers {
+			if a.headerAllowlist.allowed(h.Key) {
+				size += len(h.Key) + len(h.Value)
+			}
+		}
+		if size > a.maxHeaderBytes {
+			return nil, classify(failureHeaderSize, fmt.Errorf("headers of event %s are %d bytes, above the max of %d", ceID, size, a.maxHeaderBytes))
+		}
+	}
+	topic := &a.topic
+	if a.router != nil {
+		if routed := a.router.topic(eventType); routed != "" {
+			topic = &routed
+		}
+	}
+	return &kafka.Message{
+		Key:     key,
+		Headers: headers,
+		Value:   value,
+		TopicPartition: kafka.TopicPartition{
+			Topic: topic,
+		},
+	}, nil
+}
+
+// keyedMessage builds the message of a copy of an event, sent to the topic of its key set
+func (a *adapter) keyedMessage(copies keyedEvents, blk *pbcodec.Block, step string, ceID []byte, undoOf []byte, eventType string, extensionsKV map[string]string, key []byte, value []byte) (*kafka.Message, error) {
+	msg, err := a.message(blk, step, withLabel(ceID, copies.label), withLabel(undoOf, copies.label), eventType, extensionsKV, key, value)
+	if err != nil || copies.topic == "" {
+		return msg, err
+	}
+	msg.TopicPartition.Topic = &copies.topic
+	KeySetMessages.Inc(copies.label)
+	return msg, nil
+}
+
+func (a *adapter) nextOrdinal() []byte {
+	if a.deferOrdinal {
+		return nil
+	}
+	return []byte(strconv.FormatUint(a.ordinal.next(), 10))
+}
+
+// setHeader replaces the header of the same key, if any, so the last value wins
+func setHeader(headers []kafka.Header, key string, value []byte) []kafka.Header {
+	for i := range headers {
+		if headers[i].Key == key {
+			headers[i].Value = value
+			return headers
+		}
+	}
+	return append(headers, kafka.Header{Key: key, Value: value})
+}
+
+// dedupeKeys removes the duplicated keys, keeping their order
+func dedupeKeys(keys []string) []string {
+	var out []string
+	dedupeMap := make(map[string]bool)
+	for _, key := range keys {
+		if dedupeMap[key] {
+			continue
+		}
+		dedupeMap[key] = true
+		out = append(out, key)
+	}
+	return out
+}
+
+// transactionActivation resolves auth to the authorizations of all the matching actions
+type transactionActivation struct {
+	interpreter.Activation
+	auths []string
+}
+
+func (a *transactionActivation) ResolveName(name string) (interface{}, bool) {
+	if name == "auth" {
+		return a.auths, true
+	}
+	return a.Activation.ResolveName(name)
+}
+
+func (a *adapter) value(event *Event) ([]byte, error) {
+	if a.valueTransformer == nil {
+		return compressValue(a.compression, a.payload(marshalEvent(a.payloadVersion, event)))
+	}
+	value, err := a.valueTransformer(event)
+	if err != nil {
+		return nil, fmt.Errorf("transforming value: %w", err)
+	}
+	return compressValue(a.compression, value)
+}
+
+// payload removes the db ops of the event payload when they are sent as their own messages
+func (a *adapter) payload(value []byte) []byte {
+	if a.dbOps == nil {
+		return value
+	}
+	return withoutDBOps(value)
+}
+
+func (a *adapter) key(eventKey string, event *Event) ([]byte, error) {
+	if a.keyTransformer == nil {
+		return []byte(eventKey), nil
+	}
+	key, err := a.keyTransformer(eventKey, event)
+	if err != nil {
+		return nil, fmt.Errorf("transforming key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,374 @@
+package dkafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTransferBlock returns a block of transfers, one per transaction, flagged as matched by the
+// include filter of validTestConfig as the firehose does
+func testTransferBlock(num uint32, transfers int) *pbcodec.Block {
+	ts, _ := ptypes.TimestampProto(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC))
+	blk := &pbcodec.Block{
+		Id:     fmt.Sprintf("%08x%056d", num, 0),
+		Number: num,
+		Header: &pbcodec.BlockHeader{Timestamp: ts, Producer: "eosio", Previous: fmt.Sprintf("%08x%056d", num-1, 0)},
+	}
+	for i := 0; i < transfers; i++ {
+		data := fmt.Sprintf(`{"from":"alice","to":"bob%d","quantity":"1.0000 EOS","memo":"order:%d;ref:abc"}`, i%100, i)
+		blk.UnfilteredTransactionTraces = append(blk.UnfilteredTransactionTraces, &pbcodec.TransactionTrace{
+			Id:       fmt.Sprintf("%064x", uint64(num)<<32|uint64(i)),
+			BlockNum: uint64(num),
+			Index:    uint64(i),
+			Receipt:  &pbcodec.TransactionReceiptHeader{Status: pbcodec.TransactionStatus_TRANSACTIONSTATUS_EXECUTED},
+			ActionTraces: []*pbcodec.ActionTrace{{
+				Receiver: "eosio.token",
+				Action: &pbcodec.Action{
+					Account:       "eosio.token",
+					Name:          "transfer",
+					Authorization: []*pbcodec.PermissionLevel{{Actor: "alice", Permission: "active"}},
+					JsonData:      data,
+				},
+				Receipt:          &pbcodec.ActionReceipt{Receiver: "eosio.token", GlobalSequence: uint64(num)<<32 | uint64(i)},
+				ActionOrdinal:    1,
+				FilteringMatched: true,
+			}},
+		})
+	}
+	return blk
+}
+
+func testAdapter(tb testing.TB, config *Config) *adapter {
+	adapters, err := New(config).adapters(nil, &ordinal{}, &libTracker{})
+	require.NoError(tb, err)
+	require.Len(tb, adapters, 1)
+	return adapters[0]
+}
+
+func TestUndoMessagesReferenceTheNewOnes(t *testing.T) {
+	for _, granularity := range []string{"action", "transaction"} {
+		t.Run(granularity, func(t *testing.T) {
+			config := validTestConfig()
+			config.EventGranularity = granularity
+			adapter := testAdapter(t, config)
+			blk := testTransferBlock(10, 2)
+
+			news, err := adapter.Adapt(context.Background(), blk, pbbstream.ForkStep_STEP_NEW.String())
+			require.NoError(t, err)
+			undos, err := adapter.Adapt(context.Background(), blk, pbbstream.ForkStep_STEP_UNDO.String())
+			require.NoError(t, err)
+			require.Len(t, undos, len(news))
+			for i := range news {
+				assert.Equal(t, "", headerValue(news[i].Headers, "ce_undo_of"))
+				assert.Equal(t, undoStep, headerValue(undos[i].Headers, "ce_blkstep"))
+				assert.Equal(t, headerValue(news[i].Headers, "ce_id"), headerValue(undos[i].Headers, "ce_undo_of"))
+			}
+		})
+	}
+}
+
+func TestUndoOversizeStubsReferenceTheNewOnes(t *testing.T) {
+	config := validTestConfig()
+	config.MaxActionDataBytes = 10
+	config.OversizeSkippedEvents = true
+	adapter := testAdapter(t, config)
+	blk := testTransferBlock(10, 2)
+
+	news, err := adapter.Adapt(context.Background(), blk, pbbstream.ForkStep_STEP_NEW.String())
+	require.NoError(t, err)
+	undos, err := adapter.Adapt(context.Background(), blk, pbbstream.ForkStep_STEP_UNDO.String())
+	require.NoError(t, err)
+	require.Len(t, news, 2)
+	require.Len(t, undos, len(news))
+	for i := range news {
+		assert.Equal(t, headerValue(news[i].Headers, "ce_id"), headerValue(undos[i].Headers, "ce_undo_of"))
+	}
+}
+
+func TestTransactionSkipsTheUndecodableActionOnly(t *testing.T) {
+	config := validTestConfig()
+	config.EventGranularity = "transaction"
+	config.ProjectedFields = map[string][]string{"transfer": {"quantity:string"}}
+	config.OnError = map[string]string{failureProjectedField: "skip"}
+	blk := testTransferBlock(10, 3)
+	trx := blk.UnfilteredTransactionTraces[0]
+	for i, other := range blk.UnfilteredTransactionTraces[1:] {
+		act := other.ActionTraces[0]
+		act.ExecutionIndex, act.ActionOrdinal = uint32(i+1), uint32(i+2)
+		trx.ActionTraces = append(trx.ActionTraces, act)
+	}
+	blk.UnfilteredTransactionTraces = blk.UnfilteredTransactionTraces[:1]
+	trx.ActionTraces[1].Action.JsonData = `{"from":`
+
+	msgs, err := testAdapter(t, config).Adapt(context.Background(), blk, pbbstream.ForkStep_STEP_NEW.String())
+	require.NoError(t, err)
+	require.NotEmpty(t, msgs)
+	var event TransactionEvent
+	require.NoError(t, json.Unmarshal(msgs[0].Value, &event))
+	require.Len(t, event.ActionInfos, 2)
+	assert.Equal(t, "1.0000 EOS", event.ActionInfos[0].Fields["quantity"])
+	assert.Contains(t, string(*event.ActionInfos[0].JSONData), `"to":"bob0"`)
+	assert.Contains(t, string(*event.ActionInfos[1].JSONData), `"to":"bob2"`)
+}
+
+func TestMessagesDoNotShareTheirHeaders(t *testing.T) {
+	config := validTestConfig()
+	config.EventExtensions = map[string]string{"recipient": "string(data.to)", "order": "string(data.memo)"}
+	msgs, err := testAdapter(t, config).Adapt(context.Background(), testTransferBlock(10, 2), pbbstream.ForkStep_STEP_NEW.String())
+	require.NoError(t, err)
+	require.Len(t, msgs, 4) // keyed by from and to, per action
+
+	for i, msg := range msgs {
+		recipient := fmt.Sprintf("bob%d", i/2)
+		other := fmt.Sprintf("bob%d", 1-i/2)
+		assert.Equal(t, recipient, headerValue(msg.Headers, "recipient"))
+		seen := map[string]bool{}
+		for _, h := range msg.Headers {
+			assert.False(t, seen[h.Key], "header %s set twice", h.Key)
+			seen[h.Key] = true
+			assert.NotEqual(t, other, string(h.Value), "header %s of message %d", h.Key, i)
+			assert.NotContains(t, string(h.Value), fmt.Sprintf("order:%d;", 1-i/2), "header %s of message %d", h.Key, i)
+		}
+	}
+}
+
+func TestMaxHeaderBytesAppliesTheErrorPolicy(t *testing.T) {
+	config := validTestConfig()
+	config.MaxHeaderBytes = 64
+	_, err := testAdapter(t, config).Adapt(context.Background(), testTransferBlock(10, 1), pbbstream.ForkStep_STEP_NEW.String())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "above the max of 64")
+
+	config.OnError = map[string]string{failureHeaderSize: "skip"}
+	msgs, err := testAdapter(t, config).Adapt(context.Background(), testTransferBlock(10, 1), pbbstream.ForkStep_STEP_NEW.String())
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	config.MaxHeaderBytes = 4096
+	msgs, err = testAdapter(t, config).Adapt(context.Background(), testTransferBlock(10, 1), pbbstream.ForkStep_STEP_NEW.String())
+	require.NoError(t, err)
+	assert.Len(t, msgs, 2)
+}
+
+// heapInUse returns the bytes of the live objects, after a collection
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// BenchmarkAdaptLargeBlock compares the memory held while adapting a block of 20000 matching
+// actions when all its messages are built before being sent (Adapt) and when each one is sent as
+// it is built (AdaptStream), the send being a no-op: the peak-heap-bytes metric is the largest heap
+// growth over the block
+func BenchmarkAdaptLargeBlock(b *testing.B) {
+	const transfers = 20000
+	blk := testTransferBlock(10, transfers)
+	adapter := testAdapter(b, validTestConfig())
+	step := pbbstream.ForkStep_STEP_IRREVERSIBLE.String()
+
+	b.Run("slice", func(b *testing.B) {
+		b.ReportAllocs()
+		var peak uint64
+		for i := 0; i < b.N; i++ {
+			before := heapInUse()
+			msgs, err := adapter.Adapt(context.Background(), blk, step)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			if held := heapInUse() - before; held > peak {
+				peak = held
+			}
+			runtime.KeepAlive(msgs) // held until the block is sent
+			if len(msgs) != 2*transfers {
+				b.Fatalf("got %d messages", len(msgs))
+			}
+			b.StartTimer()
+		}
+		b.ReportMetric(float64(peak), "peak-heap-bytes")
+	})
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		var peak uint64
+		for i := 0; i < b.N; i++ {
+			before := heapInUse()
+			sent := 0
+			err := adapter.AdaptStream(context.Background(), blk, step, func(msg *kafka.Message) error {
+				sent++
+				if sent%(transfers/10) == 0 { // sampled, reading the heap stops the world
+					b.StopTimer()
+					if held := heapInUse() - before; held > peak {
+						peak = held
+					}
+					b.StartTimer()
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if sent != 2*transfers {
+				b.Fatalf("got %d messages", sent)
+			}
+		}
+		b.ReportMetric(float64(peak), "peak-heap-bytes")
+	})
+}
+
+// testFullBlock adds to a transfer block the parts the firehose trims from the light blocks: the db
+// ops, ram ops, console, raw data next to the JSON data and the header fields
+func testFullBlock(num uint32, transfers int) *pbcodec.Block {
+	blk := testTransferBlock(num, transfers)
+	blk.Header.Confirmed = 240
+	blk.Header.TransactionMroot = make([]byte, 32)
+	blk.Header.ActionMroot = make([]byte, 32)
+	blk.Header.ScheduleVersion = 7
+	blk.ProducerSignature = "SIG_K1_" + strings.Repeat("x", 94)
+	for _, trx := range blk.UnfilteredTransactionTraces {
+		act := trx.ActionTraces[0]
+		act.Action.RawData = make([]byte, 48)
+		act.Console = "transferred"
+		for _, owner := range []string{"alice", act.Action.Authorization[0].Actor} {
+			trx.DbOps = append(trx.DbOps, &pbcodec.DBOp{
+				Operation:  pbcodec.DBOp_OPERATION_UPDATE,
+				Code:       "eosio.token",
+				Scope:      owner,
+				TableName:  "accounts",
+				PrimaryKey: "EOS",
+				OldPayer:   owner,
+				NewPayer:   owner,
+				OldData:    make([]byte, 16),
+				NewData:    make([]byte, 16),
+			})
+		}
+		trx.RamOps = []*pbcodec.RAMOp{{ActionIndex: 0, Payer: "alice", Delta: 128, Usage: 4096}}
+	}
+	return blk
+}
+
+// testLightBlock trims a block as the firehose does for the light detail level
+func testLightBlock(full *pbcodec.Block) *pbcodec.Block {
+	blk := proto.Clone(full).(*pbcodec.Block)
+	blk.Header = &pbcodec.BlockHeader{Timestamp: full.Header.Timestamp, Producer: full.Header.Producer}
+	blk.ProducerSignature = ""
+	for _, trx := range blk.UnfilteredTransactionTraces {
+		trx.DbOps, trx.RamOps = nil, nil
+		for _, act := range trx.ActionTraces {
+			act.Console = ""
+			if act.Action.JsonData != "" {
+				act.Action.RawData = nil
+			}
+		}
+	}
+	return blk
+}
+
+// BenchmarkBlockDetailLevel compares the full and light blocks of 2000 transfers, from the bytes
+// received (the wire-bytes metric) to the messages built, decoding included in the allocations
+func BenchmarkBlockDetailLevel(b *testing.B) {
+	const transfers = 2000
+	full := testFullBlock(10, transfers)
+	adapter := testAdapter(b, validTestConfig())
+	step := pbbstream.ForkStep_STEP_NEW.String()
+
+	for _, level := range []struct {
+		name string
+		blk  *pbcodec.Block
+	}{
+		{"full", full},
+		{"light", testLightBlock(full)},
+	} {
+		data, err := proto.Marshal(level.blk)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(level.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(data)), "wire-bytes")
+			for i := 0; i < b.N; i++ {
+				blk := &pbcodec.Block{}
+				if err := proto.Unmarshal(data, blk); err != nil {
+					b.Fatal(err)
+				}
+				msgs, err := adapter.Adapt(context.Background(), blk, step)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(msgs) != 2*transfers {
+					b.Fatalf("got %d messages", len(msgs))
+				}
+			}
+		})
+	}
+}
+
+func TestPartiallyPopulatedTraces(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(blk *pbcodec.Block)
+		status string
+		err    string
+	}{
+		{"complete", func(blk *pbcodec.Block) {}, "EXECUTED", ""},
+		{"nil receipt", func(blk *pbcodec.Block) { blk.UnfilteredTransactionTraces[0].Receipt = nil }, "NONE", ""},
+		{"nil action receipt", func(blk *pbcodec.Block) { blk.UnfilteredTransactionTraces[0].ActionTraces[0].Receipt = nil }, "EXECUTED", ""},
+		{"empty json data with raw data", func(blk *pbcodec.Block) {
+			act := blk.UnfilteredTransactionTraces[0].ActionTraces[0]
+			act.Action.JsonData, act.Action.RawData = "", []byte{0x01, 0x02}
+		}, "EXECUTED", ""},
+		{"missing block time", func(blk *pbcodec.Block) { blk.Header.Timestamp = nil }, "", "has no time"},
+		{"missing block header", func(blk *pbcodec.Block) { blk.Header = nil }, "", "has no time"},
+		{"matched action trace without action", func(blk *pbcodec.Block) {
+			blk.UnfilteredTransactionTraces[0].ActionTraces[0].Action = nil
+		}, "", "has no action"},
+	}
+	for _, granularity := range []string{"action", "transaction"} {
+		for _, test := range tests {
+			t.Run(granularity+" "+test.name, func(t *testing.T) {
+				config := validTestConfig()
+				config.EventGranularity = granularity
+				config.EventKeysExpr = `[first_authorizer]` // data is null without json data
+				blk := testTransferBlock(10, 1)
+				test.mutate(blk)
+
+				msgs, err := testAdapter(t, config).Adapt(context.Background(), blk, pbbstream.ForkStep_STEP_NEW.String())
+				if test.err != "" {
+					require.Error(t, err)
+					assert.Contains(t, err.Error(), test.err)
+					var cerr *classifiedError
+					require.True(t, errors.As(err, &cerr), "got %v", err)
+					assert.Equal(t, failureIncompleteTrace, cerr.class)
+
+					config.OnError = map[string]string{failureIncompleteTrace: "skip"}
+					msgs, err = testAdapter(t, config).Adapt(context.Background(), blk, pbbstream.ForkStep_STEP_NEW.String())
+					require.NoError(t, err)
+					assert.Empty(t, msgs)
+					return
+				}
+				require.NoError(t, err)
+				require.Len(t, msgs, 1)
+				var event struct {
+					Status string `json:"status"`
+				}
+				require.NoError(t, json.Unmarshal(msgs[0].Value, &event))
+				assert.Equal(t, test.status, event.Status)
+			})
+		}
+	}
+}
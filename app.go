@@ -2,90 +2,126 @@ package dkafka
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"io"
-	"strings"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/dfuse-io/bstream/forkable"
-	"github.com/dfuse-io/dfuse-eosio/filtering"
-	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbblockmeta "github.com/dfuse-io/pbgo/dfuse/blockmeta/v1"
 	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
 	pbhealth "github.com/dfuse-io/pbgo/grpc/health/v1"
 
-	"github.com/golang/protobuf/ptypes"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/label"
 	"go.uber.org/zap"
-	"golang.org/x/oauth2"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/oauth"
 
 	"github.com/dfuse-io/shutter"
 )
 
-type Config struct {
-	DfuseGRPCEndpoint string
-	DfuseToken        string
-
-	DryRun        bool // do not connect to Kafka, just print to stdout
-	BatchMode     bool
-	StartBlockNum int64
-	StopBlockNum  uint64
-	StateFile     string
-
-	KafkaEndpoints         string
-	KafkaSSLEnable         bool
-	KafkaSSLCAFile         string
-	KafkaSSLAuth           bool
-	KafkaSSLClientCertFile string
-	KafkaSSLClientKeyFile  string
-
-	KafkaCursorConsumerGroupID string
-	KafkaTransactionID         string
-	CommitMinDelay             time.Duration
-
-	IncludeFilterExpr    string
-	KafkaTopic           string
-	KafkaCursorTopic     string
-	KafkaCursorPartition int32
-	EventSource          string
-	EventKeysExpr        string
-	EventTypeExpr        string
-	EventExtensions      map[string]string
-}
-
 type App struct {
 	*shutter.Shutter
 	config         *Config
 	readinessProbe pbhealth.HealthClient
+	adapterOptions []AdapterOption
+
+	headAtStartup uint64 // stop block with stop at head, kept over the reconnects and producer recoveries
+
+	instanceID string // of the lease, drawn by Run
+
+	rewound bool // the rewind is applied by the first run only, the reconnects resume from the cursor
 }
 
-func New(config *Config) *App {
+// New creates the app, the adapter options allow library users to customize the produced messages
+func New(config *Config, opts ...AdapterOption) *App {
 	return &App{
-		Shutter: shutter.New(),
-		config:  config,
+		Shutter:        shutter.New(),
+		config:         config,
+		adapterOptions: opts,
 	}
 }
 
 func (a *App) Run() error {
+	if err := a.config.Validate(); err != nil {
+		return err
+	}
+	if a.config.ExprREPL {
+		return a.runExprREPL(context.Background(), os.Stdin, os.Stdout)
+	}
 
-	// get and setup the dfuse fetcher that gets a stream of blocks, includes the filter, will include the auth token resolver/refresher
-	addr := a.config.DfuseGRPCEndpoint
-	plaintext := strings.Contains(addr, "*")
-	addr = strings.Replace(addr, "*", "", -1)
-	var dialOptions []grpc.DialOption
-	if plaintext {
-		dialOptions = append(dialOptions, grpc.WithInsecure())
-	} else {
-		transportCreds := credentials.NewTLS(&tls.Config{
-			InsecureSkipVerify: true,
+	// before connecting to the firehose, to fail on a kafka misconfiguration
+	if a.config.StartupCanary && !a.config.DryRun && !a.config.localSink() {
+		conf := createKafkaConfig(a.config)
+		staticHeaders, err := newStaticHeaders(a.config.StaticHeaders)
+		if err != nil {
+			return err
+		}
+		for _, topic := range a.topics() {
+			if err := runStartupCanary(conf, topic, a.config.EventSource, staticHeaders, a.config.KafkaCursorConsumerGroupID, a.config.StartupCanaryConsume); err != nil {
+				return err
+			}
+		}
+	}
+
+	// drawn once, a step of a timed out startup can still be acquiring the lease
+	a.instanceID = a.config.InstanceID
+	if a.instanceID == "" {
+		a.instanceID = defaultInstanceID()
+	}
+
+	// registered once, each run derives its context from this one
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.OnTerminating(func(_ error) {
+		cancel()
+	})
+
+	recovery := retrier{
+		RetryConfig: a.config.Retry,
+		operation:   "producer_recovery",
+		maxAttempts: a.config.MaxProducerRecoveries + 1,
+		onRetry: func(attempt int, err error) {
+			zlog.Warn("re-creating the kafka producer and rewinding to the last committed cursor", zap.Error(err), zap.Int("recovery", attempt))
+			ProducerRecoveries.Inc()
+		},
+	}
+	recovery.MaxElapsedTime = 0 // a run lasts, the recoveries are only bounded by their count
+	for {
+		err := recovery.do(ctx, func() error {
+			err := a.run(ctx)
+			fatal, ok := asFatalProducerError(err)
+			if !ok || a.IsTerminating() {
+				return permanent(err)
+			}
+			if fatal.fenced() {
+				return permanent(fmt.Errorf("%w: %s", ErrProducerFenced, fatal.err))
+			}
+			return err
 		})
-		dialOptions = append(dialOptions, grpc.WithTransportCredentials(transportCreds))
-		credential := oauth.NewOauthAccess(&oauth2.Token{AccessToken: a.config.DfuseToken, TokenType: "Bearer"})
-		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(credential))
+		// a proactive reconnect, not counted as a recovery
+		if !isStreamIdle(err) || a.IsTerminating() {
+			return err
+		}
+		StreamIdleReconnects.Inc()
+	}
+}
+
+// cursorLoadAttempts bounds the cursor loads failing on a transient kafka error
+const cursorLoadAttempts = 5
+
+// run streams the blocks from the last committed cursor until the end of the stream or an error,
+// its context is canceled when the app terminates
+func (a *App) run(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// get and setup the dfuse fetcher that gets a stream of blocks, includes the filter, will include the auth token resolver/refresher
+	addr, dialOptions, err := dfuseDialOptions(a.config)
+	if err != nil {
+		return err
 	}
 	conn, err := grpc.Dial(addr,
 		dialOptions...,
@@ -93,37 +129,226 @@ func (a *App) Run() error {
 	if err != nil {
 		return fmt.Errorf("connecting to grpc address %s: %w", addr, err)
 	}
+	defer conn.Close()
 
-	client := pbbstream.NewBlockStreamV2Client(conn)
-
-	req := &pbbstream.BlocksRequestV2{
-		IncludeFilterExpr: a.config.IncludeFilterExpr,
-		StartBlockNum:     a.config.StartBlockNum,
-		StopBlockNum:      a.config.StopBlockNum,
+	includeFilterExpr := a.config.includeFilterExpr()
+	if len(a.config.Pipelines) != 0 {
+		zlog.Info("running pipelines over a single block stream", zap.Int("pipelines", len(a.config.Pipelines)))
+	}
+	var systemActionGen *systemActionGenerator
+	if a.config.SystemActionsMode {
+		systemActionGen = newSystemActionGenerator(a.config.Account, a.config.SystemActions)
+		zlog.Info("system actions mode enabled", zap.String("account", a.config.Account), zap.Strings("system_actions", a.config.SystemActions))
 	}
+	if isMatchAllFilter(includeFilterExpr) {
+		zlog.Warn("unfiltered stream allowed, streaming every transaction of the chain")
+	}
+	zlog.Info("effective firehose include filter", zap.String("include_filter_expr", includeFilterExpr))
 
 	conf := createKafkaConfig(a.config)
 
-	var producer *kafka.Producer
-	if !a.config.BatchMode || !a.config.DryRun {
-		producer, err = getKafkaProducer(conf, a.config.KafkaTransactionID)
-		if err != nil {
-			return fmt.Errorf("getting kafka producer: %w", err)
-		}
-	}
+	fileSink := a.config.SinkType == "file"
+	localSink := a.config.localSink()
 
+	messageOrdinal := &ordinal{}
+	lib := &libTracker{minStep: a.config.LIBAnnounceMinStep}
 	var cp checkpointer
+	var kafkaCp *kafkaCheckpointer // gets the producer once created, the cursor load does not need it
 	if a.config.BatchMode {
 		zlog.Info("running in batch mode, ignoring cursors")
 		cp = &nilCheckpointer{}
 	} else {
-		cp = newKafkaCheckpointer(conf, a.config.KafkaCursorTopic, a.config.KafkaCursorPartition, a.config.KafkaTopic, a.config.KafkaCursorConsumerGroupID, producer)
+		switch {
+		case a.config.DryRun:
+			// the cursor is saved to the state file, never to the cursor topic
+			cp = &nilCheckpointer{}
+			if a.config.StateFile != "" {
+				fileCp := newLocalFileCheckpointer(a.config.StateFile, messageOrdinal)
+				fileCp.chainID = a.config.ExpectedChainID
+				fileCp.compatibilityMode = a.config.CursorCompatibilityMode
+				cp = fileCp
+			}
+			if a.config.DryRunWithKafkaCursor {
+				zlog.Info("dry run starting from the cursor of the live instance", zap.String("cursor_topic", a.config.cursorTopic()))
+				cp = &splitCheckpointer{load: a.kafkaCheckpointer(conf, nil, messageOrdinal), save: cp}
+			}
+		case localSink:
+			fileCp := newLocalFileCheckpointer(a.config.StateFile, messageOrdinal)
+			fileCp.chainID = a.config.ExpectedChainID
+			fileCp.compatibilityMode = a.config.CursorCompatibilityMode
+			cp = fileCp
+		default:
+			kafkaCp = a.kafkaCheckpointer(conf, nil, messageOrdinal)
+			cp = kafkaCp
+		}
+	}
 
-		cursor, err := cp.Load()
-		switch err {
-		case NoCursorErr:
-			zlog.Info("running in live mode, no cursor found: starting from beginning", zap.Int64("start_block_num", a.config.StartBlockNum))
-		case nil:
+	// the independent steps of the startup run concurrently, their results are read once all succeeded
+	startBlockNum, stopBlockNum := a.config.StartBlockNum, a.config.StopBlockNum
+	var producer *kafka.Producer
+	fatalErrors := make(chan kafka.Error, 1)
+	var lease *instanceLease
+	var cursor string
+	cursorFound := false
+	var adapters []*adapter
+	var schemas valueSchemas
+	var steps []startupStep // in the order of the failures reported
+	if a.config.ChainAPIEndpoint != "" && a.config.ExpectedChainID != "" {
+		steps = append(steps, startupStep{
+			name: "chain_id",
+			run: func(ctx context.Context) error {
+				if err := verifyChainID(ctx, a.config.ChainAPIEndpoint, a.config.ExpectedChainID); err != nil {
+					return err
+				}
+				zlog.Info("verified the chain id", zap.String("chain_id", a.config.ExpectedChainID))
+				return nil
+			},
+		})
+	}
+	if a.config.StartTime != "" || a.config.StopTime != "" {
+		steps = append(steps, startupStep{
+			name: "block_range",
+			run: func(ctx context.Context) (err error) {
+				var resolver blockTimeResolver = &firehoseSearchResolver{conn: conn, version: a.config.FirehoseVersion, filterExpr: includeFilterExpr}
+				if a.config.BlockmetaEndpoint != "" {
+					blockmetaConn, err := grpc.Dial(a.config.BlockmetaEndpoint, dialOptions...)
+					if err != nil {
+						return fmt.Errorf("connecting to blockmeta address %s: %w", a.config.BlockmetaEndpoint, err)
+					}
+					defer blockmetaConn.Close()
+					resolver = &blockmetaResolver{client: pbblockmeta.NewTimeToIDClient(blockmetaConn)}
+				}
+				startBlockNum, stopBlockNum, err = resolveBlockRange(ctx, resolver, a.config)
+				return err
+			},
+		})
+	}
+	if !localSink && !a.config.DryRun {
+		steps = append(steps, startupStep{
+			name: "kafka_producer",
+			run: func(ctx context.Context) (err error) {
+				if a.config.KafkaCloud != "" {
+					if err := checkKafkaConnectivity(conf); err != nil {
+						return err
+					}
+				}
+				producerConf := conf
+				if a.config.KafkaStatsIntervalMs > 0 {
+					producerConf = cloneConfig(conf)
+					producerConf["statistics.interval.ms"] = a.config.KafkaStatsIntervalMs
+				}
+				producer, err = getKafkaProducer(producerConf, a.config.KafkaTransactionID)
+				if err != nil {
+					return fmt.Errorf("getting kafka producer: %w", err)
+				}
+				serveProducerEvents(producer, fatalErrors)
+				return nil
+			},
+			undo: func() { producer.Close() },
+		})
+	}
+	if !a.config.BatchMode {
+		steps = append(steps, startupStep{
+			name: "cursor",
+			run: func(ctx context.Context) error {
+				// the cursor is loaded once the lease is held, the previous instance saved its last one
+				if kafkaCp != nil && a.config.LeaseTTL > 0 {
+					var err error
+					if lease, err = a.acquireLease(ctx, conf, kafkaCp); err != nil {
+						return err
+					}
+				}
+				err := retrier{RetryConfig: a.config.Retry, operation: "cursor_load", maxAttempts: cursorLoadAttempts}.do(ctx, func() error {
+					var err error
+					cursor, err = cp.Load(ctx)
+					if err != nil && !isTransientKafkaError(err) {
+						return permanent(err)
+					}
+					return err
+				})
+				switch err {
+				case NoCursorErr:
+				case nil:
+					cursorFound = true
+				default:
+					if lease != nil {
+						lease.release()
+					}
+					return fmt.Errorf("error loading cursor: %w", err)
+				}
+				return nil
+			},
+			undo: func() {
+				if lease != nil {
+					lease.release()
+				}
+			},
+		})
+	}
+	steps = append(steps, startupStep{
+		name: "expressions",
+		run: func(ctx context.Context) (err error) {
+			adapters, err = a.adapters(systemActionGen, messageOrdinal, lib)
+			return err
+		},
+	})
+	if a.config.ValueJSONSchemaFile != "" || len(a.config.ValueJSONSchemas) != 0 {
+		steps = append(steps, startupStep{
+			name: "value_schemas",
+			run: func(ctx context.Context) (err error) {
+				schemas, err = loadValueSchemas(a.config.ValueJSONSchemaFile, a.config.ValueJSONSchemas)
+				return err
+			},
+		})
+	}
+	if err := runStartupSteps(ctx, a.config.StartupTimeout, steps); err != nil {
+		return err
+	}
+
+	if producer != nil {
+		if kafkaCp != nil {
+			kafkaCp.producer = producer
+		}
+		defer func() {
+			if _, ok := asFatalProducerError(err); ok {
+				closeFatalProducer(producer, a.config.KafkaTransactionID != "")
+			} else if isStreamIdle(err) { // the next run creates its own producer
+				if remaining := producer.Flush(30000); remaining > 0 {
+					zlog.Warn("closing the kafka producer with undelivered messages", zap.Int("remaining", remaining))
+				}
+				producer.Close()
+			}
+		}()
+	}
+	var leaseLost <-chan error // never receives without lease
+	if lease != nil {
+		defer lease.release()
+		go lease.keep(ctx)
+		leaseLost = lease.lost
+	}
+
+	stopTime := a.config.stopTime()
+
+	req := &pbbstream.BlocksRequestV2{
+		IncludeFilterExpr: includeFilterExpr,
+		StartBlockNum:     startBlockNum,
+		StopBlockNum:      stopBlockNum,
+		Details:           a.config.blockDetails(),
+	}
+	if req.Details == pbbstream.BlockDetails_BLOCK_DETAILS_LIGHT {
+		zlog.Info("requesting light blocks, the payloads have no db ops")
+	}
+
+	startBlock := uint64(0)
+	if startBlockNum > 0 {
+		startBlock = uint64(startBlockNum)
+	}
+
+	var replayUntil uint64 // the messages of the blocks up to it are stamped ce_replay after a rewind
+	if !a.config.BatchMode {
+		if !cursorFound {
+			zlog.Info("running in live mode, no cursor found: starting from beginning", zap.Int64("start_block_num", startBlockNum))
+		} else {
 			c, err := forkable.CursorFromOpaque(cursor)
 			if err != nil {
 				zlog.Error("cannot decode cursor", zap.Error(err))
@@ -137,91 +362,258 @@ func (a *App) Run() error {
 				zap.Stringer("cursor_LIB", c.LIB),
 			)
 			req.StartCursor = cursor
-		default:
-			return fmt.Errorf("error loading cursor: %w", err)
+			startBlock = c.Block.Num() + 1
+			if (a.config.RewindBlocks != 0 || a.config.RewindToBlock != 0) && !a.rewound {
+				target, err := a.config.rewindTarget(c.Block.Num())
+				if err != nil {
+					return err
+				}
+				rewind(ctx, conn, a.config.FirehoseVersion, req, c.Block.Num(), target)
+				a.rewound = true
+				replayUntil = c.Block.Num()
+				startBlock = target
+				startBlockNum = req.StartBlockNum
+			}
 		}
 	}
-	if irreversibleOnly {
+	if irreversibleOnly || a.config.FailOnBlockGap {
 		req.ForkSteps = []pbbstream.ForkStep{pbbstream.ForkStep_STEP_IRREVERSIBLE}
 	}
+	if a.config.StopAtHead {
+		if a.headAtStartup == 0 {
+			resolver := &firehoseSearchResolver{conn: conn, version: a.config.FirehoseVersion, filterExpr: includeFilterExpr}
+			if a.headAtStartup, _, err = resolver.probe(ctx, -1); err != nil {
+				return fmt.Errorf("resolving the head block: %w", err)
+			}
+		}
+		head := a.headAtStartup
+		if startBlock > head {
+			zlog.Info("already caught up to the head block, nothing to stream", zap.Uint64("head_block_num", head), zap.Uint64("start_block", startBlock))
+			return a.writeBatchReport(newBatchReport())
+		}
+		if stopBlockNum == 0 || head < stopBlockNum {
+			stopBlockNum = head
+			req.StopBlockNum = head
+		}
+		zlog.Info("stopping at the head block of the startup", zap.Uint64("head_block_num", head), zap.Uint64("stop_block_num", stopBlockNum))
+	}
 
-	var s sender
-	if a.config.DryRun {
-		s = &dryRunSender{}
-	} else {
-		s, err = getKafkaSender(producer, cp, a.config.KafkaTransactionID != "")
+	tracer, shutdownTracer, err := newTracer(a.config.OtelExporterEndpoint, a.config.OtelSampleRate)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracer()
+
+	var s Sender
+	var tracksDeliveries bool
+	switch {
+	case a.config.DryRun:
+		s = &dryRunSender{cp: cp}
+	case fileSink:
+		fs, err := newFileSender(a.config.FileSinkDir, a.config.FileSinkFormat, a.config.FileSinkHeaders, a.config.FileSinkMaxBytes, a.config.FileSinkBlocksPerFile, startBlock, cp)
 		if err != nil {
 			return err
 		}
+		defer func() {
+			if err := fs.Close(); err != nil {
+				zlog.Error("cannot close file sink", zap.Error(err))
+			}
+		}()
+		s = fs
+	case a.config.SinkType == "http":
+		s = newHTTPSender(ctx, a.config.HTTPSinkURL, a.config.HTTPSinkTimeout, a.config.HTTPSinkMaxRetries, a.config.Retry, a.config.HTTPSinkConcurrency, cp)
+	default:
+		ks, err := getKafkaSender(producer, cp, a.config.KafkaTransactionID != "")
+		if err != nil {
+			return err
+		}
+		ks.maxUncommittedMessages = a.config.MaxUncommittedMessages
+		ks.maxUncommittedBytes = a.config.MaxUncommittedBytes
+		if a.config.OtelExporterEndpoint != "" {
+			ks.trackDeliveries()
+			tracksDeliveries = true
+		}
+		s = ks
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	a.OnTerminating(func(_ error) {
-		cancel()
-	})
-
-	executor, err := client.Blocks(ctx, req)
-	if err != nil {
-		return fmt.Errorf("requesting blocks from dfuse firehose: %w", err)
+	if len(a.config.StaticHeaders) != 0 {
+		headers, err := newStaticHeaders(a.config.StaticHeaders)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(headers))
+		for _, h := range headers {
+			names = append(names, h.Key)
+		}
+		zlog.Info("adding static headers", zap.Strings("static_headers", names)) // the values can be secrets
+		s = &staticHeadersSender{Sender: s, headers: headers}
 	}
 
-	// setup the transformer, that will transform incoming blocks
+	if len(a.config.HeaderAllowlist) != 0 {
+		zlog.Info("sending only the allowed headers", zap.Strings("header_allowlist", a.config.HeaderAllowlist))
+		s = &headerAllowlistSender{Sender: s, allowlist: newHeaderAllowlist(a.config.HeaderAllowlist)}
+	}
 
-	eventTypeProg, err := exprToCelProgram(a.config.EventTypeExpr)
-	if err != nil {
-		return fmt.Errorf("cannot parse event-type-expr: %w", err)
+	// before the header allowlist, which can remove the partition key header
+	if a.config.PartitionByExpr != "" && producer != nil {
+		s = newPartitionKeySender(s, producer)
 	}
-	eventKeyProg, err := exprToCelProgram(a.config.EventKeysExpr)
-	if err != nil {
-		return fmt.Errorf("cannot parse event-keys-expr: %w", err)
+
+	if !a.config.DryRun && (a.config.MaxProduceBytesPerSecond > 0 || len(a.config.MaxProduceBytesPerSecondPerTopic) != 0) {
+		zlog.Info("limiting the produce byte rate", zap.Int64("max_produce_bytes_per_second", a.config.MaxProduceBytesPerSecond), zap.Any("per_topic", a.config.MaxProduceBytesPerSecondPerTopic))
+		s = newRateLimitedSender(ctx, s, a.config.MaxProduceBytesPerSecond, a.config.MaxProduceBytesPerSecondPerTopic)
 	}
 
-	var extensions []*extension
-	for k, v := range a.config.EventExtensions {
-		prog, err := exprToCelProgram(v)
-		if err != nil {
-			return fmt.Errorf("cannot parse event-extension: %w", err)
+	var verifier *batchVerifier
+	if a.config.VerifyAfterBatch {
+		if verifier, err = newBatchVerifier(conf, a.topics()); err != nil {
+			return fmt.Errorf("recording the end offsets of the topics: %w", err)
 		}
-		extensions = append(extensions, &extension{
-			name: k,
-			expr: v,
-			prog: prog,
-		})
+		s = &digestSender{Sender: s, digest: verifier.produced}
+	}
 
+	if schemas != nil {
+		s = newSchemaValidatingSender(s, schemas, a.config.ValueSchemaSkipTopics, a.config.OnError)
 	}
 
-	sourceHeader := kafka.Header{
-		Key:   "ce_source",
-		Value: []byte(a.config.EventSource),
+	if a.config.DedupFromTargetTopic {
+		ids, err := preloadCEIDs(conf, a.topics(), startBlock, stopBlockNum, a.config.DedupFalsePositiveRate, a.config.DedupExactMaxIDs)
+		if err != nil {
+			return fmt.Errorf("preloading the target topic ce_id: %w", err)
+		}
+		s = &dedupFilterSender{Sender: s, ids: ids}
 	}
-	specHeader := kafka.Header{
-		Key:   "ce_specversion",
-		Value: []byte("1.0"),
+
+	if a.config.DedupeWindow > 0 || a.config.DedupeWindowBlocks > 0 {
+		zlog.Info("suppressing messages with the same key within the dedupe window", zap.Duration("dedupe_window", a.config.DedupeWindow), zap.Uint64("dedupe_window_blocks", a.config.DedupeWindowBlocks), zap.Strings("dedupe_event_types", a.config.DedupeEventTypes))
+		s = newDedupeSender(s, a.config.DedupeWindow, a.config.DedupeWindowBlocks, a.config.Namespace, a.config.DedupeEventTypes)
 	}
-	contentTypeHeader := kafka.Header{
-		Key:   "content-type",
-		Value: []byte("application/json"),
+
+	executor, err := openBlockStream(ctx, conn, a.config.FirehoseVersion, req)
+	if err != nil {
+		return fmt.Errorf("requesting blocks from dfuse firehose: %w", err)
 	}
-	dataContentTypeHeader := kafka.Header{
-		Key:   "ce_datacontenttype",
-		Value: []byte("application/json"),
+
+	// setup the transformer, that will transform incoming blocks
+
+	var reloads <-chan *programs
+	if a.config.ExpressionsFile != "" {
+		zlog.Info("expressions will be reloaded from file on SIGHUP", zap.String("filename", a.config.ExpressionsFile))
+		reloads = watchExpressions(ctx, a.config.ExpressionsFile) // single pipeline only
 	}
 
+	report := newBatchReport()
+	report.RequestedStartBlock = startBlockNum
+	started := time.Now()
+	checkStartBlock := req.StartCursor == ""
+
 	// loop: receive block,  transform block, send message...
+	var lastCursor string
+	commits := newCommitPolicy(a.config)
+	var previousBlock uint64
+	undos := &undoWindow{}
+	heartbeatTopic := a.topics()[0]
+	if a.config.HeartbeatTopic != "" {
+		heartbeatTopic = namespaced(a.config.Namespace, a.config.HeartbeatTopic)
+	}
+	lastMessageAt := time.Now()
+	var capture blockCapture = nopBlockCapture{}
+	if a.config.CaptureDir != "" {
+		if capture, err = newFileBlockCapture(a.config.CaptureDir, a.config.CaptureRetentionBlocks, a.config.CaptureRetentionBytes); err != nil {
+			return err
+		}
+	}
+	var redactor *redactor
+	if len(a.config.RedactFields) != 0 || len(a.config.RedactTables) != 0 {
+		if redactor, err = newRedactor(a.config.RedactFields, a.config.RedactTables, a.config.RedactHMACKey, a.config.RedactEncryptionKey); err != nil {
+			return err
+		}
+		zlog.Info("redacting the action data fields", zap.Any("redact_fields", a.config.RedactFields), zap.Strings("redact_tables", a.config.RedactTables))
+	}
+	watchdog := newBlockWatchdog(a.config.BlockProcessTimeout, a.config.MaxStreamIdle)
+	go watchdog.run(ctx)
+	stages := &blockStages{
+		adapters: adapters,
+		lib:      lib,
+		reloads:  reloads,
+		workers:  a.config.adaptWorkers(),
+		buffer:   a.config.StageBuffer,
+		streamed: a.config.MessageStreamBuffer,
+		watchdog: watchdog,
+		redactor: redactor,
+		filters:  newFilterEfficiency(a.config.FilterEfficiencyLogInterval),
+	}
+	jobs := stages.start(ctx, executor)
 	for {
-		msg, err := executor.Recv()
-		if err != nil {
-			if err == io.EOF {
+		var job *blockJob
+		select {
+		case job = <-jobs:
+		case fatalErr := <-fatalErrors:
+			return &fatalProducerError{err: fatalErr}
+		case err := <-watchdog.stuck:
+			return err
+		case err := <-leaseLost:
+			return err
+		case err := <-watchdog.idle:
+			zlog.Warn("firehose stream idle, reconnecting from the last committed cursor", zap.Error(err), zap.String("last_cursor", lastCursor))
+			if lastCursor != "" {
+				if err := s.Commit(context.Background(), lastCursor); err != nil {
+					return err
+				}
+			}
+			return err
+		case <-ctx.Done(): // terminating, the blocks left in the stages are streamed again on restart
+			if lastCursor == "" {
 				return nil
 			}
-			return fmt.Errorf("error on receive: %w", err)
+			return s.Commit(context.Background(), lastCursor)
+		}
+
+		resp := job.resp
+		if resp == nil {
+			if job.err == io.EOF {
+				if err := a.completeStream(s, heartbeatTopic, report, stopBlockNum, started, lastCursor); err != nil {
+					return err
+				}
+				if a.config.writesReport() {
+					if err := a.completeBatch(report, verifier, s, producer, lastCursor); err != nil {
+						return err
+					}
+				}
+				if (localSink || a.config.DryRun || a.config.StopAtHead) && lastCursor != "" {
+					return s.Commit(context.Background(), lastCursor)
+				}
+				return nil
+			}
+			return fmt.Errorf("error on receive: %w", job.err)
+		}
+
+		blk := resp.block
+		step := sanitizeStep(resp.step.String())
+
+		if checkStartBlock {
+			zlog.Info("first streamed block", zap.Uint32("blk_number", blk.Number), zap.Int64("start_block_num", startBlockNum))
+			if report.StartClamped, err = checkFirstStreamedBlock(startBlockNum, blk.Num(), a.config.StrictStartBlock); err != nil {
+				return err
+			}
+			checkStartBlock = false
 		}
 
-		blk := &pbcodec.Block{}
-		if err := ptypes.UnmarshalAny(msg.Block, blk); err != nil {
-			return fmt.Errorf("decoding any of type %q: %w", msg.Block.TypeUrl, err)
+		if !stopTime.IsZero() && !blockTime(blk).Before(stopTime) {
+			zlog.Info("reached the stop time", zap.Uint32("blk_number", blk.Number), zap.Time("stop_time", stopTime))
+			if err := a.completeStream(s, heartbeatTopic, report, stopBlockNum, started, lastCursor); err != nil {
+				return err
+			}
+			if a.config.writesReport() {
+				if err := a.completeBatch(report, verifier, s, producer, lastCursor); err != nil {
+					return err
+				}
+			}
+			if lastCursor == "" {
+				return nil
+			}
+			return s.Commit(context.Background(), lastCursor)
 		}
-		step := sanitizeStep(msg.Step.String())
 
 		if blk.Number%100 == 0 {
 			zlog.Info("incoming block 1/100", zap.Uint32("blk_number", blk.Number), zap.String("step", step), zap.Int("length_filtered_trx_traces", len(blk.FilteredTransactionTraces)))
@@ -230,128 +622,386 @@ func (a *App) Run() error {
 			zlog.Debug("incoming block 1/10", zap.Uint32("blk_number", blk.Number), zap.String("step", step), zap.Int("length_filtered_trx_traces", len(blk.FilteredTransactionTraces)))
 		}
 
-		for _, trx := range blk.TransactionTraces() {
-			status := sanitizeStatus(trx.Receipt.Status.String())
-			memoizableTrxTrace := &filtering.MemoizableTrxTrace{TrxTrace: trx}
-			for _, act := range trx.ActionTraces {
-				if !act.FilteringMatched {
-					continue
-				}
-				var jsonData json.RawMessage
-				if act.Action.JsonData != "" {
-					jsonData = json.RawMessage(act.Action.JsonData)
-				}
-				activation := filtering.NewActionTraceActivation(
-					act,
-					memoizableTrxTrace,
-					msg.Step.String(),
-				)
-
-				var auths []string
-				for _, auth := range act.Action.Authorization {
-					auths = append(auths, auth.Authorization())
+		if a.config.FailOnBlockGap {
+			if err := checkBlockGap(previousBlock, blk.Num()); err != nil {
+				return err
+			}
+			previousBlock = blk.Num()
+		}
+
+		capture.Begin(blk, step)
+		// with a message stream, the adapt error is only known once the messages of the block are sent
+		settle := func(adaptErr error) error {
+			if adaptErr != nil {
+				capture.Keep()
+				if !isBlockTimeout(adaptErr) || !errorPolicy(a.config.OnError).skip(adaptErr) {
+					return adaptErr
 				}
+				zlog.Warn("skipping the block that timed out", zap.Uint32("blk_number", blk.Number), zap.Error(adaptErr))
+			} else if a.config.CaptureOnlyOnError {
+				capture.Discard()
+			} else {
+				capture.Keep()
+			}
+			return nil
+		}
+		if job.stream == nil {
+			if err := settle(job.err); err != nil {
+				return err
+			}
+		}
 
-				var globalSeq uint64
-				if act.Receipt != nil {
-					globalSeq = act.Receipt.GlobalSequence
+		blkCtx, blkSpan := tracer.Start(ctx, "block", trace.WithAttributes(
+			label.Uint64("block_num", blk.Num()),
+			label.String("step", step),
+		))
+		report.addBlock(blk.Num(), len(blk.FilteredTransactionTraces), job.msgs)
+		undos.observe(time.Now(), step)
+		var forkedBlock string
+		if step == undoStep {
+			forkedBlock = forkedBlockID(resp.cursor, blk)
+		}
+		sendStart := time.Now()
+		sent := 0
+		send := func(m *kafka.Message) error {
+			if stages.workers > 1 {
+				m.Headers = setHeader(m.Headers, "ce_ordinal", []byte(strconv.FormatUint(messageOrdinal.next(), 10)))
+			}
+			if blk.Num() <= replayUntil {
+				m.Headers = setHeader(m.Headers, "ce_replay", []byte("true"))
+			}
+			if forkedBlock != "" {
+				m.Headers = setHeader(m.Headers, "ce_forkedblockid", []byte(forkedBlock))
+			}
+			startMessageSpan(blkCtx, tracer, m)
+			err := s.Send(m)
+			if err != nil || !tracksDeliveries {
+				endMessageSpan(m, err)
+			}
+			if err != nil {
+				return fmt.Errorf("sending message: %w", err)
+			}
+			sent++
+			return nil
+		}
+		for _, m := range job.msgs {
+			if err := send(m); err != nil {
+				blkSpan.End()
+				return err
+			}
+		}
+		if job.stream != nil {
+			for m := range job.stream {
+				report.addMessage(m)
+				if err := send(m); err != nil {
+					blkSpan.End()
+					return err
 				}
-				eosioAction := event{
-					BlockNum:      blk.Number,
-					BlockID:       blk.Id,
-					Status:        status,
-					Executed:      !trx.HasBeenReverted(),
-					Step:          step,
-					TransactionID: trx.Id,
-					ActionInfo: ActionInfo{
-						Account:        act.Account(),
-						Receiver:       act.Receiver,
-						Action:         act.Name(),
-						JSONData:       &jsonData,
-						DBOps:          trx.DBOpsForAction(act.ExecutionIndex),
-						Authorization:  auths,
-						GlobalSequence: globalSeq,
-					},
+			}
+			if job.err != nil && ctx.Err() != nil { // terminating, the block is adapted again on restart
+				blkSpan.End()
+				if lastCursor == "" {
+					return nil
 				}
+				return s.Commit(context.Background(), lastCursor)
+			}
+			if err := settle(job.err); err != nil {
+				blkSpan.End()
+				return err
+			}
+		}
+		if sent != 0 {
+			lastMessageAt = time.Now()
+		} else if a.config.HeartbeatInterval > 0 && time.Since(lastMessageAt) >= a.config.HeartbeatInterval {
+			if err := s.Send(heartbeatMessage(heartbeatTopic, a.config.EventSource, blk, resp.cursor)); err != nil {
+				blkSpan.End()
+				return fmt.Errorf("sending heartbeat: %w", err)
+			}
+			lastMessageAt = time.Now()
+		}
+		if a.config.LIBAnnounceMode == "message" && lib.advanced() {
+			if err := s.Send(libAdvancedMessage(heartbeatTopic, a.config.EventSource, blk, lib.current())); err != nil {
+				blkSpan.End()
+				return fmt.Errorf("sending lib announce: %w", err)
+			}
+		}
+		BlockPhaseDuration.ObserveSince(sendStart, "send")
+		BlockDuration.ObserveSince(job.received)
+		BlockProducedMessages.ObserveInt(int64(sent))
+		blkSpan.End()
 
-				eventType, err := evalString(eventTypeProg, activation)
-				if err != nil {
-					return fmt.Errorf("error eventtype eval: %w", err)
-				}
+		lastCursor = resp.cursor
+		watchdog.processed()
+		if a.IsTerminating() {
+			return s.Commit(context.Background(), resp.cursor)
+		}
 
-				extensionsKV := make(map[string]string)
-				for _, ext := range extensions {
-					val, err := evalString(ext.prog, activation)
-					if err != nil {
-						return fmt.Errorf("program: %w", err)
-					}
-					extensionsKV[ext.name] = val
+		if err := s.CommitIfAfter(context.Background(), resp.cursor, commits.delay(blockTime(blk))); err != nil {
+			return fmt.Errorf("committing message: %w", err)
+		}
+	}
+}
 
-				}
+// adapters returns the adapter of each pipeline, or the single adapter of the config when no
+// pipelines are configured
+func (a *App) adapters(systemActionGen *systemActionGenerator, messageOrdinal *ordinal, lib *libTracker) ([]*adapter, error) {
+	baseOpts := []AdapterOption{withErrorPolicy(a.config.OnError), withMaxHeaderBytes(a.config.MaxHeaderBytes), withPayloadVersion(a.config.PayloadVersion)}
+	if a.config.EmbedKeyInValue {
+		baseOpts = append(baseOpts, withEmbeddedKey())
+	}
+	if a.config.IncludeRamOps {
+		baseOpts = append(baseOpts, withRamDeltas())
+	}
+	if a.config.IncludeConsole {
+		baseOpts = append(baseOpts, withConsole(a.config.ConsoleMaxBytes))
+	}
+	if a.config.SplitDBOps {
+		split, err := newDBOpSplit(a.config.DBOpsTopic, a.config.DBOpKeyExpr, a.config.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		baseOpts = append(baseOpts, withDBOpSplit(split))
+	}
+	if a.config.MaxActionDataBytes > 0 {
+		baseOpts = append(baseOpts, withMaxActionDataBytes(a.config.MaxActionDataBytes, a.config.OversizeSkippedEvents))
+	}
+	if a.config.LIBAnnounceMode == "header" {
+		baseOpts = append(baseOpts, withLIBHeader(lib))
+	}
+	if a.config.adaptWorkers() > 1 {
+		baseOpts = append(baseOpts, withDeferredOrdinal())
+	}
+	if len(a.config.HeaderAllowlist) != 0 {
+		baseOpts = append(baseOpts, withHeaderAllowlist(newHeaderAllowlist(a.config.HeaderAllowlist)))
+	}
+	if a.config.PartitionByExpr != "" {
+		prog, err := exprToCelProgram(a.config.PartitionByExpr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse partition-by-expr: %w", err)
+		}
+		baseOpts = append(baseOpts, withPartitionBy(prog))
+	}
+	if len(a.config.SamplingRules) != 0 {
+		s, err := newSampler(a.config.SamplingRules)
+		if err != nil {
+			return nil, err
+		}
+		baseOpts = append(baseOpts, withSampler(s))
+	}
+	if len(a.config.ProjectedFields) != 0 {
+		fields, err := parseProjectedFields(a.config.ProjectedFields)
+		if err != nil {
+			return nil, err
+		}
+		baseOpts = append(baseOpts, withProjectedFields(fields))
+	}
+	if len(a.config.MemoFields) != 0 {
+		fields, err := parseMemoFields(a.config.MemoFields)
+		if err != nil {
+			return nil, err
+		}
+		baseOpts = append(baseOpts, withMemoFields(fields))
+	}
+	baseOpts = append(baseOpts, a.adapterOptions...)
+	if len(a.config.Pipelines) == 0 {
+		progs, err := compileExpressions(Expressions{
+			EventTypeExpr:    a.config.EventTypeExpr,
+			EventKeysExpr:    a.config.EventKeysExpr,
+			EventExtensions:  a.config.EventExtensions,
+			EventSubjectExpr: a.config.EventSubjectExpr,
+		})
+		if err != nil {
+			return nil, err
+		}
+		opts := baseOpts
+		if len(a.config.EventKeySets) != 0 {
+			sets, err := newKeySets(a.config.EventKeySets, a.config.EventKeySetTopics, a.config.KafkaTopic, a.config.Namespace)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(append([]AdapterOption(nil), baseOpts...), withKeySets(sets))
+		}
+		if len(a.config.TopicRouting) != 0 {
+			router, err := newTopicRouter(a.config.TopicRouting, a.config.Namespace)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(append([]AdapterOption(nil), baseOpts...), withTopicRouter(router))
+		}
+		adapters := []*adapter{newAdapter(
+			a.config.topic(),
+			a.config.Namespace,
+			a.config.EventSource,
+			progs,
+			a.config.EventGranularity,
+			a.config.ValueCompression,
+			systemActionGen,
+			a.config.PrimaryKeyRenderings,
+			messageOrdinal,
+			opts...,
+		)}
+		if a.config.KafkaTopicV2 != "" {
+			// transition mode: the same events with the v2 payload, sent in the same transaction
+			adapters = append(adapters, newAdapter(
+				namespaced(a.config.Namespace, a.config.KafkaTopicV2),
+				a.config.Namespace,
+				a.config.EventSource,
+				progs,
+				a.config.EventGranularity,
+				a.config.ValueCompression,
+				systemActionGen,
+				a.config.PrimaryKeyRenderings,
+				messageOrdinal,
+				append(append([]AdapterOption(nil), baseOpts...), withPayloadVersion(payloadV2))...,
+			))
+		}
+		return adapters, nil
+	}
 
-				eventKeys, err := evalStringArray(eventKeyProg, activation)
-				if err != nil {
-					return fmt.Errorf("event keyeval: %w", err)
-				}
+	var adapters []*adapter
+	for _, p := range a.config.Pipelines {
+		progs, err := compileExpressions(p.expressions())
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %w", p.Name, err)
+		}
+		filter, err := filterProgram(p.IncludeFilterExpr)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %w", p.Name, err)
+		}
+		eventSource := p.EventSource
+		if eventSource == "" {
+			eventSource = a.config.EventSource
+		}
+		opts := append([]AdapterOption{withPipeline(p.Name, filter)}, baseOpts...)
+		adapters = append(adapters, newAdapter(
+			namespaced(a.config.Namespace, p.KafkaTopic),
+			a.config.Namespace,
+			eventSource,
+			progs,
+			a.config.EventGranularity,
+			a.config.ValueCompression,
+			nil,
+			a.config.PrimaryKeyRenderings,
+			messageOrdinal,
+			opts...,
+		))
+	}
+	return adapters, nil
+}
 
-				dedupeMap := make(map[string]bool)
-				for _, eventKey := range eventKeys {
-					if dedupeMap[eventKey] {
-						continue
-					}
-					dedupeMap[eventKey] = true
-
-					headers := []kafka.Header{
-						kafka.Header{
-							Key:   "ce_id",
-							Value: hashString(fmt.Sprintf("%s%s%d%s%s", blk.Id, trx.Id, act.ExecutionIndex, msg.Step.String(), eventKey)),
-						},
-						sourceHeader,
-						specHeader,
-						kafka.Header{
-							Key:   "ce_type",
-							Value: []byte(eventType),
-						},
-						contentTypeHeader,
-						kafka.Header{
-							Key:   "ce_time",
-							Value: []byte(blk.MustTime().Format("2006-01-02T15:04:05.9Z")),
-						},
-						dataContentTypeHeader,
-						{
-							Key:   "ce_blkstep",
-							Value: []byte(step),
-						},
-					}
-					for k, v := range extensionsKV {
-						headers = append(headers, kafka.Header{
-							Key:   k,
-							Value: []byte(v),
-						})
-					}
-					msg := kafka.Message{
-						Key:     []byte(eventKey),
-						Headers: headers,
-						Value:   eosioAction.JSON(),
-						TopicPartition: kafka.TopicPartition{
-							Topic: &a.config.KafkaTopic,
-						},
-					}
-					if err := s.Send(&msg); err != nil {
-						return fmt.Errorf("sending message: %w", err)
-					}
-				}
+// topics returns the topics the messages are sent to, the default topic first
+func (a *App) topics() []string {
+	topics := a.eventTopics()
+	if a.config.SplitDBOps && a.config.DBOpsTopic != "" {
+		topics = append(topics, namespaced(a.config.Namespace, a.config.DBOpsTopic))
+	}
+	return topics
+}
 
+// eventTopics returns the topics the action events are sent to, the default topic first
+func (a *App) eventTopics() []string {
+	if len(a.config.Pipelines) == 0 {
+		if a.config.KafkaTopicV2 != "" {
+			return []string{a.config.topic(), namespaced(a.config.Namespace, a.config.KafkaTopicV2)}
+		}
+		topics := []string{a.config.topic()}
+		if sets, err := newKeySets(a.config.EventKeySets, a.config.EventKeySetTopics, a.config.KafkaTopic, a.config.Namespace); err == nil {
+			for _, set := range sets {
+				topics = append(topics, set.topic)
 			}
 		}
-		if a.IsTerminating() {
-			return s.Commit(context.Background(), msg.Cursor)
+		if router, err := newTopicRouter(a.config.TopicRouting, a.config.Namespace); err == nil {
+			for _, topic := range router.topics() {
+				if topic != topics[0] {
+					topics = append(topics, topic)
+				}
+			}
 		}
+		return topics
+	}
+	var topics []string
+	for _, p := range a.config.Pipelines {
+		topics = append(topics, namespaced(a.config.Namespace, p.KafkaTopic))
+	}
+	return topics
+}
 
-		if err := s.CommitIfAfter(context.Background(), msg.Cursor, a.config.CommitMinDelay); err != nil {
-			return fmt.Errorf("committing message: %w", err)
+// kafkaCheckpointer returns the checkpointer of the cursor topic, the producer saves the cursors
+func (a *App) kafkaCheckpointer(conf kafka.ConfigMap, producer *kafka.Producer, messageOrdinal *ordinal) *kafkaCheckpointer {
+	kafkaCp := newKafkaCheckpointer(conf, a.config.cursorTopic(), a.config.KafkaCursorPartition, a.config.KafkaCursorPartitionAuto, a.config.topic(), a.config.Account, a.config.KafkaCursorConsumerGroupID, producer, messageOrdinal)
+	kafkaCp.chainID = a.config.ExpectedChainID
+	kafkaCp.compatibilityMode = a.config.CursorCompatibilityMode
+	// within a transaction, the cursor is committed along with the messages
+	kafkaCp.asyncSave = a.config.CursorSaveAsync || a.config.KafkaTransactionID != ""
+	if a.config.CursorSaveTimeout > 0 {
+		kafkaCp.saveTimeout = a.config.CursorSaveTimeout
+	}
+	kafkaCp.noAdmin = a.config.NoAdminOperations
+	return kafkaCp
+}
+
+// acquireLease waits for the instance lease of the cursor signature
+func (a *App) acquireLease(ctx context.Context, conf kafka.ConfigMap, cp *kafkaCheckpointer) (*instanceLease, error) {
+	lease, err := newInstanceLease(conf, cp, a.instanceID, a.config.LeaseTTL, a.config.TakeoverGracePeriod)
+	if err != nil {
+		return nil, err
+	}
+	if err := lease.acquire(ctx); err != nil {
+		lease.producer.Close()
+		return nil, err
+	}
+	return lease, nil
+}
+
+// completeStream sends the StreamCompleted message if requested, it is committed with the last
+// messages
+func (a *App) completeStream(s Sender, topic string, report *batchReport, stopBlockNum uint64, started time.Time, lastCursor string) error {
+	if !a.config.EmitCompletionEvent {
+		return nil
+	}
+	zlog.Info("sending the stream completion event", zap.String("job_id", a.config.JobID), zap.String("topic", topic), zap.Uint64("last_block", report.LastBlock))
+	if err := s.Send(streamCompletedMessage(topic, a.config.EventSource, a.config.JobID, report, stopBlockNum, started)); err != nil {
+		return fmt.Errorf("sending stream completion event: %w", err)
+	}
+	if lastCursor == "" && !a.config.BatchMode { // no block streamed, the saved cursor is kept
+		return nil
+	}
+	if err := s.Commit(context.Background(), lastCursor); err != nil {
+		return fmt.Errorf("committing stream completion event: %w", err)
+	}
+	return nil
+}
+
+// completeBatch verifies the produced messages if requested, then writes the batch report
+func (a *App) completeBatch(report *batchReport, verifier *batchVerifier, s Sender, producer *kafka.Producer, lastCursor string) error {
+	if verifier != nil {
+		verification, err := verifier.verify(s, producer, lastCursor)
+		if err != nil {
+			return fmt.Errorf("verifying the batch run: %w", err)
 		}
+		report.Verification = verification
+	}
+	if err := a.writeBatchReport(report); err != nil {
+		return err
+	}
+	if report.Verification != nil && len(report.Verification.Discrepancies) != 0 {
+		return fmt.Errorf("batch verification found %d damaged block ranges out of %d", len(report.Verification.Discrepancies), report.Verification.Buckets)
 	}
+	return nil
+}
+
+func (a *App) writeBatchReport(report *batchReport) error {
+	zlog.Info("batch run completed",
+		zap.Uint64("first_block", report.FirstBlock),
+		zap.Uint64("last_block", report.LastBlock),
+		zap.Uint64("blocks", report.Blocks),
+		zap.Uint64("empty_blocks", report.EmptyBlocks),
+		zap.Any("messages", report.Messages),
+	)
+	if a.config.BatchReportFile == "" {
+		return nil
+	}
+	return report.write(a.config.BatchReportFile)
 }
 
 func createKafkaConfig(appConf *Config) kafka.ConfigMap {
@@ -362,6 +1012,18 @@ func createKafkaConfig(appConf *Config) kafka.ConfigMap {
 		conf["security.protocol"] = "ssl"
 		conf["ssl.ca.location"] = appConf.KafkaSSLCAFile
 	}
+	if appConf.KafkaCloud == "confluent" {
+		conf["security.protocol"] = "SASL_SSL"
+		conf["sasl.mechanisms"] = "PLAIN"
+		conf["sasl.username"] = appConf.KafkaAPIKey
+		conf["sasl.password"] = appConf.KafkaAPISecret
+		conf["api.version.request"] = true
+		conf["api.version.fallback.ms"] = 0
+		conf["session.timeout.ms"] = 45000
+		if appConf.KafkaSSLCAFile != "" {
+			conf["ssl.ca.location"] = appConf.KafkaSSLCAFile
+		}
+	}
 	if appConf.KafkaSSLAuth {
 		conf["ssl.certificate.location"] = appConf.KafkaSSLClientCertFile
 		conf["ssl.key.location"] = appConf.KafkaSSLClientKeyFile
@@ -0,0 +1,97 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+// batchReport describes what a batch run covered, so several backfill jobs can be stitched together
+type batchReport struct {
+	FirstBlock  uint64            `json:"first_block"`
+	LastBlock   uint64            `json:"last_block"`
+	Blocks      uint64            `json:"blocks"`
+	EmptyBlocks uint64            `json:"empty_blocks"` // blocks without any matching transaction
+	Messages    map[string]uint64 `json:"messages"`     // generated messages per topic
+
+	RequestedStartBlock int64 `json:"requested_start_block"`
+	StartClamped        bool  `json:"start_clamped"` // the firehose history starts after the requested start block
+
+	Verification *verificationReport `json:"verification,omitempty"` // with the verify after batch mode
+}
+
+func newBatchReport() *batchReport {
+	return &batchReport{
+		Messages: make(map[string]uint64),
+	}
+}
+
+func (r *batchReport) addBlock(blockNum uint64, matchingTrxs int, msgs []*kafka.Message) {
+	if r.Blocks == 0 {
+		r.FirstBlock = blockNum
+	}
+	r.LastBlock = blockNum
+	r.Blocks++
+	if matchingTrxs == 0 {
+		r.EmptyBlocks++
+	}
+	for _, msg := range msgs {
+		r.addMessage(msg)
+	}
+}
+
+func (r *batchReport) addMessage(msg *kafka.Message) {
+	if msg.TopicPartition.Topic != nil {
+		r.Messages[*msg.TopicPartition.Topic]++
+	}
+}
+
+func (r *batchReport) write(filename string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, content, 0644); err != nil {
+		return fmt.Errorf("writing batch report: %w", err)
+	}
+	return nil
+}
+
+// checkBlockGap returns an error when the block does not follow the previous one
+func checkBlockGap(previous uint64, current uint64) error {
+	if previous != 0 && current != previous+1 {
+		BlockGaps.Inc()
+		return fmt.Errorf("block gap detected: received block %d after block %d", current, previous)
+	}
+	return nil
+}
+
+// firstChainBlock is the first block streamed from a chain with its full history
+const firstChainBlock = 2
+
+// checkFirstStreamedBlock compares the first streamed block to the requested start block: a
+// firehose with a pruned history starts at its first streamable block instead. It tells if the
+// start was clamped, or fails with strict.
+func checkFirstStreamedBlock(requested int64, first uint64, strict bool) (clamped bool, err error) {
+	if requested < 0 { // relative to the head
+		return false, nil
+	}
+	expected := uint64(requested)
+	if expected < firstChainBlock {
+		expected = firstChainBlock
+	}
+	if first <= expected {
+		return false, nil
+	}
+	if strict {
+		return false, fmt.Errorf("start block %d is below the first streamable block %d of the firehose (pruned history)", requested, first)
+	}
+	zlog.Warn("START BLOCK CLAMPED: the start block is below the first streamable block of the firehose (pruned history), the blocks in between are missing",
+		zap.Int64("start_block_num", requested),
+		zap.Uint64("first_streamable_block_num", first),
+	)
+	return true, nil
+}
@@ -0,0 +1,21 @@
+package dkafka
+
+import (
+	"time"
+)
+
+// blockPhases accumulates the time spent adapting a block in each phase, the durations are added
+// around each phase and observed once the block is adapted
+type blockPhases struct {
+	decode         time.Duration // payload of the matching actions, with their db ops
+	eval           time.Duration // filter, event type, keys and extensions expressions
+	marshal        time.Duration // JSON value, compressed
+	matchedActions int
+}
+
+func (p *blockPhases) observe() {
+	BlockPhaseDuration.ObserveDuration(p.decode, "decode")
+	BlockPhaseDuration.ObserveDuration(p.eval, "eval")
+	BlockPhaseDuration.ObserveDuration(p.marshal, "marshal")
+	BlockMatchedActions.ObserveInt(int64(p.matchedActions))
+}
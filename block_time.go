@@ -0,0 +1,135 @@
+package dkafka
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbblockmeta "github.com/dfuse-io/pbgo/dfuse/blockmeta/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/golang/protobuf/ptypes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// blockTimeResolver returns the first block produced at or after a time
+type blockTimeResolver interface {
+	blockAt(ctx context.Context, t time.Time) (uint64, error)
+}
+
+// blockmetaResolver looks the blocks up in the dfuse blockmeta service
+type blockmetaResolver struct {
+	client pbblockmeta.TimeToIDClient
+}
+
+func (r *blockmetaResolver) blockAt(ctx context.Context, t time.Time) (uint64, error) {
+	ts, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := r.client.After(ctx, &pbblockmeta.RelativeTimeRequest{Time: ts, Inclusive: true})
+	if err != nil {
+		return 0, fmt.Errorf("looking up the block after %s: %w", t, err)
+	}
+	return blockNumFromID(resp.Id)
+}
+
+// blockNumFromID reads the block number encoded in the first 4 bytes of an EOS block ID
+func blockNumFromID(id string) (uint64, error) {
+	if len(id) < 8 {
+		return 0, fmt.Errorf("invalid block id %q", id)
+	}
+	return strconv.ParseUint(id[:8], 16, 32)
+}
+
+// firehoseSearchResolver binary searches the blocks by requesting them one by one from the firehose
+type firehoseSearchResolver struct {
+	conn       *grpc.ClientConn
+	version    string
+	filterExpr string
+}
+
+func (r *firehoseSearchResolver) blockAt(ctx context.Context, t time.Time) (uint64, error) {
+	head, headTime, err := r.probe(ctx, -1)
+	if err != nil {
+		return 0, fmt.Errorf("getting the head block: %w", err)
+	}
+	if headTime.Before(t) {
+		return 0, fmt.Errorf("no block after %s, the head block %d is at %s", t, head, headTime)
+	}
+	low, high := uint64(1), head // the block at high is at or after t
+	for low < high {
+		mid := low + (high-low)/2
+		_, midTime, err := r.probe(ctx, int64(mid))
+		if err != nil {
+			return 0, fmt.Errorf("getting block %d: %w", mid, err)
+		}
+		if midTime.Before(t) {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	return high, nil
+}
+
+// probe returns the number and time of the block, negative numbers are relative to the head
+func (r *firehoseSearchResolver) probe(ctx context.Context, blockNum int64) (uint64, time.Time, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req := &pbbstream.BlocksRequestV2{StartBlockNum: blockNum, IncludeFilterExpr: r.filterExpr}
+	if blockNum >= 0 {
+		req.StopBlockNum = uint64(blockNum)
+	}
+	stream, err := openBlockStream(ctx, r.conn, r.version, req)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	t := blockTime(resp.block)
+	if t.IsZero() {
+		return 0, time.Time{}, fmt.Errorf("block %d has no time", resp.block.Num())
+	}
+	return resp.block.Num(), t, nil
+}
+
+// blockTime returns the time of the block, the zero time if the block has no header or timestamp
+func blockTime(blk *pbcodec.Block) time.Time {
+	if blk.Header == nil {
+		return time.Time{}
+	}
+	t, err := ptypes.Timestamp(blk.Header.Timestamp)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// resolveBlockRange returns the start and stop block numbers of the configured start and stop
+// times, a stop time after the head block is left to the stream loop
+func resolveBlockRange(ctx context.Context, resolver blockTimeResolver, conf *Config) (int64, uint64, error) {
+	startBlockNum, stopBlockNum := conf.StartBlockNum, conf.StopBlockNum
+	if conf.StartTime != "" {
+		startTime, _ := time.Parse(time.RFC3339, conf.StartTime)
+		num, err := resolver.blockAt(ctx, startTime)
+		if err != nil {
+			return 0, 0, fmt.Errorf("resolving start time: %w", err)
+		}
+		startBlockNum = int64(num)
+		zlog.Info("resolved start time", zap.String("start_time", conf.StartTime), zap.Int64("start_block_num", startBlockNum))
+	}
+	if stopTime := conf.stopTime(); !stopTime.IsZero() && stopTime.Before(time.Now()) {
+		num, err := resolver.blockAt(ctx, stopTime)
+		if err != nil {
+			return 0, 0, fmt.Errorf("resolving stop time: %w", err)
+		}
+		stopBlockNum = num - 1 // last block before the stop time
+		zlog.Info("resolved stop time", zap.String("stop_time", conf.StopTime), zap.Uint64("stop_block_num", stopBlockNum))
+	}
+	return startBlockNum, stopBlockNum, nil
+}
@@ -0,0 +1,138 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+const canaryEventType = "Canary"
+
+const canaryTimeout = 30 * time.Second
+
+// Canary is the payload of the message produced at startup to check the access to the topics,
+// canaries are left in the topics
+type Canary struct {
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+}
+
+func canaryMessage(topic string, eventSource string, now time.Time) *kafka.Message {
+	hostname, _ := os.Hostname()
+	value, _ := json.Marshal(Canary{Time: now, Hostname: hostname})
+	return &kafka.Message{
+		Key: []byte("canary"),
+		Headers: []kafka.Header{
+			{Key: "ce_id", Value: hashString(fmt.Sprintf("%s%s%s%d", canaryEventType, topic, hostname, now.UnixNano()))},
+			{Key: "ce_source", Value: []byte(eventSource)},
+			{Key: "ce_specversion", Value: []byte("1.0")},
+			{Key: "ce_type", Value: []byte(canaryEventType)},
+			{Key: controlHeader, Value: []byte(canaryEventType)},
+			{Key: "content-type", Value: []byte("application/json")},
+			{Key: "ce_time", Value: []byte(now.UTC().Format("2006-01-02T15:04:05.9Z"))},
+			{Key: "ce_datacontenttype", Value: []byte("application/json")},
+		},
+		Value: value,
+		TopicPartition: kafka.TopicPartition{
+			Topic:     &topic,
+			Partition: kafka.PartitionAny,
+		},
+	}
+}
+
+// runStartupCanary produces a canary message to the topic and waits for its delivery, then
+// optionally reads it back with the consumer group, so a misconfiguration fails the startup
+// instead of the first messages. The producer is not transactional.
+func runStartupCanary(conf kafka.ConfigMap, topic string, eventSource string, staticHeaders []kafka.Header, consumerGroupID string, consume bool) error {
+	producerConf := cloneConfig(conf)
+	producer, err := kafka.NewProducer(&producerConf)
+	if err != nil {
+		return fmt.Errorf("creating kafka client: %w", err)
+	}
+	defer producer.Close()
+
+	msg := canaryMessage(topic, eventSource, time.Now())
+	msg.Headers = append(msg.Headers, staticHeaders...)
+	deliveries := make(chan kafka.Event, 1)
+	if err := producer.Produce(msg, deliveries); err != nil {
+		return canaryError("producing to", topic, err)
+	}
+	var delivered *kafka.Message
+	select {
+	case ev := <-deliveries:
+		m, ok := ev.(*kafka.Message)
+		if !ok {
+			return fmt.Errorf("startup canary: unexpected delivery event %s", ev)
+		}
+		if m.TopicPartition.Error != nil {
+			return canaryError("producing to", topic, m.TopicPartition.Error)
+		}
+		delivered = m
+	case <-time.After(canaryTimeout):
+		return canaryError("producing to", topic, lastClientError(producer.Events(), kafka.NewError(kafka.ErrTimedOut, "delivery not confirmed", false)))
+	}
+	zlog.Info("startup canary delivered", zap.String("topic", topic), zap.Int32("partition", delivered.TopicPartition.Partition), zap.Int64("offset", int64(delivered.TopicPartition.Offset)))
+	if !consume {
+		return nil
+	}
+
+	consumerConfig := cloneConfig(conf)
+	consumerConfig["group.id"] = consumerGroupID
+	consumerConfig["enable.auto.commit"] = false
+	consumer, err := kafka.NewConsumer(&consumerConfig)
+	if err != nil {
+		return fmt.Errorf("creating consumer: %w", err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Printf("error closing consumer: %s", err)
+		}
+	}()
+
+	partition := []kafka.TopicPartition{{Topic: &topic, Partition: delivered.TopicPartition.Partition}}
+	if _, err := consumer.Committed(partition, int(canaryTimeout/time.Millisecond)); err != nil {
+		return canaryError(fmt.Sprintf("reading the offsets of the consumer group %q on", consumerGroupID), topic, err)
+	}
+	partition[0].Offset = delivered.TopicPartition.Offset
+	if err := consumer.Assign(partition); err != nil {
+		return canaryError("consuming from", topic, err)
+	}
+	ceID := headerValue(msg.Headers, "ce_id")
+	deadline := time.Now().Add(canaryTimeout)
+	for time.Now().Before(deadline) {
+		switch event := consumer.Poll(1000).(type) {
+		case kafka.Error:
+			return canaryError("consuming from", topic, event)
+		case *kafka.Message:
+			if headerValue(event.Headers, "ce_id") == ceID {
+				zlog.Info("startup canary consumed back", zap.String("topic", topic), zap.String("consumer_group", consumerGroupID))
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("startup canary: the canary produced to %s was not consumed back within %s", topic, canaryTimeout)
+}
+
+// lastClientError returns the last error event emitted by the client, or the default error
+func lastClientError(events chan kafka.Event, cause error) error {
+	for {
+		select {
+		case ev := <-events:
+			if kerr, ok := ev.(kafka.Error); ok && kerr.Code() != kafka.ErrAllBrokersDown {
+				cause = kerr
+			}
+			continue
+		default:
+		}
+		return cause
+	}
+}
+
+func canaryError(operation string, topic string, err error) error {
+	return fmt.Errorf("startup canary failed %s topic %s: %s: %w", operation, topic, connectivityHint(err), err)
+}
@@ -0,0 +1,54 @@
+package dkafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"strings"
+)
+
+// decodeJSON decodes the numbers as json.Number, so the uint64 values (global sequences,
+// amounts) never go through a float64 and lose their precision
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// canonicalJSON re-encodes a JSON document with its object keys sorted, without insignificant
+// whitespace and with the integers never in scientific notation, so an event always has the same
+// bytes; a document which is not valid JSON is returned as is
+func canonicalJSON(data []byte) []byte {
+	var doc interface{}
+	if err := decodeJSON(data, &doc); err != nil {
+		return data
+	}
+	out, err := json.Marshal(canonicalNumbers(doc))
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// canonicalNumbers rewrites the integers in scientific notation (ex: 1e+21) as plain integers,
+// the other numbers keep their literal
+func canonicalNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = canonicalNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = canonicalNumbers(item)
+		}
+	case json.Number:
+		if !strings.ContainsAny(string(v), "eE") {
+			return v
+		}
+		if r, ok := new(big.Rat).SetString(string(v)); ok && r.IsInt() {
+			return json.Number(r.Num().String())
+		}
+	}
+	return v
+}
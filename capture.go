@@ -0,0 +1,126 @@
+package dkafka
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+)
+
+const captureFileSuffix = ".pb.zst"
+
+// blockCapture saves the received blocks for forensics: a block is begun before it is adapted,
+// then kept (written) or discarded once its outcome is known
+type blockCapture interface {
+	Begin(blk *pbcodec.Block, step string)
+	Keep()
+	Discard()
+}
+
+type nopBlockCapture struct{}
+
+func (nopBlockCapture) Begin(*pbcodec.Block, string) {}
+func (nopBlockCapture) Keep()                        {}
+func (nopBlockCapture) Discard()                     {}
+
+// fileBlockCapture writes the blocks as zstd-compressed protobuf files, named after the block
+// number so they sort by block, and prunes the oldest files above the retention
+type fileBlockCapture struct {
+	dir             string
+	retentionBlocks int   // files kept, unbounded if zero
+	retentionBytes  int64 // total size of the files kept, unbounded if zero
+
+	pending     *pbcodec.Block
+	pendingStep string
+	files       []captureFile // oldest first
+	totalBytes  int64
+}
+
+type captureFile struct {
+	name string
+	size int64
+}
+
+func newFileBlockCapture(dir string, retentionBlocks int, retentionBytes int64) (*fileBlockCapture, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating capture dir: %w", err)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing capture dir: %w", err)
+	}
+	c := &fileBlockCapture{dir: dir, retentionBlocks: retentionBlocks, retentionBytes: retentionBytes}
+	for _, info := range infos { // sorted by name
+		if info.IsDir() || !strings.HasSuffix(info.Name(), captureFileSuffix) {
+			continue
+		}
+		c.files = append(c.files, captureFile{name: info.Name(), size: info.Size()})
+		c.totalBytes += info.Size()
+	}
+	c.prune()
+	return c, nil
+}
+
+func (c *fileBlockCapture) Begin(blk *pbcodec.Block, step string) {
+	c.pending = blk
+	c.pendingStep = step
+}
+
+func (c *fileBlockCapture) Discard() {
+	c.pending = nil
+}
+
+// Keep writes the pending block, a failure is logged as the capture must not stop the stream
+func (c *fileBlockCapture) Keep() {
+	if c.pending == nil {
+		return
+	}
+	blk := c.pending
+	c.pending = nil
+	if err := c.write(blk); err != nil {
+		zlog.Warn("cannot capture block", zap.Uint32("blk_number", blk.Number), zap.Error(err))
+	}
+}
+
+func (c *fileBlockCapture) write(blk *pbcodec.Block) error {
+	data, err := proto.Marshal(blk)
+	if err != nil {
+		return err
+	}
+	if data, err = compressValue("zstd", data); err != nil {
+		return err
+	}
+	id := blk.Id
+	if len(id) > 8 {
+		id = id[len(id)-8:]
+	}
+	name := fmt.Sprintf("%010d-%s-%s%s", blk.Number, id, c.pendingStep, captureFileSuffix)
+	if err := ioutil.WriteFile(filepath.Join(c.dir, name), data, 0644); err != nil {
+		return err
+	}
+	CapturedBlocks.Inc()
+	c.files = append(c.files, captureFile{name: name, size: int64(len(data))})
+	c.totalBytes += int64(len(data))
+	sort.Slice(c.files, func(i, j int) bool { return c.files[i].name < c.files[j].name })
+	c.prune()
+	return nil
+}
+
+// prune removes the oldest files until the retention is met, the last file is always kept
+func (c *fileBlockCapture) prune() {
+	for len(c.files) > 1 && ((c.retentionBlocks > 0 && len(c.files) > c.retentionBlocks) || (c.retentionBytes > 0 && c.totalBytes > c.retentionBytes)) {
+		oldest := c.files[0]
+		if err := os.Remove(filepath.Join(c.dir, oldest.name)); err != nil && !os.IsNotExist(err) {
+			zlog.Warn("cannot prune captured block", zap.String("file", oldest.name), zap.Error(err))
+			return
+		}
+		c.files = c.files[1:]
+		c.totalBytes -= oldest.size
+	}
+}
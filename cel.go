@@ -4,24 +4,94 @@ import (
 	"fmt"
 
 	"github.com/dfuse-io/dfuse-eosio/filtering"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
 	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/interpreter"
 )
 
-func exprToCelProgram(stripped string) (prog cel.Program, err error) {
-	env, err := cel.NewEnv(filtering.ActionTraceDeclarations)
+func exprToCelProgram(stripped string, opts ...cel.EnvOption) (prog cel.Program, err error) {
+	env, err := cel.NewEnv(append([]cel.EnvOption{filtering.ActionTraceDeclarations, eventDeclarations, cel.Lib(memoLib{})}, opts...)...)
 	if err != nil {
 		return nil, fmt.Errorf("creating new CEL environment: %w", err)
 	}
 
-	exprAst, issues := env.Compile(stripped)
+	exprAst, issues := env.CompileSource(celSource(stripped))
 	if issues != nil && issues.Err() != nil {
-		return nil, fmt.Errorf("compiling AST expression %s: %w", stripped, issues.Err())
+		return nil, fmt.Errorf("compiling AST expression %s: %w", exprDescription(stripped), issues.Err())
 	}
 
 	prog, err = env.Program(exprAst)
 	if err != nil {
-		return nil, fmt.Errorf("creating program from AST expression %s: %w", stripped, err)
+		return nil, fmt.Errorf("creating program from AST expression %s: %w", exprDescription(stripped), err)
 	}
 
 	return
 }
+
+// eventDeclarations are the names resolved by the event expressions in addition to the ones of
+// the firehose filter
+var eventDeclarations = cel.Declarations(
+	decls.NewIdent("producer", decls.String, nil),         // block producer
+	decls.NewIdent("schedule_version", decls.Uint, nil),   // producers schedule version of the block
+	decls.NewIdent("trx_id", decls.String, nil),           // same as transaction_id
+	decls.NewIdent("trx_index", decls.Uint, nil),          // same as transaction_index
+	decls.NewIdent("first_authorizer", decls.String, nil), // actor of the first authorization of the first action of the transaction
+	decls.NewIdent("cpu_usage_us", decls.Uint, nil),       // billed cpu of the transaction
+	decls.NewIdent("net_usage_words", decls.Uint, nil),    // billed net of the transaction
+	decls.NewIdent("ram_delta", decls.Int, nil),           // net RAM usage change of the action, in bytes
+	decls.NewIdent("console", decls.String, nil),          // console output of the action
+)
+
+// eventActivation resolves the block and transaction level names of the event expressions
+type eventActivation struct {
+	interpreter.Activation
+	blk *pbcodec.Block
+	trx *pbcodec.TransactionTrace
+	act *pbcodec.ActionTrace
+}
+
+func newEventActivation(blk *pbcodec.Block, trx *pbcodec.TransactionTrace, act *pbcodec.ActionTrace, activation interpreter.Activation) *eventActivation {
+	return &eventActivation{Activation: activation, blk: blk, trx: trx, act: act}
+}
+
+func (a *eventActivation) ResolveName(name string) (interface{}, bool) {
+	switch name {
+	case "producer":
+		if a.blk.Header == nil {
+			return "", true
+		}
+		return a.blk.Header.Producer, true
+	case "schedule_version":
+		if a.blk.Header == nil {
+			return uint64(0), true
+		}
+		return uint64(a.blk.Header.ScheduleVersion), true
+	case "trx_id":
+		return a.trx.Id, true
+	case "trx_index":
+		return a.trx.Index, true
+	case "first_authorizer":
+		for _, act := range a.trx.ActionTraces {
+			if act.Action != nil && len(act.Action.Authorization) != 0 {
+				return act.Action.Authorization[0].Actor, true
+			}
+		}
+		return "", true
+	case "cpu_usage_us":
+		if a.trx.Receipt == nil {
+			return uint64(0), true
+		}
+		return uint64(a.trx.Receipt.CpuUsageMicroSeconds), true
+	case "net_usage_words":
+		if a.trx.Receipt == nil {
+			return uint64(0), true
+		}
+		return uint64(a.trx.Receipt.NetUsageWords), true
+	case "ram_delta":
+		return ramDelta(a.trx, a.act), true
+	case "console":
+		return actionConsole(a.act), true
+	}
+	return a.Activation.ResolveName(name)
+}
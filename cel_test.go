@@ -0,0 +1,82 @@
+package dkafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dfuse-io/dfuse-eosio/filtering"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEventActivation returns the activation of the first action of a transfer block, with its
+// block and transaction level fields set
+func testEventActivation() *eventActivation {
+	blk := testTransferBlock(10, 1)
+	blk.Header.ScheduleVersion = 7
+	trx := blk.UnfilteredTransactionTraces[0]
+	trx.ProducerBlockId = blk.Id
+	trx.BlockTime = blk.Header.Timestamp
+	trx.Receipt.CpuUsageMicroSeconds = 250
+	trx.Receipt.NetUsageWords = 16
+	trx.RamOps = []*pbcodec.RAMOp{{ActionIndex: 0, Delta: 128}, {ActionIndex: 0, Delta: -28}}
+	act := trx.ActionTraces[0]
+	act.Console = "transferred"
+	return newEventActivation(blk, trx, act, filtering.NewActionTraceActivation(act, &filtering.MemoizableTrxTrace{TrxTrace: trx}, "NEW"))
+}
+
+func TestEventExpressionsResolveTheBlockAndTransactionNames(t *testing.T) {
+	activation := testEventActivation()
+	for _, expr := range []string{
+		`block_num == 10u`,
+		`block_id == "0000000a` + "00000000000000000000000000000000000000000000000000000000" + `"`,
+		`block_time == "2021-06-01T12:00:00.0Z"`,
+		`producer == "eosio"`,
+		`schedule_version == 7u`,
+		`trx_id == transaction_id && trx_id.size() == 64`,
+		`trx_index == 0u`,
+		`first_authorizer == "alice"`,
+		`cpu_usage_us == 250u`,
+		`net_usage_words == 16u`,
+		`ram_delta == 100`,
+		`console == "transferred"`,
+	} {
+		t.Run(expr, func(t *testing.T) {
+			prog, err := exprToCelProgram(expr)
+			require.NoError(t, err)
+			matched, err := evalBool(prog, activation)
+			require.NoError(t, err)
+			assert.True(t, matched)
+		})
+	}
+}
+
+func TestEventExpressionsRejectUndeclaredNamesAtCompileTime(t *testing.T) {
+	_, err := exprToCelProgram(`delay_sec > 0u`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "undeclared reference to 'delay_sec'")
+}
+
+// TestTransactionGranularityFilterResolvesTheEventNames evaluates the pipeline filter with the same
+// activation as the action granularity
+func TestTransactionGranularityFilterResolvesTheEventNames(t *testing.T) {
+	config := validTestConfig()
+	config.EventGranularity = "transaction"
+	adapter := testAdapter(t, config)
+	for _, bench := range []struct {
+		filter string
+		msgs   int
+	}{
+		{`producer == "eosio" && first_authorizer == "alice"`, 4}, // a transaction per transfer, keyed by from and to
+		{`producer == "other"`, 0},
+	} {
+		filter, err := exprToCelProgram(bench.filter)
+		require.NoError(t, err)
+		adapter.filter = filter
+		msgs, err := adapter.Adapt(context.Background(), testTransferBlock(10, 2), pbbstream.ForkStep_STEP_NEW.String())
+		require.NoError(t, err)
+		assert.Len(t, msgs, bench.msgs, bench.filter)
+	}
+}
@@ -0,0 +1,57 @@
+package dkafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// fetchChainID returns the chain ID reported by the get_info endpoint of the chain API (nodeos),
+// the firehose blocks do not carry it
+func fetchChainID(ctx context.Context, apiEndpoint string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(apiEndpoint, "/")+"/v1/chain/get_info", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("requesting chain info: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting chain info: %s", resp.Status)
+	}
+	var info struct {
+		ChainID string `json:"chain_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("decoding chain info: %w", err)
+	}
+	return info.ChainID, nil
+}
+
+// verifyChainID fails if the chain API serves another chain than the expected one
+func verifyChainID(ctx context.Context, apiEndpoint string, expected string) error {
+	chainID, err := fetchChainID(ctx, apiEndpoint)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(chainID, expected) {
+		return fmt.Errorf("chain id mismatch: expected %s, %s serves %s -- is dkafka pointed at the right network?", expected, apiEndpoint, chainID)
+	}
+	return nil
+}
+
+// checkCursorChainID refuses a cursor saved against another chain, the cursors saved without
+// chain ID are accepted
+func checkCursorChainID(cursorChainID string, expected string) error {
+	if expected == "" || cursorChainID == "" || strings.EqualFold(cursorChainID, expected) {
+		return nil
+	}
+	return fmt.Errorf("cursor was saved against chain %s, not the expected chain %s -- refusing to resume it", cursorChainID, expected)
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"os"
 	"strings"
 	"time"
 
@@ -16,74 +19,234 @@ import (
 var NoCursorErr = errors.New("no cursor exists")
 
 type checkpointer interface {
-	Save(cursor string) error
-	Load() (cursor string, err error)
+	Save(ctx context.Context, cursor string) error
+	Load(ctx context.Context) (cursor string, err error)
 }
 
 type nilCheckpointer struct{}
 
-func (n *nilCheckpointer) Save(string) error {
+func (n *nilCheckpointer) Save(context.Context, string) error {
 	return nil
 }
 
-func (n *nilCheckpointer) Load() (string, error) {
+func (n *nilCheckpointer) Load(context.Context) (string, error) {
 	return "", NoCursorErr
 }
 
-func newKafkaCheckpointer(conf kafka.ConfigMap, cursorTopic string, cursorPartition int32, dataTopic string, consumerGroupID string, producer *kafka.Producer) *kafkaCheckpointer {
+// splitCheckpointer loads the cursor from a checkpointer and saves it to another, ex: a dry run
+// starting from the cursor of the live instance without ever overwriting it
+type splitCheckpointer struct {
+	load checkpointer
+	save checkpointer
+}
+
+func (c *splitCheckpointer) Save(ctx context.Context, cursor string) error {
+	return c.save.Save(ctx, cursor)
+}
+
+func (c *splitCheckpointer) Load(ctx context.Context) (string, error) {
+	return c.load.Load(ctx)
+}
+
+const cursorTopicPartitions = 10
+
+// defaultCursorSaveTimeout bounds the wait for the delivery of a saved cursor if the config sets none
+const defaultCursorSaveTimeout = 10 * time.Second
+
+// cursorProducer is the part of the kafka producer saving the cursors
+type cursorProducer interface {
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error)
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+}
+
+// cursorConsumer is the part of the kafka consumer reading the cursor partition
+type cursorConsumer interface {
+	Assign(partitions []kafka.TopicPartition) error
+	Poll(timeoutMs int) kafka.Event
+}
+
+// newKafkaCheckpointer creates a checkpointer saving the cursors on the given partition of the cursor topic,
+// with autoPartition the partition is derived from the signature and the partition count of the cursor topic
+func newKafkaCheckpointer(conf kafka.ConfigMap, cursorTopic string, cursorPartition int32, autoPartition bool, dataTopic string, account string, consumerGroupID string, producer *kafka.Producer, ordinal *ordinal) *kafkaCheckpointer {
 	consumerConfig := cloneConfig(conf)
-	id := strings.Replace(fmt.Sprintf("dk-%s-%s-%d", dataTopic, cursorTopic, cursorPartition), "_", "", -1)
 
 	consumerConfig["group.id"] = consumerGroupID
 	consumerConfig["enable.auto.commit"] = false
+	consumerConfig["enable.partition.eof"] = true
 
-	return &kafkaCheckpointer{
+	signature := cursorSignature(dataTopic, account)
+	c := &kafkaCheckpointer{
 		consumerConfig: consumerConfig,
 		topic:          cursorTopic,
-		partition:      cursorPartition,
-		key:            []byte(id),
-		producer:       producer,
+		dataTopic:      dataTopic,
+		signature:      signature,
+		key:            []byte("dk-cursor-" + signature),
+		autoPartition:  autoPartition,
+		ordinal:        ordinal,
+		saveTimeout:    defaultCursorSaveTimeout,
+	}
+	if producer != nil {
+		c.producer = producer
+	}
+	if !autoPartition {
+		c.setPartition(cursorPartition)
 	}
+	return c
 }
 
 type kafkaCheckpointer struct {
-	key            []byte
-	producer       *kafka.Producer
+	key            []byte // compaction key, derived from the signature
+	legacyKey      []byte // key of the cursors saved before they were keyed by signature
+	producer       cursorProducer
 	consumerConfig kafka.ConfigMap
 	topic          string
 	partition      int32
+	dataTopic      string
+	signature      string
+	ordinal        *ordinal // saved and restored with the cursor
+	chainID        string   // saved with the cursor, a cursor of another chain is refused
+	loaded         *cs      // last loaded cursor
+	asyncSave      bool     // Save does not wait for the delivery of the cursor
+	noAdmin        bool     // the cursor topic is never created nor subscribed, Read and Describe on it suffice
+	saveTimeout    time.Duration
+
+	compatibilityMode bool // a cursor saved by a newer version is accepted
+
+	lease *leaseRecord // last loaded instance lease, read along with the cursor
+
+	autoPartition     bool
+	partitionResolved bool
 }
 
-// in case we need it
-//func newFileCheckpointer(filename string) *localFileCheckpointer {
-//	return &localFileCheckpointer{
-//		filename: filename,
-//	}
-//}
-//
-//type localFileCheckpointer struct {
-//	filename string
-//}
-//
-//func (c *localFileCheckpointer) Save(cursor string) error {
-//	dat := []byte(cursor)
-//	return ioutil.WriteFile(c.filename, dat, 0644)
-//}
-//
-//func (c *localFileCheckpointer) Load() (string, error) {
-//	dat, err := ioutil.ReadFile(c.filename)
-//	if os.IsNotExist(err) {
-//		return "", NoCursorErr
-//	}
-//	return string(dat), err
-//}
+// cursorSignature identifies the dkafka instance owning a cursor
+func cursorSignature(dataTopic string, account string) string {
+	return fmt.Sprintf("%s:%s", dataTopic, account)
+}
+
+func autoCursorPartition(signature string, partitionCount int) int32 {
+	return hashPartition(signature, partitionCount)
+}
+
+func (c *kafkaCheckpointer) setPartition(partition int32) {
+	c.partition = partition
+	c.legacyKey = []byte(strings.Replace(fmt.Sprintf("dk-%s-%s-%d", c.dataTopic, c.topic, partition), "_", "", -1))
+	c.partitionResolved = true
+}
+
+func (c *kafkaCheckpointer) resolvePartition(partitionCount int) {
+	if c.partitionResolved {
+		return
+	}
+	c.setPartition(autoCursorPartition(c.signature, partitionCount))
+	zlog.Warn("cursor partition auto-assigned, make sure no other instance uses this signature",
+		zap.String("cursor_topic", c.topic),
+		zap.Int32("cursor_partition", c.partition),
+		zap.Int("partition_count", partitionCount),
+		zap.String("signature", c.signature),
+	)
+}
+
+// newLocalFileCheckpointer creates a checkpointer saving the cursors to the state file, along with
+// the ordinal of the messages so it survives the restarts
+func newLocalFileCheckpointer(filename string, ordinal *ordinal) *localFileCheckpointer {
+	return &localFileCheckpointer{
+		filename: filename,
+		ordinal:  ordinal,
+	}
+}
+
+type localFileCheckpointer struct {
+	filename string
+	ordinal  *ordinal
+	chainID  string // if set, saved along with the cursor
+	loaded   *cs    // last loaded cursor
+
+	compatibilityMode bool // a cursor saved by a newer version is accepted
+}
+
+func (c *localFileCheckpointer) Save(_ context.Context, cursor string) error {
+	dat, err := json.Marshal(cs{Version: cursorVersion, Cursor: cursor, Ordinal: c.ordinal.current(), ChainID: c.chainID})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.filename, dat, 0644)
+}
+
+func (c *localFileCheckpointer) Load(context.Context) (string, error) {
+	dat, err := ioutil.ReadFile(c.filename)
+	if os.IsNotExist(err) || (err == nil && len(dat) == 0) {
+		return "", NoCursorErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if dat[0] != '{' {
+		c.loaded = &cs{Cursor: string(dat)}
+		return string(dat), nil
+	}
+	cursor := &cs{}
+	if err := json.Unmarshal(dat, cursor); err != nil {
+		return "", fmt.Errorf("decoding state file: %w", err)
+	}
+	c.loaded = cursor
+	if err := checkCursorVersion(cursor.Version, c.compatibilityMode); err != nil {
+		return "", err
+	}
+	if err := checkCursorChainID(cursor.ChainID, c.chainID); err != nil {
+		return "", err
+	}
+	c.ordinal.set(cursor.Ordinal)
+	if cursor.Cursor == "" {
+		return "", NoCursorErr
+	}
+	return cursor.Cursor, nil
+}
+
+// cursorVersion is the version of the cursor envelope saved by this binary, the cursors saved before
+// the envelope was versioned have no "v" field (v0). Bump it when a field changes how a cursor must be
+// resumed, older binaries then refuse the cursor instead of ignoring the field.
+const cursorVersion = 1
 
 type cs struct {
-	Cursor string `json:"cursor"`
+	Version   int    `json:"v,omitempty"`
+	Cursor    string `json:"cursor"`
+	Signature string `json:"signature,omitempty"`
+	Ordinal   uint64 `json:"ordinal,omitempty"` // missing from the cursors saved by older versions
+	ChainID   string `json:"chain_id,omitempty"`
+}
+
+// checkCursorVersion refuses a cursor saved by a newer dkafka version, unless in compatibility mode
+// (emergency rollbacks), where its unknown fields are ignored
+func checkCursorVersion(version int, compatibilityMode bool) error {
+	if version <= cursorVersion {
+		return nil
+	}
+	if compatibilityMode {
+		zlog.Warn("cursor saved by a newer dkafka version, resuming it in compatibility mode: its new fields are ignored",
+			zap.Int("cursor_version", version),
+			zap.Int("supported_version", cursorVersion),
+		)
+		return nil
+	}
+	return fmt.Errorf("cursor was saved by a newer dkafka version (cursor format v%d, this binary supports up to v%d) -- upgrade dkafka, or set {cursor-compatibility-mode} to force resuming it", version, cursorVersion)
 }
 
-func (c *kafkaCheckpointer) Save(cursor string) error {
-	v, err := json.Marshal(cs{Cursor: cursor})
+func (c *kafkaCheckpointer) Save(ctx context.Context, cursor string) error {
+	if !c.partitionResolved {
+		md, err := c.producer.GetMetadata(&c.topic, false, 500)
+		if err == nil {
+			err = topicMetadataError(md, c.topic)
+		}
+		if err != nil {
+			return fmt.Errorf("getting metadata: %w", missingACL(err, "Describe", "topic "+c.topic))
+		}
+		parts := md.Topics[c.topic].Partitions
+		if len(parts) == 0 {
+			return fmt.Errorf("cursor topic %q does not exist", c.topic)
+		}
+		c.resolvePartition(len(parts))
+	}
+	v, err := json.Marshal(cs{Version: cursorVersion, Cursor: cursor, Signature: c.signature, Ordinal: c.ordinal.current(), ChainID: c.chainID})
 	if err != nil {
 		return err
 	}
@@ -95,10 +258,40 @@ func (c *kafkaCheckpointer) Save(cursor string) error {
 		},
 		Value: v,
 	}
-	return c.producer.Produce(msg, nil)
+	if c.asyncSave {
+		return c.producer.Produce(msg, nil)
+	}
+
+	start := time.Now()
+	deliveries := make(chan kafka.Event, 1)
+	if err := c.producer.Produce(msg, deliveries); err != nil {
+		return err
+	}
+	select {
+	case ev := <-deliveries:
+		if m, ok := ev.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+			return fmt.Errorf("delivering cursor: %w", missingACL(m.TopicPartition.Error, "Write", "topic "+c.topic))
+		}
+	case <-time.After(c.saveTimeout):
+		return fmt.Errorf("cursor delivery not confirmed after %s", c.saveTimeout)
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for the cursor delivery: %w", ctx.Err())
+	}
+	CursorSaveDuration.ObserveSince(start)
+	return nil
 }
 
-func (c *kafkaCheckpointer) Load() (string, error) {
+// cursorLoadTimeout bounds the total time of a cursor load, cursorScanMaxOffsets the offsets read
+// backwards looking for a cursor saved with the legacy key, and the window of the keyed scan
+const (
+	cursorLoadTimeout    = 2 * time.Minute
+	cursorScanMaxOffsets = 1000
+)
+
+func (c *kafkaCheckpointer) Load(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, cursorLoadTimeout)
+	defer cancel()
+
 	consumer, err := kafka.NewConsumer(&c.consumerConfig)
 	if err != nil {
 		return "", fmt.Errorf("creating consumer: %w", err)
@@ -110,30 +303,219 @@ func (c *kafkaCheckpointer) Load() (string, error) {
 		}
 	}()
 
-	consumer.Subscribe(c.topic, nil)
+	if !c.noAdmin {
+		consumer.Subscribe(c.topic, nil)
+	}
 
 	md, err := consumer.GetMetadata(&c.topic, false, 500)
-	if err != nil {
-		return "", fmt.Errorf("getting metadata: %w", err)
+	if err == nil {
+		err = topicMetadataError(md, c.topic)
 	}
-	parts := md.Topics[c.topic].Partitions
-	if len(parts) == 0 {
+	switch {
+	case err != nil && c.noAdmin && isAuthorizationError(err):
+		if !c.partitionResolved {
+			return "", fmt.Errorf("resolving the auto cursor partition: %w", missingACL(err, "Describe", "topic "+c.topic))
+		}
+		zlog.Warn("cannot describe the cursor topic, assuming it exists",
+			zap.String("cursor_topic", c.topic),
+			zap.Int32("cursor_partition", c.partition),
+			zap.Error(err),
+		)
+	case err != nil:
+		return "", fmt.Errorf("getting metadata: %w", missingACL(err, "Describe", "topic "+c.topic))
+	case len(md.Topics[c.topic].Partitions) == 0:
+		if c.noAdmin {
+			return "", fmt.Errorf("cursor topic %q does not exist and admin operations are disabled, create it with cleanup.policy=compact", c.topic)
+		}
 		zlog.Info("cursor topic does not exist, creating", zap.String("cursor_topic", c.topic))
 		err := createKafkaCursorTopic(consumer, c.topic, len(md.Brokers))
 		if err != nil {
 			return "", err
 		}
-	} else if len(parts)-1 < int(c.partition) {
-		return "", fmt.Errorf("requested cursor partition does not exist in cursor topic")
+		c.resolvePartition(cursorTopicPartitions)
+	default:
+		parts := md.Topics[c.topic].Partitions
+		c.resolvePartition(len(parts))
+		if len(parts)-1 < int(c.partition) {
+			return "", fmt.Errorf("requested cursor partition does not exist in cursor topic")
+		}
+		if err := ensureCursorTopicCompacted(consumer, c.topic, c.noAdmin); err != nil {
+			zlog.Warn("cannot check the cleanup policy of the cursor topic, it must be compact to keep the cursor of each instance",
+				zap.String("cursor_topic", c.topic),
+				zap.Error(err),
+			)
+		}
 	}
 
 	low, high, err := consumer.QueryWatermarkOffsets(c.topic, c.partition, 500)
+	if err != nil && (!c.noAdmin || !isAuthorizationError(err)) {
+		return "", fmt.Errorf("getting low/high: %w", missingACL(err, "Describe", "topic "+c.topic))
+	}
+	if err != nil {
+		zlog.Warn("cannot query the cursor partition offsets, reading it from the beginning",
+			zap.String("cursor_topic", c.topic),
+			zap.Int32("cursor_partition", c.partition),
+			zap.Error(err),
+		)
+		low, high = int64(kafka.OffsetBeginning), unknownHighWatermark
+	}
+
+	cursor, err := c.loadKeyed(ctx, consumer, low, high)
+	if err != nil {
+		return "", err
+	}
+	if cursor == nil && high != unknownHighWatermark {
+		// cursors saved before they were keyed by signature, found by offset
+		cursor, err = c.loadLatest(ctx, consumer, low, high)
+		if err != nil {
+			return "", err
+		}
+	}
+	if cursor == nil {
+		return "", NoCursorErr
+	}
+	return c.resume(cursor)
+}
+
+// resume checks the loaded cursor can be resumed by this instance and restores its ordinal
+func (c *kafkaCheckpointer) resume(cursor *cs) (string, error) {
+	if cursor.Signature != "" && cursor.Signature != c.signature {
+		if c.autoPartition {
+			return "", fmt.Errorf("cursor partition %d belongs to %q, not to %q -- refusing to overwrite another instance cursor", c.partition, cursor.Signature, c.signature)
+		}
+		zlog.Warn("cursor partition belongs to another instance signature, ignored as the partition is set explicitly",
+			zap.Int32("cursor_partition", c.partition),
+			zap.String("cursor_signature", cursor.Signature),
+			zap.String("signature", c.signature),
+		)
+	}
+	c.loaded = cursor
+	if err := checkCursorVersion(cursor.Version, c.compatibilityMode); err != nil {
+		return "", err
+	}
+	if err := checkCursorChainID(cursor.ChainID, c.chainID); err != nil {
+		return "", err
+	}
+	c.ordinal.set(cursor.Ordinal)
+	if cursor.Cursor == "" {
+		return "", NoCursorErr
+	}
+	return cursor.Cursor, nil
+}
+
+// unknownHighWatermark is the high watermark of a partition whose offsets cannot be queried,
+// it is read until the end of partition event
+const unknownHighWatermark = int64(math.MaxInt64)
+
+// loadKeyed returns the last cursor saved with the key of this instance, which compaction keeps
+// even when the older segments are deleted. The partition is read by windows of
+// cursorScanMaxOffsets offsets, backwards from the high watermark, and the scan stops once the
+// window holding the cursor and the one before it, for an older lease record, are read: a
+// partition shared by many instances, or not compacted yet, is not read in full on each start.
+func (c *kafkaCheckpointer) loadKeyed(ctx context.Context, consumer cursorConsumer, low, high int64) (*cs, error) {
+	c.lease = nil
+	if high == unknownHighWatermark {
+		// the offsets cannot be queried, the partition is read from its start
+		return c.loadKeyedRange(ctx, consumer, low, high)
+	}
+	var found *cs
+	for to := high; to > low; to -= cursorScanMaxOffsets {
+		from := to - cursorScanMaxOffsets
+		if from < low {
+			from = low
+		}
+		cursor, err := c.loadKeyedRange(ctx, consumer, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if found != nil {
+			return found, nil // the window before the one of the cursor was read for the lease
+		}
+		found = cursor
+		if found != nil && c.lease != nil {
+			return found, nil
+		}
+	}
+	return found, nil
+}
+
+// loadKeyedRange reads the offsets from low to high and returns the last cursor saved with the key
+// of this instance among them, setting the lease if none was found in the later offsets
+func (c *kafkaCheckpointer) loadKeyedRange(ctx context.Context, consumer cursorConsumer, low, high int64) (*cs, error) {
+	if high <= low {
+		return nil, nil
+	}
+	err := consumer.Assign([]kafka.TopicPartition{
+		kafka.TopicPartition{
+			Topic:     &c.topic,
+			Partition: c.partition,
+			Offset:    kafka.Offset(low),
+		}})
 	if err != nil {
-		return "", fmt.Errorf("getting low/high: %w", err)
+		return nil, err
+	}
+
+	var found *cs
+	var lease *leaseRecord
+	done := func() (*cs, error) {
+		if c.lease == nil {
+			c.lease = lease
+		}
+		return found, nil
+	}
+	leaseID := leaseKey(c.signature)
+	for {
+		ev, err := pollContext(ctx, consumer, time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("reading cursor partition: %w", err)
+		}
+		switch event := ev.(type) {
+		case kafka.Error:
+			return nil, missingACL(event, "Read", "topic "+c.topic)
+		case kafka.PartitionEOF:
+			return done()
+		case *kafka.Message:
+			if int64(event.TopicPartition.Offset) >= high {
+				// the last offsets of the range were compacted away
+				return done()
+			}
+			if string(event.Key) == string(c.key) {
+				cursor := &cs{}
+				if err := json.Unmarshal(event.Value, cursor); err != nil {
+					return nil, err
+				}
+				found = cursor
+			}
+			if string(event.Key) == string(leaseID) {
+				record := &leaseRecord{}
+				if err := json.Unmarshal(event.Value, record); err != nil {
+					return nil, err
+				}
+				lease = record
+			}
+			if int64(event.TopicPartition.Offset) >= high-1 {
+				return done()
+			}
+		case nil:
+			// the last offsets can be transaction markers, never delivered
+			return done()
+		}
 	}
+}
 
+// loadLatest returns the last cursor of the partition, saved with the legacy key, among the last
+// cursorScanMaxOffsets offsets
+func (c *kafkaCheckpointer) loadLatest(ctx context.Context, consumer cursorConsumer, low, high int64) (*cs, error) {
 	for i := kafka.Offset(high) - 1; i >= kafka.Offset(low); i-- {
-		err = consumer.Assign([]kafka.TopicPartition{
+		if int64(i) < high-cursorScanMaxOffsets {
+			zlog.Warn("no legacy cursor found in the last offsets of the cursor partition, scan stopped",
+				zap.String("cursor_topic", c.topic),
+				zap.Int32("cursor_partition", c.partition),
+				zap.Int("scanned_offsets", cursorScanMaxOffsets),
+			)
+			return nil, nil
+		}
+		err := consumer.Assign([]kafka.TopicPartition{
 			kafka.TopicPartition{
 				Topic:     &c.topic,
 				Partition: c.partition,
@@ -141,31 +523,49 @@ func (c *kafkaCheckpointer) Load() (string, error) {
 			}})
 
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
-		ev := consumer.Poll(1000)
+		ev, err := pollContext(ctx, consumer, time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("scanning cursor partition: %w", err)
+		}
 		switch event := ev.(type) {
 		case kafka.Error:
-			return "", event
+			return nil, missingACL(event, "Read", "topic "+c.topic)
 		case *kafka.Message:
-			cursor := cs{}
-			if err := json.Unmarshal(event.Value, &cursor); err != nil {
-				return "", err
+			if strings.HasPrefix(string(event.Key), "dk-lease-") || strings.HasPrefix(string(event.Key), "dk-cursor-") {
+				continue // a lease or the keyed cursor of another signature sharing the partition
+			}
+			cursor := &cs{}
+			if err := json.Unmarshal(event.Value, cursor); err != nil {
+				return nil, err
 			}
 			if strings.HasPrefix(string(event.Key), "dk-") {
-				if string(event.Key) != string(c.key) {
-					return "", fmt.Errorf("invalid key for cursor: expected %s, got %s -- are you reading from the right partition?", string(c.key), string(event.Key))
+				if string(event.Key) != string(c.legacyKey) {
+					return nil, fmt.Errorf("invalid key for cursor: expected %s, got %s -- are you reading from the right partition?", string(c.legacyKey), string(event.Key))
 				}
 			}
-			if cursor.Cursor == "" {
-				err = NoCursorErr
-			}
-			return cursor.Cursor, err
+			return cursor, nil
 		default:
 		}
 	}
-	return "", NoCursorErr
+	return nil, nil
+}
+
+// pollContext polls the consumer for up to the timeout, nil if no event came, returning early
+// with the error of the context once it is done
+func pollContext(ctx context.Context, consumer cursorConsumer, timeout time.Duration) (kafka.Event, error) {
+	const slice = 100 * time.Millisecond
+	for waited := time.Duration(0); waited < timeout; waited += slice {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if ev := consumer.Poll(int(slice / time.Millisecond)); ev != nil {
+			return ev, nil
+		}
+	}
+	return nil, ctx.Err()
 }
 
 func cloneConfig(in kafka.ConfigMap) kafka.ConfigMap {
@@ -176,12 +576,80 @@ func cloneConfig(in kafka.ConfigMap) kafka.ConfigMap {
 	return out
 }
 
+// ensureCursorTopicCompacted sets cleanup.policy=compact on an existing cursor topic created
+// without it, whose older cursors would be deleted with their segments; with the admin operations
+// disabled the policy is only checked
+func ensureCursorTopicCompacted(c *kafka.Consumer, cursorTopic string, noAdmin bool) error {
+	adminCli, err := kafka.NewAdminClientFromConsumer(c)
+	if err != nil {
+		return fmt.Errorf("creating admin client: %w", err)
+	}
+	defer adminCli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resource := kafka.ConfigResource{Type: kafka.ResourceTopic, Name: cursorTopic}
+	results, err := adminCli.DescribeConfigs(ctx, []kafka.ConfigResource{resource})
+	if err == nil && len(results) == 1 && results[0].Error.Code() != kafka.ErrNoError {
+		err = results[0].Error
+	}
+	if err != nil {
+		return fmt.Errorf("describing the cursor topic configs: %w", missingACL(err, "DescribeConfigs", "topic "+cursorTopic))
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("describing the cursor topic configs: got %d results", len(results))
+	}
+	config, compacted, err := compactedTopicConfig(results[0].Config)
+	if err != nil || compacted {
+		return err
+	}
+	if noAdmin {
+		zlog.Warn("the cursor topic is not compacted and admin operations are disabled, set its cleanup.policy to compact",
+			zap.String("cursor_topic", cursorTopic),
+		)
+		return nil
+	}
+
+	zlog.Info("setting the cleanup policy of the cursor topic to compact", zap.String("cursor_topic", cursorTopic))
+	resource.Config = kafka.StringMapToConfigEntries(config, kafka.AlterOperationSet)
+	results, err = adminCli.AlterConfigs(ctx, []kafka.ConfigResource{resource})
+	if err == nil && len(results) == 1 && results[0].Error.Code() != kafka.ErrNoError {
+		err = results[0].Error
+	}
+	if err != nil {
+		return fmt.Errorf("altering the cursor topic configs: %w", missingACL(err, "AlterConfigs", "topic "+cursorTopic))
+	}
+	return nil
+}
+
+// compactedTopicConfig tells if the cleanup policy of the topic compacts it, if not it returns the
+// configs set on the topic with the compact policy: the alter request reverts the configs it omits
+func compactedTopicConfig(entries map[string]kafka.ConfigEntryResult) (map[string]string, bool, error) {
+	for _, policy := range strings.Split(entries["cleanup.policy"].Value, ",") {
+		if strings.TrimSpace(policy) == "compact" {
+			return nil, true, nil
+		}
+	}
+	config := map[string]string{}
+	for name, entry := range entries {
+		if entry.Source != kafka.ConfigSourceDynamicTopic {
+			continue
+		}
+		if entry.IsSensitive {
+			return nil, false, fmt.Errorf("the cursor topic sets the sensitive config %s, which would be reverted, set its cleanup.policy to compact", name)
+		}
+		config[name] = entry.Value
+	}
+	config["cleanup.policy"] = "compact"
+	return config, false, nil
+}
+
 func createKafkaCursorTopic(c *kafka.Consumer, cursorTopic string, maxAvailableBrokers int) error {
 	adminCli, err := kafka.NewAdminClientFromConsumer(c)
 	if err != nil {
 		return fmt.Errorf("creating admin client: %w", err)
 	}
-	numParts := 10
+	numParts := cursorTopicPartitions
 	replicationFactor := 3
 	if replicationFactor > maxAvailableBrokers {
 		replicationFactor = maxAvailableBrokers
@@ -194,11 +662,19 @@ func createKafkaCursorTopic(c *kafka.Consumer, cursorTopic string, maxAvailableB
 		[]kafka.TopicSpecification{{
 			Topic:             cursorTopic,
 			NumPartitions:     numParts,
-			ReplicationFactor: replicationFactor}},
+			ReplicationFactor: replicationFactor,
+			Config: map[string]string{
+				"cleanup.policy": "compact", // keeps the last cursor of each instance
+			}}},
 		// Admin options
 		kafka.SetAdminOperationTimeout(time.Second*10))
 	if err != nil {
-		return fmt.Errorf("creating topic: %w", err)
+		return fmt.Errorf("creating topic: %w", missingACL(err, "Create", "the cluster"))
+	}
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError && result.Error.Code() != kafka.ErrTopicAlreadyExists {
+			return fmt.Errorf("creating topic %s: %w", result.Topic, missingACL(result.Error, "Create", "the cluster"))
+		}
 	}
 
 	zlog.Info("creating topic", zap.Any("results", results), zap.Int("num_partitions", numParts), zap.Int("replication_factor", replicationFactor))
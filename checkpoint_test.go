@@ -0,0 +1,425 @@
+package dkafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCursorProducer records the produced cursors and acknowledges them with ack, dropping the
+// acknowledgement if nil
+type testCursorProducer struct {
+	produced []*kafka.Message
+	ack      func(msg *kafka.Message) kafka.Event
+}
+
+func (p *testCursorProducer) GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error) {
+	return nil, errors.New("no metadata")
+}
+
+func (p *testCursorProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	p.produced = append(p.produced, msg)
+	if p.ack != nil && deliveryChan != nil {
+		deliveryChan <- p.ack(msg)
+	}
+	return nil
+}
+
+func testKafkaCheckpointer(producer cursorProducer) *kafkaCheckpointer {
+	c := newKafkaCheckpointer(kafka.ConfigMap{}, "_dkafka_cursor", 0, false, "transfers", "eosio.token", "dkafka", nil, &ordinal{})
+	c.producer = producer
+	c.saveTimeout = 50 * time.Millisecond
+	return c
+}
+
+func TestKafkaCheckpointerSaveWaitsForDelivery(t *testing.T) {
+	producer := &testCursorProducer{ack: func(msg *kafka.Message) kafka.Event { return msg }}
+	c := testKafkaCheckpointer(producer)
+
+	require.NoError(t, c.Save(context.Background(), "cursor-1"))
+	require.Len(t, producer.produced, 1)
+	var saved cs
+	require.NoError(t, json.Unmarshal(producer.produced[0].Value, &saved))
+	assert.Equal(t, "cursor-1", saved.Cursor)
+	assert.Equal(t, "_dkafka_cursor", *producer.produced[0].TopicPartition.Topic)
+}
+
+func TestKafkaCheckpointerSaveFailsOnDroppedAck(t *testing.T) {
+	producer := &testCursorProducer{} // the delivery is never reported
+	c := testKafkaCheckpointer(producer)
+
+	started := time.Now()
+	err := c.Save(context.Background(), "cursor-1")
+	assert.EqualError(t, err, "cursor delivery not confirmed after 50ms")
+	assert.True(t, time.Since(started) < 5*time.Second)
+}
+
+func TestKafkaCheckpointerSaveFailsOnDeliveryError(t *testing.T) {
+	producer := &testCursorProducer{ack: func(msg *kafka.Message) kafka.Event {
+		failed := *msg
+		failed.TopicPartition.Error = errors.New("broker down")
+		return &failed
+	}}
+	c := testKafkaCheckpointer(producer)
+
+	err := c.Save(context.Background(), "cursor-1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "delivering cursor: broker down")
+}
+
+func TestKafkaCheckpointerSaveCanceled(t *testing.T) {
+	c := testKafkaCheckpointer(&testCursorProducer{})
+	c.saveTimeout = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := c.Save(ctx, "cursor-1")
+	assert.True(t, errors.Is(err, context.Canceled), "got %v", err)
+}
+
+func TestKafkaCheckpointerAsyncSaveDoesNotWait(t *testing.T) {
+	producer := &testCursorProducer{}
+	c := testKafkaCheckpointer(producer)
+	c.asyncSave = true
+
+	require.NoError(t, c.Save(context.Background(), "cursor-1"))
+	assert.Len(t, producer.produced, 1)
+}
+
+func TestKafkaCheckpointerSavesSynchronouslyByDefault(t *testing.T) {
+	c := newKafkaCheckpointer(kafka.ConfigMap{}, "_dkafka_cursor", 0, false, "transfers", "eosio.token", "dkafka", nil, &ordinal{})
+	assert.False(t, c.asyncSave)
+	assert.Equal(t, defaultCursorSaveTimeout, c.saveTimeout)
+}
+
+// testCursorPartition serves its messages from the assigned offset, skipping the compacted ones,
+// counting the messages read
+type testCursorPartition struct {
+	messages []*kafka.Message
+	next     int
+	read     int
+}
+
+func (p *testCursorPartition) Assign(partitions []kafka.TopicPartition) error {
+	p.next = 0
+	for p.next < len(p.messages) && p.messages[p.next].TopicPartition.Offset < partitions[0].Offset {
+		p.next++
+	}
+	return nil
+}
+
+func (p *testCursorPartition) Poll(timeoutMs int) kafka.Event {
+	if p.next == len(p.messages) {
+		return kafka.PartitionEOF{}
+	}
+	msg := p.messages[p.next]
+	p.next++
+	p.read++
+	return msg
+}
+
+func (p *testCursorPartition) add(offset int64, key []byte, value interface{}) {
+	data, _ := json.Marshal(value)
+	p.messages = append(p.messages, &kafka.Message{Key: key, Value: data, TopicPartition: kafka.TopicPartition{Offset: kafka.Offset(offset)}})
+}
+
+func TestKafkaCheckpointerLoadKeyedScansBackwards(t *testing.T) {
+	c := testKafkaCheckpointer(nil)
+	other := []byte("dk-cursor-other")
+	partition := &testCursorPartition{}
+	for i := int64(0); i < 10*cursorScanMaxOffsets; i += 2 { // every other offset compacted away
+		partition.add(i, other, cs{Cursor: fmt.Sprintf("other-%d", i)})
+	}
+	high := int64(10*cursorScanMaxOffsets + 10)
+	partition.add(high-10, leaseKey(c.signature), leaseRecord{InstanceID: "instance-1"})
+	partition.add(high-5, c.key, cs{Cursor: "cursor-1"})
+	partition.add(high-3, c.key, cs{Cursor: "cursor-2"})
+
+	cursor, err := c.loadKeyed(context.Background(), partition, 0, high)
+	require.NoError(t, err)
+	require.NotNil(t, cursor)
+	assert.Equal(t, "cursor-2", cursor.Cursor)
+	require.NotNil(t, c.lease)
+	assert.Equal(t, "instance-1", c.lease.InstanceID)
+	assert.True(t, partition.read <= cursorScanMaxOffsets, "read %d messages", partition.read) // the last window only
+}
+
+func TestKafkaCheckpointerLoadKeyedReadsTheLeaseBeforeTheCursor(t *testing.T) {
+	c := testKafkaCheckpointer(nil)
+	partition := &testCursorPartition{}
+	partition.add(5, leaseKey(c.signature), leaseRecord{InstanceID: "instance-1"})
+	partition.add(cursorScanMaxOffsets+5, leaseKey(c.signature), leaseRecord{InstanceID: "instance-2"})
+	partition.add(2*cursorScanMaxOffsets+5, c.key, cs{Cursor: "cursor-1"})
+	partition.add(3*cursorScanMaxOffsets+5, []byte("dk-cursor-other"), cs{Cursor: "other"})
+
+	cursor, err := c.loadKeyed(context.Background(), partition, 0, 3*cursorScanMaxOffsets+6)
+	require.NoError(t, err)
+	require.NotNil(t, cursor)
+	assert.Equal(t, "cursor-1", cursor.Cursor)
+	require.NotNil(t, c.lease)
+	assert.Equal(t, "instance-2", c.lease.InstanceID) // the oldest window was not read
+}
+
+func TestKafkaCheckpointerLoadKeyedWithoutCursor(t *testing.T) {
+	c := testKafkaCheckpointer(nil)
+	partition := &testCursorPartition{}
+	partition.add(5, []byte("dk-cursor-other"), cs{Cursor: "other"})
+	partition.add(2*cursorScanMaxOffsets, []byte("dk-cursor-other"), cs{Cursor: "other"})
+
+	cursor, err := c.loadKeyed(context.Background(), partition, 0, 2*cursorScanMaxOffsets+1)
+	require.NoError(t, err)
+	assert.Nil(t, cursor)
+	assert.Nil(t, c.lease)
+}
+
+func TestCompactedTopicConfig(t *testing.T) {
+	_, compacted, err := compactedTopicConfig(map[string]kafka.ConfigEntryResult{
+		"cleanup.policy": {Name: "cleanup.policy", Value: "compact,delete", Source: kafka.ConfigSourceDynamicTopic},
+	})
+	require.NoError(t, err)
+	assert.True(t, compacted)
+
+	config, compacted, err := compactedTopicConfig(map[string]kafka.ConfigEntryResult{
+		"cleanup.policy": {Name: "cleanup.policy", Value: "delete", Source: kafka.ConfigSourceDefault},
+		"retention.ms":   {Name: "retention.ms", Value: "3600000", Source: kafka.ConfigSourceDynamicTopic},
+		"segment.bytes":  {Name: "segment.bytes", Value: "1073741824", Source: kafka.ConfigSourceStaticBroker},
+	})
+	require.NoError(t, err)
+	assert.False(t, compacted)
+	assert.Equal(t, map[string]string{"cleanup.policy": "compact", "retention.ms": "3600000"}, config)
+
+	_, _, err = compactedTopicConfig(map[string]kafka.ConfigEntryResult{
+		"cleanup.policy": {Name: "cleanup.policy", Value: "delete", Source: kafka.ConfigSourceDynamicTopic},
+		"secret":         {Name: "secret", IsSensitive: true, Source: kafka.ConfigSourceDynamicTopic},
+	})
+	assert.Error(t, err)
+}
+
+func TestKafkaCheckpointerLoadSkipsTheCursorsOfOtherSignatures(t *testing.T) {
+	c := testKafkaCheckpointer(nil)
+	c.setPartition(0)
+	partition := &testCursorPartition{}
+	partition.add(0, []byte("dk-cursor-other:eosio"), cs{Cursor: "other", Signature: "other:eosio"})
+	partition.add(1, leaseKey("other:eosio"), leaseRecord{InstanceID: "instance-1"})
+
+	cursor, err := c.loadKeyed(context.Background(), partition, 0, 2)
+	require.NoError(t, err)
+	assert.Nil(t, cursor)
+	cursor, err = c.loadLatest(context.Background(), partition, 0, 2)
+	require.NoError(t, err)
+	assert.Nil(t, cursor)
+}
+
+func TestKafkaCheckpointerLoadLatestRejectsUnknownLegacyKeys(t *testing.T) {
+	c := testKafkaCheckpointer(nil)
+	c.setPartition(0)
+	partition := &testCursorPartition{}
+	partition.add(0, c.legacyKey, cs{Cursor: "legacy"})
+	partition.add(1, []byte("dk-cursor-other:eosio"), cs{Cursor: "other", Signature: "other:eosio"})
+
+	cursor, err := c.loadLatest(context.Background(), partition, 0, 2)
+	require.NoError(t, err)
+	require.NotNil(t, cursor)
+	assert.Equal(t, "legacy", cursor.Cursor)
+
+	partition.add(2, []byte("dk-othertopic-dkafkacursor-0"), cs{Cursor: "unknown"})
+	_, err = c.loadLatest(context.Background(), partition, 0, 3)
+	assert.Error(t, err)
+}
+
+func TestLocalFileCheckpointerKeepsTheOrdinal(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state")
+	saved := &ordinal{}
+	saved.set(41)
+	saved.next()
+	require.NoError(t, newLocalFileCheckpointer(filename, saved).Save(context.Background(), "cursor-1"))
+
+	restarted := &ordinal{}
+	cursor, err := newLocalFileCheckpointer(filename, restarted).Load(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "cursor-1", cursor)
+	assert.Equal(t, uint64(42), restarted.current())
+	assert.Equal(t, uint64(43), restarted.next())
+}
+
+// cancellingCursorPartition cancels the load after some polls, a partition with no event to
+// deliver blocking each poll for its timeout as a silent broker would
+type cancellingCursorPartition struct {
+	testCursorPartition
+	cancelAfter int
+	cancel      context.CancelFunc
+	silent      bool
+	polls       int
+}
+
+func (p *cancellingCursorPartition) Poll(timeoutMs int) kafka.Event {
+	if p.polls++; p.polls == p.cancelAfter {
+		p.cancel()
+	}
+	if p.silent {
+		time.Sleep(time.Duration(timeoutMs) * time.Millisecond)
+		return nil
+	}
+	return p.testCursorPartition.Poll(timeoutMs)
+}
+
+func TestKafkaCheckpointerLoadIsCancelledMidScan(t *testing.T) {
+	high := int64(10 * cursorScanMaxOffsets)
+	for _, test := range []struct {
+		name   string
+		silent bool
+		load   func(c *kafkaCheckpointer, ctx context.Context, consumer cursorConsumer) (*cs, error)
+	}{
+		{name: "keyed", load: func(c *kafkaCheckpointer, ctx context.Context, consumer cursorConsumer) (*cs, error) {
+			return c.loadKeyed(ctx, consumer, 0, high)
+		}},
+		{name: "keyed from a silent broker", silent: true, load: func(c *kafkaCheckpointer, ctx context.Context, consumer cursorConsumer) (*cs, error) {
+			return c.loadKeyed(ctx, consumer, 0, high)
+		}},
+		{name: "latest from a silent broker", silent: true, load: func(c *kafkaCheckpointer, ctx context.Context, consumer cursorConsumer) (*cs, error) {
+			return c.loadLatest(ctx, consumer, 0, high)
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := testKafkaCheckpointer(nil)
+			c.setPartition(0)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			partition := &cancellingCursorPartition{cancelAfter: 3, cancel: cancel, silent: test.silent}
+			for i := int64(0); i < high; i++ {
+				partition.add(i, []byte("dk-cursor-other"), cs{Cursor: "other"})
+			}
+
+			started := time.Now()
+			cursor, err := test.load(c, ctx, partition)
+			assert.True(t, errors.Is(err, context.Canceled), "got %v", err)
+			assert.Nil(t, cursor)
+			assert.Equal(t, 3, partition.polls) // no poll once cancelled
+			assert.True(t, time.Since(started) < time.Second, "returned after %s", time.Since(started))
+		})
+	}
+}
+
+// cursorRoundTrip saves a cursor, with the ordinal 41, and loads it back through a checkpointer
+type cursorRoundTrip struct {
+	saved             string // the saved cursor as is, instead of the one of Save
+	savedChainID      string
+	chainID           string
+	compatibilityMode bool
+}
+
+func (rt cursorRoundTrip) kafka(t *testing.T) (string, uint64, error) {
+	producer := &testCursorProducer{ack: func(msg *kafka.Message) kafka.Event { return msg }}
+	c := testKafkaCheckpointer(producer)
+	c.ordinal.set(41)
+	c.chainID = rt.savedChainID
+	partition := &testCursorPartition{}
+	if rt.saved == "" {
+		require.NoError(t, c.Save(context.Background(), "cursor-1"))
+		partition.messages = producer.produced
+	} else {
+		partition.add(0, c.key, json.RawMessage(rt.saved))
+	}
+
+	restarted := testKafkaCheckpointer(nil)
+	restarted.chainID = rt.chainID
+	restarted.compatibilityMode = rt.compatibilityMode
+	loaded, err := restarted.loadKeyed(context.Background(), partition, 0, 1)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	cursor, err := restarted.resume(loaded)
+	return cursor, restarted.ordinal.current(), err
+}
+
+func (rt cursorRoundTrip) file(t *testing.T) (string, uint64, error) {
+	filename := filepath.Join(t.TempDir(), "state")
+	c := newLocalFileCheckpointer(filename, &ordinal{})
+	c.ordinal.set(41)
+	c.chainID = rt.savedChainID
+	if rt.saved == "" {
+		require.NoError(t, c.Save(context.Background(), "cursor-1"))
+	} else {
+		require.NoError(t, ioutil.WriteFile(filename, []byte(rt.saved), 0644))
+	}
+
+	restarted := newLocalFileCheckpointer(filename, &ordinal{})
+	restarted.chainID = rt.chainID
+	restarted.compatibilityMode = rt.compatibilityMode
+	cursor, err := restarted.Load(context.Background())
+	return cursor, restarted.ordinal.current(), err
+}
+
+func testCursorRoundTrip(t *testing.T, rt cursorRoundTrip, err string) {
+	for name, load := range map[string]func(t *testing.T) (string, uint64, error){"kafka": rt.kafka, "file": rt.file} {
+		t.Run(name, func(t *testing.T) {
+			cursor, ordinal, loadErr := load(t)
+			if err != "" {
+				require.Error(t, loadErr)
+				assert.Contains(t, loadErr.Error(), err)
+				return
+			}
+			require.NoError(t, loadErr)
+			assert.Equal(t, "cursor-1", cursor)
+			assert.Equal(t, uint64(41), ordinal)
+		})
+	}
+}
+
+func TestCursorVersionRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		rt   cursorRoundTrip
+		err  string
+	}{
+		{name: "v0 without version", rt: cursorRoundTrip{saved: `{"cursor":"cursor-1","ordinal":41}`}},
+		{name: "current version", rt: cursorRoundTrip{}},
+		{
+			name: "newer version refused",
+			rt:   cursorRoundTrip{saved: `{"v":2,"cursor":"cursor-1","ordinal":41,"resume_at":"later"}`},
+			err:  "cursor format v2, this binary supports up to v1",
+		},
+		{
+			name: "newer version in compatibility mode",
+			rt:   cursorRoundTrip{saved: `{"v":2,"cursor":"cursor-1","ordinal":41,"resume_at":"later"}`, compatibilityMode: true},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			testCursorRoundTrip(t, test.rt, test.err)
+		})
+	}
+}
+
+func TestCursorChainIDRoundTrip(t *testing.T) {
+	const eos = "aca376f206b8fc25a6ed44dbdc66547c36c6c33e3a119ffbeaef943642f0e906"
+	const wax = "1064487b3cd1a897ce03ae5b6a865651747e2e152090f99c1d19d44e01aea5a4"
+	for _, test := range []struct {
+		name string
+		rt   cursorRoundTrip
+		err  string
+	}{
+		{name: "same chain", rt: cursorRoundTrip{savedChainID: eos, chainID: eos}},
+		{name: "same chain in upper case", rt: cursorRoundTrip{savedChainID: strings.ToUpper(eos), chainID: eos}},
+		{
+			name: "another chain",
+			rt:   cursorRoundTrip{savedChainID: wax, chainID: eos},
+			err:  "cursor was saved against chain " + wax + ", not the expected chain " + eos,
+		},
+		{name: "cursor without chain id", rt: cursorRoundTrip{chainID: eos}},
+		{name: "older cursor without chain id", rt: cursorRoundTrip{saved: `{"v":1,"cursor":"cursor-1","ordinal":41}`, chainID: eos}},
+		{name: "no expected chain id", rt: cursorRoundTrip{savedChainID: wax}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			testCursorRoundTrip(t, test.rt, test.err)
+		})
+	}
+}
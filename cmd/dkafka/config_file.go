@@ -0,0 +1,194 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/dfuse-io/dkafka"
+	"github.com/spf13/viper"
+)
+
+// configFlags maps the Config fields to the flag overriding their config file value when it is
+// explicitly set (on the command line or through the environment)
+var configFlags = map[string]string{
+	"DfuseGRPCEndpoint":          "global-dfuse-firehose-grpc-addr",
+	"DfuseToken":                 "global-dfuse-auth-token",
+	"DfusePlaintext":             "global-dfuse-plaintext",
+	"FirehoseVersion":            "global-dfuse-firehose-version",
+	"BlockDetailLevel":           "publish-cmd-block-detail-level",
+	"ExpectedChainID":            "publish-cmd-expected-chain-id",
+	"CursorCompatibilityMode":    "publish-cmd-cursor-compatibility-mode",
+	"ChainAPIEndpoint":           "publish-cmd-chain-api-endpoint",
+	"IncludeFilterExpr":          "global-dfuse-firehose-include-expr",
+	"AllowUnfilteredStream":      "global-allow-unfiltered-stream",
+	"DfuseTLSCAFile":             "global-dfuse-tls-ca-file",
+	"DfuseTLSClientCertFile":     "global-dfuse-tls-client-cert-file",
+	"DfuseTLSClientKeyFile":      "global-dfuse-tls-client-key-file",
+	"DfuseTLSInsecureSkipVerify": "global-dfuse-tls-insecure-skip-verify",
+	"GRPCProxyURL":               "global-dfuse-grpc-proxy-url",
+	"DryRun":                     "global-dry-run",
+	"DryRunWithKafkaCursor":      "publish-cmd-dry-run-with-kafka-cursor",
+	"KafkaEndpoints":             "global-kafka-endpoints",
+	"KafkaSSLEnable":             "global-kafka-ssl-enable",
+	"KafkaSSLCAFile":             "global-kafka-ssl-ca-file",
+	"KafkaSSLAuth":               "global-kafka-ssl-auth",
+	"KafkaSSLClientCertFile":     "global-kafka-ssl-client-cert-file",
+	"KafkaSSLClientKeyFile":      "global-kafka-ssl-client-key-file",
+	"KafkaCloud":                 "global-kafka-cloud",
+	"KafkaAPIKey":                "global-kafka-api-key",
+	"KafkaAPISecret":             "global-kafka-api-secret",
+	"Namespace":                  "global-namespace",
+	"KafkaTopic":                 "global-kafka-topic",
+	"KafkaCursorTopic":           "global-kafka-cursor-topic",
+	"KafkaCursorPartition":       "global-kafka-cursor-partition",
+	"KafkaCursorPartitionAuto":   "global-kafka-cursor-partition",
+	"KafkaCursorConsumerGroupID": "global-kafka-cursor-consumer-group-id",
+	"NoAdminOperations":          "global-no-admin-operations",
+	"KafkaTransactionID":         "global-kafka-transaction-id",
+	"KafkaStatsIntervalMs":       "publish-cmd-kafka-stats-interval-ms",
+	"StartupCanary":              "publish-cmd-startup-canary",
+	"StartupCanaryConsume":       "publish-cmd-startup-canary-consume",
+	"CursorSaveAsync":            "publish-cmd-cursor-save-async",
+	"CursorSaveTimeout":          "publish-cmd-cursor-save-timeout",
+	"LeaseTTL":                   "publish-cmd-lease-ttl",
+	"TakeoverGracePeriod":        "publish-cmd-takeover-grace-period",
+	"InstanceID":                 "publish-cmd-instance-id",
+	"StartupTimeout":             "publish-cmd-startup-timeout",
+	"MaxProducerRecoveries":      "publish-cmd-max-producer-recoveries",
+	"Retry.InitialInterval":      "publish-cmd-retry-initial-interval",
+	"Retry.MaxInterval":          "publish-cmd-retry-max-interval",
+	"Retry.MaxElapsedTime":       "publish-cmd-retry-max-elapsed-time",
+	"AdaptWorkers":               "publish-cmd-adapt-workers",
+	"StageBuffer":                "publish-cmd-stage-buffer",
+	"MessageStreamBuffer":        "publish-cmd-message-stream-buffer",
+	"BlockProcessTimeout":        "publish-cmd-block-process-timeout",
+	"MaxStreamIdle":              "publish-cmd-max-stream-idle",
+	"CommitMinDelay":             "publish-cmd-delay-between-commits",
+	"CommitMinDelayLive":         "publish-cmd-delay-between-commits-live",
+	"CommitMinDelayCatchup":      "publish-cmd-delay-between-commits-catchup",
+	"NearHeadThreshold":          "publish-cmd-near-head-threshold",
+	"DedupeWindow":               "publish-cmd-dedupe-window",
+	"DedupeWindowBlocks":         "publish-cmd-dedupe-window-blocks",
+	"DedupeEventTypes":           "publish-cmd-dedupe-event-types",
+	"DedupFromTargetTopic":       "publish-cmd-dedup-from-target-topic",
+	"DedupFalsePositiveRate":     "publish-cmd-dedup-false-positive-rate",
+	"DedupExactMaxIDs":           "publish-cmd-dedup-exact-max-ids",
+	"EventSource":                "publish-cmd-event-source",
+	"EventKeysExpr":              "publish-cmd-event-keys-expr",
+	"EventTypeExpr":              "publish-cmd-event-type-expr",
+	"EventExtensions":            "publish-cmd-event-extensions-expr",
+	"EventSubjectExpr":           "publish-cmd-event-subject-expr",
+	"PartitionByExpr":            "publish-cmd-partition-by-expr",
+	"EmbedKeyInValue":            "publish-cmd-embed-key-in-value",
+	"IncludeRamOps":              "publish-cmd-include-ram-ops",
+	"IncludeConsole":             "publish-cmd-include-console",
+	"ConsoleMaxBytes":            "publish-cmd-console-max-bytes",
+	"MaxHeaderBytes":             "publish-cmd-max-header-bytes",
+	"HeaderAllowlist":            "publish-cmd-header-allowlist",
+	"StaticHeaders":              "publish-cmd-static-headers",
+	"HeartbeatInterval":          "publish-cmd-heartbeat-interval",
+	"HeartbeatTopic":             "publish-cmd-heartbeat-topic",
+	"LIBAnnounceMode":            "publish-cmd-lib-announce-mode",
+	"LIBAnnounceMinStep":         "publish-cmd-lib-announce-min-step",
+	"ExpressionsFile":            "publish-cmd-expressions-file",
+	"EventGranularity":           "publish-cmd-event-granularity",
+	"ValueCompression":           "publish-cmd-value-compression",
+	"PayloadVersion":             "publish-cmd-payload-version",
+	"KafkaTopicV2":               "publish-cmd-kafka-topic-v2",
+	"CaptureDir":                 "publish-cmd-capture-dir",
+	"CaptureRetentionBlocks":     "publish-cmd-capture-retention-blocks",
+	"CaptureRetentionBytes":      "publish-cmd-capture-retention-bytes",
+	"CaptureOnlyOnError":         "publish-cmd-capture-only-on-error",
+	"OtelExporterEndpoint":       "publish-cmd-otel-exporter-endpoint",
+	"OtelSampleRate":             "publish-cmd-otel-sample-rate",
+	"PrimaryKeyRenderings":       "publish-cmd-primary-key-renderings",
+	"ProjectedFields":            "publish-cmd-projected-fields",
+	"MemoFields":                 "publish-cmd-memo-fields",
+	"SamplingRules":              "publish-cmd-sampling-rules",
+	"RedactFields":               "publish-cmd-redact-fields",
+	"RedactTables":               "publish-cmd-redact-tables",
+	"RedactHMACKey":              "publish-cmd-redact-hmac-key",
+	"RedactEncryptionKey":        "publish-cmd-redact-encryption-key",
+	"OnError":                    "publish-cmd-on-error",
+	"ValueJSONSchemaFile":        "publish-cmd-value-json-schema-file",
+	"ValueJSONSchemas":           "publish-cmd-value-json-schemas",
+	"ValueSchemaSkipTopics":      "publish-cmd-value-schema-skip-topics",
+	"Pipelines":                  "publish-cmd-pipelines-file",
+	"TopicRouting":               "publish-cmd-topic-routing",
+	"EventKeySets":               "publish-cmd-event-key-sets",
+	"MaxActionDataBytes":         "publish-cmd-max-action-data-bytes",
+	"SplitDBOps":                 "publish-cmd-split-db-ops",
+	"DBOpsTopic":                 "publish-cmd-db-ops-topic",
+	"DBOpKeyExpr":                "publish-cmd-db-op-key-expr",
+	"OversizeSkippedEvents":      "publish-cmd-oversize-skipped-events",
+	"EventKeySetTopics":          "publish-cmd-event-key-set-topics",
+	"BatchMode":                  "publish-cmd-batch-mode",
+	"StopAtHead":                 "publish-cmd-stop-at-head",
+	"ExprREPL":                   "publish-cmd-expr-repl",
+	"ExprREPLBlockFile":          "publish-cmd-expr-repl-block-file",
+	"ExprREPLBlockNum":           "publish-cmd-expr-repl-block-num",
+	"ExprREPLEnv":                "publish-cmd-expr-repl-env",
+	"StartBlockNum":              "publish-cmd-start-block-num",
+	"StopBlockNum":               "publish-cmd-stop-block-num",
+	"StartTime":                  "publish-cmd-start-time",
+	"StopTime":                   "publish-cmd-stop-time",
+	"BlockmetaEndpoint":          "publish-cmd-blockmeta-grpc-addr",
+	"StateFile":                  "publish-cmd-state-file",
+	"RewindBlocks":               "publish-cmd-rewind-blocks",
+	"RewindToBlock":              "publish-cmd-rewind-to-block",
+	"FailOnBlockGap":             "publish-cmd-fail-on-block-gap",
+	"StrictStartBlock":           "publish-cmd-strict-start-block",
+	"BatchReportFile":            "publish-cmd-batch-report-file",
+	"VerifyAfterBatch":           "publish-cmd-verify-after-batch",
+	"EmitCompletionEvent":        "publish-cmd-emit-completion-event",
+	"JobID":                      "publish-cmd-job-id",
+	"SinkType":                   "publish-cmd-sink-type",
+	"HTTPSinkURL":                "publish-cmd-http-sink-url",
+	"HTTPSinkTimeout":            "publish-cmd-http-sink-timeout",
+	"HTTPSinkMaxRetries":         "publish-cmd-http-sink-max-retries",
+	"HTTPSinkConcurrency":        "publish-cmd-http-sink-concurrency",
+	"FileSinkDir":                "publish-cmd-file-sink-dir",
+	"FileSinkFormat":             "publish-cmd-file-sink-format",
+	"FileSinkHeaders":            "publish-cmd-file-sink-headers",
+	"FileSinkMaxBytes":           "publish-cmd-file-sink-max-bytes",
+	"FileSinkBlocksPerFile":      "publish-cmd-file-sink-blocks-per-file",
+	"Account":                    "publish-cmd-account",
+	"SystemActionsMode":          "publish-cmd-system-actions-mode",
+	"SystemActions":              "publish-cmd-system-actions",
+
+	"MaxProduceBytesPerSecond":         "publish-cmd-max-produce-bytes-per-second",
+	"MaxProduceBytesPerSecondPerTopic": "publish-cmd-max-produce-bytes-per-second-per-topic",
+
+	"FilterEfficiencyLogInterval": "publish-cmd-filter-efficiency-log-interval",
+
+	"MaxUncommittedMessages": "publish-cmd-max-uncommitted-messages",
+	"MaxUncommittedBytes":    "publish-cmd-max-uncommitted-bytes",
+}
+
+// loadConfigFile applies the config file over the flag defaults, then the explicitly set flags
+// over the config file
+func loadConfigFile(filename string, flagsConf *dkafka.Config) (*dkafka.Config, error) {
+	conf, err := dkafka.LoadConfigFile(filename, flagsConf)
+	if err != nil {
+		return nil, err
+	}
+	dst := reflect.ValueOf(conf).Elem()
+	src := reflect.ValueOf(flagsConf).Elem()
+	for field, flag := range configFlags {
+		if viper.IsSet(flag) {
+			configField(dst, field).Set(configField(src, field))
+		}
+	}
+	if err := conf.LoadExpressionFiles(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// configField returns the field at the dotted path, ex: "Retry.MaxInterval"
+func configField(v reflect.Value, path string) reflect.Value {
+	for _, name := range strings.Split(path, ".") {
+		v = v.FieldByName(name)
+	}
+	return v
+}
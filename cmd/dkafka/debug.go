@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/dfuse-io/dkafka"
 	"github.com/spf13/cobra"
@@ -42,6 +43,13 @@ var CursorWriteCmd = &cobra.Command{
 	RunE:  cursorWriteE,
 }
 
+var CursorAtBlockCmd = &cobra.Command{
+	Use:   "at-block",
+	Short: "prints the cursor of an irreversible block, resuming from it streams the next block",
+	Long:  "",
+	RunE:  cursorAtBlockE,
+}
+
 var DebugWriteCmd = &cobra.Command{
 	Use:   "write",
 	Short: "",
@@ -73,30 +81,78 @@ func init() {
 	CursorCmd.AddCommand(CursorReadCmd)
 	CursorCmd.AddCommand(CursorDeleteCmd)
 	CursorCmd.AddCommand(CursorWriteCmd)
+	CursorCmd.AddCommand(CursorAtBlockCmd)
+
+	CursorCmd.PersistentFlags().String("account", "", "account of the publish command, used to derive the cursor partition when {kafka-cursor-partition} is 'auto'")
+	CursorCmd.PersistentFlags().String("state-file", "", "if set, the cursor is read from and written to this state file (file and http sinks) instead of the cursor topic")
+	CursorCmd.PersistentFlags().String("expected-chain-id", "", "chain id of the publish command, a saved cursor of another chain is refused")
+	CursorCmd.PersistentFlags().Bool("cursor-compatibility-mode", false, "read a cursor saved by a newer dkafka version, ignoring the fields this version does not know")
+
+	CursorWriteCmd.Flags().Bool("force", false, "overwrite a saved cursor belonging to another chain or instance")
+	CursorAtBlockCmd.Flags().Bool("write", false, "write the cursor in the checkpointer")
+	CursorAtBlockCmd.Flags().Bool("force", false, "with {write}, overwrite a saved cursor belonging to another chain or instance")
 
 }
 
-func getDkafkaConf() *dkafka.Config {
-	return &dkafka.Config{
+func getDkafkaConf() (*dkafka.Config, error) {
+	cursorPartition, cursorPartitionAuto, err := getCursorPartition()
+	if err != nil {
+		return nil, err
+	}
+	stateFile := viper.GetString("cursor-global-state-file")
+	sinkType := "kafka"
+	if stateFile != "" {
+		sinkType = "file"
+	}
+	conf := &dkafka.Config{
 		KafkaEndpoints:         viper.GetString("global-kafka-endpoints"),
 		KafkaSSLEnable:         viper.GetBool("global-kafka-ssl-enable"),
 		KafkaSSLCAFile:         viper.GetString("global-kafka-ssl-ca-file"),
 		KafkaSSLAuth:           viper.GetBool("global-kafka-ssl-auth"),
 		KafkaSSLClientCertFile: viper.GetString("global-kafka-ssl-client-cert-file"),
 		KafkaSSLClientKeyFile:  viper.GetString("global-kafka-ssl-client-key-file"),
+		KafkaCloud:             viper.GetString("global-kafka-cloud"),
+		KafkaAPIKey:            viper.GetString("global-kafka-api-key"),
+		KafkaAPISecret:         viper.GetString("global-kafka-api-secret"),
+		Namespace:              viper.GetString("global-namespace"),
 		KafkaTopic:             viper.GetString("global-kafka-topic"),
 		KafkaTransactionID:     viper.GetString("global-kafka-transaction-id"),
 
 		KafkaCursorTopic:           viper.GetString("global-kafka-cursor-topic"),
-		KafkaCursorPartition:       int32(viper.GetUint32("global-kafka-cursor-partition")),
+		KafkaCursorPartition:       cursorPartition,
+		KafkaCursorPartitionAuto:   cursorPartitionAuto,
 		KafkaCursorConsumerGroupID: viper.GetString("global-kafka-cursor-consumer-group-id"),
+		NoAdminOperations:          viper.GetBool("global-no-admin-operations"),
+		Account:                    viper.GetString("cursor-global-account"),
+		ExpectedChainID:            viper.GetString("cursor-global-expected-chain-id"),
+		CursorCompatibilityMode:    viper.GetBool("cursor-global-cursor-compatibility-mode"),
+		StateFile:                  stateFile,
+		SinkType:                   sinkType,
+
+		DfuseGRPCEndpoint:          viper.GetString("global-dfuse-firehose-grpc-addr"),
+		DfuseToken:                 viper.GetString("global-dfuse-auth-token"),
+		DfusePlaintext:             viper.GetBool("global-dfuse-plaintext"),
+		FirehoseVersion:            viper.GetString("global-dfuse-firehose-version"),
+		IncludeFilterExpr:          viper.GetString("global-dfuse-firehose-include-expr"),
+		DfuseTLSCAFile:             viper.GetString("global-dfuse-tls-ca-file"),
+		DfuseTLSClientCertFile:     viper.GetString("global-dfuse-tls-client-cert-file"),
+		DfuseTLSClientKeyFile:      viper.GetString("global-dfuse-tls-client-key-file"),
+		DfuseTLSInsecureSkipVerify: getDfuseTLSInsecureSkipVerify(),
+		GRPCProxyURL:               viper.GetString("global-dfuse-grpc-proxy-url"),
 	}
+	if err := conf.LoadExpressionFiles(); err != nil {
+		return nil, err
+	}
+	return conf, nil
 }
 
 func debugWriteE(cmd *cobra.Command, args []string) error {
 	SetupLogger()
 
-	conf := getDkafkaConf()
+	conf, err := getDkafkaConf()
+	if err != nil {
+		return err
+	}
 	key := viper.GetString("debug-write-cmd-key")
 	value := viper.GetString("debug-write-cmd-value")
 
@@ -109,7 +165,10 @@ func debugWriteE(cmd *cobra.Command, args []string) error {
 func debugReadE(cmd *cobra.Command, args []string) error {
 	SetupLogger()
 
-	conf := getDkafkaConf()
+	conf, err := getDkafkaConf()
+	if err != nil {
+		return err
+	}
 	values := viper.GetInt("debug-read-cmd-values")
 	offset := viper.GetInt("debug-read-cmd-offset")
 	groupID := viper.GetString("debug-read-cmd-group-id")
@@ -123,7 +182,10 @@ func debugReadE(cmd *cobra.Command, args []string) error {
 func cursorReadE(cmd *cobra.Command, args []string) error {
 	SetupLogger()
 
-	conf := getDkafkaConf()
+	conf, err := getDkafkaConf()
+	if err != nil {
+		return err
+	}
 
 	zlog.Info("reading cursor from kafka", zap.Reflect("config", conf))
 	cmd.SilenceUsage = true
@@ -134,7 +196,10 @@ func cursorReadE(cmd *cobra.Command, args []string) error {
 func cursorWriteE(cmd *cobra.Command, args []string) error {
 	SetupLogger()
 
-	conf := getDkafkaConf()
+	conf, err := getDkafkaConf()
+	if err != nil {
+		return err
+	}
 	if len(args) != 1 {
 		return fmt.Errorf("cursor write command requires exactly one argument: cursorvalue")
 	}
@@ -142,12 +207,43 @@ func cursorWriteE(cmd *cobra.Command, args []string) error {
 	zlog.Info("writing cursor value from kafka", zap.Reflect("config", conf), zap.String("cursor", args[0]))
 	cmd.SilenceUsage = true
 	debugger := dkafka.NewDebugger(conf)
-	return debugger.WriteCursor(args[0])
+	return debugger.ImportCursor(args[0], viper.GetBool("cursor-write-cmd-force"))
+}
+
+func cursorAtBlockE(cmd *cobra.Command, args []string) error {
+	SetupLogger()
+
+	conf, err := getDkafkaConf()
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("cursor at-block command requires exactly one argument: block number")
+	}
+	blockNum, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid block number %q: %w", args[0], err)
+	}
+
+	cmd.SilenceUsage = true
+	debugger := dkafka.NewDebugger(conf)
+	cursor, err := debugger.CursorAtBlock(blockNum)
+	if err != nil {
+		return err
+	}
+	fmt.Println(cursor)
+	if !viper.GetBool("cursor-at-block-cmd-write") {
+		return nil
+	}
+	return debugger.ImportCursor(cursor, viper.GetBool("cursor-at-block-cmd-force"))
 }
 func cursorDeleteE(cmd *cobra.Command, args []string) error {
 	SetupLogger()
 
-	conf := getDkafkaConf()
+	conf, err := getDkafkaConf()
+	if err != nil {
+		return err
+	}
 
 	zlog.Info("reading debug values from kafka", zap.Reflect("config", conf))
 	cmd.SilenceUsage = true
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dfuse-io/dkafka"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+var DiffCmd = &cobra.Command{
+	Use:   "diff <config-file-a> <config-file-b>",
+	Short: "adapts the same irreversible blocks with two config files and reports the messages differing, fails if any",
+	Long:  "",
+	Args:  cobra.ExactArgs(2),
+	RunE:  diffRunE,
+}
+
+func init() {
+	RootCmd.AddCommand(DiffCmd)
+
+	DiffCmd.Flags().Int64("start-block-num", 0, "first block adapted")
+	DiffCmd.Flags().Uint64("stop-block-num", 0, "last block adapted")
+	DiffCmd.Flags().String("capture-dir", "", "if set, the blocks captured in this directory (see {capture-dir} of the publish command) are adapted instead of the firehose blocks")
+	DiffCmd.Flags().String("report-format", "text", "format of the report printed, one of: text, json")
+}
+
+func diffRunE(cmd *cobra.Command, args []string) error {
+	SetupLogger()
+
+	// the publish flag defaults are the base of both config files
+	base, err := publishConfig()
+	if err != nil {
+		return err
+	}
+	confA, err := loadConfigFile(args[0], base)
+	if err != nil {
+		return err
+	}
+	confB, err := loadConfigFile(args[1], base)
+	if err != nil {
+		return err
+	}
+	opts := dkafka.DiffOptions{
+		StartBlockNum: viper.GetInt64("diff-cmd-start-block-num"),
+		StopBlockNum:  viper.GetUint64("diff-cmd-stop-block-num"),
+		CaptureDir:    viper.GetString("diff-cmd-capture-dir"),
+	}
+	if opts.StopBlockNum == 0 && opts.CaptureDir == "" {
+		return fmt.Errorf("diff command requires {stop-block-num} when reading the firehose")
+	}
+	format := viper.GetString("diff-cmd-report-format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid report format %q, must be one of: text, json", format)
+	}
+
+	cmd.SilenceUsage = true
+	zlog.Info("diffing config files", zap.String("config_a", args[0]), zap.String("config_b", args[1]), zap.Reflect("options", opts))
+	report, err := dkafka.Diff(context.Background(), confA, confB, opts)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		report.WriteText(os.Stdout)
+	}
+	if n := report.Differences(); n != 0 {
+		return fmt.Errorf("%d messages differ between %s and %s", n, args[0], args[1])
+	}
+	return nil
+}
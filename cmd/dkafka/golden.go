@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/dfuse-io/dkafka"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var GoldenCmd = &cobra.Command{
+	Use:   "golden <config-file> <fixtures-dir> <out-dir>",
+	Short: "writes the messages a config file produces for each block of the fixtures dir to golden files, without connecting to kafka or the firehose",
+	Long:  "",
+	Args:  cobra.ExactArgs(3),
+	RunE:  goldenRunE,
+}
+
+func init() {
+	RootCmd.AddCommand(GoldenCmd)
+}
+
+func goldenRunE(cmd *cobra.Command, args []string) error {
+	SetupLogger()
+
+	// the publish flag defaults are the base of the config file
+	base, err := publishConfig()
+	if err != nil {
+		return err
+	}
+	base.DryRun = true
+	conf, err := loadConfigFile(args[0], base)
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+	zlog.Info("generating golden files", zap.String("config", args[0]), zap.String("fixtures_dir", args[1]), zap.String("out_dir", args[2]))
+	return dkafka.GenerateGoldenFrom(conf, args[1], args[2])
+}
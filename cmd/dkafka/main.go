@@ -1,13 +1,19 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 
+	"github.com/dfuse-io/dkafka"
+
 	"go.uber.org/zap"
 )
 
+// fencedExitCode tells the supervisor that another instance took over the transactional ID
+const fencedExitCode = 3
+
 func init() {
 }
 
@@ -17,6 +23,9 @@ func main() {
 	}()
 
 	if err := RootCmd.Execute(); err != nil {
+		if errors.Is(err, dkafka.ErrProducerFenced) {
+			os.Exit(fencedExitCode)
+		}
 		os.Exit(1)
 	}
 }
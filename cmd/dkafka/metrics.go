@@ -0,0 +1,12 @@
+package main
+
+import (
+	"github.com/dfuse-io/dkafka"
+	"github.com/dfuse-io/dmetrics"
+)
+
+func init() {
+	dmetrics.Register(
+		dkafka.MetricsSet,
+	)
+}
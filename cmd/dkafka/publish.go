@@ -2,11 +2,13 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dfuse-io/derr"
 	"github.com/dfuse-io/dkafka"
+	"github.com/dfuse-io/dmetrics"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -22,77 +24,505 @@ var PublishCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(PublishCmd)
 
+	PublishCmd.Flags().String("config-file", "", "if set, YAML or JSON file holding the configuration (snake_case keys, ex: kafka_topic), the flags explicitly set take precedence")
+
 	PublishCmd.Flags().Duration("delay-between-commits", time.Second*10, "no commits to kafka blow this delay, except un shutdown")
+	PublishCmd.Flags().Duration("delay-between-commits-live", 0, "if non-zero, replaces {delay-between-commits} when the block lag is below {near-head-threshold}")
+	PublishCmd.Flags().Duration("delay-between-commits-catchup", 0, "if non-zero, replaces {delay-between-commits} when the block lag is above {near-head-threshold}")
+	PublishCmd.Flags().Duration("near-head-threshold", 30*time.Second, "blocks lagging less than this delay behind the wall clock are considered near the chain head")
+
+	PublishCmd.Flags().Duration("dedupe-window", 0, "if non-zero, only the last db op message generated for a key within this delay is sent (never applied to Undo steps)")
+	PublishCmd.Flags().Bool("dedup-from-target-topic", false, "before streaming, read the target topic and skip the messages whose ce_id is already present (ex: when re-running an overlapping backfill)")
+	PublishCmd.Flags().Float64("dedup-false-positive-rate", 0.0001, "false positive rate of the Bloom filter holding the preloaded ce_id, new messages are dropped at this rate")
+	PublishCmd.Flags().Int("dedup-exact-max-ids", 1000000, "the preloaded ce_id are held in an exact set up to this number of messages in the target topic, in a Bloom filter above")
+	PublishCmd.Flags().Uint64("dedupe-window-blocks", 0, "if non-zero, only the last db op message generated for a key within this number of blocks is sent (never applied to Undo steps)")
+	PublishCmd.Flags().StringSlice("dedupe-event-types", nil, "event types of the action events also suppressed within the dedupe window, the action events are all sent by default (ex: CounterUpdated)")
+	PublishCmd.Flags().String("metrics-listen-addr", ":9102", "if non-empty, the process will expose prometheus metrics on this address")
+	PublishCmd.Flags().String("expected-chain-id", "", "if set, saved with the cursors: a cursor saved against another chain is refused")
+	PublishCmd.Flags().Bool("cursor-compatibility-mode", false, "resume a cursor saved by a newer dkafka version, ignoring the fields this version does not know, for emergency rollbacks only")
+	PublishCmd.Flags().String("chain-api-endpoint", "", "nodeos API (ex: https://eos.example.com) whose chain id is checked against {expected-chain-id} at startup")
+	PublishCmd.Flags().Bool("cursor-save-async", false, "do not wait for kafka to confirm the delivery of each saved cursor before streaming on (the cursor is committed with the messages when {kafka-transaction-id} is set)")
+	PublishCmd.Flags().Duration("cursor-save-timeout", 10*time.Second, "the stream fails if the delivery of a saved cursor is not confirmed within this delay, unless {cursor-save-async}")
+	PublishCmd.Flags().Duration("lease-ttl", 0, "if non-zero, a lease record is written to the cursor partition every third of this ttl: an instance refuses to start while another one holds a live lease for the same cursor signature, and stops when it cannot write its lease for this long")
+	PublishCmd.Flags().Duration("takeover-grace-period", 0, "with {lease-ttl}, wait up to this time at startup for the lease of another instance to expire instead of refusing to start")
+	PublishCmd.Flags().Duration("startup-timeout", 0, "if non-zero, fail a run whose startup steps (kafka producer, cursor load, expressions, chain id, block range) do not complete within this time, instead of waiting on a slow dependency")
+	PublishCmd.Flags().String("instance-id", "", "with {lease-ttl}, identifies this instance in the lease records (defaults to the hostname, pid and start time)")
+	PublishCmd.Flags().Int("adapt-workers", 1, "number of blocks adapted (expressions evaluated and payloads marshalled) concurrently, the messages are still sent in block order")
+	PublishCmd.Flags().String("block-detail-level", "full", "detail of the requested blocks, one of: full, light (trimmed by the firehose: no db ops, ram ops nor console, v1 only)")
+	PublishCmd.Flags().Int("stage-buffer", 16, "number of blocks queued between the receive, adapt and send stages")
+	PublishCmd.Flags().Int("message-stream-buffer", 0, "if non-zero, the messages of a block are sent while it is adapted, at most this many queued per block, instead of holding all the messages of the block in memory (for blocks with a huge number of matching actions)")
+	PublishCmd.Flags().Int64("max-uncommitted-messages", 0, "if non-zero, the cursor is committed (with the transaction) at the end of the block reaching this many messages sent since the last commit, even before {delay-between-commits}, bounding the producer queue during Undo bursts")
+	PublishCmd.Flags().Int64("max-uncommitted-bytes", 0, "if non-zero, same as {max-uncommitted-messages} for the bytes of the messages sent since the last commit")
+	PublishCmd.Flags().Duration("filter-efficiency-log-interval", 5*time.Minute, "if non-zero, the ratio of the actions matching {dfuse-firehose-include-expr} among the actions of the delivered transactions is logged at this interval, with the most skipped actions")
+	PublishCmd.Flags().Duration("max-stream-idle", 2*time.Minute, "if non-zero, the firehose stream is opened again from the last committed cursor when no block was received for this time (a silently dropped connection), 0 disables it for networks with irregular block production")
+	PublishCmd.Flags().Duration("block-process-timeout", 5*time.Minute, "if non-zero, the adapting of a block is canceled after this time, logging the block and the goroutine stacks; the run fails unless the block_timeout failure class is skipped")
+	PublishCmd.Flags().Int("max-producer-recoveries", 3, "number of times the kafka producer is re-created after a fatal error, resuming from the last committed cursor, before giving up")
+	PublishCmd.Flags().Duration("retry-initial-interval", 500*time.Millisecond, "first backoff of the retries (http sink requests, cursor loads, producer recoveries), doubled at each retry with jitter")
+	PublishCmd.Flags().Duration("retry-max-interval", 30*time.Second, "maximum backoff of the retries")
+	PublishCmd.Flags().Duration("retry-max-elapsed-time", 0, "if non-zero, the http sink requests and cursor loads are not retried past this time since their first attempt")
+	PublishCmd.Flags().Bool("dry-run-with-kafka-cursor", false, "in {dry-run}, start from the cursor saved in {kafka-cursor-topic} by the live instance (never saved to it, the dry run cursor goes to {state-file})")
+	PublishCmd.Flags().Bool("startup-canary", false, "before streaming, produce a 'Canary' message to the destination topics and wait for its delivery, failing on a misconfiguration (skipped in {dry-run})")
+	PublishCmd.Flags().Bool("startup-canary-consume", false, "with {startup-canary}, also read the canary back with {kafka-cursor-consumer-group-id}")
+	PublishCmd.Flags().Int("kafka-stats-interval-ms", 0, "if non-zero, the librdkafka statistics are collected at this interval and exposed as metrics (broker rtt, throttle, outbuf and retries)")
 
 	PublishCmd.Flags().String("event-source", "dkafka", "custom value for produced cloudevent source")
 	PublishCmd.Flags().String("event-keys-expr", "[account]", "CEL expression defining the event keys. More then one key will result in multiple events being sent. Must resolve to an array of strings")
 	PublishCmd.Flags().String("event-type-expr", "(notif?'!':'')+account+'/'+action", "CEL expression defining the event type. Must resolve to a string")
 
+	PublishCmd.Flags().String("partition-by-expr", "", "if set, CEL expression defining the partition key of the events, sent as the 'ce_partitionkey' header and hashed to choose the kafka partition, instead of the message key which is unchanged (ex: all the events of an account on the same partition). Must resolve to a string")
+	PublishCmd.Flags().String("event-subject-expr", "", "if set, CEL expression defining the cloudevent subject, sent as the 'ce_subject' header (omitted if empty). Must resolve to a string")
 	PublishCmd.Flags().StringSlice("event-extensions-expr", []string{}, "cloudevent extension definitions in this format: '{key}:{CEL expression}' (ex: 'blk:string(block_num)')")
+	PublishCmd.Flags().Duration("heartbeat-interval", 0, "if non-zero, a 'Heartbeat' event is sent when no message was produced for this long while blocks are flowing")
+	PublishCmd.Flags().String("heartbeat-topic", "", "topic of the heartbeat events, defaults to the destination topic")
+	PublishCmd.Flags().String("lib-announce-mode", "off", "announce the last irreversible block number of the stream: 'off', 'header' (ce_libnum header on every message) or 'message' ('LibAdvanced' events sent to the heartbeat topic)")
+	PublishCmd.Flags().Uint32("lib-announce-min-step", 120, "in 'message' lib announce mode, a 'LibAdvanced' event is sent when the last irreversible block advanced by at least this number of blocks")
+	PublishCmd.Flags().Int("max-header-bytes", 0, "if non-zero, the events whose header keys and values exceed this size fail the stream, or are skipped with --on-error=header_size:skip")
+	PublishCmd.Flags().StringSlice("static-headers", []string{}, "header added to every message produced (events and control messages), in this format: '{name}:{value}', the value can be 'env:{name}' or 'file:{path}', ex: 'environment:prod', 'deployment:env:DEPLOYMENT_ID'")
+	PublishCmd.Flags().StringSlice("header-allowlist", nil, "if set, only these headers are sent (ce_id and ce_type always are), ex: ce_id,ce_type,ce_time,content-type")
+	PublishCmd.Flags().Bool("include-console", false, "add the console output of each action to the payload, under 'console' (can be large, meant for debugging)")
+	PublishCmd.Flags().Bool("split-db-ops", false, "send the action events without their db ops, and each db op as its own 'DBOp' message with a 'ce_parentid' header holding the ce_id of its action event")
+	PublishCmd.Flags().String("db-ops-topic", "", "topic of the db op messages with {split-db-ops}, the topic of their action event if empty")
+	PublishCmd.Flags().String("db-op-key-expr", "", "CEL expression defining the key of the db op messages with {split-db-ops}, resolving the action names and db_op_code, db_op_scope, db_op_table, db_op_primary_key, db_op_operation, db_op_index (ex: 'db_op_scope + \":\" + db_op_primary_key'), '{code}:{scope}:{table}:{primary_key}' if empty. Must resolve to a string")
+	PublishCmd.Flags().Int("max-action-data-bytes", 0, "if non-zero, the actions whose data (raw or decoded) is above this size are skipped before being decoded, ex: spam notifications of megabytes")
+	PublishCmd.Flags().Bool("oversize-skipped-events", false, "send an 'OversizeSkipped' event, keyed by the account, in place of each action skipped by {max-action-data-bytes}")
+	PublishCmd.Flags().Int("console-max-bytes", 4096, "the console output added with {include-console} is truncated above this size, unbounded if zero")
+	PublishCmd.Flags().Bool("include-ram-ops", false, "add the RAM usage changes (payer, delta, usage) of each action to the payload, under 'ram_deltas'")
+	PublishCmd.Flags().Bool("embed-key-in-value", false, "duplicate the message key in the JSON value, under '_key', for consumers ignoring the keys")
+	PublishCmd.Flags().String("event-granularity", "action", "generate one event per matching 'action', or one per 'transaction' holding all its matching actions")
+	PublishCmd.Flags().String("payload-version", "v1", "shape of the JSON payloads, 'v1' or 'v2' ('act_info' becomes 'action' and the db ops are at the top level), announced in the 'ce_dataschema' header")
+	PublishCmd.Flags().String("kafka-topic-v2", "", "if set, transition mode: the events are also sent to this topic with the v2 payload, in the same transaction as the v1 events of {kafka-topic}")
+	PublishCmd.Flags().String("value-compression", "none", "compress the message values themselves, one of: none, gzip, zstd (the content type becomes 'application/json+{compression}')")
+	PublishCmd.Flags().String("capture-dir", "", "if set, write the received blocks to this dir as zstd-compressed protobuf files, for forensics")
+	PublishCmd.Flags().Int("capture-retention-blocks", 0, "if non-zero, the oldest captured block files are pruned above this count")
+	PublishCmd.Flags().Int64("capture-retention-bytes", 0, "if non-zero, the oldest captured block files are pruned above this total size")
+	PublishCmd.Flags().Bool("capture-only-on-error", false, "only capture the blocks whose events failed to be generated")
+	PublishCmd.Flags().String("otel-exporter-endpoint", "", "if set, export the block and message tracing spans to this OTLP collector address (ex: localhost:55680)")
+	PublishCmd.Flags().Float64("otel-sample-rate", 0.01, "ratio of the blocks traced when {otel-exporter-endpoint} is set")
+	PublishCmd.Flags().StringSlice("event-key-sets", []string{}, "copies of the events keyed differently, in this format: '{label}:{CEL expression}' resolving to an array of strings (ex: 'accounts:[account]'), replacing {event-keys-expr}; each copy is sent to {kafka-topic}-{label} with the label appended to its ce_id")
+	PublishCmd.Flags().StringSlice("event-key-set-topics", []string{}, "topic of the copies of an event key set, in this format: '{label}:{topic}', {kafka-topic}-{label} if not set")
+	PublishCmd.Flags().StringSlice("topic-routing", []string{}, "topic of the events whose ce_type matches the pattern, in this format: '{pattern}:{topic}', the pattern being a glob or a regex prefixed by 're:', ex: 'Transfer*:transfers'; the first matching route applies, {kafka-topic} if none matches")
+	PublishCmd.Flags().String("pipelines-file", "", "if set, JSON file holding an array of pipelines (name, include_filter_expr, kafka_topic, event_source, event_type_expr, event_keys_expr, event_extensions, event_subject_expr) sharing the same block stream")
+	PublishCmd.Flags().String("expressions-file", "", "if set, reload the event type, keys and extensions expressions from this JSON file on SIGHUP")
+
+	PublishCmd.Flags().StringSlice("on-error", []string{}, "action on a failure class in this format: '{class}:{fail|skip}', classes: cel_event_type, cel_event_key, cel_extension, cel_event_subject, header_size, value_schema (default: fail)")
+	PublishCmd.Flags().String("value-json-schema-file", "", "if set, JSON schema validating the message values before they are sent, a file or one of: builtin:action, builtin:transaction")
+	PublishCmd.Flags().StringSlice("value-json-schemas", []string{}, "JSON schema of the values of an event type in this format: '{ce_type}:{schema file or builtin:name}', takes precedence over {value-json-schema-file}")
+	PublishCmd.Flags().StringSlice("value-schema-skip-topics", []string{}, "topics whose message values are not validated against the JSON schemas")
+	PublishCmd.Flags().Int64("max-produce-bytes-per-second", 0, "if non-zero, the sends are delayed to keep the bytes (key, value and headers) produced to all the topics under this rate")
+	PublishCmd.Flags().StringSlice("max-produce-bytes-per-second-per-topic", []string{}, "byte rate limit of a topic in this format: '{topic}:{bytes per second}', the topic as produced (with its namespace)")
+	PublishCmd.Flags().StringSlice("redact-fields", []string{}, "sensitive action data field, redacted before any expression or payload sees it, in this format: '{action}:{path}:{drop|mask|hmac|encrypt}', ex: 'transfer:memo:hmac'")
+	PublishCmd.Flags().StringSlice("redact-tables", []string{}, "tables whose db ops binary data is dropped, the db ops are not redacted by the --redact-fields paths")
+	PublishCmd.Flags().String("redact-hmac-key", "", "key of the hmac redaction mode, literal, 'env:{name}' or 'file:{path}'")
+	PublishCmd.Flags().String("redact-encryption-key", "", "base64 AES key (16, 24 or 32 bytes) of the encrypt redaction mode, literal, 'env:{name}' or 'file:{path}'")
+	PublishCmd.Flags().StringSlice("sampling-rules", []string{}, "share of the events of an action kept, in this format: '{action}:{rate}[:{random|deterministic}]', ex: 'transfer:0.1:deterministic' keeps 10% of the transfer event keys (the Undo steps are never sampled, rules matching a CEL expression are set in the config file)")
+	PublishCmd.Flags().StringSlice("projected-fields", []string{}, "action data field copied to the 'fields' object of the payload, in this format: '{action}:{path}:{string|long|double|bool}', ex: 'transfer:quantity:string'")
+	PublishCmd.Flags().StringSlice("memo-fields", []string{}, "key of a 'key:value;key:value' memo of the action data copied to the 'fields' object of the payload, in this format: '{action}:{path}:{key}', ex: 'transfer:memo:order_id'")
+	PublishCmd.Flags().StringSlice("primary-key-renderings", []string{}, "rendering of the db ops primary key added as 'key' in the payload, in this format: '{table}:{auto|decimal|name|symbol}' ('*' as table applies to all tables)")
 
 	PublishCmd.Flags().Bool("batch-mode", false, "Batch mode will ignore cursor and always start from {start-block-num}.")
 	PublishCmd.Flags().Int64("start-block-num", 0, "If we are in {batch-mode} or no prior cursor exists, start streaming from this block number (if negative, relative to HEAD)")
 	PublishCmd.Flags().Uint64("stop-block-num", 0, "If non-zero, stop processing before this block number")
+	PublishCmd.Flags().String("start-time", "", "RFC3339 time replacing {start-block-num}: start from the first block produced at or after it")
+	PublishCmd.Flags().String("stop-time", "", "RFC3339 time replacing {stop-block-num}: stop before the first block produced at or after it")
+	PublishCmd.Flags().String("blockmeta-grpc-addr", "", "dfuse blockmeta endpoint resolving {start-time} and {stop-time} to blocks, the firehose is binary searched if empty")
 	PublishCmd.Flags().String("state-file", "./dkafka.state.json", "progress will be saved into this file")
+	PublishCmd.Flags().Uint64("rewind-blocks", 0, "if non-zero, stream again this number of blocks before the loaded cursor, their messages carry a ce_replay=true header; remove it once the run started, it applies at every start")
+	PublishCmd.Flags().Uint64("rewind-to-block", 0, "if non-zero, stream again from this block up to the loaded cursor, like {rewind-blocks}")
+	PublishCmd.Flags().Bool("fail-on-block-gap", false, "only stream irreversible blocks and fail if a received block does not follow the previous one")
+	PublishCmd.Flags().Bool("strict-start-block", false, "fail when the first streamed block is after {start-block-num}, the firehose history being pruned, instead of logging a warning")
+	PublishCmd.Flags().Bool("verify-after-batch", false, "at the end of a {batch-mode} run, read back the produced messages and compare their count and ce_id digest per 10000-block range, failing on a discrepancy")
+	PublishCmd.Flags().Bool("emit-completion-event", false, "once the stream reaches {stop-block-num}, {stop-time} or the end of a {batch-mode} stream, send a StreamCompleted message keyed by {job-id} to the first topic (or {heartbeat-topic}) in the last transaction")
+	PublishCmd.Flags().String("job-id", "", "identifier of the batch job, key of the StreamCompleted message")
+	PublishCmd.Flags().Bool("stop-at-head", false, "resume from the cursor as in live mode, and exit once the head block of the startup is processed and its cursor committed, ex: incremental exports scheduled by cron; the batch report is written")
+	PublishCmd.Flags().Bool("expr-repl", false, "instead of streaming, read expressions from stdin and print their result for each action of a block matching {dfuse-firehose-include-expr}, kafka is not used")
+	PublishCmd.Flags().String("expr-repl-block-file", "", "with {expr-repl}, the block: a file of {capture-dir} or a JSON block")
+	PublishCmd.Flags().Uint64("expr-repl-block-num", 0, "with {expr-repl}, the block fetched from the firehose if there is no {expr-repl-block-file}")
+	PublishCmd.Flags().String("expr-repl-env", "", "with {expr-repl}, the initial environment, one of: default (include filter), action (event expressions, the default), table (db op key expression, evaluated per db op)")
+	PublishCmd.Flags().String("batch-report-file", "", "if set, in {batch-mode} or with {stop-at-head}, write a JSON report of the covered block range and message counts to this file")
+
+	PublishCmd.Flags().String("sink-type", "kafka", "where events are sent, one of: kafka, file, http")
+	PublishCmd.Flags().String("file-sink-dir", "./dkafka-export", "directory where events are written when {sink-type} is 'file'")
+	PublishCmd.Flags().String("file-sink-format", "json", "format of the files written when {sink-type} is 'file', one of: json (newline-delimited), csv")
+	PublishCmd.Flags().String("http-sink-url", "", "endpoint receiving the events as binary-mode CloudEvents when {sink-type} is 'http', ex: a Knative broker")
+	PublishCmd.Flags().Duration("http-sink-timeout", 10*time.Second, "timeout of each request to the http sink")
+	PublishCmd.Flags().Int("http-sink-max-retries", 5, "retries of a request to the http sink on network errors and 5xx, 408 or 429 responses, with an exponential backoff")
+	PublishCmd.Flags().Int("http-sink-concurrency", 1, "requests in flight to the http sink, the events are not delivered in order above 1")
+	PublishCmd.Flags().StringSlice("file-sink-headers", []string{"ce_id", "ce_type", "ce_time", "ce_blkstep"}, "event headers preserved in the files written when {sink-type} is 'file'")
+	PublishCmd.Flags().Int64("file-sink-max-bytes", 0, "if non-zero, rotate the file sink file once it reaches this size (checked on cursor commit)")
+	PublishCmd.Flags().Uint64("file-sink-blocks-per-file", 0, "if non-zero, rotate the file sink file once it covers this number of blocks (checked on cursor commit)")
+
+	PublishCmd.Flags().String("account", "", "contract account followed by {system-actions-mode}")
+	PublishCmd.Flags().Bool("system-actions-mode", false, "also emit events for eosio system actions (permissions, code and abi deployment) affecting {account}")
+	PublishCmd.Flags().StringSlice("system-actions", dkafka.DefaultSystemActions, "eosio system actions followed in {system-actions-mode}")
 
 }
 
 func publishRunE(cmd *cobra.Command, args []string) error {
 	SetupLogger()
 
+	conf, err := publishConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+	if addr := viper.GetString("publish-cmd-metrics-listen-addr"); addr != "" {
+		go dmetrics.Serve(addr)
+	}
+	signalHandler := derr.SetupSignalHandler(time.Second)
+
+	zlog.Info("starting dkafka publisher", zap.Reflect("config", conf))
+	app := dkafka.New(conf)
+	go func() { app.Shutdown(app.Run()) }()
+
+	select {
+	case <-signalHandler:
+		app.Shutdown(fmt.Errorf("shutdown signal received"))
+	case <-app.Terminating():
+	}
+	zlog.Info("terminating", zap.Error(app.Err()))
+
+	<-app.Terminated()
+	return app.Err()
+}
+
+// publishConfig returns the configuration of the publish flags and config file
+func publishConfig() (*dkafka.Config, error) {
 	extensions := make(map[string]string)
 	for _, ext := range viper.GetStringSlice("publish-cmd-event-extensions-expr") {
 		kv := strings.SplitN(ext, ":", 2)
 		if len(kv) != 2 {
-			return fmt.Errorf("invalid value for extension: %s", ext)
+			return nil, fmt.Errorf("invalid value for extension: %s", ext)
 		}
 		extensions[kv[0]] = kv[1]
 	}
 
+	staticHeaders := make(map[string]string)
+	for _, h := range viper.GetStringSlice("publish-cmd-static-headers") {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid value for static header: %s", h)
+		}
+		staticHeaders[kv[0]] = kv[1]
+	}
+
+	renderings := make(map[string]string)
+	for _, r := range viper.GetStringSlice("publish-cmd-primary-key-renderings") {
+		kv := strings.SplitN(r, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid value for primary key rendering: %s", r)
+		}
+		renderings[kv[0]] = kv[1]
+	}
+
+	redactFields := make(map[string][]string)
+	for _, f := range viper.GetStringSlice("publish-cmd-redact-fields") {
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid value for redacted field: %s", f)
+		}
+		redactFields[kv[0]] = append(redactFields[kv[0]], kv[1])
+	}
+
+	projectedFields := make(map[string][]string)
+	for _, f := range viper.GetStringSlice("publish-cmd-projected-fields") {
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid value for projected field: %s", f)
+		}
+		projectedFields[kv[0]] = append(projectedFields[kv[0]], kv[1])
+	}
+
+	memoFields := make(map[string][]string)
+	for _, f := range viper.GetStringSlice("publish-cmd-memo-fields") {
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid value for memo field: %s", f)
+		}
+		memoFields[kv[0]] = append(memoFields[kv[0]], kv[1])
+	}
+
+	keySets := make(map[string]string)
+	for _, ks := range viper.GetStringSlice("publish-cmd-event-key-sets") {
+		kv := strings.SplitN(ks, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid value for event key set: %s", ks)
+		}
+		keySets[kv[0]] = kv[1]
+	}
+
+	keySetTopics := make(map[string]string)
+	for _, t := range viper.GetStringSlice("publish-cmd-event-key-set-topics") {
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid value for event key set topic: %s", t)
+		}
+		keySetTopics[kv[0]] = kv[1]
+	}
+
+	var topicRouting []dkafka.TopicRoute
+	for _, r := range viper.GetStringSlice("publish-cmd-topic-routing") {
+		i := strings.LastIndex(r, ":") // the topic names cannot hold a colon, the patterns can
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid value for topic route: %s", r)
+		}
+		topicRouting = append(topicRouting, dkafka.TopicRoute{TypePattern: r[:i], Topic: r[i+1:]})
+	}
+
+	var samplingRules []dkafka.SamplingRule
+	for _, r := range viper.GetStringSlice("publish-cmd-sampling-rules") {
+		parts := strings.Split(r, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid value for sampling rule: %s", r)
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate for sampling rule %s: %w", r, err)
+		}
+		rule := dkafka.SamplingRule{Action: parts[0], Rate: rate}
+		if len(parts) == 3 {
+			rule.Mode = parts[2]
+		}
+		samplingRules = append(samplingRules, rule)
+	}
+
+	onError := make(map[string]string)
+	for _, p := range viper.GetStringSlice("publish-cmd-on-error") {
+		kv := strings.SplitN(p, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid value for on error policy: %s", p)
+		}
+		onError[kv[0]] = kv[1]
+	}
+
+	valueSchemas := make(map[string]string)
+	for _, v := range viper.GetStringSlice("publish-cmd-value-json-schemas") {
+		kv := strings.SplitN(v, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid value for value json schema: %s", v)
+		}
+		valueSchemas[kv[0]] = kv[1]
+	}
+
+	topicByteRates := make(map[string]int64)
+	for _, v := range viper.GetStringSlice("publish-cmd-max-produce-bytes-per-second-per-topic") {
+		kv := strings.SplitN(v, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid value for max produce bytes per second per topic: %s", v)
+		}
+		rate, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for max produce bytes per second per topic: %s: %w", v, err)
+		}
+		topicByteRates[kv[0]] = rate
+	}
+
+	cursorPartition, cursorPartitionAuto, err := getCursorPartition()
+	if err != nil {
+		return nil, err
+	}
+
 	conf := &dkafka.Config{
 		DfuseToken:        viper.GetString("global-dfuse-auth-token"),
 		DfuseGRPCEndpoint: viper.GetString("global-dfuse-firehose-grpc-addr"),
+		DfusePlaintext:    viper.GetBool("global-dfuse-plaintext"),
+		FirehoseVersion:   viper.GetString("global-dfuse-firehose-version"),
+		BlockDetailLevel:  viper.GetString("publish-cmd-block-detail-level"),
 		IncludeFilterExpr: viper.GetString("global-dfuse-firehose-include-expr"),
 
+		AllowUnfilteredStream: viper.GetBool("global-allow-unfiltered-stream"),
+
+		BlockmetaEndpoint: viper.GetString("publish-cmd-blockmeta-grpc-addr"),
+
+		ExpectedChainID:  viper.GetString("publish-cmd-expected-chain-id"),
+		ChainAPIEndpoint: viper.GetString("publish-cmd-chain-api-endpoint"),
+
+		CursorCompatibilityMode: viper.GetBool("publish-cmd-cursor-compatibility-mode"),
+
+		DfuseTLSCAFile:             viper.GetString("global-dfuse-tls-ca-file"),
+		DfuseTLSClientCertFile:     viper.GetString("global-dfuse-tls-client-cert-file"),
+		DfuseTLSClientKeyFile:      viper.GetString("global-dfuse-tls-client-key-file"),
+		DfuseTLSInsecureSkipVerify: getDfuseTLSInsecureSkipVerify(),
+		GRPCProxyURL:               viper.GetString("global-dfuse-grpc-proxy-url"),
+
 		DryRun:                     viper.GetBool("global-dry-run"),
+		DryRunWithKafkaCursor:      viper.GetBool("publish-cmd-dry-run-with-kafka-cursor"),
 		KafkaEndpoints:             viper.GetString("global-kafka-endpoints"),
 		KafkaSSLEnable:             viper.GetBool("global-kafka-ssl-enable"),
 		KafkaSSLCAFile:             viper.GetString("global-kafka-ssl-ca-file"),
 		KafkaSSLAuth:               viper.GetBool("global-kafka-ssl-auth"),
 		KafkaSSLClientCertFile:     viper.GetString("global-kafka-ssl-client-cert-file"),
 		KafkaSSLClientKeyFile:      viper.GetString("global-kafka-ssl-client-key-file"),
+		KafkaCloud:                 viper.GetString("global-kafka-cloud"),
+		KafkaAPIKey:                viper.GetString("global-kafka-api-key"),
+		KafkaAPISecret:             viper.GetString("global-kafka-api-secret"),
+		Namespace:                  viper.GetString("global-namespace"),
 		KafkaTopic:                 viper.GetString("global-kafka-topic"),
 		KafkaCursorTopic:           viper.GetString("global-kafka-cursor-topic"),
-		KafkaCursorPartition:       int32(viper.GetUint32("global-kafka-cursor-partition")),
+		KafkaCursorPartition:       cursorPartition,
+		KafkaCursorPartitionAuto:   cursorPartitionAuto,
 		KafkaCursorConsumerGroupID: viper.GetString("global-kafka-cursor-consumer-group-id"),
+		NoAdminOperations:          viper.GetBool("global-no-admin-operations"),
 		KafkaTransactionID:         viper.GetString("global-kafka-transaction-id"),
-		CommitMinDelay:             viper.GetDuration("publish-cmd-delay-between-commits"),
+		KafkaStatsIntervalMs:       viper.GetInt("publish-cmd-kafka-stats-interval-ms"),
+		StartupCanary:              viper.GetBool("publish-cmd-startup-canary"),
+		StartupCanaryConsume:       viper.GetBool("publish-cmd-startup-canary-consume"),
+		CursorSaveAsync:            viper.GetBool("publish-cmd-cursor-save-async"),
+		CursorSaveTimeout:          viper.GetDuration("publish-cmd-cursor-save-timeout"),
+		LeaseTTL:                   viper.GetDuration("publish-cmd-lease-ttl"),
+		TakeoverGracePeriod:        viper.GetDuration("publish-cmd-takeover-grace-period"),
+		InstanceID:                 viper.GetString("publish-cmd-instance-id"),
+		StartupTimeout:             viper.GetDuration("publish-cmd-startup-timeout"),
+		MaxProducerRecoveries:      viper.GetInt("publish-cmd-max-producer-recoveries"),
+		Retry: dkafka.RetryConfig{
+			InitialInterval: viper.GetDuration("publish-cmd-retry-initial-interval"),
+			MaxInterval:     viper.GetDuration("publish-cmd-retry-max-interval"),
+			MaxElapsedTime:  viper.GetDuration("publish-cmd-retry-max-elapsed-time"),
+		},
+		AdaptWorkers:           viper.GetInt("publish-cmd-adapt-workers"),
+		StageBuffer:            viper.GetInt("publish-cmd-stage-buffer"),
+		MessageStreamBuffer:    viper.GetInt("publish-cmd-message-stream-buffer"),
+		BlockProcessTimeout:    viper.GetDuration("publish-cmd-block-process-timeout"),
+		MaxStreamIdle:          viper.GetDuration("publish-cmd-max-stream-idle"),
+		CommitMinDelay:         viper.GetDuration("publish-cmd-delay-between-commits"),
+		CommitMinDelayLive:     viper.GetDuration("publish-cmd-delay-between-commits-live"),
+		CommitMinDelayCatchup:  viper.GetDuration("publish-cmd-delay-between-commits-catchup"),
+		NearHeadThreshold:      viper.GetDuration("publish-cmd-near-head-threshold"),
+		DedupeWindow:           viper.GetDuration("publish-cmd-dedupe-window"),
+		DedupeWindowBlocks:     viper.GetUint64("publish-cmd-dedupe-window-blocks"),
+		DedupeEventTypes:       viper.GetStringSlice("publish-cmd-dedupe-event-types"),
+		DedupFromTargetTopic:   viper.GetBool("publish-cmd-dedup-from-target-topic"),
+		DedupFalsePositiveRate: viper.GetFloat64("publish-cmd-dedup-false-positive-rate"),
+		DedupExactMaxIDs:       viper.GetInt("publish-cmd-dedup-exact-max-ids"),
+
+		EventSource:      viper.GetString("publish-cmd-event-source"),
+		EventKeysExpr:    viper.GetString("publish-cmd-event-keys-expr"),
+		EventTypeExpr:    viper.GetString("publish-cmd-event-type-expr"),
+		EventExtensions:  extensions,
+		EventSubjectExpr: viper.GetString("publish-cmd-event-subject-expr"),
+		PartitionByExpr:  viper.GetString("publish-cmd-partition-by-expr"),
+		EmbedKeyInValue:  viper.GetBool("publish-cmd-embed-key-in-value"),
+		IncludeRamOps:    viper.GetBool("publish-cmd-include-ram-ops"),
+		IncludeConsole:   viper.GetBool("publish-cmd-include-console"),
+		ConsoleMaxBytes:  viper.GetInt("publish-cmd-console-max-bytes"),
+		MaxHeaderBytes:   viper.GetInt("publish-cmd-max-header-bytes"),
+		HeaderAllowlist:  viper.GetStringSlice("publish-cmd-header-allowlist"),
+		StaticHeaders:    staticHeaders,
+
+		HeartbeatInterval:  viper.GetDuration("publish-cmd-heartbeat-interval"),
+		HeartbeatTopic:     viper.GetString("publish-cmd-heartbeat-topic"),
+		LIBAnnounceMode:    viper.GetString("publish-cmd-lib-announce-mode"),
+		LIBAnnounceMinStep: viper.GetUint32("publish-cmd-lib-announce-min-step"),
+		ExpressionsFile:    viper.GetString("publish-cmd-expressions-file"),
+
+		EventGranularity: viper.GetString("publish-cmd-event-granularity"),
+		ValueCompression: viper.GetString("publish-cmd-value-compression"),
+		PayloadVersion:   viper.GetString("publish-cmd-payload-version"),
+		KafkaTopicV2:     viper.GetString("publish-cmd-kafka-topic-v2"),
+
+		CaptureDir:             viper.GetString("publish-cmd-capture-dir"),
+		CaptureRetentionBlocks: viper.GetInt("publish-cmd-capture-retention-blocks"),
+		CaptureRetentionBytes:  viper.GetInt64("publish-cmd-capture-retention-bytes"),
+		CaptureOnlyOnError:     viper.GetBool("publish-cmd-capture-only-on-error"),
+
+		OtelExporterEndpoint: viper.GetString("publish-cmd-otel-exporter-endpoint"),
+		OtelSampleRate:       viper.GetFloat64("publish-cmd-otel-sample-rate"),
+
+		PrimaryKeyRenderings: renderings,
+		ProjectedFields:      projectedFields,
+		MemoFields:           memoFields,
+		SamplingRules:        samplingRules,
+		RedactFields:         redactFields,
+		RedactTables:         viper.GetStringSlice("publish-cmd-redact-tables"),
+		RedactHMACKey:        viper.GetString("publish-cmd-redact-hmac-key"),
+		RedactEncryptionKey:  viper.GetString("publish-cmd-redact-encryption-key"),
+		OnError:              onError,
 
-		EventSource:     viper.GetString("publish-cmd-event-source"),
-		EventKeysExpr:   viper.GetString("publish-cmd-event-keys-expr"),
-		EventTypeExpr:   viper.GetString("publish-cmd-event-type-expr"),
-		EventExtensions: extensions,
+		ValueJSONSchemaFile:   viper.GetString("publish-cmd-value-json-schema-file"),
+		ValueJSONSchemas:      valueSchemas,
+		ValueSchemaSkipTopics: viper.GetStringSlice("publish-cmd-value-schema-skip-topics"),
+
+		MaxProduceBytesPerSecond:         viper.GetInt64("publish-cmd-max-produce-bytes-per-second"),
+		MaxProduceBytesPerSecondPerTopic: topicByteRates,
+
+		FilterEfficiencyLogInterval: viper.GetDuration("publish-cmd-filter-efficiency-log-interval"),
+
+		MaxUncommittedMessages: viper.GetInt64("publish-cmd-max-uncommitted-messages"),
+		MaxUncommittedBytes:    viper.GetInt64("publish-cmd-max-uncommitted-bytes"),
 
 		BatchMode:     viper.GetBool("publish-cmd-batch-mode"),
 		StartBlockNum: viper.GetInt64("publish-cmd-start-block-num"),
 		StopBlockNum:  viper.GetUint64("publish-cmd-stop-block-num"),
+		StartTime:     viper.GetString("publish-cmd-start-time"),
+		StopTime:      viper.GetString("publish-cmd-stop-time"),
 		StateFile:     viper.GetString("publish-cmd-state-file"),
-	}
+		StopAtHead:    viper.GetBool("publish-cmd-stop-at-head"),
 
-	cmd.SilenceUsage = true
-	signalHandler := derr.SetupSignalHandler(time.Second)
+		ExprREPL:          viper.GetBool("publish-cmd-expr-repl"),
+		ExprREPLBlockFile: viper.GetString("publish-cmd-expr-repl-block-file"),
+		ExprREPLBlockNum:  viper.GetUint64("publish-cmd-expr-repl-block-num"),
+		ExprREPLEnv:       viper.GetString("publish-cmd-expr-repl-env"),
 
-	zlog.Info("starting dkafka publisher", zap.Reflect("config", conf))
-	app := dkafka.New(conf)
-	go func() { app.Shutdown(app.Run()) }()
+		RewindBlocks:  viper.GetUint64("publish-cmd-rewind-blocks"),
+		RewindToBlock: viper.GetUint64("publish-cmd-rewind-to-block"),
 
-	select {
-	case <-signalHandler:
-		app.Shutdown(fmt.Errorf("shutdown signal received"))
-	case <-app.Terminating():
+		FailOnBlockGap:   viper.GetBool("publish-cmd-fail-on-block-gap"),
+		StrictStartBlock: viper.GetBool("publish-cmd-strict-start-block"),
+		BatchReportFile:  viper.GetString("publish-cmd-batch-report-file"),
+		VerifyAfterBatch: viper.GetBool("publish-cmd-verify-after-batch"),
+
+		EmitCompletionEvent: viper.GetBool("publish-cmd-emit-completion-event"),
+		JobID:               viper.GetString("publish-cmd-job-id"),
+
+		SinkType:              viper.GetString("publish-cmd-sink-type"),
+		FileSinkDir:           viper.GetString("publish-cmd-file-sink-dir"),
+		FileSinkFormat:        viper.GetString("publish-cmd-file-sink-format"),
+		FileSinkHeaders:       viper.GetStringSlice("publish-cmd-file-sink-headers"),
+		FileSinkMaxBytes:      viper.GetInt64("publish-cmd-file-sink-max-bytes"),
+		FileSinkBlocksPerFile: viper.GetUint64("publish-cmd-file-sink-blocks-per-file"),
+
+		HTTPSinkURL:         viper.GetString("publish-cmd-http-sink-url"),
+		HTTPSinkTimeout:     viper.GetDuration("publish-cmd-http-sink-timeout"),
+		HTTPSinkMaxRetries:  viper.GetInt("publish-cmd-http-sink-max-retries"),
+		HTTPSinkConcurrency: viper.GetInt("publish-cmd-http-sink-concurrency"),
+
+		Account:           viper.GetString("publish-cmd-account"),
+		SystemActionsMode: viper.GetBool("publish-cmd-system-actions-mode"),
+		SystemActions:     viper.GetStringSlice("publish-cmd-system-actions"),
+
+		TopicRouting: topicRouting,
+
+		EventKeySets:      keySets,
+		EventKeySetTopics: keySetTopics,
+
+		SplitDBOps:  viper.GetBool("publish-cmd-split-db-ops"),
+		DBOpsTopic:  viper.GetString("publish-cmd-db-ops-topic"),
+		DBOpKeyExpr: viper.GetString("publish-cmd-db-op-key-expr"),
+
+		MaxActionDataBytes:    viper.GetInt("publish-cmd-max-action-data-bytes"),
+		OversizeSkippedEvents: viper.GetBool("publish-cmd-oversize-skipped-events"),
 	}
-	zlog.Info("terminating", zap.Error(app.Err()))
 
-	<-app.Terminated()
-	return app.Err()
+	if filename := viper.GetString("publish-cmd-pipelines-file"); filename != "" {
+		pipelines, err := dkafka.LoadPipelines(filename)
+		if err != nil {
+			return nil, err
+		}
+		conf.Pipelines = pipelines
+	}
+
+	if filename := viper.GetString("publish-cmd-config-file"); filename != "" {
+		conf, err = loadConfigFile(filename, conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.LoadExpressionFiles(); err != nil {
+		return nil, err
+	}
+	return conf, nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -28,8 +29,16 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	RootCmd.PersistentFlags().String("dfuse-firehose-grpc-addr", "localhost:13035", "firehose endpoint to connect to")
+	RootCmd.PersistentFlags().String("dfuse-firehose-version", "v1", "firehose API of the endpoint, one of: v1 (dfuse bstream v1), v2 (sf.firehose.v2, {dfuse-firehose-include-expr} is then applied by dkafka)")
 	RootCmd.PersistentFlags().String("dfuse-firehose-include-expr", "executed", "CEL expression tu use for requests to firehose")
+	RootCmd.PersistentFlags().Bool("allow-unfiltered-stream", false, "allow an empty {dfuse-firehose-include-expr}, streaming every transaction of the chain")
 	RootCmd.PersistentFlags().String("dfuse-auth-token", "", "JWT to authenticate to dfuse (empty to skip authentication)")
+	RootCmd.PersistentFlags().Bool("dfuse-plaintext", false, "connect to the dfuse endpoint without TLS (replaces the deprecated '*' marker in {dfuse-firehose-grpc-addr})")
+	RootCmd.PersistentFlags().String("dfuse-tls-ca-file", "", "path to certificate authority validating the dfuse endpoint")
+	RootCmd.PersistentFlags().String("dfuse-tls-client-cert-file", "", "path to client certificate to authenticate to the dfuse endpoint with mutual TLS")
+	RootCmd.PersistentFlags().String("dfuse-tls-client-key-file", "", "path to client key to authenticate to the dfuse endpoint with mutual TLS")
+	RootCmd.PersistentFlags().Bool("dfuse-tls-insecure-skip-verify", false, "skip the verification of the dfuse endpoint certificate (if not set, only verified with {dfuse-tls-ca-file})")
+	RootCmd.PersistentFlags().String("dfuse-grpc-proxy-url", "", "http(s)://[user:pass@]host:port proxy tunneling the dfuse connections with CONNECT (if not set, HTTPS_PROXY and NO_PROXY are honored)")
 	RootCmd.PersistentFlags().Bool("dry-run", false, "do not send anything to kafka, just print content")
 	RootCmd.PersistentFlags().String("kafka-endpoints", "127.0.0.1:9092", "comma-separated kafka endpoint addresses")
 	RootCmd.PersistentFlags().Bool("kafka-ssl-enable", false, "use SSL when connecting to kafka endpoints")
@@ -38,12 +47,18 @@ func init() {
 	RootCmd.PersistentFlags().String("kafka-ssl-client-cert-file", "./client.crt.pem", "path to client certificate to authenticate to kafka endpoint")
 	RootCmd.PersistentFlags().String("kafka-ssl-client-key-file", "./client.key.pem", "path to client key to authenticate to kafka endpoint")
 
+	RootCmd.PersistentFlags().String("kafka-cloud", "", "if set to 'confluent', connect to Confluent Cloud using {kafka-api-key} and {kafka-api-secret} (SASL_SSL/PLAIN)")
+	RootCmd.PersistentFlags().String("kafka-api-key", "", "kafka cloud api key")
+	RootCmd.PersistentFlags().String("kafka-api-secret", "", "kafka cloud api secret")
+
 	RootCmd.PersistentFlags().String("kafka-transaction-id", "dkafkatransaction", "Unique ID for transactions")
 
+	RootCmd.PersistentFlags().String("namespace", "", "if set, prefixed to {kafka-topic}, {kafka-cursor-topic} and the event types (ex: 'prod.eos.mycontract')")
 	RootCmd.PersistentFlags().String("kafka-topic", "default", "kafka topic to use for all events writes or reads")
 	RootCmd.PersistentFlags().String("kafka-cursor-topic", "_dkafka_cursors", "kafka topic where cursor will be loaded and saved")
-	RootCmd.PersistentFlags().Uint32("kafka-cursor-partition", 0, "kafka partition where cursor will be loaded and saved")
+	RootCmd.PersistentFlags().String("kafka-cursor-partition", "0", "kafka partition where cursor will be loaded and saved, 'auto' to derive it from {kafka-topic} and {account}")
 	RootCmd.PersistentFlags().String("kafka-cursor-consumer-group-id", "dkafkaconsumer", "Consumer group ID for reading cursor")
+	RootCmd.PersistentFlags().Bool("no-admin-operations", false, "never create the cursor topic nor subscribe to it, for service accounts limited to Read/Describe on the cursor topic and Write on the data topics")
 
 	RootCmd.PersistentFlags().String("log-format", "text", "Format for logging to stdout. Either 'text' or 'stackdriver'")
 	RootCmd.PersistentFlags().CountP("verbose", "v", "Enables verbose output (-vvvv for max verbosity)")
@@ -78,3 +93,26 @@ func recurseViperCommands(root *cobra.Command, segments []string) {
 		recurseViperCommands(cmd, append(segments, cmd.Name()))
 	}
 }
+
+// getDfuseTLSInsecureSkipVerify returns nil when the dfuse-tls-insecure-skip-verify flag is not
+// set, keeping the default of older versions
+func getDfuseTLSInsecureSkipVerify() *bool {
+	if !viper.IsSet("global-dfuse-tls-insecure-skip-verify") {
+		return nil
+	}
+	skip := viper.GetBool("global-dfuse-tls-insecure-skip-verify")
+	return &skip
+}
+
+// getCursorPartition parses the kafka-cursor-partition flag, a partition number or "auto"
+func getCursorPartition() (int32, bool, error) {
+	value := viper.GetString("global-kafka-cursor-partition")
+	if value == "auto" {
+		return 0, true, nil
+	}
+	partition, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || partition < 0 {
+		return 0, false, fmt.Errorf("invalid kafka cursor partition %q, must be a positive number or 'auto'", value)
+	}
+	return int32(partition), false, nil
+}
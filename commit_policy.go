@@ -0,0 +1,57 @@
+package dkafka
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// commitPolicy chooses the minimum delay between two cursor commits from the lag of the block:
+// near the chain head the cursor is committed often, during a catch-up rarely
+type commitPolicy struct {
+	nearHeadThreshold time.Duration
+	liveDelay         time.Duration
+	catchupDelay      time.Duration
+	nearHead          *bool // regime of the previous block, nil before the first one
+}
+
+func newCommitPolicy(conf *Config) *commitPolicy {
+	p := &commitPolicy{
+		nearHeadThreshold: conf.NearHeadThreshold,
+		liveDelay:         conf.CommitMinDelayLive,
+		catchupDelay:      conf.CommitMinDelayCatchup,
+	}
+	if p.liveDelay == 0 {
+		p.liveDelay = conf.CommitMinDelay
+	}
+	if p.catchupDelay == 0 {
+		p.catchupDelay = conf.CommitMinDelay
+	}
+	return p
+}
+
+// delay returns the minimum delay between commits for a block produced at blockTime
+func (p *commitPolicy) delay(blockTime time.Time) time.Duration {
+	lag := time.Since(blockTime)
+	if lag < 0 {
+		lag = 0
+	}
+	BlockLag.SetFloat64(lag.Seconds())
+
+	nearHead := lag < p.nearHeadThreshold
+	if p.nearHead == nil || *p.nearHead != nearHead {
+		if nearHead {
+			CommitRegime.SetInt(1, "live")
+			CommitRegime.SetInt(0, "catchup")
+		} else {
+			CommitRegime.SetInt(0, "live")
+			CommitRegime.SetInt(1, "catchup")
+		}
+		zlog.Info("commit regime changed", zap.Bool("near_head", nearHead), zap.Duration("lag", lag))
+		p.nearHead = &nearHead
+	}
+	if nearHead {
+		return p.liveDelay
+	}
+	return p.catchupDelay
+}
@@ -0,0 +1,60 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Version of dkafka, set at build time with -ldflags "-X github.com/dfuse-io/dkafka.Version=v1.2.3"
+var Version = "dev"
+
+const streamCompletedEventType = "StreamCompleted"
+
+// StreamCompleted is the payload of the message sent when a stream reaches its stop block, in the
+// last transaction so it is only visible once all the messages before it are
+type StreamCompleted struct {
+	JobID               string            `json:"job_id"`
+	RequestedStartBlock int64             `json:"requested_start_block"`
+	StopBlock           uint64            `json:"stop_block"` // 0 when stopped by the stop time or the end of the firehose stream
+	FirstBlock          uint64            `json:"first_block"`
+	LastBlock           uint64            `json:"last_block"`
+	Blocks              uint64            `json:"blocks"`
+	Messages            map[string]uint64 `json:"messages"` // generated messages per topic
+	DurationSeconds     float64           `json:"duration_seconds"`
+	Version             string            `json:"dkafka_version"`
+}
+
+func streamCompletedMessage(topic string, eventSource string, jobID string, report *batchReport, stopBlockNum uint64, started time.Time) *kafka.Message {
+	now := time.Now().UTC()
+	value, _ := json.Marshal(StreamCompleted{
+		JobID:               jobID,
+		RequestedStartBlock: report.RequestedStartBlock,
+		StopBlock:           stopBlockNum,
+		FirstBlock:          report.FirstBlock,
+		LastBlock:           report.LastBlock,
+		Blocks:              report.Blocks,
+		Messages:            report.Messages,
+		DurationSeconds:     now.Sub(started).Seconds(),
+		Version:             Version,
+	})
+	return &kafka.Message{
+		Key: []byte(jobID),
+		Headers: []kafka.Header{
+			{Key: "ce_id", Value: hashString(fmt.Sprintf("%s%d%d%s", jobID, report.FirstBlock, report.LastBlock, streamCompletedEventType))},
+			{Key: "ce_source", Value: []byte(eventSource)},
+			{Key: "ce_specversion", Value: []byte("1.0")},
+			{Key: "ce_type", Value: []byte(streamCompletedEventType)},
+			{Key: controlHeader, Value: []byte(streamCompletedEventType)},
+			{Key: "content-type", Value: []byte("application/json")},
+			{Key: "ce_time", Value: []byte(now.Format("2006-01-02T15:04:05.9Z"))},
+			{Key: "ce_datacontenttype", Value: []byte("application/json")},
+		},
+		Value: value,
+		TopicPartition: kafka.TopicPartition{
+			Topic: &topic,
+		},
+	}
+}
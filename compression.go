@@ -0,0 +1,87 @@
+package dkafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var zstdEncoder struct {
+	sync.Once
+	*zstd.Encoder
+	err error
+}
+
+var zstdDecoder struct {
+	sync.Once
+	*zstd.Decoder
+	err error
+}
+
+func validateValueCompression(compression string) error {
+	switch compression {
+	case "", "none", "gzip", "zstd":
+		return nil
+	}
+	return fmt.Errorf("invalid value compression %q, must be one of: none, gzip, zstd", compression)
+}
+
+// valueContentType returns the content type of the values compressed with the given algorithm
+func valueContentType(compression string) string {
+	switch compression {
+	case "gzip", "zstd":
+		return "application/json+" + compression
+	}
+	return "application/json"
+}
+
+func compressValue(compression string, value []byte) ([]byte, error) {
+	switch compression {
+	case "gzip":
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(value); err != nil {
+			return nil, fmt.Errorf("compressing value: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("compressing value: %w", err)
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		zstdEncoder.Do(func() {
+			zstdEncoder.Encoder, zstdEncoder.err = zstd.NewWriter(nil)
+		})
+		if zstdEncoder.err != nil {
+			return nil, fmt.Errorf("creating zstd encoder: %w", zstdEncoder.err)
+		}
+		return zstdEncoder.EncodeAll(value, nil), nil
+	}
+	return value, nil
+}
+
+// decompressValue decompresses the value according to the suffix of its content type
+func decompressValue(contentType string, value []byte) ([]byte, error) {
+	switch {
+	case strings.HasSuffix(contentType, "+gzip"):
+		r, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing value: %w", err)
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case strings.HasSuffix(contentType, "+zstd"):
+		zstdDecoder.Do(func() {
+			zstdDecoder.Decoder, zstdDecoder.err = zstd.NewReader(nil)
+		})
+		if zstdDecoder.err != nil {
+			return nil, fmt.Errorf("creating zstd decoder: %w", zstdDecoder.err)
+		}
+		return zstdDecoder.DecodeAll(value, nil)
+	}
+	return value, nil
+}
@@ -0,0 +1,651 @@
+package dkafka
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dfuse-io/dfuse-eosio/filtering"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+)
+
+type Config struct {
+	DfuseGRPCEndpoint string `yaml:"dfuse_grpc_endpoint"`
+	DfuseToken        string `yaml:"dfuse_token"`
+	DfusePlaintext    bool   `yaml:"dfuse_plaintext"`
+	FirehoseVersion   string `yaml:"firehose_version"`   // "v1" (default, dfuse bstream v1) or "v2" (sf.firehose.v2)
+	BlockDetailLevel  string `yaml:"block_detail_level"` // "full" (default) or "light" (trimmed traces, v1 only)
+
+	BlockmetaEndpoint string `yaml:"blockmeta_endpoint"` // resolves the start and stop times, the firehose is searched if empty
+
+	ExpectedChainID  string `yaml:"expected_chain_id"`  // saved with the cursors, a cursor of another chain is refused
+	ChainAPIEndpoint string `yaml:"chain_api_endpoint"` // nodeos API checked against the expected chain id at startup
+
+	CursorCompatibilityMode bool `yaml:"cursor_compatibility_mode"` // resumes a cursor saved by a newer version, ignoring its new fields (emergency rollbacks)
+
+	DfuseTLSCAFile             string `yaml:"dfuse_tls_ca_file"`
+	DfuseTLSClientCertFile     string `yaml:"dfuse_tls_client_cert_file"` // authenticates to the dfuse endpoint with mutual TLS
+	DfuseTLSClientKeyFile      string `yaml:"dfuse_tls_client_key_file"`
+	DfuseTLSInsecureSkipVerify *bool  `yaml:"dfuse_tls_insecure_skip_verify"` // if nil, the server certificate is only verified with a CA file
+
+	GRPCProxyURL string `yaml:"grpc_proxy_url"` // http(s)://[user:pass@]host:port CONNECT proxy of the dfuse endpoint, HTTPS_PROXY if empty
+
+	DryRun        bool   `yaml:"dry_run"` // do not connect to Kafka, just print to stdout, the cursor is saved to the state file
+	BatchMode     bool   `yaml:"batch_mode"`
+	StartBlockNum int64  `yaml:"start_block_num"`
+	StopBlockNum  uint64 `yaml:"stop_block_num"`
+	StartTime     string `yaml:"start_time"` // RFC3339, resolved to the first block at or after it
+	StopTime      string `yaml:"stop_time"`  // RFC3339, the stream stops before the first block at or after it
+	StateFile     string `yaml:"state_file"`
+
+	DryRunWithKafkaCursor bool `yaml:"dry_run_with_kafka_cursor"` // the dry run loads the cursor of the cursor topic, never saved to it
+
+	StopAtHead bool `yaml:"stop_at_head"` // resume from the cursor and stop at the head block of the startup, writing the batch report
+
+	ExprREPL          bool   `yaml:"expr_repl"`            // evaluate the expressions read from stdin against a block instead of streaming
+	ExprREPLBlockFile string `yaml:"expr_repl_block_file"` // captured (zstd-compressed protobuf) or JSON block of the expression REPL
+	ExprREPLBlockNum  uint64 `yaml:"expr_repl_block_num"`  // block of the expression REPL fetched from the firehose, if no block file
+	ExprREPLEnv       string `yaml:"expr_repl_env"`        // initial environment of the expression REPL: default, action (default) or table
+
+	RewindBlocks  uint64 `yaml:"rewind_blocks"`   // the blocks streamed again before the loaded cursor, one-shot
+	RewindToBlock uint64 `yaml:"rewind_to_block"` // the loaded cursor is moved back to this block, one-shot
+
+	FailOnBlockGap   bool   `yaml:"fail_on_block_gap"`  // stream irreversible blocks only and fail if one is missing
+	StrictStartBlock bool   `yaml:"strict_start_block"` // fail instead of starting later when the firehose history is pruned
+	BatchReportFile  string `yaml:"batch_report_file"`  // written at the end of a batch run
+	VerifyAfterBatch bool   `yaml:"verify_after_batch"` // read back the produced messages at the end of a batch run
+
+	EmitCompletionEvent bool   `yaml:"emit_completion_event"` // send a StreamCompleted message once the stop block is reached
+	JobID               string `yaml:"job_id"`                // key of the StreamCompleted message
+
+	SinkType              string   `yaml:"sink_type"` // "kafka", "file" or "http"
+	FileSinkDir           string   `yaml:"file_sink_dir"`
+	FileSinkFormat        string   `yaml:"file_sink_format"` // "json" or "csv"
+	FileSinkHeaders       []string `yaml:"file_sink_headers"`
+	FileSinkMaxBytes      int64    `yaml:"file_sink_max_bytes"`
+	FileSinkBlocksPerFile uint64   `yaml:"file_sink_blocks_per_file"`
+
+	HTTPSinkURL         string        `yaml:"http_sink_url"` // receives the events as binary-mode CloudEvents
+	HTTPSinkTimeout     time.Duration `yaml:"http_sink_timeout"`
+	HTTPSinkMaxRetries  int           `yaml:"http_sink_max_retries"`
+	HTTPSinkConcurrency int           `yaml:"http_sink_concurrency"` // requests in flight, the events are not ordered above 1
+
+	KafkaEndpoints         string `yaml:"kafka_endpoints"`
+	KafkaSSLEnable         bool   `yaml:"kafka_ssl_enable"`
+	KafkaSSLCAFile         string `yaml:"kafka_ssl_ca_file"`
+	KafkaSSLAuth           bool   `yaml:"kafka_ssl_auth"`
+	KafkaSSLClientCertFile string `yaml:"kafka_ssl_client_cert_file"`
+	KafkaSSLClientKeyFile  string `yaml:"kafka_ssl_client_key_file"`
+	KafkaCloud             string `yaml:"kafka_cloud"` // "confluent" to apply the Confluent Cloud defaults
+	KafkaAPIKey            string `yaml:"kafka_api_key"`
+	KafkaAPISecret         string `json:"-" yaml:"kafka_api_secret"` // never logged
+
+	KafkaCursorConsumerGroupID string        `yaml:"kafka_cursor_consumer_group_id"`
+	NoAdminOperations          bool          `yaml:"no_admin_operations"` // never create the cursor topic, Read and Describe on it suffice
+	KafkaTransactionID         string        `yaml:"kafka_transaction_id"`
+	CursorSaveAsync            bool          `yaml:"cursor_save_async"`       // do not wait for the delivery of the kafka cursor, never waited for within a transaction
+	CursorSaveTimeout          time.Duration `yaml:"cursor_save_timeout"`     // of the cursor delivery, defaultCursorSaveTimeout if zero
+	StartupCanary              bool          `yaml:"startup_canary"`          // produce a canary message to the topics before streaming
+	StartupCanaryConsume       bool          `yaml:"startup_canary_consume"`  // read the canary back with the cursor consumer group
+	KafkaStatsIntervalMs       int           `yaml:"kafka_stats_interval_ms"` // librdkafka statistics surfaced as metrics, disabled if zero
+	MaxProducerRecoveries      int           `yaml:"max_producer_recoveries"` // producers re-created after a fatal error before giving up
+	Retry                      RetryConfig   `yaml:"retry"`                   // backoff of the http sink requests, cursor loads and producer recoveries
+	CommitMinDelay             time.Duration `yaml:"commit_min_delay"`
+	CommitMinDelayLive         time.Duration `yaml:"commit_min_delay_live"`    // used when the block lag is below the near head threshold, defaults to CommitMinDelay
+	CommitMinDelayCatchup      time.Duration `yaml:"commit_min_delay_catchup"` // used otherwise, defaults to CommitMinDelay
+	NearHeadThreshold          time.Duration `yaml:"near_head_threshold"`
+	AdaptWorkers               int           `yaml:"adapt_workers"`         // blocks adapted concurrently, 1 if zero
+	StageBuffer                int           `yaml:"stage_buffer"`          // blocks queued between the receive, adapt and send stages
+	BlockProcessTimeout        time.Duration `yaml:"block_process_timeout"` // of the adapt stage of a block, disabled if zero
+	MaxStreamIdle              time.Duration `yaml:"max_stream_idle"`       // the stream is opened again after this time without block, disabled if zero
+
+	MessageStreamBuffer int `yaml:"message_stream_buffer"` // if set, the messages of a block are sent while it is adapted, at most this many queued
+
+	FilterEfficiencyLogInterval time.Duration `yaml:"filter_efficiency_log_interval"` // of the summary of the actions matching the firehose filter, disabled if zero
+
+	MaxUncommittedMessages int64 `yaml:"max_uncommitted_messages"` // the cursor is committed at the end of the block reaching it, before the commit delay, disabled if zero
+	MaxUncommittedBytes    int64 `yaml:"max_uncommitted_bytes"`    // same, for the bytes of the messages (key, value and headers)
+
+	LeaseTTL            time.Duration `yaml:"lease_ttl"`             // a single instance produces for the cursor signature, heartbeats every third of it, disabled if zero
+	TakeoverGracePeriod time.Duration `yaml:"takeover_grace_period"` // waited at startup for the lease of another instance to expire, refused at once if zero
+	InstanceID          string        `yaml:"instance_id"`           // written in the lease, defaults to the hostname, pid and start time
+
+	StartupTimeout time.Duration `yaml:"startup_timeout"` // bounds the concurrent startup steps (producer, cursor load, expressions...) of each run, unbounded if zero
+
+	CaptureDir             string `yaml:"capture_dir"`              // the received blocks are written to this dir, as zstd-compressed protobuf, if set
+	CaptureRetentionBlocks int    `yaml:"capture_retention_blocks"` // the oldest block files are pruned above this count, unbounded if zero
+	CaptureRetentionBytes  int64  `yaml:"capture_retention_bytes"`  // the oldest block files are pruned above this total size, unbounded if zero
+	CaptureOnlyOnError     bool   `yaml:"capture_only_on_error"`    // only write the blocks whose adaptation failed
+
+	OtelExporterEndpoint string  `yaml:"otel_exporter_endpoint"` // OTLP collector receiving the block and message spans, tracing is disabled if empty
+	OtelSampleRate       float64 `yaml:"otel_sample_rate"`       // ratio of the traced blocks
+
+	DedupeWindow       time.Duration `yaml:"dedupe_window"`        // only send the last db op message per key generated within this delay
+	DedupeWindowBlocks uint64        `yaml:"dedupe_window_blocks"` // only send the last db op message per key generated within this number of blocks
+	DedupeEventTypes   []string      `yaml:"dedupe_event_types"`   // event types of the action events also suppressed within the dedupe window, all kept if empty
+
+	DedupFromTargetTopic   bool    `yaml:"dedup_from_target_topic"`   // skip the messages whose ce_id is already in the target topic
+	DedupFalsePositiveRate float64 `yaml:"dedup_false_positive_rate"` // of the Bloom filter, new messages are dropped at this rate
+	DedupExactMaxIDs       int     `yaml:"dedup_exact_max_ids"`       // the ce_id are held in an exact set up to this count
+
+	Namespace                string            `yaml:"namespace"` // ex: "prod.eos.mycontract", prefixed to the topics and event types
+	IncludeFilterExpr        string            `yaml:"include_filter_expr"`
+	AllowUnfilteredStream    bool              `yaml:"allow_unfiltered_stream"` // acknowledges an include filter matching the whole chain
+	KafkaTopic               string            `yaml:"kafka_topic"`
+	KafkaTopicV2             string            `yaml:"kafka_topic_v2"`  // if set, the events are also sent to this topic with the v2 payload
+	PayloadVersion           string            `yaml:"payload_version"` // "v1" (default) or "v2", announced in the ce_dataschema header
+	KafkaCursorTopic         string            `yaml:"kafka_cursor_topic"`
+	KafkaCursorPartition     int32             `yaml:"kafka_cursor_partition"`
+	KafkaCursorPartitionAuto bool              `yaml:"kafka_cursor_partition_auto"` // derive the cursor partition from the topic and account
+	EventSource              string            `yaml:"event_source"`
+	EventKeysExpr            string            `yaml:"event_keys_expr"`
+	EventTypeExpr            string            `yaml:"event_type_expr"`
+	EventExtensions          map[string]string `yaml:"event_extensions"`
+	EventSubjectExpr         string            `yaml:"event_subject_expr"`     // ce_subject header, omitted if empty
+	PartitionByExpr          string            `yaml:"partition_by_expr"`      // ce_partitionkey header, hashed to the partition instead of the message key
+	EmbedKeyInValue          bool              `yaml:"embed_key_in_value"`     // duplicates the message key in the value under "_key"
+	IncludeRamOps            bool              `yaml:"include_ram_ops"`        // adds the RAM usage changes of the actions to the payload
+	IncludeConsole           bool              `yaml:"include_console"`        // adds the console output of the actions to the payload
+	ConsoleMaxBytes          int               `yaml:"console_max_bytes"`      // the console output is truncated above, unbounded if zero
+	HeartbeatInterval        time.Duration     `yaml:"heartbeat_interval"`     // a heartbeat is sent when no message was produced for this long
+	HeartbeatTopic           string            `yaml:"heartbeat_topic"`        // defaults to the destination topic, also receives the LIB announces
+	LIBAnnounceMode          string            `yaml:"lib_announce_mode"`      // "off" (default), "header" (ce_libnum on every message) or "message" (LibAdvanced events)
+	LIBAnnounceMinStep       uint32            `yaml:"lib_announce_min_step"`  // blocks the LIB must advance by between two LibAdvanced events
+	MaxHeaderBytes           int               `yaml:"max_header_bytes"`       // total size of the header keys and values, unbounded if zero
+	HeaderAllowlist          []string          `yaml:"header_allowlist"`       // headers sent (ce_id and ce_type always are), all if empty
+	StaticHeaders            SecretValues      `yaml:"static_headers"`         // header name to its literal, "env:{name}" or "file:{path}" value, added to every message, literals never logged
+	ValueCompression         string            `yaml:"value_compression"`      // "none" (default), "gzip" or "zstd", compresses the value itself
+	EventGranularity         string            `yaml:"event_granularity"`      // "action" (default) or "transaction"
+	ExpressionsFile          string            `yaml:"expressions_file"`       // JSON file reloading the event expressions on SIGHUP
+	PrimaryKeyRenderings     map[string]string `yaml:"primary_key_renderings"` // table name ("*" for all) to one of: auto, decimal, name, symbol
+	OnError                  map[string]string `yaml:"on_error"`               // failure class to "fail" (default) or "skip"
+	ValueJSONSchemaFile      string            `yaml:"value_json_schema_file"` // JSON schema of the values, or "builtin:action" / "builtin:transaction"
+	ValueJSONSchemas         map[string]string `yaml:"value_json_schemas"`     // ce_type to the JSON schema of its values, precedes the schema file
+	ValueSchemaSkipTopics    []string          `yaml:"value_schema_skip_topics"`
+
+	ProjectedFields map[string][]string `yaml:"projected_fields"` // action name to the '{path}:{type}' of its data fields copied to the payload "fields"
+
+	MemoFields map[string][]string `yaml:"memo_fields"` // action name to the '{path}:{key}' of the 'key:value;key:value' memo keys copied to the payload "fields"
+
+	SamplingRules []SamplingRule `yaml:"sampling_rules"` // share of the events kept per action, the first matching rule applies, never the Undo steps
+
+	RedactFields        map[string][]string `yaml:"redact_fields"`                  // action name to the '{path}:{drop|mask|hmac|encrypt}' of its sensitive data fields, the db ops are not redacted by path
+	RedactTables        []string            `yaml:"redact_tables"`                  // tables whose db ops data is dropped, the binary rows cannot be redacted by path
+	RedactHMACKey       string              `json:"-" yaml:"redact_hmac_key"`       // literal, "env:{name}" or "file:{path}", never logged
+	RedactEncryptionKey string              `json:"-" yaml:"redact_encryption_key"` // base64 AES key, literal, "env:{name}" or "file:{path}", never logged
+
+	MaxProduceBytesPerSecond         int64            `yaml:"max_produce_bytes_per_second"`           // client-side byte rate of all the topics, unlimited if zero
+	MaxProduceBytesPerSecondPerTopic map[string]int64 `yaml:"max_produce_bytes_per_second_per_topic"` // topic (as produced, with its namespace) to its own byte rate
+
+	Pipelines []PipelineConfig `yaml:"pipelines"` // if set, replace the single pipeline defined by the filter, topic and event expressions
+
+	TopicRouting []TopicRoute `yaml:"topic_routing"` // topic per event type, the first matching route applies, kafka topic if none matches
+
+	SplitDBOps  bool   `yaml:"split_db_ops"`   // the db ops are sent as their own messages, referencing their action event
+	DBOpsTopic  string `yaml:"db_ops_topic"`   // topic of the db op messages, the one of their action event if empty
+	DBOpKeyExpr string `yaml:"db_op_key_expr"` // key of the db op messages, "{code}:{scope}:{table}:{primary_key}" if empty
+
+	MaxActionDataBytes    int  `yaml:"max_action_data_bytes"`   // the actions with more data (raw or decoded) are skipped before being decoded, unbounded if zero
+	OversizeSkippedEvents bool `yaml:"oversize_skipped_events"` // an OversizeSkipped event replaces each skipped action
+
+	EventKeySets      map[string]string `yaml:"event_key_sets"`       // label to the keys expression of a copy of the events, replacing the event keys if set
+	EventKeySetTopics map[string]string `yaml:"event_key_set_topics"` // label to the topic of its copies, kafka topic suffixed with "-{label}" if not set
+
+	Account           string   `yaml:"account"` // contract account followed by the system actions mode
+	SystemActionsMode bool     `yaml:"system_actions_mode"`
+	SystemActions     []string `yaml:"system_actions"`
+}
+
+// ValidationErrors holds all the violations found by Config.Validate
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(msgs, "; "))
+}
+
+// Validate checks the whole configuration and reports all the violations together
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	kafkaSink := !c.DryRun && !c.localSink()
+
+	if c.DfuseGRPCEndpoint == "" {
+		check(fmt.Errorf("dfuse grpc endpoint is required"))
+	}
+
+	if c.DfusePlaintext && (c.DfuseTLSCAFile != "" || c.DfuseTLSClientCertFile != "") {
+		check(fmt.Errorf("dfuse plaintext and dfuse tls files are mutually exclusive"))
+	}
+	if (c.DfuseTLSClientCertFile == "") != (c.DfuseTLSClientKeyFile == "") {
+		check(fmt.Errorf("dfuse tls client certificate and key files must be set together"))
+	}
+	if c.GRPCProxyURL != "" {
+		_, err := parseProxyURL(c.GRPCProxyURL)
+		check(err)
+	}
+
+	if c.ChainAPIEndpoint != "" && c.ExpectedChainID == "" {
+		check(fmt.Errorf("chain api endpoint requires an expected chain id"))
+	}
+
+	switch c.FirehoseVersion {
+	case "", "v1", "v2":
+	default:
+		check(fmt.Errorf("invalid firehose version %q, must be one of: v1, v2", c.FirehoseVersion))
+	}
+
+	switch c.BlockDetailLevel {
+	case "", "full":
+	case "light":
+		if c.FirehoseVersion == "v2" {
+			check(fmt.Errorf("block detail level light requires the firehose v1 API"))
+		}
+		if c.IncludeRamOps || c.IncludeConsole {
+			check(fmt.Errorf("block detail level light drops the ram ops and the console, they cannot be included"))
+		}
+	default:
+		check(fmt.Errorf("invalid block detail level %q, must be one of: full, light", c.BlockDetailLevel))
+	}
+
+	switch c.SinkType {
+	case "", "kafka":
+	case "file":
+		if c.DryRun {
+			check(fmt.Errorf("dry run and file sink are mutually exclusive"))
+		}
+		if c.FileSinkDir == "" {
+			check(fmt.Errorf("file sink requires a directory"))
+		}
+		switch c.FileSinkFormat {
+		case "json", "csv":
+		default:
+			check(fmt.Errorf("invalid file sink format %q, must be one of: json, csv", c.FileSinkFormat))
+		}
+		if c.FileSinkMaxBytes < 0 {
+			check(fmt.Errorf("file sink max bytes must be positive"))
+		}
+	case "http":
+		if c.HTTPSinkURL == "" {
+			check(fmt.Errorf("http sink requires a url"))
+		}
+		if c.HTTPSinkMaxRetries < 0 {
+			check(fmt.Errorf("http sink max retries must be positive"))
+		}
+		if c.HTTPSinkConcurrency < 1 {
+			check(fmt.Errorf("http sink concurrency must be at least 1"))
+		}
+	default:
+		check(fmt.Errorf("invalid sink type %q, must be one of: kafka, file, http", c.SinkType))
+	}
+
+	if kafkaSink {
+		if c.KafkaEndpoints == "" {
+			check(fmt.Errorf("kafka endpoints are required"))
+		}
+		if c.KafkaTopic == "" {
+			check(fmt.Errorf("kafka topic is required"))
+		}
+	}
+	if !c.BatchMode && !c.localSink() && c.KafkaCursorTopic == "" {
+		check(fmt.Errorf("kafka cursor topic is required outside of batch mode"))
+	}
+	if c.KafkaCursorPartition < 0 {
+		check(fmt.Errorf("kafka cursor partition must be positive, got %d", c.KafkaCursorPartition))
+	}
+	if c.KafkaSSLAuth && !c.KafkaSSLEnable && c.KafkaCloud == "" {
+		check(fmt.Errorf("kafka ssl auth requires kafka ssl enable"))
+	}
+	switch c.KafkaCloud {
+	case "":
+	case "confluent":
+		if c.KafkaAPIKey == "" || c.KafkaAPISecret == "" {
+			check(fmt.Errorf("kafka cloud %q requires an api key and an api secret", c.KafkaCloud))
+		}
+	default:
+		check(fmt.Errorf("invalid kafka cloud %q, must be one of: confluent", c.KafkaCloud))
+	}
+
+	if c.StartTime != "" {
+		if c.StartBlockNum != 0 {
+			check(fmt.Errorf("start time and start block num are mutually exclusive"))
+		}
+		if _, err := time.Parse(time.RFC3339, c.StartTime); err != nil {
+			check(fmt.Errorf("invalid start time: %w", err))
+		}
+	}
+	if c.StopTime != "" {
+		if c.StopBlockNum != 0 {
+			check(fmt.Errorf("stop time and stop block num are mutually exclusive"))
+		}
+		if _, err := time.Parse(time.RFC3339, c.StopTime); err != nil {
+			check(fmt.Errorf("invalid stop time: %w", err))
+		}
+	}
+	if c.DryRunWithKafkaCursor && (!c.DryRun || c.BatchMode || c.localSink()) {
+		check(fmt.Errorf("dry run with kafka cursor requires a dry run of the kafka sink outside of batch mode"))
+	}
+	if c.RewindBlocks != 0 && c.RewindToBlock != 0 {
+		check(fmt.Errorf("rewind blocks and rewind to block are mutually exclusive"))
+	}
+	if (c.RewindBlocks != 0 || c.RewindToBlock != 0) && c.BatchMode {
+		check(fmt.Errorf("rewind requires a cursor, it cannot be used in batch mode"))
+	}
+	if c.LeaseTTL < 0 || c.TakeoverGracePeriod < 0 {
+		check(fmt.Errorf("lease ttl and takeover grace period must be positive"))
+	}
+	if c.LeaseTTL > 0 && (c.BatchMode || c.DryRun || c.localSink()) {
+		check(fmt.Errorf("lease ttl requires the kafka cursor, it cannot be used in batch mode, dry run nor with a local sink"))
+	}
+	if c.LeaseTTL == 0 && (c.TakeoverGracePeriod != 0 || c.InstanceID != "") {
+		check(fmt.Errorf("takeover grace period and instance id require a lease ttl"))
+	}
+	if c.StartupTimeout < 0 {
+		check(fmt.Errorf("startup timeout must be positive"))
+	}
+	if c.StartupTimeout > 0 && c.LeaseTTL > 0 && c.TakeoverGracePeriod >= c.StartupTimeout {
+		check(fmt.Errorf("startup timeout must exceed the takeover grace period, waited within the startup"))
+	}
+	if c.ExprREPL && (c.ExprREPLBlockFile == "") == (c.ExprREPLBlockNum == 0) {
+		check(fmt.Errorf("expr repl requires either a block file or a block num"))
+	}
+	if !c.ExprREPL && (c.ExprREPLBlockFile != "" || c.ExprREPLBlockNum != 0 || c.ExprREPLEnv != "") {
+		check(fmt.Errorf("expr repl block file, block num and env require expr repl"))
+	}
+	if c.ExprREPLEnv != "" && !exprREPLEnvs[c.ExprREPLEnv] {
+		check(fmt.Errorf("invalid expr repl env %q, one of: default, action, table", c.ExprREPLEnv))
+	}
+	if c.StopAtHead && (c.BatchMode || c.StopTime != "") {
+		check(fmt.Errorf("stop at head resumes from the cursor, it cannot be used in batch mode nor with a stop time"))
+	}
+	if c.EmitCompletionEvent {
+		if !c.BatchMode && !c.StopAtHead && c.StopBlockNum == 0 && c.StopTime == "" {
+			check(fmt.Errorf("emit completion event requires batch mode, stop at head, a stop block num or a stop time"))
+		}
+		if c.JobID == "" {
+			check(fmt.Errorf("emit completion event requires a job id"))
+		}
+	}
+	if c.StopBlockNum != 0 && c.StartBlockNum > 0 && uint64(c.StartBlockNum) > c.StopBlockNum {
+		check(fmt.Errorf("start block num %d is after stop block num %d", c.StartBlockNum, c.StopBlockNum))
+	}
+	if c.KafkaStatsIntervalMs < 0 {
+		check(fmt.Errorf("kafka stats interval must be positive, got %d", c.KafkaStatsIntervalMs))
+	}
+	if c.DedupFromTargetTopic {
+		if !kafkaSink {
+			check(fmt.Errorf("dedup from target topic requires the kafka sink"))
+		}
+		if c.DedupFalsePositiveRate <= 0 || c.DedupFalsePositiveRate >= 1 {
+			check(fmt.Errorf("dedup false positive rate must be between 0 and 1, got %g", c.DedupFalsePositiveRate))
+		}
+	}
+	if c.MaxActionDataBytes < 0 {
+		check(fmt.Errorf("max action data bytes must be positive, got %d", c.MaxActionDataBytes))
+	}
+	if c.ConsoleMaxBytes < 0 {
+		check(fmt.Errorf("console max bytes must be positive, got %d", c.ConsoleMaxBytes))
+	}
+	if c.HeartbeatInterval < 0 {
+		check(fmt.Errorf("heartbeat interval must be positive, got %s", c.HeartbeatInterval))
+	}
+	if c.MaxHeaderBytes < 0 {
+		check(fmt.Errorf("max header bytes must be positive, got %d", c.MaxHeaderBytes))
+	}
+	if c.ValueJSONSchemaFile != "" || len(c.ValueJSONSchemas) != 0 {
+		if _, err := loadValueSchemas(c.ValueJSONSchemaFile, c.ValueJSONSchemas); err != nil {
+			check(fmt.Errorf("invalid value JSON schema: %w", err))
+		}
+	}
+	if c.AdaptWorkers < 0 || c.StageBuffer < 0 || c.BlockProcessTimeout < 0 || c.MessageStreamBuffer < 0 {
+		check(fmt.Errorf("adapt workers, stage buffer, block process timeout and message stream buffer must be positive"))
+	}
+	if c.MaxUncommittedMessages < 0 || c.MaxUncommittedBytes < 0 {
+		check(fmt.Errorf("max uncommitted messages and bytes must be positive"))
+	}
+	if (c.MaxUncommittedMessages != 0 || c.MaxUncommittedBytes != 0) && (c.DryRun || c.localSink()) {
+		check(fmt.Errorf("max uncommitted messages and bytes require the kafka sink"))
+	}
+	if c.FilterEfficiencyLogInterval < 0 {
+		check(fmt.Errorf("filter efficiency log interval must be positive, got %s", c.FilterEfficiencyLogInterval))
+	}
+	if c.MaxStreamIdle < 0 {
+		check(fmt.Errorf("max stream idle must be positive"))
+	}
+	if c.CaptureRetentionBlocks < 0 || c.CaptureRetentionBytes < 0 {
+		check(fmt.Errorf("capture retention must be positive"))
+	}
+	if c.CursorSaveTimeout < 0 {
+		check(fmt.Errorf("cursor save timeout must be positive, got %s", c.CursorSaveTimeout))
+	}
+	if c.MaxProducerRecoveries < 0 {
+		check(fmt.Errorf("max producer recoveries must be positive, got %d", c.MaxProducerRecoveries))
+	}
+	check(c.Retry.validate())
+	if c.MaxProduceBytesPerSecond < 0 {
+		check(fmt.Errorf("max produce bytes per second must be positive, got %d", c.MaxProduceBytesPerSecond))
+	}
+	for topic, rate := range c.MaxProduceBytesPerSecondPerTopic {
+		if rate <= 0 {
+			check(fmt.Errorf("max produce bytes per second of topic %s must be positive, got %d", topic, rate))
+		}
+	}
+	if len(c.DedupeEventTypes) != 0 && c.DedupeWindow == 0 && c.DedupeWindowBlocks == 0 {
+		check(fmt.Errorf("dedupe event types require a dedupe window"))
+	}
+	if (c.DedupeWindow > 0 || c.DedupeWindowBlocks > 0) && !c.SplitDBOps && len(c.DedupeEventTypes) == 0 {
+		check(fmt.Errorf("the dedupe window only suppresses the db op messages by default, it requires split db ops or dedupe event types"))
+	}
+	if c.CommitMinDelay < 0 || c.CommitMinDelayLive < 0 || c.CommitMinDelayCatchup < 0 || c.NearHeadThreshold < 0 || c.DedupeWindow < 0 {
+		check(fmt.Errorf("delays must be positive"))
+	}
+
+	if c.SystemActionsMode {
+		if c.Account == "" {
+			check(fmt.Errorf("system actions mode requires an account"))
+		}
+		check(validateSystemActions(c.SystemActions))
+	}
+	check(validatePrimaryKeyRenderings(c.PrimaryKeyRenderings))
+	if _, err := parseProjectedFields(c.ProjectedFields); err != nil {
+		check(err)
+	}
+	if _, err := parseMemoFields(c.MemoFields); err != nil {
+		check(err)
+	}
+	if _, err := newSampler(c.SamplingRules); err != nil {
+		check(err)
+	}
+	if _, err := newStaticHeaders(c.StaticHeaders); err != nil {
+		check(err)
+	}
+	if _, err := newRedactor(c.RedactFields, c.RedactTables, c.RedactHMACKey, c.RedactEncryptionKey); err != nil {
+		check(err)
+	}
+	check(validateValueCompression(c.ValueCompression))
+	check(validateLIBAnnounceMode(c.LIBAnnounceMode))
+	check(validatePayloadVersion(c.PayloadVersion))
+	if c.VerifyAfterBatch && (!c.BatchMode || !kafkaSink || c.DryRun) {
+		check(fmt.Errorf("verify after batch requires the batch mode and the kafka sink, without dry run"))
+	}
+	if c.KafkaTopicV2 != "" {
+		if len(c.Pipelines) != 0 {
+			check(fmt.Errorf("kafka topic v2 is not supported with pipelines"))
+		}
+		if c.PayloadVersion == payloadV2 {
+			check(fmt.Errorf("kafka topic v2 requires the v1 payload version on kafka topic"))
+		}
+		if c.KafkaTopicV2 == c.KafkaTopic {
+			check(fmt.Errorf("kafka topic v2 must differ from kafka topic"))
+		}
+	}
+	check(validateErrorPolicy(c.OnError))
+	if c.OtelExporterEndpoint != "" && (c.OtelSampleRate < 0 || c.OtelSampleRate > 1) {
+		check(fmt.Errorf("otel sample rate must be between 0 and 1, got %f", c.OtelSampleRate))
+	}
+	switch c.EventGranularity {
+	case "", "action", "transaction":
+	default:
+		check(fmt.Errorf("invalid event granularity %q, must be one of: action, transaction", c.EventGranularity))
+	}
+
+	check(validateFilterExpr(c.IncludeFilterExpr))
+	if _, err := exprToCelProgram(c.EventTypeExpr); err != nil {
+		check(fmt.Errorf("cannot parse event-type-expr: %w", err))
+	}
+	if _, err := exprToCelProgram(c.EventKeysExpr); err != nil {
+		check(fmt.Errorf("cannot parse event-keys-expr: %w", err))
+	}
+	for k, v := range c.EventExtensions {
+		if _, err := extensionName(k); err != nil {
+			check(err)
+		}
+		if _, err := exprToCelProgram(v); err != nil {
+			check(fmt.Errorf("cannot parse event-extension %s: %w", k, err))
+		}
+	}
+	if c.EventSubjectExpr != "" {
+		if _, err := exprToCelProgram(c.EventSubjectExpr); err != nil {
+			check(fmt.Errorf("cannot parse event-subject-expr: %w", err))
+		}
+	}
+	if c.SplitDBOps {
+		if c.BlockDetailLevel == "light" {
+			check(fmt.Errorf("split db ops requires the full block detail level, the light blocks have no db ops"))
+		}
+		if _, err := newDBOpSplit(c.DBOpsTopic, c.DBOpKeyExpr, c.Namespace); err != nil {
+			check(err)
+		}
+	} else if c.DBOpsTopic != "" || c.DBOpKeyExpr != "" {
+		check(fmt.Errorf("db ops topic and db op key expr require split db ops"))
+	}
+	if c.PartitionByExpr != "" {
+		if _, err := exprToCelProgram(c.PartitionByExpr); err != nil {
+			check(fmt.Errorf("cannot parse partition-by-expr: %w", err))
+		}
+	}
+
+	if isMatchAllFilter(c.includeFilterExpr()) && !c.AllowUnfilteredStream {
+		check(fmt.Errorf("the include filter expr matches every transaction of the chain, which can produce millions of messages: set an include filter expr, or allow the unfiltered stream explicitly"))
+	}
+
+	if len(c.EventKeySets) != 0 || len(c.EventKeySetTopics) != 0 {
+		if len(c.Pipelines) != 0 || c.KafkaTopicV2 != "" || len(c.TopicRouting) != 0 || c.SystemActionsMode {
+			check(fmt.Errorf("event key sets are not supported with pipelines, kafka topic v2, topic routing nor system actions mode"))
+		}
+		if _, err := newKeySets(c.EventKeySets, c.EventKeySetTopics, c.KafkaTopic, c.Namespace); err != nil {
+			check(err)
+		}
+	}
+
+	if len(c.TopicRouting) != 0 {
+		if len(c.Pipelines) != 0 || c.KafkaTopicV2 != "" {
+			check(fmt.Errorf("topic routing is not supported with pipelines nor kafka topic v2"))
+		}
+		if _, err := newTopicRouter(c.TopicRouting, c.Namespace); err != nil {
+			check(err)
+		}
+	}
+
+	if len(c.Pipelines) != 0 {
+		if c.SystemActionsMode {
+			check(fmt.Errorf("system actions mode is not supported with pipelines"))
+		}
+		if c.ExpressionsFile != "" {
+			check(fmt.Errorf("expressions file reload is not supported with pipelines"))
+		}
+		names := make(map[string]bool)
+		for _, p := range c.Pipelines {
+			if names[p.Name] {
+				check(fmt.Errorf("duplicated pipeline name %q", p.Name))
+			}
+			names[p.Name] = true
+			errs = append(errs, p.validate()...)
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// stopTime returns the parsed stop time, zero if not set
+func (c *Config) stopTime() time.Time {
+	t, _ := time.Parse(time.RFC3339, c.StopTime)
+	return t
+}
+
+// localSink tells if the events are sent outside of kafka, the cursor is then saved in the state file
+func (c *Config) localSink() bool {
+	return c.SinkType == "file" || c.SinkType == "http"
+}
+
+// writesReport tells if the batch report is written once the stop block is reached
+func (c *Config) writesReport() bool {
+	return c.BatchMode || c.StopAtHead
+}
+
+// adaptWorkers returns the number of blocks adapted concurrently, at least one
+func (c *Config) adaptWorkers() int {
+	if c.AdaptWorkers < 1 {
+		return 1
+	}
+	return c.AdaptWorkers
+}
+
+// blockDetails returns the detail level of the requested blocks
+func (c *Config) blockDetails() pbbstream.BlockDetails {
+	if c.BlockDetailLevel == "light" {
+		return pbbstream.BlockDetails_BLOCK_DETAILS_LIGHT
+	}
+	return pbbstream.BlockDetails_BLOCK_DETAILS_FULL
+}
+
+// includeFilterExpr returns the filter sent to the firehose: the filter of the pipelines, or
+// the include filter expr, extended with the system actions in system actions mode
+func (c *Config) includeFilterExpr() string {
+	expr := c.IncludeFilterExpr
+	if len(c.Pipelines) != 0 {
+		expr = pipelinesFilter(c.Pipelines)
+	}
+	if c.SystemActionsMode {
+		expr = withSystemActionsFilter(expr, c.Account, c.SystemActions)
+	}
+	return expr
+}
+
+// validateFilterExpr compiles the firehose include filter the way the firehose does
+func validateFilterExpr(expr string) error {
+	stripped := strings.TrimSpace(expr)
+	if stripped == "" || stripped == "true" || stripped == "*" {
+		return nil
+	}
+	env, err := cel.NewEnv(filtering.ActionTraceDeclarations)
+	if err != nil {
+		return fmt.Errorf("creating new CEL environment: %w", err)
+	}
+	if parsed, issues := env.ParseSource(celSource(expr)); issues == nil || issues.Err() == nil {
+		if calls := memoFunctionCalls(parsed.Expr()); len(calls) != 0 {
+			return fmt.Errorf("include filter expr cannot call %s: the filter is evaluated by the firehose server, the memo functions are only available to the expressions evaluated by dkafka", strings.Join(calls, ", "))
+		}
+	}
+	exprAst, issues := env.CompileSource(celSource(expr))
+	if issues != nil && issues.Err() != nil {
+		return fmt.Errorf("cannot parse include filter expr: %w", issues.Err())
+	}
+	if exprAst.ResultType() != decls.Bool {
+		return fmt.Errorf("include filter expr must resolve to a bool")
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package dkafka
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// LoadConfigFile returns a copy of base with the values of the YAML (or JSON) config file, the
+// fields absent from the file keep their base value. The keys are the snake_case field names,
+// ex: kafka_topic, event_extensions, pipelines.
+func LoadConfigFile(filename string, base *Config) (*Config, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var doc interface{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, fmt.Errorf("decoding config file %s: %w", filename, err)
+	}
+	if doc == nil {
+		conf := *base
+		return &conf, nil
+	}
+	if errs := checkConfigNode(doc, reflect.TypeOf(Config{}), ""); len(errs) != 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+		return nil, fmt.Errorf("config file %s: %w", filename, ValidationErrors(errs))
+	}
+
+	var fileConf Config
+	if err := yaml.UnmarshalStrict(content, &fileConf); err != nil {
+		return nil, fmt.Errorf("decoding config file %s: %w", filename, err)
+	}
+
+	conf := *base
+	mergeConfigNode(reflect.ValueOf(&conf).Elem(), reflect.ValueOf(fileConf), doc.(map[interface{}]interface{}))
+	return &conf, nil
+}
+
+// mergeConfigNode sets the fields of dst present in the YAML node from src, the nested objects
+// (ex: retry) are merged field by field
+func mergeConfigNode(dst reflect.Value, src reflect.Value, node map[interface{}]interface{}) {
+	for key, v := range node {
+		i, ok := yamlFieldIndex(dst.Type(), fmt.Sprint(key))
+		if !ok {
+			continue
+		}
+		if m, ok := v.(map[interface{}]interface{}); ok && dst.Field(i).Kind() == reflect.Struct {
+			mergeConfigNode(dst.Field(i), src.Field(i), m)
+			continue
+		}
+		dst.Field(i).Set(src.Field(i))
+	}
+}
+
+// checkConfigNode checks the decoded YAML node against the type, the errors hold the path of
+// the invalid nodes (ex: "pipelines[1].kafka_topic")
+func checkConfigNode(node interface{}, t reflect.Type, path string) (errs []error) {
+	invalid := func(expected string) []error {
+		return []error{fmt.Errorf("%s: expected %s, got %v", displayPath(path), expected, node)}
+	}
+	if node == nil {
+		return nil
+	}
+
+	if t == durationType {
+		if s, ok := node.(string); ok {
+			if _, err := time.ParseDuration(s); err == nil {
+				return nil
+			}
+		}
+		return invalid("a duration (ex: 10s)")
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return checkConfigNode(node, t.Elem(), path)
+	case reflect.Struct:
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return invalid("an object")
+		}
+		for k, v := range m {
+			key := fmt.Sprint(k)
+			i, ok := yamlFieldIndex(t, key)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown field", displayPath(path+"."+key)))
+				continue
+			}
+			errs = append(errs, checkConfigNode(v, t.Field(i).Type, path+"."+key)...)
+		}
+	case reflect.Map:
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return invalid("an object")
+		}
+		for k, v := range m {
+			errs = append(errs, checkConfigNode(v, t.Elem(), fmt.Sprintf("%s.%v", path, k))...)
+		}
+	case reflect.Slice:
+		l, ok := node.([]interface{})
+		if !ok {
+			return invalid("a list")
+		}
+		for i, v := range l {
+			errs = append(errs, checkConfigNode(v, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.String:
+		if _, ok := node.(string); !ok {
+			return invalid("a string")
+		}
+	case reflect.Bool:
+		if _, ok := node.(bool); !ok {
+			return invalid("a boolean")
+		}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		switch node.(type) {
+		case int, int64:
+		default:
+			return invalid("an integer")
+		}
+	case reflect.Uint64:
+		switch n := node.(type) {
+		case uint64:
+		case int:
+			if n < 0 {
+				return invalid("a positive integer")
+			}
+		default:
+			return invalid("a positive integer")
+		}
+	case reflect.Float64:
+		switch node.(type) {
+		case int, float64:
+		default:
+			return invalid("a number")
+		}
+	}
+	return errs
+}
+
+func yamlFieldIndex(t reflect.Type, key string) (int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0] == key {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func displayPath(path string) string {
+	return strings.TrimPrefix(path, ".")
+}
@@ -0,0 +1,229 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// validTestConfig is the smallest configuration streaming to kafka
+func validTestConfig() *Config {
+	return &Config{
+		DfuseGRPCEndpoint: "localhost:9000",
+		KafkaEndpoints:    "localhost:9092",
+		KafkaTopic:        "transfers",
+		KafkaCursorTopic:  "_dkafka_cursor",
+		IncludeFilterExpr: `receiver == "eosio.token" && action == "transfer"`,
+		EventTypeExpr:     `"TokenTransfer"`,
+		EventKeysExpr:     `[data.from, data.to]`,
+	}
+}
+
+func TestConfigValidateValid(t *testing.T) {
+	require.NoError(t, validTestConfig().Validate())
+
+	dryRun := validTestConfig()
+	dryRun.DryRun, dryRun.KafkaEndpoints, dryRun.KafkaTopic = true, "", ""
+	assert.NoError(t, dryRun.Validate())
+
+	batch := validTestConfig()
+	batch.BatchMode, batch.KafkaCursorTopic = true, ""
+	assert.NoError(t, batch.Validate())
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(c *Config)
+		err    string
+	}{
+		{"dfuse endpoint", func(c *Config) { c.DfuseGRPCEndpoint = "" }, "dfuse grpc endpoint is required"},
+		{"plaintext with tls files", func(c *Config) { c.DfusePlaintext, c.DfuseTLSCAFile = true, "ca.pem" }, "dfuse plaintext and dfuse tls files are mutually exclusive"},
+		{"tls client cert without key", func(c *Config) { c.DfuseTLSClientCertFile = "cert.pem" }, "dfuse tls client certificate and key files must be set together"},
+		{"grpc proxy url", func(c *Config) { c.GRPCProxyURL = "ftp://proxy:21" }, `invalid grpc proxy url scheme "ftp"`},
+		{"chain api without chain id", func(c *Config) { c.ChainAPIEndpoint = "http://localhost:8888" }, "chain api endpoint requires an expected chain id"},
+		{"firehose version", func(c *Config) { c.FirehoseVersion = "v3" }, `invalid firehose version "v3"`},
+		{"light blocks on firehose v2", func(c *Config) { c.BlockDetailLevel, c.FirehoseVersion = "light", "v2" }, "block detail level light requires the firehose v1 API"},
+		{"light blocks with ram ops", func(c *Config) { c.BlockDetailLevel, c.IncludeRamOps = "light", true }, "block detail level light drops the ram ops and the console"},
+		{"block detail level", func(c *Config) { c.BlockDetailLevel = "medium" }, `invalid block detail level "medium"`},
+		{"dry run file sink", func(c *Config) { c.SinkType, c.DryRun, c.FileSinkDir, c.FileSinkFormat = "file", true, "out", "json" }, "dry run and file sink are mutually exclusive"},
+		{"file sink dir", func(c *Config) { c.SinkType, c.FileSinkFormat = "file", "json" }, "file sink requires a directory"},
+		{"file sink format", func(c *Config) { c.SinkType, c.FileSinkDir, c.FileSinkFormat = "file", "out", "xml" }, `invalid file sink format "xml"`},
+		{"file sink max bytes", func(c *Config) {
+			c.SinkType, c.FileSinkDir, c.FileSinkFormat, c.FileSinkMaxBytes = "file", "out", "json", -1
+		}, "file sink max bytes must be positive"},
+		{"http sink url", func(c *Config) { c.SinkType, c.HTTPSinkConcurrency = "http", 1 }, "http sink requires a url"},
+		{"http sink max retries", func(c *Config) {
+			c.SinkType, c.HTTPSinkURL, c.HTTPSinkConcurrency, c.HTTPSinkMaxRetries = "http", "http://sink", 1, -1
+		}, "http sink max retries must be positive"},
+		{"http sink concurrency", func(c *Config) { c.SinkType, c.HTTPSinkURL = "http", "http://sink" }, "http sink concurrency must be at least 1"},
+		{"sink type", func(c *Config) { c.SinkType = "s3" }, `invalid sink type "s3"`},
+		{"kafka endpoints", func(c *Config) { c.KafkaEndpoints = "" }, "kafka endpoints are required"},
+		{"kafka topic", func(c *Config) { c.KafkaTopic = "" }, "kafka topic is required"},
+		{"kafka cursor topic", func(c *Config) { c.KafkaCursorTopic = "" }, "kafka cursor topic is required outside of batch mode"},
+		{"kafka cursor partition", func(c *Config) { c.KafkaCursorPartition = -1 }, "kafka cursor partition must be positive"},
+		{"kafka ssl auth", func(c *Config) { c.KafkaSSLAuth = true }, "kafka ssl auth requires kafka ssl enable"},
+		{"kafka cloud credentials", func(c *Config) { c.KafkaCloud = "confluent" }, `kafka cloud "confluent" requires an api key and an api secret`},
+		{"kafka cloud", func(c *Config) { c.KafkaCloud = "aiven" }, `invalid kafka cloud "aiven"`},
+		{"start time and block", func(c *Config) { c.StartTime, c.StartBlockNum = "2021-06-01T00:00:00Z", 10 }, "start time and start block num are mutually exclusive"},
+		{"start time", func(c *Config) { c.StartTime = "yesterday" }, "invalid start time"},
+		{"stop time and block", func(c *Config) { c.StopTime, c.StopBlockNum = "2021-06-01T00:00:00Z", 10 }, "stop time and stop block num are mutually exclusive"},
+		{"stop time", func(c *Config) { c.StopTime = "tomorrow" }, "invalid stop time"},
+		{"dry run with kafka cursor", func(c *Config) { c.DryRunWithKafkaCursor = true }, "dry run with kafka cursor requires a dry run of the kafka sink outside of batch mode"},
+		{"rewind blocks and to block", func(c *Config) { c.RewindBlocks, c.RewindToBlock = 10, 100 }, "rewind blocks and rewind to block are mutually exclusive"},
+		{"rewind in batch mode", func(c *Config) { c.RewindBlocks, c.BatchMode = 10, true }, "rewind requires a cursor, it cannot be used in batch mode"},
+		{"lease ttl", func(c *Config) { c.LeaseTTL = -time.Second }, "lease ttl and takeover grace period must be positive"},
+		{"lease in batch mode", func(c *Config) { c.LeaseTTL, c.BatchMode = time.Minute, true }, "lease ttl requires the kafka cursor"},
+		{"instance id without lease", func(c *Config) { c.InstanceID = "a" }, "takeover grace period and instance id require a lease ttl"},
+		{"startup timeout", func(c *Config) { c.StartupTimeout = -time.Second }, "startup timeout must be positive"},
+		{"startup timeout below takeover grace", func(c *Config) {
+			c.LeaseTTL, c.TakeoverGracePeriod, c.StartupTimeout = time.Minute, time.Minute, 30*time.Second
+		}, "startup timeout must exceed the takeover grace period"},
+		{"expr repl block", func(c *Config) { c.ExprREPL = true }, "expr repl requires either a block file or a block num"},
+		{"expr repl options", func(c *Config) { c.ExprREPLBlockNum = 10 }, "expr repl block file, block num and env require expr repl"},
+		{"expr repl env", func(c *Config) { c.ExprREPL, c.ExprREPLBlockNum, c.ExprREPLEnv = true, 10, "db" }, `invalid expr repl env "db"`},
+		{"stop at head in batch mode", func(c *Config) { c.StopAtHead, c.BatchMode = true, true }, "stop at head resumes from the cursor"},
+		{"completion event without stop", func(c *Config) { c.EmitCompletionEvent, c.JobID = true, "job" }, "emit completion event requires batch mode, stop at head, a stop block num or a stop time"},
+		{"completion event job id", func(c *Config) { c.EmitCompletionEvent, c.BatchMode = true, true }, "emit completion event requires a job id"},
+		{"start after stop", func(c *Config) { c.StartBlockNum, c.StopBlockNum = 20, 10 }, "start block num 20 is after stop block num 10"},
+		{"kafka stats interval", func(c *Config) { c.KafkaStatsIntervalMs = -1 }, "kafka stats interval must be positive"},
+		{"dedup without kafka", func(c *Config) { c.DedupFromTargetTopic, c.DedupFalsePositiveRate, c.DryRun = true, 0.01, true }, "dedup from target topic requires the kafka sink"},
+		{"dedup false positive rate", func(c *Config) { c.DedupFromTargetTopic = true }, "dedup false positive rate must be between 0 and 1"},
+		{"max action data bytes", func(c *Config) { c.MaxActionDataBytes = -1 }, "max action data bytes must be positive"},
+		{"console max bytes", func(c *Config) { c.ConsoleMaxBytes = -1 }, "console max bytes must be positive"},
+		{"heartbeat interval", func(c *Config) { c.HeartbeatInterval = -time.Second }, "heartbeat interval must be positive"},
+		{"max header bytes", func(c *Config) { c.MaxHeaderBytes = -1 }, "max header bytes must be positive"},
+		{"value json schema", func(c *Config) { c.ValueJSONSchemas = map[string]string{"TokenTransfer": "{"} }, "invalid value JSON schema"},
+		{"adapt workers", func(c *Config) { c.AdaptWorkers = -1 }, "adapt workers, stage buffer, block process timeout and message stream buffer must be positive"},
+		{"max uncommitted messages", func(c *Config) { c.MaxUncommittedMessages = -1 }, "max uncommitted messages and bytes must be positive"},
+		{"max uncommitted without kafka", func(c *Config) { c.MaxUncommittedMessages, c.DryRun = 10, true }, "max uncommitted messages and bytes require the kafka sink"},
+		{"filter efficiency log interval", func(c *Config) { c.FilterEfficiencyLogInterval = -time.Second }, "filter efficiency log interval must be positive"},
+		{"max stream idle", func(c *Config) { c.MaxStreamIdle = -time.Second }, "max stream idle must be positive"},
+		{"capture retention", func(c *Config) { c.CaptureRetentionBlocks = -1 }, "capture retention must be positive"},
+		{"cursor save timeout", func(c *Config) { c.CursorSaveTimeout = -time.Second }, "cursor save timeout must be positive"},
+		{"max producer recoveries", func(c *Config) { c.MaxProducerRecoveries = -1 }, "max producer recoveries must be positive"},
+		{"retry intervals", func(c *Config) { c.Retry.InitialInterval = -time.Second }, "retry intervals and max elapsed time must be positive"},
+		{"retry max interval", func(c *Config) { c.Retry.InitialInterval, c.Retry.MaxInterval = time.Minute, time.Second }, "retry max interval 1s is below the initial interval 1m0s"},
+		{"max produce bytes per second", func(c *Config) { c.MaxProduceBytesPerSecond = -1 }, "max produce bytes per second must be positive"},
+		{"max produce bytes per second of a topic", func(c *Config) { c.MaxProduceBytesPerSecondPerTopic = map[string]int64{"transfers": 0} }, "max produce bytes per second of topic transfers must be positive"},
+		{"dedupe event types without window", func(c *Config) { c.DedupeEventTypes = []string{"TokenTransfer"} }, "dedupe event types require a dedupe window"},
+		{"dedupe window without db ops", func(c *Config) { c.DedupeWindowBlocks = 10 }, "the dedupe window only suppresses the db op messages by default"},
+		{"delays", func(c *Config) { c.CommitMinDelay = -time.Second }, "delays must be positive"},
+		{"system actions account", func(c *Config) { c.SystemActionsMode = true }, "system actions mode requires an account"},
+		{"system actions", func(c *Config) { c.SystemActionsMode, c.Account, c.SystemActions = true, "alice", []string{"unknown"} }, `unsupported system action "unknown"`},
+		{"primary key renderings", func(c *Config) { c.PrimaryKeyRenderings = map[string]string{"*": "hex"} }, `invalid primary key rendering "hex"`},
+		{"projected fields", func(c *Config) { c.ProjectedFields = map[string][]string{"transfer": {"quantity"}} }, `invalid projected field "quantity"`},
+		{"memo fields", func(c *Config) { c.MemoFields = map[string][]string{"transfer": {"memo:"}} }, `invalid memo field "memo:"`},
+		{"sampling rules", func(c *Config) { c.SamplingRules = []SamplingRule{{Action: "transfer", Rate: 2}} }, "sampling rule 0: rate must be between 0 and 1"},
+		{"static headers", func(c *Config) { c.StaticHeaders = map[string]string{"x-team": "env:"} }, "resolving static header x-team"},
+		{"redact fields", func(c *Config) { c.RedactFields = map[string][]string{"transfer": {"memo:shred"}} }, `invalid redaction mode "shred"`},
+		{"value compression", func(c *Config) { c.ValueCompression = "lz4" }, `invalid value compression "lz4"`},
+		{"lib announce mode", func(c *Config) { c.LIBAnnounceMode = "always" }, `invalid lib announce mode "always"`},
+		{"payload version", func(c *Config) { c.PayloadVersion = "v3" }, `invalid payload version "v3"`},
+		{"verify after batch", func(c *Config) { c.VerifyAfterBatch = true }, "verify after batch requires the batch mode and the kafka sink"},
+		{"kafka topic v2 with v2 payload", func(c *Config) { c.KafkaTopicV2, c.PayloadVersion = "transfers-v2", payloadV2 }, "kafka topic v2 requires the v1 payload version on kafka topic"},
+		{"kafka topic v2", func(c *Config) { c.KafkaTopicV2 = "transfers" }, "kafka topic v2 must differ from kafka topic"},
+		{"kafka topic v2 with pipelines", func(c *Config) {
+			c.KafkaTopicV2 = "transfers-v2"
+			c.Pipelines = []PipelineConfig{{Name: "p", KafkaTopic: "t", IncludeFilterExpr: `action == "transfer"`, EventTypeExpr: `"T"`, EventKeysExpr: `[account]`}}
+		}, "kafka topic v2 is not supported with pipelines"},
+		{"error policy", func(c *Config) { c.OnError = map[string]string{"decode": "skip"} }, `invalid error policy failure class "decode"`},
+		{"otel sample rate", func(c *Config) { c.OtelExporterEndpoint, c.OtelSampleRate = "localhost:4317", 2 }, "otel sample rate must be between 0 and 1"},
+		{"event granularity", func(c *Config) { c.EventGranularity = "block" }, `invalid event granularity "block"`},
+		{"include filter expr", func(c *Config) { c.IncludeFilterExpr = "action ==" }, "cannot parse include filter expr"},
+		{"include filter expr type", func(c *Config) { c.IncludeFilterExpr = `action` }, "include filter expr must resolve to a bool"},
+		{"event type expr", func(c *Config) { c.EventTypeExpr = "(" }, "cannot parse event-type-expr"},
+		{"event keys expr", func(c *Config) { c.EventKeysExpr = "[" }, "cannot parse event-keys-expr"},
+		{"event extension name", func(c *Config) { c.EventExtensions = map[string]string{"Bad-Name": `"x"`} }, `invalid event-extension name "Bad-Name"`},
+		{"event extension expr", func(c *Config) { c.EventExtensions = map[string]string{"region": "("} }, "cannot parse event-extension region"},
+		{"event subject expr", func(c *Config) { c.EventSubjectExpr = "(" }, "cannot parse event-subject-expr"},
+		{"split db ops on light blocks", func(c *Config) { c.SplitDBOps, c.BlockDetailLevel = true, "light" }, "split db ops requires the full block detail level"},
+		{"db op key expr", func(c *Config) { c.SplitDBOps, c.DBOpKeyExpr = true, "(" }, "cannot parse db-op-key-expr"},
+		{"db ops topic without split", func(c *Config) { c.DBOpsTopic = "dbops" }, "db ops topic and db op key expr require split db ops"},
+		{"partition by expr", func(c *Config) { c.PartitionByExpr = "(" }, "cannot parse partition-by-expr"},
+		{"unfiltered stream", func(c *Config) { c.IncludeFilterExpr = "" }, "the include filter expr matches every transaction of the chain"},
+		{"event key sets with topic routing", func(c *Config) {
+			c.EventKeySets = map[string]string{"from": "[data.from]"}
+			c.TopicRouting = []TopicRoute{{TypePattern: "*", Topic: "all"}}
+		}, "event key sets are not supported with pipelines, kafka topic v2, topic routing nor system actions mode"},
+		{"event key sets", func(c *Config) { c.EventKeySets = map[string]string{"from": "("} }, "cannot parse event key set from"},
+		{"topic routing with kafka topic v2", func(c *Config) {
+			c.KafkaTopicV2 = "transfers-v2"
+			c.TopicRouting = []TopicRoute{{TypePattern: "*", Topic: "all"}}
+		}, "topic routing is not supported with pipelines nor kafka topic v2"},
+		{"topic routing", func(c *Config) { c.TopicRouting = []TopicRoute{{TypePattern: "re:(", Topic: "all"}} }, "topic route 0: invalid regex"},
+		{"pipelines in system actions mode", func(c *Config) {
+			c.SystemActionsMode, c.Account = true, "alice"
+			c.Pipelines = []PipelineConfig{{Name: "p", KafkaTopic: "t", IncludeFilterExpr: `action == "transfer"`, EventTypeExpr: `"T"`, EventKeysExpr: `[account]`}}
+		}, "system actions mode is not supported with pipelines"},
+		{"pipelines with expressions file", func(c *Config) {
+			c.ExpressionsFile = "expressions.yaml"
+			c.Pipelines = []PipelineConfig{{Name: "p", KafkaTopic: "t", IncludeFilterExpr: `action == "transfer"`, EventTypeExpr: `"T"`, EventKeysExpr: `[account]`}}
+		}, "expressions file reload is not supported with pipelines"},
+		{"duplicated pipeline", func(c *Config) {
+			p := PipelineConfig{Name: "p", KafkaTopic: "t", IncludeFilterExpr: `action == "transfer"`, EventTypeExpr: `"T"`, EventKeysExpr: `[account]`}
+			c.Pipelines = []PipelineConfig{p, p}
+		}, `duplicated pipeline name "p"`},
+		{"pipeline name", func(c *Config) {
+			c.Pipelines = []PipelineConfig{{KafkaTopic: "t", IncludeFilterExpr: `action == "transfer"`, EventTypeExpr: `"T"`, EventKeysExpr: `[account]`}}
+		}, "pipeline name is required"},
+		{"pipeline kafka topic", func(c *Config) {
+			c.Pipelines = []PipelineConfig{{Name: "p", IncludeFilterExpr: `action == "transfer"`, EventTypeExpr: `"T"`, EventKeysExpr: `[account]`}}
+		}, "pipeline p: kafka topic is required"},
+		{"pipeline include filter", func(c *Config) {
+			c.Pipelines = []PipelineConfig{{Name: "p", KafkaTopic: "t", IncludeFilterExpr: `split(data.memo, ",")[0] == "a"`, EventTypeExpr: `"T"`, EventKeysExpr: `[account]`}}
+		}, "pipeline p: include filter expr cannot call split"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := validTestConfig()
+			test.mutate(c)
+			err := c.Validate()
+			require.Error(t, err)
+
+			var errs ValidationErrors
+			require.True(t, errors.As(err, &errs))
+			var msgs []string
+			for _, e := range errs {
+				msgs = append(msgs, e.Error())
+			}
+			assert.True(t, containsMessage(msgs, test.err), "no error containing %q in: %s", test.err, strings.Join(msgs, "; "))
+		})
+	}
+}
+
+func TestConfigValidateReportsAllViolations(t *testing.T) {
+	c := validTestConfig()
+	c.DfuseGRPCEndpoint, c.KafkaTopic, c.MaxHeaderBytes = "", "", -1
+
+	err := c.Validate()
+	var errs ValidationErrors
+	require.True(t, errors.As(err, &errs))
+	assert.Len(t, errs, 3)
+	assert.True(t, strings.HasPrefix(err.Error(), "invalid configuration: "))
+}
+
+func TestConfigLogRedactsTheStaticHeaderLiterals(t *testing.T) {
+	c := validTestConfig()
+	c.StaticHeaders = SecretValues{"x-api-key": "s3cr3t", "x-token": "env:TOKEN", "x-cert": "file:/etc/cert"}
+	c.KafkaAPISecret, c.RedactHMACKey = "kafka-s3cr3t", "hmac-s3cr3t"
+
+	logged, err := json.Marshal(c)
+	require.NoError(t, err)
+	assert.NotContains(t, string(logged), "s3cr3t")
+	assert.Contains(t, string(logged), `"StaticHeaders":{"x-api-key":"[redacted]","x-cert":"file:/etc/cert","x-token":"env:TOKEN"}`)
+}
+
+func containsMessage(msgs []string, substr string) bool {
+	for _, msg := range msgs {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
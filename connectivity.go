@@ -0,0 +1,51 @@
+package dkafka
+
+import (
+	"fmt"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+// checkKafkaConnectivity issues a metadata request against the cluster and turns a failure
+// into an actionable error, using the error events emitted by the client while connecting
+func checkKafkaConnectivity(conf kafka.ConfigMap) error {
+	producer, err := kafka.NewProducer(&conf)
+	if err != nil {
+		return fmt.Errorf("creating kafka client: %w", err)
+	}
+	defer producer.Close()
+
+	md, err := producer.GetMetadata(nil, false, 10000)
+	if err == nil {
+		zlog.Info("kafka connectivity check succeeded", zap.Int("brokers", len(md.Brokers)))
+		return nil
+	}
+
+	cause := lastClientError(producer.Events(), err)
+	return fmt.Errorf("kafka connectivity check failed: %s: %w", connectivityHint(cause), cause)
+}
+
+func connectivityHint(err error) string {
+	kerr, ok := err.(kafka.Error)
+	if !ok {
+		return "unexpected error"
+	}
+	switch kerr.Code() {
+	case kafka.ErrAuthentication, kafka.ErrSaslAuthenticationFailed:
+		return "authentication failed, check the api key and secret"
+	case kafka.ErrResolve:
+		return "cannot resolve the broker hostnames, check the endpoints (DNS)"
+	case kafka.ErrSsl:
+		return "TLS handshake failed, check the CA file and the endpoints"
+	case kafka.ErrClusterAuthorizationFailed, kafka.ErrTopicAuthorizationFailed:
+		return "authorization failed, check the ACLs of the service account"
+	case kafka.ErrGroupAuthorizationFailed:
+		return "consumer group authorization failed, check the group ACLs of the service account"
+	case kafka.ErrUnknownTopicOrPart, kafka.ErrUnknownTopic:
+		return "the topic does not exist, create it or check its name and namespace"
+	case kafka.ErrTransport, kafka.ErrAllBrokersDown, kafka.ErrTimedOut:
+		return "cannot reach the brokers, check the endpoints and the network"
+	}
+	return "unexpected kafka error"
+}
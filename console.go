@@ -0,0 +1,44 @@
+package dkafka
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+)
+
+const consoleTruncatedMarker = "...[truncated]"
+
+// actionConsole returns the console output of the action, with the invalid UTF-8 sequences
+// replaced. It is redacted when the action exceeded the chain limits, its output is then partial.
+func actionConsole(act *pbcodec.ActionTrace) string {
+	if exceededLimits(act) {
+		return ""
+	}
+	return strings.ToValidUTF8(act.Console, "\uFFFD")
+}
+
+// exceededLimits tells if the action failed on a resource limit (cpu, net, ram, deadline)
+func exceededLimits(act *pbcodec.ActionTrace) bool {
+	if act.Exception == nil {
+		return false
+	}
+	name := act.Exception.Name
+	return strings.Contains(name, "exceeded") || strings.Contains(name, "deadline")
+}
+
+// truncateConsole cuts the console on a rune boundary so it fits in maxBytes with the marker,
+// it is not truncated if maxBytes is zero
+func truncateConsole(console string, maxBytes int) string {
+	if maxBytes <= 0 || len(console) <= maxBytes {
+		return console
+	}
+	cut := maxBytes - len(consoleTruncatedMarker)
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(console[cut]) {
+		cut--
+	}
+	return console[:cut] + consoleTruncatedMarker
+}
@@ -0,0 +1,188 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/interpreter"
+)
+
+const dbOpEventType = "DBOp"
+
+// dbOpDeclarations are the names resolved by the db op key expression in addition to the ones of
+// the event expressions
+var dbOpDeclarations = cel.Declarations(
+	decls.NewIdent("db_op_code", decls.String, nil),        // contract account of the table
+	decls.NewIdent("db_op_scope", decls.String, nil),       // scope of the row
+	decls.NewIdent("db_op_table", decls.String, nil),       // table name
+	decls.NewIdent("db_op_primary_key", decls.String, nil), // primary key of the row, as delivered by the firehose
+	decls.NewIdent("db_op_operation", decls.String, nil),   // INSERT, UPDATE or REMOVE
+	decls.NewIdent("db_op_index", decls.Uint, nil),         // index of the db op in the action
+)
+
+// DBOpEvent is the payload of the db op messages when the db ops are split from the action events
+type DBOpEvent struct {
+	BlockNum       uint32 `json:"block_num"`
+	BlockID        string `json:"block_id"`
+	Status         string `json:"status"`
+	Executed       bool   `json:"executed"`
+	Step           string `json:"block_step"`
+	TransactionID  string `json:"trx_id"`
+	Account        string `json:"account"`
+	Action         string `json:"action"`
+	GlobalSequence uint64 `json:"global_seq"`
+	Index          int    `json:"index"` // of the db op in the action
+	DBOp           *DBOp  `json:"db_op"`
+}
+
+// dbOpSplit produces the db ops of the actions as their own messages, referencing the ce_id of the
+// action event in their ce_parentid header
+type dbOpSplit struct {
+	topic   string      // namespaced, topic of the action event if empty
+	keyProg cel.Program // "{code}:{scope}:{table}:{primary_key}" if nil
+}
+
+func newDBOpSplit(topic string, keyExpr string, namespace string) (*dbOpSplit, error) {
+	s := &dbOpSplit{}
+	if topic != "" {
+		s.topic = namespaced(namespace, topic)
+	}
+	if keyExpr != "" {
+		prog, err := exprToCelProgram(keyExpr, dbOpDeclarations)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse db-op-key-expr: %w", err)
+		}
+		s.keyProg = prog
+	}
+	return s, nil
+}
+
+// dbOpActivation resolves the db op names over the names of its action
+type dbOpActivation struct {
+	interpreter.Activation
+	op    *DBOp
+	index int
+}
+
+func (a *dbOpActivation) ResolveName(name string) (interface{}, bool) {
+	switch name {
+	case "db_op_code":
+		return a.op.Code, true
+	case "db_op_scope":
+		return a.op.Scope, true
+	case "db_op_table":
+		return a.op.TableName, true
+	case "db_op_primary_key":
+		return a.op.PrimaryKey, true
+	case "db_op_operation":
+		return a.op.Operation.String(), true
+	case "db_op_index":
+		return uint64(a.index), true
+	}
+	return a.Activation.ResolveName(name)
+}
+
+// dbOpKey returns the key of the db op message
+func (s *dbOpSplit) dbOpKey(activation interpreter.Activation, op *DBOp, index int) (string, error) {
+	if s.keyProg == nil {
+		return fmt.Sprintf("%s:%s:%s:%s", op.Code, op.Scope, op.TableName, op.PrimaryKey), nil
+	}
+	key, err := evalString(s.keyProg, &dbOpActivation{Activation: activation, op: op, index: index})
+	if err != nil {
+		return "", classify(failureEventKey, fmt.Errorf("db op key eval: %w", err))
+	}
+	return key, nil
+}
+
+// dbOpParent is the first message of an action event, referenced by its db op messages
+type dbOpParent struct {
+	id     string
+	undoOf []byte
+	topic  string
+}
+
+func newDBOpParent(msg *kafka.Message, undoOf []byte) *dbOpParent {
+	return &dbOpParent{id: headerValue(msg.Headers, "ce_id"), undoOf: undoOf, topic: *msg.TopicPartition.Topic}
+}
+
+// emitDBOps emits a message per db op of the action; the db op ce_id derive from the parent ones
+// (and the action position in a transaction event) so the Undo messages reference the New ones
+func (a *adapter) emitDBOps(activation interpreter.Activation, blk *pbcodec.Block, trx *pbcodec.TransactionTrace, step string, info ActionInfo, position string, parent *dbOpParent, emit func(*kafka.Message) error) error {
+	for i, op := range info.DBOps {
+		key, err := a.dbOps.dbOpKey(activation, op, i)
+		if err != nil {
+			if a.errorPolicy.skip(err) {
+				continue
+			}
+			return err
+		}
+		payload, _ := json.Marshal(DBOpEvent{
+			BlockNum:       blk.Number,
+			BlockID:        blk.Id,
+			Status:         trxStatus(trx),
+			Executed:       !trx.HasBeenReverted(),
+			Step:           step,
+			TransactionID:  trx.Id,
+			Account:        info.Account,
+			Action:         info.Action,
+			GlobalSequence: info.GlobalSequence,
+			Index:          i,
+			DBOp:           op,
+		})
+		value, err := compressValue(a.compression, canonicalJSON(payload))
+		if err != nil {
+			return err
+		}
+		ceID := hashString(parent.id + position + strconv.Itoa(i))
+		var undoOf []byte
+		if parent.undoOf != nil {
+			undoOf = hashString(string(parent.undoOf) + position + strconv.Itoa(i))
+		}
+		msg, err := a.message(blk, step, ceID, undoOf, dbOpEventType, nil, []byte(key), value)
+		if err != nil {
+			if a.errorPolicy.skip(err) {
+				continue
+			}
+			return err
+		}
+		msg.Headers = append(msg.Headers, kafka.Header{Key: "ce_parentid", Value: []byte(parent.id)})
+		topic := a.dbOps.topic
+		if topic == "" {
+			topic = parent.topic
+		}
+		msg.TopicPartition.Topic = &topic
+		if err := emit(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withoutDBOps removes the db ops of the action event payload, v1 or v2, action or transaction
+func withoutDBOps(payload []byte) []byte {
+	var doc map[string]interface{}
+	if err := decodeJSON(payload, &doc); err != nil {
+		return payload
+	}
+	delete(doc, "db_ops")
+	if info, ok := doc["act_info"].(map[string]interface{}); ok {
+		delete(info, "db_ops")
+	}
+	if infos, ok := doc["act_infos"].([]interface{}); ok {
+		for _, info := range infos {
+			if info, ok := info.(map[string]interface{}); ok {
+				delete(info, "db_ops")
+			}
+		}
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return payload
+	}
+	return out
+}
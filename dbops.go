@@ -0,0 +1,124 @@
+package dkafka
+
+import (
+	"fmt"
+	"strconv"
+
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+)
+
+// DBOp is a database operation as found in the event payload. The raw primary key,
+// as delivered by the firehose, is always kept; Key holds its rendering when one is
+// configured for the table.
+type DBOp struct {
+	*pbcodec.DBOp
+	Key string `json:"key,omitempty"`
+}
+
+var primaryKeyRenderings = map[string]bool{
+	"auto":    true,
+	"decimal": true,
+	"name":    true,
+	"symbol":  true,
+}
+
+func validatePrimaryKeyRenderings(renderings map[string]string) error {
+	for table, rendering := range renderings {
+		if !primaryKeyRenderings[rendering] {
+			return fmt.Errorf("invalid primary key rendering %q for table %q, must be one of: auto, decimal, name, symbol", rendering, table)
+		}
+	}
+	return nil
+}
+
+// newDBOps wraps the db ops, rendering their primary key according to the renderings
+// configured per table name ("*" applying to every other table)
+func newDBOps(ops []*pbcodec.DBOp, renderings map[string]string) ([]*DBOp, error) {
+	out := make([]*DBOp, 0, len(ops))
+	for _, op := range ops {
+		rendering, found := renderings[op.TableName]
+		if !found {
+			rendering = renderings["*"]
+		}
+		key, err := renderPrimaryKey(op.PrimaryKey, rendering)
+		if err != nil {
+			return nil, fmt.Errorf("rendering primary key of table %s: %w", op.TableName, err)
+		}
+		out = append(out, &DBOp{DBOp: op, Key: key})
+	}
+	return out, nil
+}
+
+// renderPrimaryKey renders a name-encoded primary key, "auto" (or no rendering) leaves it
+// as delivered by the firehose
+func renderPrimaryKey(primaryKey string, rendering string) (string, error) {
+	switch rendering {
+	case "", "auto":
+		return "", nil
+	case "name":
+		return primaryKey, nil
+	}
+
+	value, err := nameToUint64(primaryKey)
+	if err != nil {
+		return "", err
+	}
+	switch rendering {
+	case "decimal":
+		return strconv.FormatUint(value, 10), nil
+	case "symbol":
+		return symbolCodeToString(value)
+	}
+	return "", fmt.Errorf("unknown primary key rendering %q", rendering)
+}
+
+// nameToUint64 decodes an EOSIO name into its uint64 value
+func nameToUint64(name string) (uint64, error) {
+	if len(name) > 13 {
+		return 0, fmt.Errorf("invalid name %q: more than 13 characters", name)
+	}
+	var value uint64
+	for i := 0; i <= 12; i++ {
+		var c uint64
+		if i < len(name) {
+			symbol, err := nameCharToSymbol(name[i])
+			if err != nil {
+				return 0, fmt.Errorf("invalid name %q: %w", name, err)
+			}
+			c = uint64(symbol)
+		}
+		if i < 12 {
+			c &= 0x1f
+			c <<= uint(64 - 5*(i+1))
+		} else {
+			c &= 0x0f
+		}
+		value |= c
+	}
+	return value, nil
+}
+
+func nameCharToSymbol(c byte) (byte, error) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return c - 'a' + 6, nil
+	case c >= '1' && c <= '5':
+		return c - '1' + 1, nil
+	case c == '.':
+		return 0, nil
+	}
+	return 0, fmt.Errorf("invalid character %q", c)
+}
+
+// symbolCodeToString decodes a symbol code (ex: the primary key of the token accounts table)
+func symbolCodeToString(value uint64) (string, error) {
+	var out []byte
+	for ; value != 0; value >>= 8 {
+		c := byte(value & 0xff)
+		if c < 'A' || c > 'Z' {
+			return "", fmt.Errorf("invalid symbol code character %q", c)
+		}
+		out = append(out, c)
+	}
+	return string(out), nil
+}
@@ -2,11 +2,15 @@ package dkafka
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/dfuse-io/bstream/forkable"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 type Debugger struct {
@@ -19,87 +23,213 @@ func NewDebugger(config *Config) *Debugger {
 	}
 }
 
-func (d *Debugger) ReadCursor() error {
-	conf := createKafkaConfig(d.config)
+// CursorInfo is a saved cursor with its decoded block references
+type CursorInfo struct {
+	Version      int    `json:"v"` // of the cursor envelope, 0 if saved before it was versioned
+	Cursor       string `json:"cursor"`
+	Step         string `json:"step"`
+	BlockNum     uint64 `json:"block_num"`
+	BlockID      string `json:"block_id"`
+	HeadBlockNum uint64 `json:"head_block_num"`
+	LIBNum       uint64 `json:"lib_num"`
+	ChainID      string `json:"chain_id,omitempty"`
+	Signature    string `json:"signature,omitempty"` // topic and account of the instance owning a kafka cursor
+}
+
+func newCursorInfo(saved *cs) (*CursorInfo, error) {
+	c, err := forkable.CursorFromOpaque(saved.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("decoding cursor: %w", err)
+	}
+	return &CursorInfo{
+		Version:      saved.Version,
+		Cursor:       saved.Cursor,
+		Step:         c.Step.String(),
+		BlockNum:     c.Block.Num(),
+		BlockID:      c.Block.ID(),
+		HeadBlockNum: c.HeadBlock.Num(),
+		LIBNum:       c.LIB.Num(),
+		ChainID:      saved.ChainID,
+		Signature:    saved.Signature,
+	}, nil
+}
+
+// savedCursor is implemented by the checkpointers recording the last loaded cursor
+type savedCursor interface {
+	saved() *cs
+}
+
+func (c *kafkaCheckpointer) saved() *cs     { return c.loaded }
+func (c *localFileCheckpointer) saved() *cs { return c.loaded }
 
+// checkpointer returns the checkpointer of the configuration, the state file with a local sink or
+// the cursor topic, and its close function
+func (d *Debugger) checkpointer() (checkpointer, func(), error) {
+	if d.config.localSink() {
+		cp := newLocalFileCheckpointer(d.config.StateFile, &ordinal{})
+		cp.chainID = d.config.ExpectedChainID
+		cp.compatibilityMode = d.config.CursorCompatibilityMode
+		return cp, func() {}, nil
+	}
+
+	conf := createKafkaConfig(d.config)
 	producer, err := getKafkaProducer(conf, "")
 	if err != nil {
-		return fmt.Errorf("getting kafka producer: %w", err)
+		return nil, nil, fmt.Errorf("getting kafka producer: %w", err)
 	}
+	cp := newKafkaCheckpointer(conf, d.config.cursorTopic(), d.config.KafkaCursorPartition, d.config.KafkaCursorPartitionAuto, d.config.topic(), d.config.Account, d.config.KafkaCursorConsumerGroupID, producer, &ordinal{})
+	cp.chainID = d.config.ExpectedChainID
+	cp.compatibilityMode = d.config.CursorCompatibilityMode
+	cp.noAdmin = d.config.NoAdminOperations
+	return cp, producer.Close, nil
+}
 
-	cp := newKafkaCheckpointer(conf, d.config.KafkaCursorTopic, d.config.KafkaCursorPartition, d.config.KafkaTopic, d.config.KafkaCursorConsumerGroupID, producer)
+// ExportCursor returns the saved cursor, nil if there is none
+func (d *Debugger) ExportCursor() (*CursorInfo, error) {
+	cp, closeCp, err := d.checkpointer()
+	if err != nil {
+		return nil, err
+	}
+	defer closeCp()
+
+	if _, err := cp.Load(context.Background()); err != nil {
+		if err == NoCursorErr {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return newCursorInfo(cp.(savedCursor).saved())
+}
 
-	cursor, err := cp.Load()
+func (d *Debugger) ReadCursor() error {
+	info, err := d.ExportCursor()
 	if err != nil {
 		return err
 	}
-	fmt.Println("cursor is", cursor)
-	if cursor != "" {
-		c, err := forkable.CursorFromOpaque(cursor)
-		if err != nil {
-			return err
-		}
-		zlog.Info("running in live mode, found cursor",
-			zap.String("cursor", cursor),
-			zap.Stringer("plain_cursor", c),
-			zap.Stringer("cursor_block", c.Block),
-			zap.Stringer("cursor_head_block", c.HeadBlock),
-			zap.Stringer("cursor_LIB", c.LIB),
-		)
-		fmt.Printf("%+v\n", c)
+	if info == nil {
+		fmt.Println("no cursor found")
+		return nil
 	}
+	out, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
 	return nil
 }
 
-func (d *Debugger) WriteCursor(cursor string) error {
+// ImportCursor saves the cursor (opaque or plain) in the checkpointer. Unless forced, the saved
+// cursor must belong to the same chain and, in the cursor topic, to the same topic and account.
+func (d *Debugger) ImportCursor(cursor string, force bool) error {
 	if cursor == "" {
 		return d.DeleteCursor()
 	}
-
-	conf := createKafkaConfig(d.config)
-
-	producer, err := getKafkaProducer(conf, "")
-	if err != nil {
-		return fmt.Errorf("getting kafka producer: %w", err)
-	}
-
 	if c, err := forkable.CursorFromString(cursor); err == nil {
 		cursor = c.ToOpaque() // we always write opaque version
 	}
-	if _, err = forkable.CursorFromOpaque(cursor); err != nil {
+	if _, err := forkable.CursorFromOpaque(cursor); err != nil {
 		return fmt.Errorf("invalid cursor: %s", cursor)
 	}
 
-	cp := newKafkaCheckpointer(conf, d.config.KafkaCursorTopic, d.config.KafkaCursorPartition, d.config.KafkaTopic, d.config.KafkaCursorConsumerGroupID, producer)
-
-	err = cp.Save(cursor)
+	cp, closeCp, err := d.checkpointer()
 	if err != nil {
 		return err
 	}
+	defer closeCp()
+
+	if err := d.checkOverwrite(cp, force); err != nil {
+		return err
+	}
+	if err := cp.Save(context.Background(), cursor); err != nil {
+		return err
+	}
 	fmt.Println("successfully set cursor to", cursor)
-	producer.Close()
 	return nil
 }
 
-func (d *Debugger) DeleteCursor() error {
-	conf := createKafkaConfig(d.config)
+func (d *Debugger) WriteCursor(cursor string) error {
+	return d.ImportCursor(cursor, false)
+}
 
-	producer, err := getKafkaProducer(conf, "")
+func (d *Debugger) DeleteCursor() error {
+	cp, closeCp, err := d.checkpointer()
 	if err != nil {
-		return fmt.Errorf("getting kafka producer: %w", err)
+		return err
 	}
+	defer closeCp()
 
-	cp := newKafkaCheckpointer(conf, d.config.KafkaCursorTopic, d.config.KafkaCursorPartition, d.config.KafkaTopic, d.config.KafkaCursorConsumerGroupID, producer)
-
-	err = cp.Save("")
-	if err != nil {
+	if _, err := cp.Load(context.Background()); err != nil && err != NoCursorErr { // keeps the saved ordinal
+		return err
+	}
+	if err := cp.Save(context.Background(), ""); err != nil {
 		return err
 	}
 	fmt.Println("successfully set empty cursor")
-	producer.Close()
 	return nil
 }
 
+// checkOverwrite loads the saved cursor, keeping its ordinal, and refuses to overwrite the cursor
+// of another chain or instance unless forced
+func (d *Debugger) checkOverwrite(cp checkpointer, force bool) error {
+	_, err := cp.Load(context.Background())
+	if err == NoCursorErr {
+		return nil
+	}
+	if err != nil {
+		if force {
+			zlog.Warn("overwriting the saved cursor", zap.Error(err))
+			return nil
+		}
+		return fmt.Errorf("%w -- force to overwrite it", err)
+	}
+	saved := cp.(savedCursor).saved()
+	signature := cursorSignature(d.config.topic(), d.config.Account)
+	if saved.Signature != "" && saved.Signature != signature && !force {
+		return fmt.Errorf("saved cursor belongs to %q, not to %q -- force to overwrite it", saved.Signature, signature)
+	}
+	return nil
+}
+
+// CursorAtBlock returns the cursor of the block once irreversible, resuming from it streams
+// the next block
+func (d *Debugger) CursorAtBlock(blockNum uint64) (string, error) {
+	addr, dialOptions, err := dfuseDialOptions(d.config)
+	if err != nil {
+		return "", err
+	}
+	conn, err := grpc.Dial(addr, dialOptions...)
+	if err != nil {
+		return "", fmt.Errorf("connecting to grpc address %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return irreversibleCursorAt(ctx, conn, d.config.FirehoseVersion, d.config.includeFilterExpr(), blockNum)
+}
+
+// irreversibleCursorAt returns the cursor of an irreversible block, resuming from it streams the
+// next block
+func irreversibleCursorAt(ctx context.Context, conn *grpc.ClientConn, version string, filterExpr string, blockNum uint64) (string, error) {
+	stream, err := openBlockStream(ctx, conn, version, &pbbstream.BlocksRequestV2{
+		IncludeFilterExpr: filterExpr,
+		StartBlockNum:     int64(blockNum),
+		StopBlockNum:      blockNum,
+		ForkSteps:         []pbbstream.ForkStep{pbbstream.ForkStep_STEP_IRREVERSIBLE},
+	})
+	if err != nil {
+		return "", fmt.Errorf("requesting block %d: %w", blockNum, err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return "", fmt.Errorf("receiving block %d: %w", blockNum, err)
+	}
+	if resp.block.Num() != blockNum {
+		return "", fmt.Errorf("firehose returned block %d instead of %d", resp.block.Num(), blockNum)
+	}
+	return resp.cursor, nil
+}
+
 func (d *Debugger) Write(key, val string) error {
 	conf := createKafkaConfig(d.config)
 	producer, err := getKafkaProducer(conf, d.config.KafkaTransactionID)
@@ -112,14 +242,15 @@ func (d *Debugger) Write(key, val string) error {
 		return err
 	}
 
+	topic := d.config.topic()
 	msg := kafka.Message{
 		Key:   []byte(key),
 		Value: []byte(val),
 		TopicPartition: kafka.TopicPartition{
-			Topic: &d.config.KafkaTopic,
+			Topic: &topic,
 		},
 	}
-	fmt.Printf("sending message: %s:%s to topic %s\n", key, val, d.config.KafkaTopic)
+	fmt.Printf("sending message: %s:%s to topic %s\n", key, val, topic)
 	if err := s.Send(&msg); err != nil {
 		return fmt.Errorf("sending message: %w", err)
 	}
@@ -150,13 +281,14 @@ func (d *Debugger) Read(groupID string, numValues int, startOffset int) error {
 		}
 	}()
 
-	consumer.Subscribe(d.config.KafkaTopic, nil)
+	topic := d.config.topic()
+	consumer.Subscribe(topic, nil)
 
 	if startOffset >= 0 {
 		zlog.Debug("setting offset to..", zap.Int("start_offset", startOffset))
 		err = consumer.Assign([]kafka.TopicPartition{
 			kafka.TopicPartition{
-				Topic:  &d.config.KafkaTopic,
+				Topic:  &topic,
 				Offset: kafka.Offset(startOffset),
 			}})
 		if err != nil {
@@ -0,0 +1,186 @@
+package dkafka
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+// ceIDSet holds the ce_id of the messages already present in the target topics
+type ceIDSet interface {
+	add(id []byte)
+	contains(id []byte) bool
+}
+
+type exactCEIDSet map[string]struct{}
+
+func (s exactCEIDSet) add(id []byte) {
+	s[string(id)] = struct{}{}
+}
+
+func (s exactCEIDSet) contains(id []byte) bool {
+	_, found := s[string(id)]
+	return found
+}
+
+// bloomCEIDSet is a Bloom filter, contains can return true for an id never added with the
+// false positive rate it was sized for
+type bloomCEIDSet struct {
+	bits   []uint64
+	size   uint64
+	hashes int
+}
+
+func newBloomCEIDSet(expected int, falsePositiveRate float64) *bloomCEIDSet {
+	n := math.Max(float64(expected), 1)
+	size := uint64(math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	hashes := int(math.Max(1, math.Round(float64(size)/n*math.Ln2)))
+	return &bloomCEIDSet{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: hashes,
+	}
+}
+
+// positions returns the bits of the id, derived from two hashes (Kirsch-Mitzenmacher)
+func (s *bloomCEIDSet) positions(id []byte) []uint64 {
+	h := fnv.New128a()
+	h.Write(id)
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:])
+	out := make([]uint64, s.hashes)
+	for i := range out {
+		out[i] = (h1 + uint64(i)*h2) % s.size
+	}
+	return out
+}
+
+func (s *bloomCEIDSet) add(id []byte) {
+	for _, pos := range s.positions(id) {
+		s.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (s *bloomCEIDSet) contains(id []byte) bool {
+	for _, pos := range s.positions(id) {
+		if s.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// preloadCEIDs reads the target topics up to their current end and collects the ce_id of the
+// messages of the blocks within [startBlock, stopBlock] (stopBlock 0 is unbounded). An exact set
+// is used up to exactMaxIDs messages, a Bloom filter above.
+func preloadCEIDs(conf kafka.ConfigMap, topics []string, startBlock uint64, stopBlock uint64, falsePositiveRate float64, exactMaxIDs int) (ceIDSet, error) {
+	consumerConfig := cloneConfig(conf)
+	consumerConfig["group.id"] = "dkafka-dedup-preload"
+	consumerConfig["enable.auto.commit"] = false
+	consumerConfig["enable.partition.eof"] = true
+	consumer, err := kafka.NewConsumer(&consumerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("creating consumer: %w", err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Printf("error closing consumer: %s", err)
+		}
+	}()
+
+	var assignment []kafka.TopicPartition
+	ends := make(map[partitionKey]int64) // high watermark of the partitions not read yet
+	total := 0
+	for i := range topics {
+		topic := topics[i]
+		md, err := consumer.GetMetadata(&topic, false, 5000)
+		if err != nil {
+			return nil, fmt.Errorf("getting metadata of %s: %w", topic, err)
+		}
+		for _, p := range md.Topics[topic].Partitions {
+			low, high, err := consumer.QueryWatermarkOffsets(topic, p.ID, 5000)
+			if err != nil {
+				return nil, fmt.Errorf("getting low/high of %s/%d: %w", topic, p.ID, err)
+			}
+			if high <= low {
+				continue
+			}
+			assignment = append(assignment, kafka.TopicPartition{Topic: &topic, Partition: p.ID, Offset: kafka.Offset(low)})
+			ends[partitionKey{topic, p.ID}] = high
+			total += int(high - low)
+		}
+	}
+
+	var ids ceIDSet = make(exactCEIDSet)
+	if total > exactMaxIDs {
+		ids = newBloomCEIDSet(total, falsePositiveRate)
+	}
+	zlog.Info("preloading the ce_id of the target topics", zap.Strings("topics", topics), zap.Int("messages", total), zap.Bool("bloom_filter", total > exactMaxIDs))
+	if len(assignment) == 0 {
+		return ids, nil
+	}
+	if err := consumer.Assign(assignment); err != nil {
+		return nil, err
+	}
+
+	added := 0
+	for len(ends) != 0 {
+		ev := consumer.Poll(1000)
+		switch event := ev.(type) {
+		case kafka.Error:
+			return nil, event
+		case kafka.PartitionEOF:
+			delete(ends, partitionKey{*event.Topic, event.Partition})
+		case *kafka.Message:
+			if inBlockRange(event, startBlock, stopBlock) {
+				if id := headerValue(event.Headers, "ce_id"); id != "" {
+					ids.add([]byte(id))
+					added++
+				}
+			}
+			key := partitionKey{*event.TopicPartition.Topic, event.TopicPartition.Partition}
+			if int64(event.TopicPartition.Offset) >= ends[key]-1 {
+				delete(ends, key)
+			}
+		case nil:
+			// the last offsets can be transaction markers, never delivered
+			ends = nil
+		}
+	}
+	zlog.Info("preloaded the ce_id of the target topics", zap.Int("ids", added))
+	return ids, nil
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// inBlockRange reads the block number of the JSON values, the other values are always in range
+func inBlockRange(msg *kafka.Message, startBlock uint64, stopBlock uint64) bool {
+	blockNum, ok := messageBlockNum(msg)
+	if !ok {
+		return true
+	}
+	return blockNum >= startBlock && (stopBlock == 0 || blockNum <= stopBlock)
+}
+
+// dedupFilterSender drops the messages already present in the target topics
+type dedupFilterSender struct {
+	Sender
+	ids ceIDSet
+}
+
+func (s *dedupFilterSender) Send(msg *kafka.Message) error {
+	if !isControlMessage(msg) && s.ids.contains([]byte(headerValue(msg.Headers, "ce_id"))) {
+		DedupSkippedMessages.Inc(*msg.TopicPartition.Topic)
+		return nil
+	}
+	return s.Sender.Send(msg)
+}
@@ -0,0 +1,129 @@
+package dkafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// dedupeSender buffers the messages for a window of time or blocks and only sends
+// the last message generated for each key within that window. Only the db op messages, whose last
+// state wins, and the action events of the opted in types are suppressed, the other messages are
+// buffered with them to keep their order. Undo steps are never suppressed: the buffer is flushed
+// and they are sent right away.
+type dedupeSender struct {
+	next         Sender
+	window       time.Duration
+	windowBlocks uint64
+	eventTypes   map[string]bool // ce_type of the suppressed messages
+
+	pending     []*kafka.Message
+	pendingIdx  map[string]int
+	windowStart time.Time
+	blocks      uint64
+}
+
+func newDedupeSender(next Sender, window time.Duration, windowBlocks uint64, namespace string, eventTypes []string) *dedupeSender {
+	types := map[string]bool{namespacedEventType(namespace, dbOpEventType): true}
+	for _, eventType := range eventTypes {
+		types[namespacedEventType(namespace, eventType)] = true
+	}
+	return &dedupeSender{
+		next:         next,
+		window:       window,
+		windowBlocks: windowBlocks,
+		eventTypes:   types,
+		pendingIdx:   make(map[string]int),
+	}
+}
+
+func (s *dedupeSender) Send(msg *kafka.Message) error {
+	if isControlMessage(msg) {
+		return s.next.Send(msg)
+	}
+	if headerValue(msg.Headers, "ce_blkstep") == undoStep {
+		if err := s.flush(); err != nil {
+			return err
+		}
+		return s.next.Send(msg)
+	}
+
+	if len(s.pending) == 0 {
+		s.windowStart = time.Now()
+		s.blocks = 0
+	}
+	if !s.eventTypes[headerValue(msg.Headers, "ce_type")] {
+		s.pending = append(s.pending, msg)
+		return nil
+	}
+
+	var topic string
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	dedupeKey := topic + "\x00" + string(msg.Key)
+	if idx, found := s.pendingIdx[dedupeKey]; found {
+		endMessageSpan(s.pending[idx], nil)
+		s.pending[idx] = nil
+		SuppressedMessages.Inc(topic)
+	}
+	s.pendingIdx[dedupeKey] = len(s.pending)
+	s.pending = append(s.pending, msg)
+	return nil
+}
+
+// CommitIfAfter is called once per block: it flushes the buffer when the window is over.
+// The cursor is never committed while messages are still buffered.
+func (s *dedupeSender) CommitIfAfter(ctx context.Context, cursor string, minimumDelay time.Duration) error {
+	s.blocks++
+	if len(s.pending) != 0 {
+		if !s.windowOver() {
+			return nil
+		}
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	return s.next.CommitIfAfter(ctx, cursor, minimumDelay)
+}
+
+func (s *dedupeSender) Commit(ctx context.Context, cursor string) error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.next.Commit(ctx, cursor)
+}
+
+func (s *dedupeSender) windowOver() bool {
+	if s.windowBlocks > 0 && s.blocks >= s.windowBlocks {
+		return true
+	}
+	if s.window > 0 && time.Since(s.windowStart) >= s.window {
+		return true
+	}
+	return false
+}
+
+func (s *dedupeSender) flush() error {
+	for _, msg := range s.pending {
+		if msg == nil {
+			continue
+		}
+		if err := s.next.Send(msg); err != nil {
+			return err
+		}
+	}
+	s.pending = nil
+	s.pendingIdx = make(map[string]int)
+	return nil
+}
+
+func headerValue(headers []kafka.Header, key string) string {
+	for _, h := range headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package dkafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSender keeps the keys of the messages sent
+type recordingSender struct {
+	discardSender
+	sent []string
+}
+
+func (s *recordingSender) Send(msg *kafka.Message) error {
+	s.sent = append(s.sent, string(msg.Key))
+	return nil
+}
+
+func testDedupeMessage(ceType string, step string, key string) *kafka.Message {
+	topic := "counters"
+	return &kafka.Message{
+		Key:            []byte(key),
+		TopicPartition: kafka.TopicPartition{Topic: &topic},
+		Headers: []kafka.Header{
+			{Key: "ce_type", Value: []byte(ceType)},
+			{Key: "ce_blkstep", Value: []byte(step)},
+		},
+	}
+}
+
+func TestDedupeSenderSuppressesDBOpsOnly(t *testing.T) {
+	next := &recordingSender{}
+	s := newDedupeSender(next, 0, 10, "", nil)
+
+	require.NoError(t, s.Send(testDedupeMessage("CounterUpdated", "NEW", "action-1")))
+	require.NoError(t, s.Send(testDedupeMessage(dbOpEventType, "NEW", "row-1")))
+	require.NoError(t, s.Send(testDedupeMessage("CounterUpdated", "NEW", "action-1")))
+	require.NoError(t, s.Send(testDedupeMessage(dbOpEventType, "NEW", "row-1")))
+	require.NoError(t, s.Send(testDedupeMessage(dbOpEventType, "NEW", "row-2")))
+	assert.Empty(t, next.sent)
+
+	require.NoError(t, s.Commit(context.Background(), "cursor"))
+	assert.Equal(t, []string{"action-1", "action-1", "row-1", "row-2"}, next.sent)
+}
+
+func TestDedupeSenderSuppressesOptedInEventTypes(t *testing.T) {
+	next := &recordingSender{}
+	s := newDedupeSender(next, 0, 10, "eos", []string{"CounterUpdated"})
+
+	require.NoError(t, s.Send(testDedupeMessage("eos.CounterUpdated", "NEW", "a")))
+	require.NoError(t, s.Send(testDedupeMessage("eos.Transfer", "NEW", "a")))
+	require.NoError(t, s.Send(testDedupeMessage("eos.CounterUpdated", "NEW", "a")))
+	require.NoError(t, s.Send(testDedupeMessage("eos."+dbOpEventType, "NEW", "row")))
+	require.NoError(t, s.Send(testDedupeMessage("eos."+dbOpEventType, "NEW", "row")))
+
+	require.NoError(t, s.Commit(context.Background(), "cursor"))
+	assert.Equal(t, []string{"a", "a", "row"}, next.sent)
+}
+
+func TestDedupeSenderNeverSuppressesUndo(t *testing.T) {
+	next := &recordingSender{}
+	s := newDedupeSender(next, time.Hour, 0, "", nil)
+
+	require.NoError(t, s.Send(testDedupeMessage(dbOpEventType, "NEW", "row-1")))
+	require.NoError(t, s.Send(testDedupeMessage(dbOpEventType, undoStep, "row-1")))
+	require.NoError(t, s.Send(testDedupeMessage(dbOpEventType, undoStep, "row-1")))
+	assert.Equal(t, []string{"row-1", "row-1", "row-1"}, next.sent)
+}
+
+func TestDedupeSenderHoldsTheCursorWithinTheWindow(t *testing.T) {
+	next := &recordingSender{}
+	s := newDedupeSender(next, 0, 2, "", nil)
+
+	require.NoError(t, s.Send(testDedupeMessage(dbOpEventType, "NEW", "row-1")))
+	require.NoError(t, s.CommitIfAfter(context.Background(), "cursor-1", 0))
+	assert.Empty(t, next.sent)
+	require.NoError(t, s.Send(testDedupeMessage(dbOpEventType, "NEW", "row-1")))
+	require.NoError(t, s.CommitIfAfter(context.Background(), "cursor-2", 0))
+	assert.Equal(t, []string{"row-1"}, next.sent)
+}
+
+func TestDedupeSenderTellsControlMessagesByTheirHeader(t *testing.T) {
+	next := &recordingSender{}
+	s := newDedupeSender(next, 0, 10, "", []string{streamCompletedEventType})
+
+	// an event of the stream named as a control message
+	require.NoError(t, s.Send(testDedupeMessage(streamCompletedEventType, "NEW", "job-1")))
+	require.NoError(t, s.Send(testDedupeMessage(streamCompletedEventType, "NEW", "job-1")))
+	heartbeat := heartbeatMessage("counters", "dkafka", testTransferBlock(10, 0), "cursor")
+	require.NoError(t, s.Send(heartbeat))
+	assert.Equal(t, []string{"heartbeat"}, next.sent)
+
+	require.NoError(t, s.Commit(context.Background(), "cursor"))
+	assert.Equal(t, []string{"heartbeat", "job-1"}, next.sent)
+}
@@ -0,0 +1,77 @@
+package dkafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/oauth"
+)
+
+// dfuseDialOptions returns the address and the grpc dial options of the dfuse endpoint
+func dfuseDialOptions(conf *Config) (string, []grpc.DialOption, error) {
+	addr := conf.DfuseGRPCEndpoint
+	plaintext := conf.DfusePlaintext
+	if strings.Contains(addr, "*") {
+		zlog.Warn("the '*' plaintext marker in the dfuse address is deprecated, use the dfuse plaintext option instead", zap.String("address", addr))
+		addr = strings.Replace(addr, "*", "", -1)
+		plaintext = true
+	}
+	if err := logGRPCProxy(conf, addr); err != nil {
+		return "", nil, err
+	}
+	dialer := grpc.WithContextDialer(proxyDialer(conf))
+	if plaintext {
+		return addr, []grpc.DialOption{grpc.WithInsecure(), dialer}, nil
+	}
+
+	tlsConfig, err := dfuseTLSConfig(conf)
+	if err != nil {
+		return "", nil, err
+	}
+	dialOptions := []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), dialer}
+	if conf.DfuseToken != "" {
+		credential := oauth.NewOauthAccess(&oauth2.Token{AccessToken: conf.DfuseToken, TokenType: "Bearer"})
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(credential))
+	}
+	return addr, dialOptions, nil
+}
+
+// dfuseTLSConfig builds the TLS configuration of the dfuse endpoint. When the insecure skip
+// verify option is unset, the server certificate is only verified if a CA file is given,
+// as older versions never verified it.
+func dfuseTLSConfig(conf *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if conf.DfuseTLSInsecureSkipVerify != nil {
+		tlsConfig.InsecureSkipVerify = *conf.DfuseTLSInsecureSkipVerify
+	} else {
+		tlsConfig.InsecureSkipVerify = conf.DfuseTLSCAFile == ""
+	}
+
+	if conf.DfuseTLSCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.DfuseTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading dfuse tls ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in dfuse tls ca file %s", conf.DfuseTLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if conf.DfuseTLSClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.DfuseTLSClientCertFile, conf.DfuseTLSClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading dfuse tls client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
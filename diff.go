@@ -0,0 +1,403 @@
+package dkafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/cel-go/cel"
+	"google.golang.org/grpc"
+)
+
+// diffIgnoredHeaders differ between two runs over the same blocks
+var diffIgnoredHeaders = map[string]bool{"ce_ordinal": true}
+
+// DiffOptions selects the blocks adapted by both configurations
+type DiffOptions struct {
+	StartBlockNum int64
+	StopBlockNum  uint64
+	CaptureDir    string // if set, the captured blocks of the range are read instead of the firehose
+}
+
+// DiffMessage identifies a message of the diff report
+type DiffMessage struct {
+	BlockNum uint64 `json:"block_num"`
+	Topic    string `json:"topic"`
+	ID       string `json:"ce_id"`
+	Key      string `json:"key"`
+}
+
+// MessageDiff is a message with the same topic and ce_id in both configurations, but another
+// key, headers or value
+type MessageDiff struct {
+	DiffMessage
+	Key     []string `json:"key_diff,omitempty"`     // "a -> b"
+	Headers []string `json:"headers_diff,omitempty"` // "name: a -> b"
+	Value   []string `json:"value_diff,omitempty"`   // "json.path: a -> b"
+}
+
+// DiffReport holds the differences between the messages of two configurations
+type DiffReport struct {
+	Blocks    int           `json:"blocks"`
+	MessagesA int           `json:"messages_a"`
+	MessagesB int           `json:"messages_b"`
+	OnlyInA   []DiffMessage `json:"only_in_a"`
+	OnlyInB   []DiffMessage `json:"only_in_b"`
+	Changed   []MessageDiff `json:"changed"`
+}
+
+// Differences returns the number of messages differing between the two configurations
+func (r *DiffReport) Differences() int {
+	return len(r.OnlyInA) + len(r.OnlyInB) + len(r.Changed)
+}
+
+// WriteText writes the report for humans
+func (r *DiffReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "%d blocks, %d messages in A, %d messages in B, %d differences\n", r.Blocks, r.MessagesA, r.MessagesB, r.Differences())
+	for _, m := range r.OnlyInA {
+		fmt.Fprintf(w, "only in A: block %d topic %s ce_id %s key %s\n", m.BlockNum, m.Topic, m.ID, m.Key)
+	}
+	for _, m := range r.OnlyInB {
+		fmt.Fprintf(w, "only in B: block %d topic %s ce_id %s key %s\n", m.BlockNum, m.Topic, m.ID, m.Key)
+	}
+	for _, m := range r.Changed {
+		fmt.Fprintf(w, "changed: block %d topic %s ce_id %s\n", m.BlockNum, m.Topic, m.ID)
+		for _, d := range m.Key {
+			fmt.Fprintf(w, "  key: %s\n", d)
+		}
+		for _, d := range m.Headers {
+			fmt.Fprintf(w, "  header %s\n", d)
+		}
+		for _, d := range m.Value {
+			fmt.Fprintf(w, "  value %s\n", d)
+		}
+	}
+}
+
+// Diff adapts the same irreversible blocks with both configurations, in memory, and reports the
+// messages differing. The messages are matched by topic and ce_id.
+func Diff(ctx context.Context, a, b *Config, opts DiffOptions) (*DiffReport, error) {
+	pipelineA, err := newDiffPipeline(a)
+	if err != nil {
+		return nil, fmt.Errorf("config A: %w", err)
+	}
+	pipelineB, err := newDiffPipeline(b)
+	if err != nil {
+		return nil, fmt.Errorf("config B: %w", err)
+	}
+
+	report := &DiffReport{}
+	var msgsA, msgsB []*kafka.Message
+	err = diffBlocks(ctx, a, b, opts, func(blk *pbcodec.Block) error {
+		report.Blocks++
+		blkMsgs, err := pipelineA.adapt(ctx, blk)
+		if err != nil {
+			return fmt.Errorf("config A, block %d: %w", blk.Number, err)
+		}
+		msgsA = append(msgsA, blkMsgs...)
+		if blkMsgs, err = pipelineB.adapt(ctx, blk); err != nil {
+			return fmt.Errorf("config B, block %d: %w", blk.Number, err)
+		}
+		msgsB = append(msgsB, blkMsgs...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.MessagesA = len(msgsA)
+	report.MessagesB = len(msgsB)
+	report.compare(msgsA, msgsB)
+	return report, nil
+}
+
+// diffPipeline adapts the blocks the way a run of its configuration does
+type diffPipeline struct {
+	filterExpr string
+	filter     cel.Program // nil matches all the actions
+	redactor   *redactor   // nil if no field is redacted
+	adapters   []*adapter
+}
+
+func newDiffPipeline(config *Config) (*diffPipeline, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	p := &diffPipeline{filterExpr: config.includeFilterExpr()}
+	var err error
+	if p.filter, err = filterProgram(p.filterExpr); err != nil {
+		return nil, fmt.Errorf("compiling include filter expr: %w", err)
+	}
+	if len(config.RedactFields) != 0 || len(config.RedactTables) != 0 {
+		if p.redactor, err = newRedactor(config.RedactFields, config.RedactTables, config.RedactHMACKey, config.RedactEncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+	var systemActionGen *systemActionGenerator
+	if config.SystemActionsMode {
+		systemActionGen = newSystemActionGenerator(config.Account, config.SystemActions)
+	}
+	if p.adapters, err = New(config).adapters(systemActionGen, &ordinal{}, &libTracker{minStep: config.LIBAnnounceMinStep}); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// adapt applies the include filter of the configuration to a copy of the block, the blocks are
+// requested with the filters of both configurations
+func (p *diffPipeline) adapt(ctx context.Context, blk *pbcodec.Block) ([]*kafka.Message, error) {
+	return p.adaptStep(ctx, blk, pbbstream.ForkStep_STEP_IRREVERSIBLE.String())
+}
+
+// adaptStep is adapt for a block streamed with the step
+func (p *diffPipeline) adaptStep(ctx context.Context, blk *pbcodec.Block, rawStep string) ([]*kafka.Message, error) {
+	blk = proto.Clone(blk).(*pbcodec.Block)
+	blk.UnfilteredTransactionTraces = blk.TransactionTraces()
+	applyIncludeFilter(blk, p.filterExpr, p.filter, rawStep)
+	if p.redactor != nil {
+		p.redactor.redact(blk)
+	}
+
+	var msgs []*kafka.Message
+	for _, adapter := range p.adapters {
+		adapterMsgs, err := adapter.Adapt(ctx, blk, rawStep)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range adapterMsgs {
+			msg.Opaque = uint64(blk.Number)
+		}
+		msgs = append(msgs, adapterMsgs...)
+	}
+	return msgs, nil
+}
+
+// diffBlocks calls fn with the irreversible blocks of the range, read from the capture dir or
+// the firehose endpoint of the first configuration
+func diffBlocks(ctx context.Context, a, b *Config, opts DiffOptions, fn func(blk *pbcodec.Block) error) error {
+	if opts.CaptureDir != "" {
+		return capturedBlocks(opts.CaptureDir, opts.StartBlockNum, opts.StopBlockNum, fn)
+	}
+
+	filterExpr := ""
+	if exprA, exprB := a.includeFilterExpr(), b.includeFilterExpr(); !isMatchAllFilter(exprA) && !isMatchAllFilter(exprB) {
+		filterExpr = fmt.Sprintf("(%s) || (%s)", exprA, exprB)
+	}
+	addr, dialOptions, err := dfuseDialOptions(a)
+	if err != nil {
+		return err
+	}
+	conn, err := grpc.Dial(addr, dialOptions...)
+	if err != nil {
+		return fmt.Errorf("connecting to grpc address %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	stream, err := openBlockStream(ctx, conn, a.FirehoseVersion, &pbbstream.BlocksRequestV2{
+		IncludeFilterExpr: filterExpr,
+		StartBlockNum:     opts.StartBlockNum,
+		StopBlockNum:      opts.StopBlockNum,
+		ForkSteps:         []pbbstream.ForkStep{pbbstream.ForkStep_STEP_IRREVERSIBLE},
+	})
+	if err != nil {
+		return fmt.Errorf("requesting blocks from dfuse firehose: %w", err)
+	}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("receiving blocks: %w", err)
+		}
+		if err := fn(resp.block); err != nil {
+			return err
+		}
+		if opts.StopBlockNum != 0 && resp.block.Num() >= opts.StopBlockNum {
+			return nil
+		}
+	}
+}
+
+// capturedBlocks calls fn with the blocks of the capture dir within the range, in block order
+func capturedBlocks(dir string, startBlockNum int64, stopBlockNum uint64, fn func(blk *pbcodec.Block) error) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("listing capture dir: %w", err)
+	}
+	for _, info := range infos { // sorted by name, so by block
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, captureFileSuffix) {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.SplitN(name, "-", 2)[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if (startBlockNum > 0 && num < uint64(startBlockNum)) || (stopBlockNum != 0 && num > stopBlockNum) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if data, err = decompressValue("+zstd", data); err != nil {
+			return fmt.Errorf("reading captured block %s: %w", name, err)
+		}
+		blk := &pbcodec.Block{}
+		if err := proto.Unmarshal(data, blk); err != nil {
+			return fmt.Errorf("decoding captured block %s: %w", name, err)
+		}
+		if err := fn(blk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *DiffReport) compare(msgsA, msgsB []*kafka.Message) {
+	byID := make(map[string][]*kafka.Message, len(msgsB))
+	for _, msg := range msgsB {
+		id := diffMessageID(msg)
+		byID[id] = append(byID[id], msg)
+	}
+	for _, msgA := range msgsA {
+		id := diffMessageID(msgA)
+		candidates := byID[id]
+		if len(candidates) == 0 {
+			r.OnlyInA = append(r.OnlyInA, newDiffMessage(msgA))
+			continue
+		}
+		msgB := candidates[0]
+		byID[id] = candidates[1:]
+		if d, changed := diffMessage(msgA, msgB); changed {
+			r.Changed = append(r.Changed, d)
+		}
+	}
+	for _, msgB := range msgsB { // in order
+		id := diffMessageID(msgB)
+		for _, left := range byID[id] {
+			if left == msgB {
+				r.OnlyInB = append(r.OnlyInB, newDiffMessage(msgB))
+			}
+		}
+	}
+}
+
+func diffMessageID(msg *kafka.Message) string {
+	return *msg.TopicPartition.Topic + "/" + headerValue(msg.Headers, "ce_id")
+}
+
+func newDiffMessage(msg *kafka.Message) DiffMessage {
+	blockNum, _ := msg.Opaque.(uint64)
+	return DiffMessage{
+		BlockNum: blockNum,
+		Topic:    *msg.TopicPartition.Topic,
+		ID:       headerValue(msg.Headers, "ce_id"),
+		Key:      string(msg.Key),
+	}
+}
+
+func diffMessage(msgA, msgB *kafka.Message) (MessageDiff, bool) {
+	d := MessageDiff{DiffMessage: newDiffMessage(msgA)}
+	if !bytes.Equal(msgA.Key, msgB.Key) {
+		d.Key = append(d.Key, fmt.Sprintf("%s -> %s", msgA.Key, msgB.Key))
+	}
+
+	headersA, headersB := diffHeaders(msgA.Headers), diffHeaders(msgB.Headers)
+	var names []string
+	for name := range headersA {
+		names = append(names, name)
+	}
+	for name := range headersB {
+		if _, ok := headersA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if headersA[name] != headersB[name] {
+			d.Headers = append(d.Headers, fmt.Sprintf("%s: %q -> %q", name, headersA[name], headersB[name]))
+		}
+	}
+
+	d.Value = diffValues(msgA, msgB)
+	return d, len(d.Key) != 0 || len(d.Headers) != 0 || len(d.Value) != 0
+}
+
+func diffHeaders(headers []kafka.Header) map[string]string {
+	out := make(map[string]string, len(headers))
+	for _, h := range headers {
+		if !diffIgnoredHeaders[h.Key] {
+			out[h.Key] = string(h.Value)
+		}
+	}
+	return out
+}
+
+// diffValues compares the decompressed values as JSON, or as bytes when they are not JSON
+func diffValues(msgA, msgB *kafka.Message) []string {
+	valueA, errA := decompressValue(headerValue(msgA.Headers, "content-type"), msgA.Value)
+	valueB, errB := decompressValue(headerValue(msgB.Headers, "content-type"), msgB.Value)
+	if errA != nil || errB != nil {
+		valueA, valueB = msgA.Value, msgB.Value
+	}
+	if bytes.Equal(valueA, valueB) {
+		return nil
+	}
+	var docA, docB interface{}
+	if decodeJSON(valueA, &docA) != nil || decodeJSON(valueB, &docB) != nil {
+		return []string{fmt.Sprintf("%d bytes -> %d bytes", len(valueA), len(valueB))}
+	}
+	var diffs []string
+	diffJSON("$", docA, docB, &diffs)
+	return diffs
+}
+
+// diffJSON appends the paths whose values differ, the missing values are shown as null
+func diffJSON(path string, a, b interface{}, diffs *[]string) {
+	if objA, ok := a.(map[string]interface{}); ok {
+		if objB, ok := b.(map[string]interface{}); ok {
+			keys := make(map[string]bool, len(objA)+len(objB))
+			for k := range objA {
+				keys[k] = true
+			}
+			for k := range objB {
+				keys[k] = true
+			}
+			sorted := make([]string, 0, len(keys))
+			for k := range keys {
+				sorted = append(sorted, k)
+			}
+			sort.Strings(sorted)
+			for _, k := range sorted {
+				diffJSON(path+"."+k, objA[k], objB[k], diffs)
+			}
+			return
+		}
+	}
+	if arrA, ok := a.([]interface{}); ok {
+		if arrB, ok := b.([]interface{}); ok && len(arrA) == len(arrB) {
+			for i := range arrA {
+				diffJSON(fmt.Sprintf("%s[%d]", path, i), arrA[i], arrB[i], diffs)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		encodedA, _ := json.Marshal(a)
+		encodedB, _ := json.Marshal(b)
+		*diffs = append(*diffs, fmt.Sprintf("%s: %s -> %s", path, encodedA, encodedB))
+	}
+}
@@ -0,0 +1,81 @@
+package dkafka
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// failure classes of the error policy
+const (
+	failureEventType   = "cel_event_type"
+	failureEventKey    = "cel_event_key"
+	failureExtension   = "cel_extension"
+	failureSubject     = "cel_event_subject"
+	failureHeaderSize  = "header_size"
+	failureValueSchema = "value_schema"
+
+	failureProjectedField = "projected_field"
+	failureBlockTimeout   = "block_timeout"
+	failureExtensionValue = "extension_value"
+
+	failureIncompleteTrace = "incomplete_trace"
+	failurePartitionKey    = "cel_partition_key"
+)
+
+var failureClasses = []string{failureEventType, failureEventKey, failureExtension, failureSubject, failureHeaderSize, failureValueSchema, failureProjectedField, failureBlockTimeout, failureExtensionValue, failureIncompleteTrace, failurePartitionKey}
+
+// errorPolicy maps a failure class to its action, "fail" (default) or "skip"
+type errorPolicy map[string]string
+
+// classifiedError is an error of a failure class of the error policy
+type classifiedError struct {
+	class string
+	err   error
+}
+
+func (e *classifiedError) Error() string { return e.err.Error() }
+func (e *classifiedError) Unwrap() error { return e.err }
+
+func classify(class string, err error) error {
+	return &classifiedError{class: class, err: err}
+}
+
+// skip reports whether the message failing with err must be dropped instead of failing the
+// stream, the failures of a class are counted by action
+func (p errorPolicy) skip(err error) bool {
+	var cerr *classifiedError
+	if !errors.As(err, &cerr) {
+		return false
+	}
+	if p[cerr.class] != "skip" {
+		PolicyFailures.Inc(cerr.class, "fail")
+		return false
+	}
+	PolicyFailures.Inc(cerr.class, "skip")
+	zlog.Debug("skipping message", zap.String("failure_class", cerr.class), zap.Error(err))
+	return true
+}
+
+func validateErrorPolicy(policy map[string]string) error {
+	for class, action := range policy {
+		known := false
+		for _, c := range failureClasses {
+			known = known || c == class
+		}
+		if !known {
+			classes := append([]string(nil), failureClasses...)
+			sort.Strings(classes)
+			return fmt.Errorf("invalid error policy failure class %q, must be one of: %s", class, strings.Join(classes, ", "))
+		}
+		switch action {
+		case "fail", "skip":
+		default:
+			return fmt.Errorf("invalid error policy action %q for %s, must be one of: fail, skip", action, class)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package dkafka
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/dfuse-io/dfuse-eosio/filtering"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types/ref"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// exprREPLEnvs are the environments of the expression REPL: the firehose include filter, the event
+// expressions (evaluated per action) and the db op key expression (evaluated per db op)
+var exprREPLEnvs = map[string]bool{"default": true, "action": true, "table": true}
+
+var jsonValueType = reflect.TypeOf(&structpb.Value{})
+
+// exprREPL evaluates the expressions read line by line against the actions of a block matching
+// the include filter, printing the result per action or db op
+type exprREPL struct {
+	blk  *pbcodec.Block
+	env  string
+	step string
+	out  io.Writer
+
+	primaryKeyRenderings map[string]string
+}
+
+// runExprREPL loads the block of the configuration and evaluates the expressions of in until its
+// end, kafka is never used
+func (a *App) runExprREPL(ctx context.Context, in io.Reader, out io.Writer) error {
+	blk, err := a.exprREPLBlock(ctx)
+	if err != nil {
+		return err
+	}
+	filter, err := filterProgram(a.config.includeFilterExpr())
+	if err != nil {
+		return fmt.Errorf("cannot parse include filter: %w", err)
+	}
+	step := pbbstream.ForkStep_STEP_NEW.String()
+	blk.UnfilteredTransactionTraces = blk.TransactionTraces()
+	applyIncludeFilter(blk, a.config.includeFilterExpr(), filter, step)
+
+	repl := &exprREPL{blk: blk, env: a.config.ExprREPLEnv, step: step, out: out, primaryKeyRenderings: a.config.PrimaryKeyRenderings}
+	if repl.env == "" {
+		repl.env = "action"
+	}
+	fmt.Fprintf(out, "block %d (%s), %d matching transactions, %s environment -- ':env default|action|table' switches the environment\n", blk.Number, blk.Id, len(blk.FilteredTransactionTraces), repl.env)
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "//"):
+		case line == ":quit" || line == ":q":
+			return nil
+		case strings.HasPrefix(line, ":env"):
+			env := strings.TrimSpace(strings.TrimPrefix(line, ":env"))
+			if !exprREPLEnvs[env] {
+				fmt.Fprintf(out, "unknown environment %q, one of: default, action, table\n", env)
+				continue
+			}
+			repl.env = env
+		default:
+			repl.eval(line)
+		}
+	}
+}
+
+// exprREPLBlock reads the block file, a captured block or a JSON block, or fetches the block from
+// the firehose
+func (a *App) exprREPLBlock(ctx context.Context) (*pbcodec.Block, error) {
+	if a.config.ExprREPLBlockFile != "" {
+		return readBlockFile(a.config.ExprREPLBlockFile)
+	}
+	addr, dialOptions, err := dfuseDialOptions(a.config)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(addr, dialOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to grpc address %s: %w", addr, err)
+	}
+	defer conn.Close()
+	num := a.config.ExprREPLBlockNum
+	stream, err := openBlockStream(ctx, conn, a.config.FirehoseVersion, &pbbstream.BlocksRequestV2{
+		StartBlockNum: int64(num),
+		StopBlockNum:  num,
+		ForkSteps:     []pbbstream.ForkStep{pbbstream.ForkStep_STEP_IRREVERSIBLE},
+		Details:       a.config.blockDetails(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("requesting block %d from dfuse firehose: %w", num, err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, fmt.Errorf("receiving block %d: %w", num, err)
+	}
+	return resp.block, nil
+}
+
+// readBlockFile reads a block of the capture dir (zstd-compressed protobuf) or a JSON block
+func readBlockFile(path string) (*pbcodec.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading block file: %w", err)
+	}
+	blk := &pbcodec.Block{}
+	if strings.HasSuffix(path, captureFileSuffix) {
+		if data, err = decompressValue("+zstd", data); err != nil {
+			return nil, fmt.Errorf("reading captured block %s: %w", path, err)
+		}
+		if err := proto.Unmarshal(data, blk); err != nil {
+			return nil, fmt.Errorf("decoding captured block %s: %w", path, err)
+		}
+		return blk, nil
+	}
+	if err := (&jsonpb.Unmarshaler{AllowUnknownFields: true}).Unmarshal(strings.NewReader(string(data)), blk); err != nil {
+		return nil, fmt.Errorf("decoding JSON block %s: %w", path, err)
+	}
+	return blk, nil
+}
+
+// program compiles the expression in the environment, its errors hold the CEL position info
+func (r *exprREPL) program(expr string) (cel.Program, error) {
+	switch r.env {
+	case "default":
+		env, err := cel.NewEnv(filtering.ActionTraceDeclarations)
+		if err != nil {
+			return nil, fmt.Errorf("creating new CEL environment: %w", err)
+		}
+		exprAst, issues := env.Compile(expr)
+		if issues != nil && issues.Err() != nil {
+			return nil, issues.Err()
+		}
+		return env.Program(exprAst)
+	case "table":
+		return exprToCelProgram(expr, dbOpDeclarations)
+	}
+	return exprToCelProgram(expr)
+}
+
+// eval prints the result of the expression per matching action, or per db op of the matching
+// actions in the table environment
+func (r *exprREPL) eval(expr string) {
+	prog, err := r.program(expr)
+	if err != nil {
+		fmt.Fprintln(r.out, err)
+		return
+	}
+	results := 0
+	for _, trx := range r.blk.TransactionTraces() {
+		memoizableTrxTrace := &filtering.MemoizableTrxTrace{TrxTrace: trx}
+		for _, act := range trx.ActionTraces {
+			if !act.FilteringMatched || act.Action == nil {
+				continue
+			}
+			actionActivation := filtering.NewActionTraceActivation(act, memoizableTrxTrace, r.step)
+			prefix := fmt.Sprintf("trx %s action #%d %s::%s", trx.Id, act.ActionOrdinal, act.Action.Account, act.Action.Name)
+			switch r.env {
+			case "default":
+				r.print(prefix, prog, actionActivation)
+			case "action":
+				r.print(prefix, prog, newEventActivation(r.blk, trx, act, actionActivation))
+			case "table":
+				ops, err := newDBOps(trx.DBOpsForAction(act.ExecutionIndex), r.primaryKeyRenderings)
+				if err != nil {
+					fmt.Fprintf(r.out, "%s: %s\n", prefix, err)
+					continue
+				}
+				activation := newEventActivation(r.blk, trx, act, actionActivation)
+				for i, op := range ops {
+					dbOpPrefix := fmt.Sprintf("%s db op #%d %s/%s/%s/%s", prefix, i, op.Code, op.Scope, op.TableName, op.PrimaryKey)
+					r.print(dbOpPrefix, prog, &dbOpActivation{Activation: activation, op: op, index: i})
+					results++
+				}
+				continue
+			}
+			results++
+		}
+	}
+	if results == 0 {
+		fmt.Fprintln(r.out, "no matching action (or db op) in the block")
+	}
+}
+
+func (r *exprREPL) print(prefix string, prog cel.Program, activation interface{}) {
+	res, _, err := prog.Eval(activation)
+	if err != nil {
+		fmt.Fprintf(r.out, "%s: error: %s\n", prefix, err)
+		return
+	}
+	fmt.Fprintf(r.out, "%s => %s\n", prefix, formatCELValue(res))
+}
+
+// formatCELValue renders the value as JSON, or with its Go formatting if it has no JSON form
+func formatCELValue(val ref.Val) string {
+	if native, err := val.ConvertToNative(jsonValueType); err == nil {
+		if out, err := (&jsonpb.Marshaler{}).MarshalToString(native.(*structpb.Value)); err == nil {
+			return out
+		}
+	}
+	return fmt.Sprintf("%v", val.Value())
+}
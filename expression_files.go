@@ -0,0 +1,127 @@
+package dkafka
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/common"
+	"go.uber.org/zap"
+)
+
+// exprFiles maps the expressions read from "@{path}" files to their path, so the compilation
+// errors cite the file
+var exprFiles sync.Map
+
+// expandExprFile returns the expression of an "@{path}" reference, other expressions as is. The
+// lines starting with "//" are blanked rather than removed, so the lines and columns of the
+// compilation errors are the ones of the file
+func expandExprFile(expr string) (string, error) {
+	if !strings.HasPrefix(expr, "@") {
+		return expr, nil
+	}
+	path := strings.TrimPrefix(expr, "@")
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading expression file: %w", err)
+	}
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "//") {
+			lines[i] = ""
+		} else {
+			lines[i] = strings.TrimRight(line, " \t\r")
+		}
+	}
+	effective := strings.TrimRight(strings.Join(lines, "\n"), "\n")
+	if strings.TrimSpace(effective) == "" {
+		return "", fmt.Errorf("expression file %s holds no expression", path)
+	}
+	exprFiles.Store(effective, path)
+	zlog.Info("expression read from file", zap.String("path", path), zap.String("sha256", exprHash(effective)))
+	return effective, nil
+}
+
+// exprHash identifies the effective expression in the logs
+func exprHash(expr string) string {
+	sum := sha256.Sum256([]byte(expr))
+	return hex.EncodeToString(sum[:])
+}
+
+// celSource returns the source of the expression, described by its file if it was read from one
+func celSource(expr string) common.Source {
+	if path, found := exprFiles.Load(expr); found {
+		return common.NewStringSource(expr, path.(string))
+	}
+	return common.NewTextSource(expr)
+}
+
+// exprDescription names the expression in the errors: its file, or the expression itself
+func exprDescription(expr string) string {
+	if path, found := exprFiles.Load(expr); found {
+		return "file " + path.(string)
+	}
+	return expr
+}
+
+// expandExprFiles replaces the "@{path}" references of the expressions by their file expression
+func expandExprFiles(exprs ...*string) error {
+	for _, expr := range exprs {
+		expanded, err := expandExprFile(*expr)
+		if err != nil {
+			return err
+		}
+		*expr = expanded
+	}
+	return nil
+}
+
+func expandExprMapFiles(exprs map[string]string) error {
+	for k, v := range exprs {
+		expanded, err := expandExprFile(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		exprs[k] = expanded
+	}
+	return nil
+}
+
+func (e *Expressions) expandFiles() error {
+	if err := expandExprFiles(&e.EventTypeExpr, &e.EventKeysExpr, &e.EventSubjectExpr); err != nil {
+		return err
+	}
+	return expandExprMapFiles(e.EventExtensions)
+}
+
+// LoadExpressionFiles replaces the expressions given as "@{path}" by the content of the file,
+// whose comment lines (starting with "//") are stripped; it must be called before Validate
+func (c *Config) LoadExpressionFiles() error {
+	if err := expandExprFiles(&c.IncludeFilterExpr, &c.EventTypeExpr, &c.EventKeysExpr, &c.EventSubjectExpr, &c.PartitionByExpr, &c.DBOpKeyExpr); err != nil {
+		return err
+	}
+	if err := expandExprMapFiles(c.EventExtensions); err != nil {
+		return fmt.Errorf("event extension %w", err)
+	}
+	if err := expandExprMapFiles(c.EventKeySets); err != nil {
+		return fmt.Errorf("event key set %w", err)
+	}
+	for i := range c.SamplingRules {
+		if err := expandExprFiles(&c.SamplingRules[i].Match); err != nil {
+			return fmt.Errorf("sampling rule %s: %w", c.SamplingRules[i].Name, err)
+		}
+	}
+	for i := range c.Pipelines {
+		p := &c.Pipelines[i]
+		if err := expandExprFiles(&p.IncludeFilterExpr, &p.EventTypeExpr, &p.EventKeysExpr, &p.EventSubjectExpr); err != nil {
+			return fmt.Errorf("pipeline %s: %w", p.Name, err)
+		}
+		if err := expandExprMapFiles(p.EventExtensions); err != nil {
+			return fmt.Errorf("pipeline %s: event extension %w", p.Name, err)
+		}
+	}
+	return nil
+}
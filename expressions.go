@@ -0,0 +1,170 @@
+package dkafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dfuse-io/dfuse-eosio/filtering"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	"github.com/google/cel-go/cel"
+	"go.uber.org/zap"
+)
+
+// Expressions is the set of CEL expressions generating the events, it can be reloaded from a JSON file
+type Expressions struct {
+	EventTypeExpr    string            `json:"event_type_expr"`
+	EventKeysExpr    string            `json:"event_keys_expr"`
+	EventExtensions  map[string]string `json:"event_extensions"`
+	EventSubjectExpr string            `json:"event_subject_expr"`
+}
+
+type programs struct {
+	eventType  cel.Program
+	eventKeys  cel.Program
+	extensions []*extension
+	subject    cel.Program // nil if no subject expression is set
+}
+
+func compileExpressions(e Expressions) (*programs, error) {
+	eventTypeProg, err := exprToCelProgram(e.EventTypeExpr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse event-type-expr: %w", err)
+	}
+	eventKeyProg, err := exprToCelProgram(e.EventKeysExpr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse event-keys-expr: %w", err)
+	}
+
+	var extensions []*extension
+	for k, v := range e.EventExtensions {
+		name, err := extensionName(k)
+		if err != nil {
+			return nil, err
+		}
+		prog, err := exprToCelProgram(v)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse event-extension: %w", err)
+		}
+		extensions = append(extensions, &extension{
+			name: name,
+			expr: v,
+			prog: prog,
+		})
+	}
+	var subjectProg cel.Program
+	if e.EventSubjectExpr != "" {
+		subjectProg, err = exprToCelProgram(e.EventSubjectExpr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse event-subject-expr: %w", err)
+		}
+	}
+	return &programs{
+		eventType:  eventTypeProg,
+		eventKeys:  eventKeyProg,
+		extensions: extensions,
+		subject:    subjectProg,
+	}, nil
+}
+
+// validate evaluates the programs against a sample action, evaluation errors depend on the
+// action data so only the results of successful evaluations are checked
+func (p *programs) validate() error {
+	act := &pbcodec.ActionTrace{
+		Receiver: "eosio.token",
+		Receipt:  &pbcodec.ActionReceipt{},
+		Action: &pbcodec.Action{
+			Account:  "eosio.token",
+			Name:     "transfer",
+			JsonData: "{}",
+		},
+	}
+	trx := &pbcodec.TransactionTrace{ActionTraces: []*pbcodec.ActionTrace{act}}
+	activation := newEventActivation(&pbcodec.Block{}, trx, act, filtering.NewActionTraceActivation(act, &filtering.MemoizableTrxTrace{TrxTrace: trx}, "STEP_NEW"))
+
+	if res, _, err := p.eventType.Eval(activation); err == nil {
+		if _, err := res.ConvertToNative(stringType); err != nil {
+			return fmt.Errorf("event-type-expr must return a string: %w", err)
+		}
+	}
+	if res, _, err := p.eventKeys.Eval(activation); err == nil {
+		if _, err := res.ConvertToNative(stringArrayType); err != nil {
+			return fmt.Errorf("event-keys-expr must return an array of strings: %w", err)
+		}
+	}
+	if p.subject != nil {
+		if res, _, err := p.subject.Eval(activation); err == nil {
+			if _, err := res.ConvertToNative(stringType); err != nil {
+				return fmt.Errorf("event-subject-expr must return a string: %w", err)
+			}
+		}
+	}
+	for _, ext := range p.extensions {
+		if res, _, err := ext.prog.Eval(activation); err == nil {
+			if _, err := res.ConvertToNative(stringType); err != nil {
+				return fmt.Errorf("event-extension %s must return a string: %w", ext.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func loadExpressions(filename string) (*programs, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading expressions file: %w", err)
+	}
+	var e Expressions
+	if err := json.Unmarshal(content, &e); err != nil {
+		return nil, fmt.Errorf("decoding expressions file: %w", err)
+	}
+	if err := e.expandFiles(); err != nil {
+		return nil, err
+	}
+	p, err := compileExpressions(e)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// watchExpressions reloads the expressions file on SIGHUP, the valid programs are sent to the
+// returned channel, only the most recent one is kept until the stream picks it up
+func watchExpressions(ctx context.Context, filename string) <-chan *programs {
+	reloads := make(chan *programs, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+			}
+
+			p, err := loadExpressions(filename)
+			if err != nil {
+				ExpressionReloads.Inc("failure")
+				zlog.Error("cannot reload expressions, keeping the current ones", zap.String("filename", filename), zap.Error(err))
+				continue
+			}
+			select {
+			case <-reloads:
+			default:
+			}
+			reloads <- p
+			ExpressionReloads.Inc("success")
+			zlog.Info("expressions reloaded, applying them on the next block", zap.String("filename", filename))
+		}
+	}()
+	return reloads
+}
@@ -0,0 +1,46 @@
+package dkafka
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// reservedExtensions are the headers an extension cannot replace
+var reservedExtensions = map[string]bool{"ce_id": true, "ce_type": true, "ce_source": true, "ce_time": true}
+
+// cloudevents attribute names, the ce_ prefix of the header excluded
+var extensionNameRegex = regexp.MustCompile(`^[a-z0-9]{1,20}$`)
+
+// extensionName returns the lowercased header name of an extension, it is refused if it is not
+// a valid cloudevents attribute name or if it is reserved
+func extensionName(name string) (string, error) {
+	lower := strings.ToLower(name)
+	if !extensionNameRegex.MatchString(strings.TrimPrefix(lower, "ce_")) {
+		return "", fmt.Errorf("invalid event-extension name %q, must be [a-z0-9]{1,20}, optionally prefixed by ce_", name)
+	}
+	if reservedExtensions[lower] {
+		return "", fmt.Errorf("event-extension %q cannot replace a reserved header", name)
+	}
+	return lower, nil
+}
+
+// sanitizeExtensionValue strips the control characters (ex: tab, newline) of an extension value,
+// a value which is not valid UTF-8 is refused as coercing it would lose data
+func sanitizeExtensionValue(name string, value string) (string, error) {
+	if !utf8.ValidString(value) {
+		return "", classify(failureExtensionValue, fmt.Errorf("event-extension %s is not valid UTF-8: %q", name, value))
+	}
+	if strings.IndexFunc(value, unicode.IsControl) == -1 {
+		return value, nil
+	}
+	ExtensionValuesSanitized.Inc(name)
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value), nil
+}
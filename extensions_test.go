@@ -0,0 +1,70 @@
+package dkafka
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtensionName(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected string
+		err      string
+	}{
+		{name: "recipient", expected: "recipient"},
+		{name: "Recipient", expected: "recipient"},
+		{name: "CE_Recipient", expected: "ce_recipient"},
+		{name: "abcdefghij0123456789", expected: "abcdefghij0123456789"},
+		{name: "abcdefghij0123456789x", err: "must be [a-z0-9]{1,20}"},
+		{name: "", err: "must be [a-z0-9]{1,20}"},
+		{name: "bad-name", err: "must be [a-z0-9]{1,20}"},
+		{name: "ce_id", err: "cannot replace a reserved header"},
+		{name: "ce_type", err: "cannot replace a reserved header"},
+		{name: "ce_source", err: "cannot replace a reserved header"},
+		{name: "CE_Time", err: "cannot replace a reserved header"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			name, err := extensionName(test.name)
+			if test.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, name)
+		})
+	}
+}
+
+func TestSanitizeExtensionValue(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		value     string
+		expected  string
+		sanitized float64
+		err       bool
+	}{
+		{name: "clean", value: "bob 🎉", expected: "bob 🎉"},
+		{name: "tab", value: "bob\tsmith", expected: "bobsmith", sanitized: 1},
+		{name: "newline", value: "bob\r\nsmith\n", expected: "bobsmith", sanitized: 1},
+		{name: "invalid", value: "bob\xffsmith", err: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			extension := "test" + test.name
+			value, err := sanitizeExtensionValue(extension, test.value)
+			assert.Equal(t, test.sanitized, testutil.ToFloat64(ExtensionValuesSanitized.Native().WithLabelValues(extension)))
+			if test.err {
+				var cerr *classifiedError
+				require.True(t, errors.As(err, &cerr), "got %v", err)
+				assert.Equal(t, failureExtensionValue, cerr.class)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, value)
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package dkafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/dfuse-io/bstream/forkable"
+	"go.uber.org/zap"
+)
+
+// fileSender writes the events into local files instead of kafka, rotating them by size
+// or block range. Files are written with a ".part" suffix and renamed to
+// "{first_block}-{last_block}.{format}" once complete. The size of a part file at each commit is
+// appended to its ".commits" file, so the part file of an interrupted export is cut to its
+// committed events and renamed on restart.
+type fileSender struct {
+	dir           string
+	format        string
+	headers       []string
+	maxBytes      int64
+	blocksPerFile uint64
+	cp            checkpointer
+	lastCommit    time.Time
+
+	file    *os.File
+	writer  *bufio.Writer
+	written int64
+
+	fileFirstBlock uint64 // first block expected in the current file
+	lastBlock      uint64 // block of the last committed cursor
+}
+
+func newFileSender(dir, format string, headers []string, maxBytes int64, blocksPerFile uint64, startBlock uint64, cp checkpointer) (*fileSender, error) {
+	switch format {
+	case "json", "csv":
+	default:
+		return nil, fmt.Errorf("invalid file sink format %q, must be one of: json, csv", format)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating file sink directory: %w", err)
+	}
+	if err := finalizeParts(dir, startBlock); err != nil {
+		return nil, err
+	}
+	return &fileSender{
+		dir:            dir,
+		format:         format,
+		headers:        headers,
+		maxBytes:       maxBytes,
+		blocksPerFile:  blocksPerFile,
+		cp:             cp,
+		fileFirstBlock: startBlock,
+	}, nil
+}
+
+type fileRecord struct {
+	Key     string            `json:"key"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Value   json.RawMessage   `json:"value"`
+}
+
+func (s *fileSender) Send(msg *kafka.Message) error {
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	headers := make(map[string]string)
+	for _, h := range msg.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+
+	counter := &countingWriter{w: s.writer}
+	switch s.format {
+	case "csv":
+		row := []string{string(msg.Key)}
+		for _, h := range s.headers {
+			row = append(row, headers[h])
+		}
+		row = append(row, string(msg.Value))
+		w := csv.NewWriter(counter)
+		if err := w.Write(row); err != nil {
+			return fmt.Errorf("writing csv record: %w", err)
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("writing csv record: %w", err)
+		}
+	default:
+		record := fileRecord{
+			Key:     string(msg.Key),
+			Headers: make(map[string]string),
+			Value:   json.RawMessage(msg.Value),
+		}
+		for _, h := range s.headers {
+			if v, ok := headers[h]; ok {
+				record.Headers[h] = v
+			}
+		}
+		if !json.Valid(msg.Value) {
+			quoted, _ := json.Marshal(string(msg.Value))
+			record.Value = quoted
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("marshalling record: %w", err)
+		}
+		if _, err := counter.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("writing json record: %w", err)
+		}
+	}
+	s.written += counter.n
+	return nil
+}
+
+func (s *fileSender) CommitIfAfter(ctx context.Context, cursor string, minimumDelay time.Duration) error {
+	if time.Since(s.lastCommit) > minimumDelay {
+		return s.Commit(ctx, cursor)
+	}
+	return nil
+}
+
+// Commit flushes and syncs the current file before saving the cursor, so a resumed
+// export never starts after events that were not persisted
+func (s *fileSender) Commit(ctx context.Context, cursor string) error {
+	if err := s.sync(); err != nil {
+		return err
+	}
+	if c, err := forkable.CursorFromOpaque(cursor); err == nil {
+		s.lastBlock = c.Block.Num()
+	}
+	if err := s.recordCommit(); err != nil {
+		return err
+	}
+	if err := s.cp.Save(ctx, cursor); err != nil {
+		return fmt.Errorf("saving cursor: %w", err)
+	}
+	s.lastCommit = time.Now()
+
+	if s.file != nil && s.shouldRotate() {
+		return s.close()
+	}
+	return nil
+}
+
+// Close flushes, syncs and closes the last file
+func (s *fileSender) Close() error {
+	return s.close()
+}
+
+func (s *fileSender) shouldRotate() bool {
+	if s.maxBytes > 0 && s.written >= s.maxBytes {
+		return true
+	}
+	if s.blocksPerFile > 0 && s.lastBlock+1 >= s.fileFirstBlock+s.blocksPerFile {
+		return true
+	}
+	return false
+}
+
+func (s *fileSender) partFilename() string {
+	return filepath.Join(s.dir, fmt.Sprintf("%010d.%s.part", s.fileFirstBlock, s.extension()))
+}
+
+func (s *fileSender) extension() string {
+	if s.format == "csv" {
+		return "csv"
+	}
+	return "jsonl"
+}
+
+func (s *fileSender) open() error {
+	// created first, a part file without commits file was not written by this sink
+	commits, err := os.Create(commitsFilename(s.partFilename()))
+	if err != nil {
+		return fmt.Errorf("creating file commits: %w", err)
+	}
+	commits.Close()
+	f, err := os.Create(s.partFilename())
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	s.file = f
+	s.writer = bufio.NewWriter(f)
+	s.written = 0
+
+	if s.format == "csv" {
+		w := csv.NewWriter(s.writer)
+		if err := w.Write(append(append([]string{"key"}, s.headers...), "value")); err != nil {
+			return fmt.Errorf("writing csv header: %w", err)
+		}
+		w.Flush()
+	}
+	zlog.Info("opened file sink file", zap.String("filename", f.Name()))
+	return nil
+}
+
+func (s *fileSender) sync() error {
+	if s.file == nil {
+		return nil
+	}
+	if err := s.writer.Flush(); err != nil {
+		return fmt.Errorf("flushing file: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("syncing file: %w", err)
+	}
+	return nil
+}
+
+func (s *fileSender) close() error {
+	if s.file == nil {
+		return nil
+	}
+	if err := s.sync(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+
+	filename := filepath.Join(s.dir, fmt.Sprintf("%010d-%010d.%s", s.fileFirstBlock, s.lastBlock, s.extension()))
+	if err := os.Rename(s.file.Name(), filename); err != nil {
+		return fmt.Errorf("renaming file: %w", err)
+	}
+	if err := os.Remove(commitsFilename(s.file.Name())); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing file commits: %w", err)
+	}
+	zlog.Info("closed file sink file", zap.String("filename", filename), zap.Int64("bytes", s.written))
+
+	s.file = nil
+	s.writer = nil
+	s.fileFirstBlock = s.lastBlock + 1
+	return nil
+}
+
+// commitsFilename lists the "{block} {size}" of the commits of the part file: the events committed
+// up to the block are the first bytes of the file
+func commitsFilename(part string) string {
+	return part + ".commits"
+}
+
+// recordCommit appends the size of the synced part file at the block of the commit, before the
+// cursor is saved
+func (s *fileSender) recordCommit() error {
+	if s.file == nil {
+		return nil
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("reading file size: %w", err)
+	}
+	f, err := os.OpenFile(commitsFilename(s.file.Name()), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening file commits: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%d %d\n", s.lastBlock, info.Size()); err != nil {
+		return fmt.Errorf("writing file commits: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing file commits: %w", err)
+	}
+	return nil
+}
+
+// finalizeParts renames the part files left by an interrupted export, cut to the events committed
+// before the start block: the next ones are streamed again. The part files without commits file
+// are left with an ".orphaned" suffix, never overwritten.
+func finalizeParts(dir string, startBlock uint64) error {
+	parts, err := filepath.Glob(filepath.Join(dir, "*.part"))
+	if err != nil {
+		return fmt.Errorf("listing part files: %w", err)
+	}
+	for _, part := range parts {
+		if err := finalizePart(part, startBlock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func finalizePart(part string, startBlock uint64) error {
+	name := strings.TrimSuffix(filepath.Base(part), ".part") // "{first_block}.{extension}"
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return fmt.Errorf("invalid part file name %s", part)
+	}
+	firstBlock, err := strconv.ParseUint(name[:i], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid part file name %s: %w", part, err)
+	}
+
+	commits, err := ioutil.ReadFile(commitsFilename(part))
+	if os.IsNotExist(err) {
+		zlog.Warn("file sink part file without commits, leaving it aside", zap.String("filename", part))
+		return os.Rename(part, part+".orphaned")
+	}
+	if err != nil {
+		return fmt.Errorf("reading file commits: %w", err)
+	}
+	var lastBlock uint64
+	var size int64 = -1
+	for _, line := range strings.Split(string(commits), "\n") {
+		var block uint64
+		var committedSize int64
+		if _, err := fmt.Sscanf(line, "%d %d", &block, &committedSize); err != nil || block >= startBlock {
+			continue // a line cut by the interruption, or a commit whose cursor was not saved
+		}
+		lastBlock, size = block, committedSize
+	}
+
+	if size < 0 {
+		zlog.Info("removing file sink part file without committed events", zap.String("filename", part))
+		if err := os.Remove(part); err != nil {
+			return fmt.Errorf("removing part file: %w", err)
+		}
+	} else {
+		if err := os.Truncate(part, size); err != nil {
+			return fmt.Errorf("cutting part file to its committed events: %w", err)
+		}
+		filename := filepath.Join(filepath.Dir(part), fmt.Sprintf("%010d-%010d%s", firstBlock, lastBlock, name[i:]))
+		if err := os.Rename(part, filename); err != nil {
+			return fmt.Errorf("renaming part file: %w", err)
+		}
+		zlog.Info("finalized file sink part file of an interrupted export", zap.String("filename", filename), zap.Int64("bytes", size))
+	}
+	if err := os.Remove(commitsFilename(part)); err != nil {
+		return fmt.Errorf("removing file commits: %w", err)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
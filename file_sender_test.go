@@ -0,0 +1,120 @@
+package dkafka
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/bstream/forkable"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCursor(blockNum uint64) string {
+	ref := bstream.NewBlockRef(fmt.Sprintf("%08xaaaaaaaa", blockNum), blockNum)
+	return (&forkable.Cursor{Step: forkable.StepNew, Block: ref, HeadBlock: ref, LIB: ref}).ToOpaque()
+}
+
+func testFileMessage(key string) *kafka.Message {
+	return &kafka.Message{Key: []byte(key), Value: []byte(`{"k":"` + key + `"}`)}
+}
+
+func dirFiles(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fileLines(t *testing.T, path string) []string {
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// interruptedExport writes a committed event per block of commits, then an uncommitted one, and
+// leaves the part file open as a killed process would
+func interruptedExport(t *testing.T, dir string, startBlock uint64, commits ...uint64) {
+	s, err := newFileSender(dir, "json", nil, 0, 0, startBlock, &nilCheckpointer{})
+	require.NoError(t, err)
+	for _, block := range commits {
+		require.NoError(t, s.Send(testFileMessage(fmt.Sprintf("committed-%d", block))))
+		require.NoError(t, s.Commit(context.Background(), testCursor(block)))
+	}
+	require.NoError(t, s.Send(testFileMessage("uncommitted")))
+	require.NoError(t, s.sync())
+}
+
+func TestFileSenderFinalizesCommittedPart(t *testing.T) {
+	dir := t.TempDir()
+	interruptedExport(t, dir, 10, 10, 11)
+
+	_, err := newFileSender(dir, "json", nil, 0, 0, 12, &nilCheckpointer{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"0000000010-0000000011.jsonl"}, dirFiles(t, dir))
+	assert.Equal(t, []string{
+		`{"key":"committed-10","value":{"k":"committed-10"}}`,
+		`{"key":"committed-11","value":{"k":"committed-11"}}`,
+	}, fileLines(t, filepath.Join(dir, "0000000010-0000000011.jsonl")))
+}
+
+func TestFileSenderFinalizesPartUpToSavedCursor(t *testing.T) {
+	dir := t.TempDir()
+	interruptedExport(t, dir, 10, 10, 11)
+
+	// the cursor of block 11 was not saved, the export resumes after block 10
+	_, err := newFileSender(dir, "json", nil, 0, 0, 11, &nilCheckpointer{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"0000000010-0000000010.jsonl"}, dirFiles(t, dir))
+	assert.Equal(t, []string{`{"key":"committed-10","value":{"k":"committed-10"}}`}, fileLines(t, filepath.Join(dir, "0000000010-0000000010.jsonl")))
+}
+
+func TestFileSenderRemovesUncommittedPart(t *testing.T) {
+	dir := t.TempDir()
+	interruptedExport(t, dir, 10)
+
+	_, err := newFileSender(dir, "json", nil, 0, 0, 10, &nilCheckpointer{})
+	require.NoError(t, err)
+
+	assert.Empty(t, dirFiles(t, dir))
+}
+
+func TestFileSenderKeepsPartWithoutCommits(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "0000000010.jsonl.part"), []byte("{}\n"), 0644))
+
+	s, err := newFileSender(dir, "json", nil, 0, 0, 10, &nilCheckpointer{})
+	require.NoError(t, err)
+	require.NoError(t, s.Send(testFileMessage("a")))
+	require.NoError(t, s.Close())
+
+	assert.Equal(t, []string{"0000000010-0000000000.jsonl", "0000000010.jsonl.part.orphaned"}, dirFiles(t, dir))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "0000000010.jsonl.part.orphaned"))
+	require.NoError(t, err)
+	assert.Equal(t, "{}\n", string(content))
+}
+
+func TestFileSenderRotationRemovesCommits(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileSender(dir, "json", nil, 0, 1, 10, &nilCheckpointer{})
+	require.NoError(t, err)
+	require.NoError(t, s.Send(testFileMessage("a")))
+	require.NoError(t, s.Commit(context.Background(), testCursor(10)))
+
+	assert.Equal(t, []string{"0000000010-0000000010.jsonl"}, dirFiles(t, dir))
+	_, err = os.Stat(filepath.Join(dir, "0000000010.jsonl.part.commits"))
+	assert.True(t, os.IsNotExist(err))
+}
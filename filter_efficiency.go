@@ -0,0 +1,105 @@
+package dkafka
+
+import (
+	"sort"
+	"time"
+
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	"go.uber.org/zap"
+)
+
+// filterLabelLimit bounds the account and action pairs labeling the filter metrics, the pairs seen
+// after the first ones are counted as "other"
+const filterLabelLimit = 100
+
+// filterEfficiency counts the action traces of the transactions delivered by the firehose against
+// the ones matching its include filter, the others are skipped. A low ratio means the filter could
+// be pushed further server-side.
+type filterEfficiency struct {
+	interval time.Duration // of the summary logs, disabled if zero
+	labels   map[string]bool
+
+	since     time.Time
+	received  uint64
+	matched   uint64
+	unmatched map[string]uint64 // per label, since the last summary
+}
+
+func newFilterEfficiency(interval time.Duration) *filterEfficiency {
+	return &filterEfficiency{
+		interval:  interval,
+		labels:    make(map[string]bool),
+		since:     time.Now(),
+		unmatched: make(map[string]uint64),
+	}
+}
+
+// label returns the account and action labels of the trace
+func (f *filterEfficiency) label(act *pbcodec.ActionTrace) (string, string) {
+	account, action := act.GetAction().GetAccount(), act.GetAction().GetName()
+	key := account + ":" + action
+	if !f.labels[key] {
+		if len(f.labels) >= filterLabelLimit {
+			return "other", "other"
+		}
+		f.labels[key] = true
+	}
+	return account, action
+}
+
+// observe counts the traces of the block, logging the summary once the interval elapsed
+func (f *filterEfficiency) observe(blk *pbcodec.Block) {
+	for _, trx := range blk.TransactionTraces() {
+		for _, act := range trx.ActionTraces {
+			account, action := f.label(act)
+			FilterReceivedActions.Inc(account, action)
+			f.received++
+			if act.FilteringMatched {
+				FilterMatchedActions.Inc(account, action)
+				f.matched++
+			} else {
+				f.unmatched[account+":"+action]++
+			}
+		}
+	}
+	if f.interval > 0 && time.Since(f.since) >= f.interval {
+		f.summarize()
+	}
+}
+
+// summarize logs the ratio of the matched traces and the most skipped actions since the last
+// summary
+func (f *filterEfficiency) summarize() {
+	ratio := 1.0
+	if f.received > 0 {
+		ratio = float64(f.matched) / float64(f.received)
+	}
+	FilterMatchRatio.SetFloat64(ratio)
+	skipped := make([]string, 0, len(f.unmatched))
+	for label := range f.unmatched {
+		skipped = append(skipped, label)
+	}
+	sort.Slice(skipped, func(i, j int) bool {
+		if f.unmatched[skipped[i]] != f.unmatched[skipped[j]] {
+			return f.unmatched[skipped[i]] > f.unmatched[skipped[j]]
+		}
+		return skipped[i] < skipped[j]
+	})
+	if len(skipped) > 5 {
+		skipped = skipped[:5]
+	}
+	top := make(map[string]uint64, len(skipped))
+	for _, label := range skipped {
+		top[label] = f.unmatched[label]
+	}
+	zlog.Info("firehose filter efficiency",
+		zap.Duration("period", time.Since(f.since).Round(time.Second)),
+		zap.Uint64("received_actions", f.received),
+		zap.Uint64("matched_actions", f.matched),
+		zap.Float64("match_ratio", ratio),
+		zap.Any("most_skipped_actions", top),
+	)
+	f.since = time.Now()
+	f.received, f.matched = 0, 0
+	f.unmatched = make(map[string]uint64)
+}
@@ -0,0 +1,274 @@
+package dkafka
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfuse-io/dfuse-eosio/filtering"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/google/cel-go/cel"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// blockResponse is a block received from the firehose, with its fork step and opaque cursor
+type blockResponse struct {
+	block  *pbcodec.Block
+	step   pbbstream.ForkStep
+	cursor string
+}
+
+// blockStream is the stream of blocks of a firehose API version
+type blockStream interface {
+	Recv() (*blockResponse, error)
+}
+
+// openBlockStream requests the blocks from the firehose, the request is translated for the
+// firehose v2 API ("sf.firehose.v2.Stream")
+func openBlockStream(ctx context.Context, conn *grpc.ClientConn, version string, req *pbbstream.BlocksRequestV2) (blockStream, error) {
+	if version == "v2" {
+		return openFirehoseV2Stream(ctx, conn, req)
+	}
+	var filter cel.Program
+	if req.Details == pbbstream.BlockDetails_BLOCK_DETAILS_LIGHT {
+		var err error
+		if filter, err = filterProgram(req.IncludeFilterExpr); err != nil {
+			return nil, fmt.Errorf("compiling include filter expr: %w", err)
+		}
+	}
+	stream, err := pbbstream.NewBlockStreamV2Client(conn).Blocks(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &bstreamV1Stream{stream: stream, light: req.Details == pbbstream.BlockDetails_BLOCK_DETAILS_LIGHT, filterExpr: req.IncludeFilterExpr, filter: filter}, nil
+}
+
+// bstreamV1Stream reads the dfuse bstream v1 stream. The light blocks lose the filtering flags
+// when trimmed by the firehose, the filter is applied again to the received transactions.
+type bstreamV1Stream struct {
+	stream     pbbstream.BlockStreamV2_BlocksClient
+	light      bool
+	filterExpr string
+	filter     cel.Program // nil matches all the actions
+}
+
+func (s *bstreamV1Stream) Recv() (*blockResponse, error) {
+	msg, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	blk := &pbcodec.Block{}
+	if err := ptypes.UnmarshalAny(msg.Block, blk); err != nil {
+		return nil, fmt.Errorf("decoding any of type %q: %w", msg.Block.TypeUrl, err)
+	}
+	if s.light {
+		if len(blk.UnfilteredTransactionTraces) == 0 {
+			blk.UnfilteredTransactionTraces = blk.FilteredTransactionTraces
+		}
+		applyIncludeFilter(blk, s.filterExpr, s.filter, msg.Step.String())
+	}
+	return &blockResponse{block: blk, step: msg.Step, cursor: msg.Cursor}, nil
+}
+
+// firehose v2 fork steps
+const (
+	firehoseV2StepNew   = 1
+	firehoseV2StepUndo  = 2
+	firehoseV2StepFinal = 3
+)
+
+// firehoseV2Stream reads the "sf.firehose.v2.Stream/Blocks" stream. The v2 API has no include
+// filter expression, the filter is applied to the received blocks so they look like the filtered
+// blocks of the v1 API.
+type firehoseV2Stream struct {
+	stream     grpc.ClientStream
+	filterExpr string
+	filter     cel.Program // nil matches all the actions
+}
+
+var firehoseV2StreamDesc = &grpc.StreamDesc{StreamName: "Blocks", ServerStreams: true}
+
+func openFirehoseV2Stream(ctx context.Context, conn *grpc.ClientConn, req *pbbstream.BlocksRequestV2) (*firehoseV2Stream, error) {
+	filter, err := filterProgram(req.IncludeFilterExpr)
+	if err != nil {
+		return nil, fmt.Errorf("compiling include filter expr: %w", err)
+	}
+	finalBlocksOnly := len(req.ForkSteps) == 1 && req.ForkSteps[0] == pbbstream.ForkStep_STEP_IRREVERSIBLE
+
+	stream, err := conn.NewStream(ctx, firehoseV2StreamDesc, "/sf.firehose.v2.Stream/Blocks", grpc.ForceCodec(firehoseV2Codec{}))
+	if err != nil {
+		return nil, err
+	}
+	v2Req := &firehoseV2Request{
+		startBlockNum:   req.StartBlockNum,
+		cursor:          req.StartCursor,
+		stopBlockNum:    req.StopBlockNum,
+		finalBlocksOnly: finalBlocksOnly,
+	}
+	if err := stream.SendMsg(v2Req); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &firehoseV2Stream{stream: stream, filterExpr: req.IncludeFilterExpr, filter: filter}, nil
+}
+
+func (s *firehoseV2Stream) Recv() (*blockResponse, error) {
+	resp := &firehoseV2Response{}
+	if err := s.stream.RecvMsg(resp); err != nil {
+		return nil, err
+	}
+
+	var step pbbstream.ForkStep
+	switch resp.step {
+	case firehoseV2StepNew:
+		step = pbbstream.ForkStep_STEP_NEW
+	case firehoseV2StepUndo:
+		step = pbbstream.ForkStep_STEP_UNDO
+	case firehoseV2StepFinal:
+		step = pbbstream.ForkStep_STEP_IRREVERSIBLE
+	default:
+		return nil, fmt.Errorf("unsupported firehose v2 fork step %d", resp.step)
+	}
+
+	// the type URL of the v2 blocks differs, their content is the same
+	blk := &pbcodec.Block{}
+	if err := proto.Unmarshal(resp.block.Value, blk); err != nil {
+		return nil, fmt.Errorf("decoding any of type %q: %w", resp.block.TypeUrl, err)
+	}
+	applyIncludeFilter(blk, s.filterExpr, s.filter, step.String())
+	return &blockResponse{block: blk, step: step, cursor: resp.cursor}, nil
+}
+
+// applyIncludeFilter marks the actions matching the filter and keeps the transactions holding some
+func applyIncludeFilter(blk *pbcodec.Block, filterExpr string, filter cel.Program, rawStep string) {
+	var filtered []*pbcodec.TransactionTrace
+	for _, trx := range blk.UnfilteredTransactionTraces {
+		memoizableTrxTrace := &filtering.MemoizableTrxTrace{TrxTrace: trx}
+		matched := false
+		for _, act := range trx.ActionTraces {
+			act.FilteringMatched = true
+			// an action trace without action cannot be evaluated, it is left to the error policy of the adapter
+			if filter != nil && act.Action != nil {
+				ok, err := evalBool(filter, filtering.NewActionTraceActivation(act, memoizableTrxTrace, rawStep))
+				act.FilteringMatched = err == nil && ok
+			}
+			matched = matched || act.FilteringMatched
+		}
+		if matched {
+			filtered = append(filtered, trx)
+		}
+	}
+	blk.FilteringApplied = true
+	blk.FilteringIncludeFilterExpr = filterExpr
+	blk.FilteredTransactionTraces = filtered
+	blk.FilteredTransactionCount = uint32(len(filtered))
+	blk.UnfilteredTransactionTraces = nil
+}
+
+// firehoseV2Request is the "sf.firehose.v2.Request" message
+type firehoseV2Request struct {
+	startBlockNum   int64
+	cursor          string
+	stopBlockNum    uint64
+	finalBlocksOnly bool
+}
+
+func (r *firehoseV2Request) marshal() []byte {
+	var b []byte
+	if r.startBlockNum != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(r.startBlockNum))
+	}
+	if r.cursor != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, r.cursor)
+	}
+	if r.stopBlockNum != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, r.stopBlockNum)
+	}
+	if r.finalBlocksOnly {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return b
+}
+
+// firehoseV2Response is the "sf.firehose.v2.Response" message
+type firehoseV2Response struct {
+	block  *any.Any
+	step   uint64
+	cursor string
+}
+
+func (r *firehoseV2Response) unmarshal(b []byte) error {
+	r.block = &any.Any{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := proto.Unmarshal(v, r.block); err != nil {
+				return err
+			}
+			b = b[n:]
+		case num == 6 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			r.step = v
+			b = b[n:]
+		case num == 10 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			r.cursor = v
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// firehoseV2Codec encodes the firehose v2 messages, which have no generated code in this module
+type firehoseV2Codec struct{}
+
+func (firehoseV2Codec) Marshal(v interface{}) ([]byte, error) {
+	req, ok := v.(*firehoseV2Request)
+	if !ok {
+		return nil, fmt.Errorf("unexpected firehose v2 message %T", v)
+	}
+	return req.marshal(), nil
+}
+
+func (firehoseV2Codec) Unmarshal(data []byte, v interface{}) error {
+	resp, ok := v.(*firehoseV2Response)
+	if !ok {
+		return fmt.Errorf("unexpected firehose v2 message %T", v)
+	}
+	return resp.unmarshal(data)
+}
+
+func (firehoseV2Codec) Name() string {
+	return "proto"
+}
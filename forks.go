@@ -0,0 +1,37 @@
+package dkafka
+
+import (
+	"time"
+
+	"github.com/dfuse-io/bstream/forkable"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+)
+
+const undoWindowDuration = time.Hour
+
+// undoWindow counts the Undo steps of the last hour, to alert on unusual fork activity
+type undoWindow struct {
+	steps []time.Time
+}
+
+func (w *undoWindow) observe(now time.Time, step string) {
+	if step == undoStep {
+		w.steps = append(w.steps, now)
+	}
+	expired := 0
+	for expired < len(w.steps) && now.Sub(w.steps[expired]) > undoWindowDuration {
+		expired++
+	}
+	w.steps = w.steps[expired:]
+	UndoStepsLastHour.SetUint64(uint64(len(w.steps)))
+}
+
+// forkedBlockID returns the id of the block causing the reorg which undoes blk, from the cursor of
+// its Undo step, empty if the cursor does not carry it (ex: firehose v2 cursors)
+func forkedBlockID(cursor string, blk *pbcodec.Block) string {
+	c, err := forkable.CursorFromOpaque(cursor)
+	if err != nil || c.HeadBlock == nil || c.HeadBlock.ID() == blk.Id {
+		return ""
+	}
+	return c.HeadBlock.ID()
+}
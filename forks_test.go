@@ -0,0 +1,34 @@
+package dkafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dfuse-io/bstream"
+	"github.com/dfuse-io/bstream/forkable"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUndoWindowCountsTheUndoStepsOfTheLastHour(t *testing.T) {
+	w := &undoWindow{}
+	start := time.Now()
+	w.observe(start, sanitizeStep(pbbstream.ForkStep_STEP_NEW.String()))
+	w.observe(start, sanitizeStep(pbbstream.ForkStep_STEP_UNDO.String()))
+	w.observe(start.Add(30*time.Minute), sanitizeStep(pbbstream.ForkStep_STEP_UNDO.String()))
+	assert.Len(t, w.steps, 2)
+
+	w.observe(start.Add(90*time.Minute), sanitizeStep(pbbstream.ForkStep_STEP_NEW.String()))
+	assert.Len(t, w.steps, 1)
+}
+
+func TestForkedBlockID(t *testing.T) {
+	undone := bstream.NewBlockRef("0000000aaaaaaaaa", 10)
+	head := bstream.NewBlockRef("0000000bbbbbbbbb", 11)
+	cursor := (&forkable.Cursor{Step: forkable.StepUndo, Block: undone, HeadBlock: head, LIB: undone}).ToOpaque()
+
+	assert.Equal(t, head.ID(), forkedBlockID(cursor, &pbcodec.Block{Id: undone.ID(), Number: 10}))
+	assert.Equal(t, "", forkedBlockID(testCursor(10), &pbcodec.Block{Id: "0000000aaaaaaaaa", Number: 10}))
+	assert.Equal(t, "", forkedBlockID("not a cursor", &pbcodec.Block{Id: undone.ID(), Number: 10}))
+}
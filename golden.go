@@ -0,0 +1,148 @@
+package dkafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+)
+
+// goldenFileSuffix is the suffix of the files written by GenerateGolden
+const goldenFileSuffix = ".golden.json"
+
+// GeneratedMessage is a message produced by a configuration, in a stable form which can be
+// committed and diffed: the headers differing between two runs are left out and the value is
+// decompressed
+type GeneratedMessage struct {
+	Topic     string            `json:"topic"`
+	Key       string            `json:"key"`
+	EventType string            `json:"ce_type"`
+	Headers   map[string]string `json:"headers"`
+	Value     json.RawMessage   `json:"value"` // a JSON string if the value is not JSON
+}
+
+// Generator produces the messages of a configuration for a block, in memory and without any
+// connection: the messages only depend on the configuration, the block and its step
+type Generator struct {
+	pipeline *diffPipeline
+}
+
+// NewGenerator validates the configuration and compiles its expressions
+func NewGenerator(config *Config) (*Generator, error) {
+	pipeline, err := newDiffPipeline(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Generator{pipeline: pipeline}, nil
+}
+
+// Generate returns the messages of the block streamed with the step (ex: "STEP_NEW"), in the
+// order they are sent
+func (g *Generator) Generate(ctx context.Context, blk *pbcodec.Block, rawStep string) ([]GeneratedMessage, error) {
+	msgs, err := g.pipeline.adaptStep(ctx, blk, rawStep)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]GeneratedMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		out = append(out, newGeneratedMessage(msg))
+	}
+	return out, nil
+}
+
+func newGeneratedMessage(msg *kafka.Message) GeneratedMessage {
+	generated := GeneratedMessage{
+		Key:       string(msg.Key),
+		EventType: headerValue(msg.Headers, "ce_type"),
+		Headers:   diffHeaders(msg.Headers),
+	}
+	if msg.TopicPartition.Topic != nil {
+		generated.Topic = *msg.TopicPartition.Topic
+	}
+	value, err := decompressValue(headerValue(msg.Headers, "content-type"), msg.Value)
+	if err != nil {
+		value = msg.Value
+	}
+	var doc interface{}
+	if decodeJSON(value, &doc) == nil {
+		generated.Value = canonicalJSON(value)
+	} else {
+		generated.Value, _ = json.Marshal(string(value))
+	}
+	return generated
+}
+
+// GenerateGolden writes the messages the config file produces for each block of the fixtures dir
+// to a golden file of the out dir, named after the block file. The fixtures are blocks of a capture
+// dir, streamed with the step of their file name, or JSON blocks (".json"), streamed as
+// irreversible. The golden files are canonical JSON, so they can be committed and diffed.
+func GenerateGolden(configPath string, fixturesDir string, outDir string) error {
+	// the messages are never produced, so the config file needs no kafka settings
+	config, err := LoadConfigFile(configPath, &Config{DryRun: true})
+	if err != nil {
+		return err
+	}
+	if err := config.LoadExpressionFiles(); err != nil {
+		return err
+	}
+	return GenerateGoldenFrom(config, fixturesDir, outDir)
+}
+
+// GenerateGoldenFrom is GenerateGolden with a loaded configuration, its expression files loaded
+func GenerateGoldenFrom(config *Config, fixturesDir string, outDir string) error {
+	generator, err := NewGenerator(config)
+	if err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(fixturesDir)
+	if err != nil {
+		return fmt.Errorf("listing fixtures dir: %w", err)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return fmt.Errorf("creating golden dir: %w", err)
+	}
+	for _, info := range infos { // sorted by name, so by block for a capture dir
+		name := info.Name()
+		if info.IsDir() || (!strings.HasSuffix(name, captureFileSuffix) && !strings.HasSuffix(name, ".json")) {
+			continue
+		}
+		blk, err := readBlockFile(filepath.Join(fixturesDir, name))
+		if err != nil {
+			return err
+		}
+		msgs, err := generator.Generate(context.Background(), blk, fixtureStep(name))
+		if err != nil {
+			return fmt.Errorf("fixture %s: %w", name, err)
+		}
+		out, err := json.MarshalIndent(msgs, "", "  ")
+		if err != nil {
+			return err
+		}
+		base := strings.TrimSuffix(strings.TrimSuffix(name, captureFileSuffix), ".json")
+		if err := ioutil.WriteFile(filepath.Join(outDir, base+goldenFileSuffix), append(out, '\n'), 0644); err != nil {
+			return fmt.Errorf("writing golden file: %w", err)
+		}
+	}
+	return nil
+}
+
+// fixtureStep returns the step of a captured block file, "{block_num}-{id}-{step}.pb.zst", or the
+// irreversible step
+func fixtureStep(name string) string {
+	if strings.HasSuffix(name, captureFileSuffix) {
+		parts := strings.SplitN(strings.TrimSuffix(name, captureFileSuffix), "-", 3)
+		if len(parts) == 3 {
+			if _, found := pbbstream.ForkStep_value[parts[2]]; found {
+				return parts[2]
+			}
+		}
+	}
+	return pbbstream.ForkStep_STEP_IRREVERSIBLE.String()
+}
@@ -0,0 +1,36 @@
+package dkafka
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// go test -run TestGoldenFiles -update rewrites the golden files after an intended change
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata/golden")
+
+func TestGoldenFiles(t *testing.T) {
+	goldenDir := filepath.Join("testdata", "golden", "expected")
+	outDir := goldenDir
+	if !*updateGolden {
+		outDir = t.TempDir()
+	}
+	require.NoError(t, GenerateGolden(filepath.Join("testdata", "golden", "config.yaml"), filepath.Join("testdata", "golden", "fixtures"), outDir))
+	if *updateGolden {
+		return
+	}
+
+	generated := dirFiles(t, outDir)
+	assert.Equal(t, dirFiles(t, goldenDir), generated, "the golden files do not match the fixtures, run go test -run TestGoldenFiles -update")
+	for _, name := range generated {
+		expected, err := ioutil.ReadFile(filepath.Join(goldenDir, name))
+		require.NoError(t, err)
+		actual, err := ioutil.ReadFile(filepath.Join(outDir, name))
+		require.NoError(t, err)
+		assert.Equal(t, string(expected), string(actual), "golden file %s differs, run go test -run TestGoldenFiles -update after an intended change", name)
+	}
+}
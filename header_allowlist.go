@@ -0,0 +1,70 @@
+package dkafka
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+// alwaysAllowedHeaders are needed by the consumers to dedupe and route the events, and to tell the
+// control messages apart
+var alwaysAllowedHeaders = []string{"ce_id", "ce_type", controlHeader}
+
+// headerAllowlist is the set of headers sent, nil allows all the headers
+type headerAllowlist map[string]bool
+
+func newHeaderAllowlist(keys []string) headerAllowlist {
+	if len(keys) == 0 {
+		return nil
+	}
+	allowlist := make(headerAllowlist, len(keys)+len(alwaysAllowedHeaders))
+	for _, key := range append(keys, alwaysAllowedHeaders...) {
+		allowlist[key] = true
+	}
+	return allowlist
+}
+
+func (l headerAllowlist) allowed(key string) bool {
+	return l == nil || l[key]
+}
+
+// headerReportAfter is the number of messages after which the bytes saved are logged
+const headerReportAfter = 1000
+
+// headerAllowlistSender removes the headers missing from the allowlist right before the sink, the
+// other senders still see them (ex: ce_blkstep for the dedupe window)
+type headerAllowlistSender struct {
+	Sender
+	allowlist headerAllowlist
+
+	messages   int
+	savedBytes int
+	totalBytes int
+}
+
+func (s *headerAllowlistSender) Send(msg *kafka.Message) error {
+	kept := msg.Headers[:0:0]
+	saved := 0
+	for _, h := range msg.Headers {
+		if s.allowlist.allowed(h.Key) {
+			kept = append(kept, h)
+		} else {
+			saved += len(h.Key) + len(h.Value)
+		}
+	}
+	msg.Headers = kept
+	HeaderBytesSaved.AddInt(saved)
+
+	if s.messages < headerReportAfter {
+		s.messages++
+		s.savedBytes += saved
+		s.totalBytes += saved + messageSize(msg)
+		if s.messages == headerReportAfter && s.totalBytes > 0 {
+			zlog.Info("header allowlist savings",
+				zap.Int("messages", s.messages),
+				zap.Int("saved_bytes", s.savedBytes),
+				zap.Float64("saved_ratio", float64(s.savedBytes)/float64(s.totalBytes)),
+			)
+		}
+	}
+	return s.Sender.Send(msg)
+}
@@ -0,0 +1,61 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+)
+
+const heartbeatEventType = "Heartbeat"
+
+// Heartbeat is the payload of the heartbeat messages, sent when no message was produced for a
+// while so the consumers can tell an idle contract from a stopped dkafka
+type Heartbeat struct {
+	BlockNum  uint32    `json:"block_num"`
+	BlockID   string    `json:"block_id"`
+	BlockTime time.Time `json:"block_time"`
+	Cursor    string    `json:"cursor"`
+}
+
+func heartbeatMessage(topic string, eventSource string, blk *pbcodec.Block, cursor string) *kafka.Message {
+	value, _ := json.Marshal(Heartbeat{
+		BlockNum:  blk.Number,
+		BlockID:   blk.Id,
+		BlockTime: blockTime(blk),
+		Cursor:    cursor,
+	})
+	return &kafka.Message{
+		Key: []byte("heartbeat"),
+		Headers: []kafka.Header{
+			{Key: "ce_id", Value: hashString(blk.Id + heartbeatEventType)},
+			{Key: "ce_source", Value: []byte(eventSource)},
+			{Key: "ce_specversion", Value: []byte("1.0")},
+			{Key: "ce_type", Value: []byte(heartbeatEventType)},
+			{Key: controlHeader, Value: []byte(heartbeatEventType)},
+			{Key: "content-type", Value: []byte("application/json")},
+			{Key: "ce_time", Value: []byte(blockTime(blk).Format("2006-01-02T15:04:05.9Z"))},
+			{Key: "ce_datacontenttype", Value: []byte("application/json")},
+		},
+		Value: value,
+		TopicPartition: kafka.TopicPartition{
+			Topic: &topic,
+		},
+	}
+}
+
+// controlHeader marks the heartbeats, LIB announces, startup canaries and stream completions, its
+// value is their event type; the events of the stream can have the same ce_type, not this header
+const controlHeader = "dk_control"
+
+// isControlMessage tells if the message is a heartbeat, a LIB announce, a startup canary or a stream
+// completion, which are never deduplicated nor validated
+func isControlMessage(msg *kafka.Message) bool {
+	for _, h := range msg.Headers {
+		if h.Key == controlHeader {
+			return true
+		}
+	}
+	return false
+}
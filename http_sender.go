@@ -0,0 +1,143 @@
+package dkafka
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// httpSender posts the events to an HTTP endpoint (ex: a Knative broker) as binary-mode
+// CloudEvents: the value is the body and the "ce_" headers become "ce-" HTTP headers. Requests
+// run concurrently up to the concurrency limit, the cursor is saved once they all succeeded.
+type httpSender struct {
+	url        string
+	client     *http.Client
+	retry      retrier
+	ctx        context.Context // interrupts the retries backoff
+	cp         checkpointer
+	lastCommit time.Time
+
+	slots    chan struct{}
+	inflight sync.WaitGroup
+	errMu    sync.Mutex
+	err      error // first failed request, returned by the next Send or Commit
+}
+
+func newHTTPSender(ctx context.Context, url string, timeout time.Duration, maxRetries int, retry RetryConfig, concurrency int, cp checkpointer) *httpSender {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &httpSender{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		retry:  retrier{RetryConfig: retry, operation: "http_sink", maxAttempts: maxRetries + 1},
+		ctx:    ctx,
+		cp:     cp,
+		slots:  make(chan struct{}, concurrency),
+	}
+}
+
+func (s *httpSender) Send(msg *kafka.Message) error {
+	if err := s.failure(); err != nil {
+		return err
+	}
+	s.slots <- struct{}{}
+	s.inflight.Add(1)
+	go func() {
+		defer func() {
+			<-s.slots
+			s.inflight.Done()
+		}()
+		if err := s.post(msg); err != nil {
+			s.errMu.Lock()
+			if s.err == nil {
+				s.err = err
+			}
+			s.errMu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (s *httpSender) CommitIfAfter(ctx context.Context, cursor string, minimumDelay time.Duration) error {
+	if time.Since(s.lastCommit) > minimumDelay {
+		return s.Commit(ctx, cursor)
+	}
+	return nil
+}
+
+// Commit waits for the in-flight requests before saving the cursor
+func (s *httpSender) Commit(ctx context.Context, cursor string) error {
+	s.inflight.Wait()
+	if err := s.failure(); err != nil {
+		return err
+	}
+	if err := s.cp.Save(ctx, cursor); err != nil {
+		return fmt.Errorf("saving cursor: %w", err)
+	}
+	s.lastCommit = time.Now()
+	return nil
+}
+
+func (s *httpSender) failure() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+// post sends the message, retrying on network errors, 5xx, 408 and 429 responses. The other
+// 4xx responses are not retried: the event is rejected by the endpoint.
+func (s *httpSender) post(msg *kafka.Message) error {
+	return s.retry.do(s.ctx, func() error {
+		retryable, err := s.postOnce(msg)
+		if !retryable {
+			return permanent(err)
+		}
+		return err
+	})
+}
+
+func (s *httpSender) postOnce(msg *kafka.Message) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(msg.Value))
+	if err != nil {
+		return false, fmt.Errorf("creating http sink request: %w", err)
+	}
+	for _, h := range msg.Headers {
+		switch {
+		case h.Key == "content-type":
+			req.Header.Set("Content-Type", string(h.Value))
+		case h.Key == "ce_datacontenttype": // carried by the Content-Type header in binary mode
+		case strings.HasPrefix(h.Key, "ce_"):
+			req.Header.Set("ce-"+strings.TrimPrefix(h.Key, "ce_"), string(h.Value))
+		default:
+			req.Header.Set(h.Key, string(h.Value))
+		}
+	}
+	if len(msg.Key) != 0 && req.Header.Get("ce-partitionkey") == "" {
+		req.Header.Set("ce-partitionkey", string(msg.Key))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		HTTPSinkResponses.Inc("error")
+		return true, fmt.Errorf("posting to http sink: %w", err)
+	}
+	resp.Body.Close()
+	HTTPSinkResponses.Inc(strconv.Itoa(resp.StatusCode))
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("http sink responded %s", resp.Status)
+	default:
+		return false, fmt.Errorf("http sink rejected the event %s: %s", headerValue(msg.Headers, "ce_id"), resp.Status)
+	}
+}
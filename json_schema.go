@@ -0,0 +1,208 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// jsonSchema is the subset of JSON Schema (draft 7) validated on the message values: type,
+// properties, required, additionalProperties (boolean), items and enum
+type jsonSchema struct {
+	Type                 jsonSchemaTypes        `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+}
+
+// jsonSchemaTypes is the type keyword, a single type or a list of types
+type jsonSchemaTypes []string
+
+func (t *jsonSchemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = []string{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = many
+	return nil
+}
+
+// builtinSchemas are the schemas of the payloads generated by dkafka, referenced as "builtin:{name}"
+var builtinSchemas = map[string]string{
+	"action":      actionEventSchema,
+	"transaction": transactionEventSchema,
+}
+
+const actionInfoSchema = `{
+	"type": "object",
+	"required": ["account", "receiver", "action", "global_seq", "authorizations", "db_ops", "json_data"],
+	"properties": {
+		"account": {"type": "string"},
+		"receiver": {"type": "string"},
+		"action": {"type": "string"},
+		"global_seq": {"type": "integer"},
+		"authorizations": {"type": ["array", "null"], "items": {"type": "string"}},
+		"db_ops": {"type": ["array", "null"], "items": {"type": "object"}},
+		"json_data": {},
+		"code_hash": {"type": "string"},
+		"ram_deltas": {"type": "array", "items": {"type": "object", "required": ["payer", "delta", "usage"]}},
+		"console": {"type": "string"},
+		"fields": {"type": "object"}
+	}
+}`
+
+const eventHeaderProperties = `
+		"block_num": {"type": "integer"},
+		"block_id": {"type": "string"},
+		"status": {"type": "string"},
+		"executed": {"type": "boolean"},
+		"block_step": {"type": "string", "enum": ["NEW", "UNDO", "IRREVERSIBLE"]},
+		"trx_id": {"type": "string"},
+		"_key": {"type": "string"},`
+
+const actionEventSchema = `{
+	"type": "object",
+	"required": ["block_num", "block_id", "status", "executed", "block_step", "trx_id", "act_info"],
+	"properties": {` + eventHeaderProperties + `
+		"act_info": ` + actionInfoSchema + `
+	}
+}`
+
+const transactionEventSchema = `{
+	"type": "object",
+	"required": ["block_num", "block_id", "status", "executed", "block_step", "trx_id", "act_infos"],
+	"properties": {` + eventHeaderProperties + `
+		"act_infos": {"type": "array", "items": ` + actionInfoSchema + `}
+	}
+}`
+
+// loadJSONSchema reads the schema file, or the builtin schema of a "builtin:{name}" reference
+func loadJSONSchema(ref string) (*jsonSchema, error) {
+	var data []byte
+	if name := strings.TrimPrefix(ref, "builtin:"); name != ref {
+		schema, found := builtinSchemas[name]
+		if !found {
+			return nil, fmt.Errorf("unknown builtin schema %q, must be one of: action, transaction", name)
+		}
+		data = []byte(schema)
+	} else {
+		var err error
+		if data, err = ioutil.ReadFile(ref); err != nil {
+			return nil, fmt.Errorf("reading schema: %w", err)
+		}
+	}
+	schema := &jsonSchema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("decoding schema %s: %w", ref, err)
+	}
+	return schema, nil
+}
+
+// validate returns the JSON pointer of the first value not matching the schema, with the reason
+func (s *jsonSchema) validate(value interface{}, pointer string) (string, error) {
+	if len(s.Type) != 0 && !s.matchesType(value) {
+		return pointer, fmt.Errorf("expected %s, got %s", strings.Join(s.Type, " or "), jsonTypeOf(value))
+	}
+	if len(s.Enum) != 0 && !s.inEnum(value) {
+		return pointer, fmt.Errorf("value not in enum")
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, found := v[name]; !found {
+				return pointer + "/" + escapePointer(name), fmt.Errorf("required property is missing")
+			}
+		}
+		for name, child := range v {
+			prop, found := s.Properties[name]
+			if !found {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return pointer + "/" + escapePointer(name), fmt.Errorf("additional property is not allowed")
+				}
+				continue
+			}
+			if failed, err := prop.validate(child, pointer+"/"+escapePointer(name)); err != nil {
+				return failed, err
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				if failed, err := s.Items.validate(item, pointer+"/"+strconv.Itoa(i)); err != nil {
+					return failed, err
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+func (s *jsonSchema) matchesType(value interface{}) bool {
+	actual := jsonTypeOf(value)
+	for _, t := range s.Type {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jsonSchema) inEnum(value interface{}) bool {
+	for _, e := range s.Enum {
+		if n, ok := value.(json.Number); ok {
+			if f, err := n.Float64(); err == nil && reflect.DeepEqual(f, e) {
+				return true
+			}
+			continue
+		}
+		if reflect.DeepEqual(value, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// escapePointer escapes a property name in a JSON pointer (RFC 6901)
+func escapePointer(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
+
+// validateJSON decodes the value and validates it against the schema
+func validateJSON(schema *jsonSchema, data []byte) (string, error) {
+	var value interface{}
+	if err := decodeJSON(data, &value); err != nil {
+		return "", fmt.Errorf("decoding value: %w", err)
+	}
+	return schema.validate(value, "")
+}
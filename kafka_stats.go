@@ -0,0 +1,75 @@
+package dkafka
+
+import (
+	"encoding/json"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+// serveProducerEvents reads the producer events channel until the producer is closed,
+// publishing the librdkafka statistics as metrics and reporting the fatal errors to the channel
+func serveProducerEvents(producer *kafka.Producer, fatalErrors chan<- kafka.Error) {
+	go func() {
+		for ev := range producer.Events() {
+			switch e := ev.(type) {
+			case *kafka.Stats:
+				recordKafkaStats(e.String())
+			case kafka.Error:
+				if !e.IsFatal() {
+					zlog.Warn("kafka producer error", zap.Error(e))
+					continue
+				}
+				zlog.Error("fatal kafka producer error", zap.Error(e))
+				select {
+				case fatalErrors <- e:
+				default: // already reported
+				}
+			}
+		}
+	}()
+}
+
+// recordKafkaStats sets the broker metrics from the statistics JSON, the fields missing or of
+// another type (they vary across librdkafka versions) are skipped
+func recordKafkaStats(statsJSON string) {
+	var stats map[string]interface{}
+	if err := json.Unmarshal([]byte(statsJSON), &stats); err != nil {
+		zlog.Debug("cannot parse kafka statistics", zap.Error(err))
+		return
+	}
+	brokers, _ := stats["brokers"].(map[string]interface{})
+	for key, v := range brokers {
+		broker, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := broker["name"].(string)
+		if name == "" {
+			name = key
+		}
+		if rtt, ok := statsNumber(broker, "rtt", "avg"); ok {
+			KafkaBrokerRTT.SetFloat64(rtt/1e6, name) // microseconds
+		}
+		if throttle, ok := statsNumber(broker, "throttle", "avg"); ok {
+			KafkaBrokerThrottle.SetFloat64(throttle/1e3, name) // milliseconds
+		}
+		if outbuf, ok := statsNumber(broker, "outbuf_cnt"); ok {
+			KafkaBrokerOutbufMessages.SetFloat64(outbuf, name)
+		}
+		if retries, ok := statsNumber(broker, "txretries"); ok {
+			KafkaBrokerTxRetries.SetFloat64(retries, name)
+		}
+	}
+}
+
+func statsNumber(obj map[string]interface{}, path ...string) (float64, bool) {
+	for _, field := range path[:len(path)-1] {
+		var ok bool
+		if obj, ok = obj[field].(map[string]interface{}); !ok {
+			return 0, false
+		}
+	}
+	n, ok := obj[path[len(path)-1]].(float64)
+	return n, ok
+}
@@ -0,0 +1,98 @@
+package dkafka
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/interpreter"
+)
+
+var keySetLabelRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// keySet produces a copy of every event keyed by its own keys expression, sent to its own topic
+type keySet struct {
+	label string
+	prog  cel.Program
+	topic string // namespaced
+}
+
+// keyedEvents are the keys of the copies of an event sent to a topic, an empty topic is the
+// topic of the adapter
+type keyedEvents struct {
+	label string
+	topic string
+	keys  []string
+}
+
+// newKeySets compiles the key sets sorted by label, the topic of a key set defaults to the kafka
+// topic suffixed with its label
+func newKeySets(exprs map[string]string, topics map[string]string, kafkaTopic string, namespace string) ([]*keySet, error) {
+	for label := range topics {
+		if _, found := exprs[label]; !found {
+			return nil, fmt.Errorf("event key set topic %q has no keys expression", label)
+		}
+	}
+	labels := make([]string, 0, len(exprs))
+	for label := range exprs {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var sets []*keySet
+	seenTopics := make(map[string]string)
+	for _, label := range labels {
+		if !keySetLabelRegex.MatchString(label) {
+			return nil, fmt.Errorf("invalid event key set label %q, must only hold letters, digits, '_' and '-'", label)
+		}
+		prog, err := exprToCelProgram(exprs[label])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse event key set %s: %w", label, err)
+		}
+		topic := topics[label]
+		if topic == "" {
+			topic = kafkaTopic + "-" + label
+		}
+		topic = namespaced(namespace, topic)
+		if other, found := seenTopics[topic]; found {
+			return nil, fmt.Errorf("event key sets %s and %s are sent to the same topic %s", other, label, topic)
+		}
+		seenTopics[topic] = label
+		sets = append(sets, &keySet{
+			label: label,
+			prog:  prog,
+			topic: topic,
+		})
+	}
+	return sets, nil
+}
+
+// keyed returns the keys of the copies of the event, the event keys sent to the adapter topic
+// when no key set is configured
+func (a *adapter) keyed(activation interpreter.Activation, eventKeys []string) ([]keyedEvents, error) {
+	if len(a.keySets) == 0 {
+		return []keyedEvents{{keys: eventKeys}}, nil
+	}
+	out := make([]keyedEvents, 0, len(a.keySets))
+	for _, set := range a.keySets {
+		keys, err := evalStringArray(set.prog, activation)
+		if err != nil {
+			return nil, classify(failureEventKey, fmt.Errorf("event key set %s eval: %w", set.label, err))
+		}
+		out = append(out, keyedEvents{
+			label: set.label,
+			topic: set.topic,
+			keys:  keys,
+		})
+	}
+	return out, nil
+}
+
+// withLabel extends the ce_id with the key set label, so the ids of the copies remain unique
+func withLabel(ceID []byte, label string) []byte {
+	if ceID == nil || label == "" {
+		return ceID
+	}
+	return append(append(ceID, '-'), label...)
+}
@@ -0,0 +1,165 @@
+package dkafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+// leaseRecord is saved next to the cursor, on the cursor partition with its own key, by the
+// instance producing for the signature. A record older than the lease TTL is expired.
+type leaseRecord struct {
+	InstanceID string    `json:"instance_id"`
+	Signature  string    `json:"signature"`
+	Heartbeat  time.Time `json:"heartbeat"`
+	Released   bool      `json:"released,omitempty"` // the instance stopped, the lease is free
+}
+
+func leaseKey(signature string) []byte {
+	return []byte("dk-lease-" + signature)
+}
+
+// held tells if the lease is held by another live instance
+func (r *leaseRecord) held(instanceID string, ttl time.Duration, now time.Time) bool {
+	return r != nil && !r.Released && r.InstanceID != instanceID && now.Sub(r.Heartbeat) < ttl
+}
+
+// defaultInstanceID identifies the process in the lease records
+func defaultInstanceID() string {
+	hostname, _ := os.Hostname()
+	return hostname + "-" + strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// instanceLease prevents two instances from producing for the same signature. Its heartbeats are
+// written by a dedicated producer, as the records of a transactional producer would only be
+// visible on commit.
+type instanceLease struct {
+	cp         *kafkaCheckpointer
+	producer   *kafka.Producer
+	instanceID string
+	ttl        time.Duration
+	grace      time.Duration // waited for the lease of another instance to expire before refusing to run
+	lost       chan error    // the heartbeats failed for longer than the ttl
+}
+
+func newInstanceLease(conf kafka.ConfigMap, cp *kafkaCheckpointer, instanceID string, ttl time.Duration, grace time.Duration) (*instanceLease, error) {
+	producer, err := getKafkaProducer(conf, "")
+	if err != nil {
+		return nil, fmt.Errorf("getting lease producer: %w", err)
+	}
+	return &instanceLease{
+		cp:         cp,
+		producer:   producer,
+		instanceID: instanceID,
+		ttl:        ttl,
+		grace:      grace,
+		lost:       make(chan error, 1),
+	}, nil
+}
+
+// acquire reads the lease with the cursor, waiting up to the takeover grace period for the lease of
+// another instance to expire, then writes the first heartbeat
+func (l *instanceLease) acquire(ctx context.Context) error {
+	deadline := time.Now().Add(l.grace)
+	for {
+		if _, err := l.cp.Load(ctx); err != nil && err != NoCursorErr {
+			return fmt.Errorf("reading the instance lease: %w", err)
+		}
+		other := l.cp.lease
+		now := time.Now()
+		if !other.held(l.instanceID, l.ttl, now) {
+			break
+		}
+		if !now.Before(deadline) {
+			return fmt.Errorf("instance %s holds the lease of %q (last heartbeat %s ago, lease ttl %s) -- refusing to run a second instance", other.InstanceID, l.cp.signature, now.Sub(other.Heartbeat).Round(time.Second), l.ttl)
+		}
+		wait := other.Heartbeat.Add(l.ttl).Sub(now)
+		if remaining := deadline.Sub(now); remaining < wait {
+			wait = remaining
+		}
+		zlog.Info("lease held by another instance, waiting for it to expire",
+			zap.String("instance_id", other.InstanceID),
+			zap.Time("heartbeat", other.Heartbeat),
+			zap.Duration("wait", wait),
+		)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := l.write(false); err != nil {
+		return fmt.Errorf("writing the instance lease: %w", err)
+	}
+	zlog.Info("instance lease acquired", zap.String("instance_id", l.instanceID), zap.String("signature", l.cp.signature), zap.Duration("lease_ttl", l.ttl))
+	return nil
+}
+
+// keep writes a heartbeat every third of the ttl until the context is done. The lease is reported
+// lost once no heartbeat was written for the ttl, another instance may then have taken over.
+func (l *instanceLease) keep(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	lastWritten := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.write(false); err != nil {
+				LeaseHeartbeatFailures.Inc()
+				zlog.Warn("cannot write the instance lease heartbeat", zap.Error(err), zap.Duration("since_last_heartbeat", time.Since(lastWritten)))
+				if time.Since(lastWritten) >= l.ttl {
+					l.lost <- fmt.Errorf("instance lease lost, no heartbeat written for %s: %w", time.Since(lastWritten).Round(time.Second), err)
+					return
+				}
+				continue
+			}
+			lastWritten = time.Now()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// release frees the lease, so a replacing instance does not wait for its expiry, and closes the
+// lease producer
+func (l *instanceLease) release() {
+	if err := l.write(true); err != nil {
+		zlog.Warn("cannot release the instance lease, it expires after its ttl", zap.Error(err))
+	}
+	l.producer.Close()
+}
+
+// write produces a lease record, waiting for its delivery up to a third of the ttl
+func (l *instanceLease) write(released bool) error {
+	value, err := json.Marshal(leaseRecord{InstanceID: l.instanceID, Signature: l.cp.signature, Heartbeat: time.Now(), Released: released})
+	if err != nil {
+		return err
+	}
+	deliveries := make(chan kafka.Event, 1)
+	err = l.producer.Produce(&kafka.Message{
+		Key: leaseKey(l.cp.signature),
+		TopicPartition: kafka.TopicPartition{
+			Topic:     &l.cp.topic,
+			Partition: l.cp.partition,
+		},
+		Value: value,
+	}, deliveries)
+	if err != nil {
+		return err
+	}
+	select {
+	case ev := <-deliveries:
+		if m, ok := ev.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+			return missingACL(m.TopicPartition.Error, "Write", "topic "+l.cp.topic)
+		}
+	case <-time.After(l.ttl / 3):
+		return fmt.Errorf("lease delivery not confirmed after %s", l.ttl/3)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+)
+
+const libAdvancedEventType = "LibAdvanced"
+
+// LibAdvanced is the payload of the messages announcing that all the events up to the last
+// irreversible block are final, so the consumers can prune their fork handling buffers
+type LibAdvanced struct {
+	LIBNum    uint32    `json:"lib_num"`
+	BlockNum  uint32    `json:"block_num"`
+	BlockID   string    `json:"block_id"`
+	BlockTime time.Time `json:"block_time"`
+}
+
+// libTracker follows the last irreversible block of the stream, taken from the blocks: the LIB
+// they reference and the block itself on the irreversible steps. It never goes backward.
+type libTracker struct {
+	lib       uint32
+	announced uint32
+	minStep   uint32
+}
+
+func (t *libTracker) observe(blk *pbcodec.Block, step pbbstream.ForkStep) {
+	lib := blk.DposIrreversibleBlocknum
+	if step == pbbstream.ForkStep_STEP_IRREVERSIBLE && blk.Number > lib {
+		lib = blk.Number
+	}
+	if lib > t.current() {
+		atomic.StoreUint32(&t.lib, lib)
+	}
+}
+
+func (t *libTracker) current() uint32 {
+	return atomic.LoadUint32(&t.lib)
+}
+
+// advanced tells if the LIB moved by at least the min step since the last announce, and records
+// the announce
+func (t *libTracker) advanced() bool {
+	lib := t.current()
+	if lib == 0 || (t.announced != 0 && lib < t.announced+t.minStep) {
+		return false
+	}
+	t.announced = lib
+	return true
+}
+
+func validateLIBAnnounceMode(mode string) error {
+	switch mode {
+	case "", "off", "header", "message":
+		return nil
+	}
+	return fmt.Errorf("invalid lib announce mode %q, must be one of: off, header, message", mode)
+}
+
+// withLIBHeader adds the last irreversible block number to the messages, as the ce_libnum header
+func withLIBHeader(tracker *libTracker) AdapterOption {
+	return func(a *adapter) {
+		a.lib = tracker
+	}
+}
+
+func libHeader(tracker *libTracker) kafka.Header {
+	return kafka.Header{Key: "ce_libnum", Value: []byte(strconv.FormatUint(uint64(tracker.current()), 10))}
+}
+
+func libAdvancedMessage(topic string, eventSource string, blk *pbcodec.Block, lib uint32) *kafka.Message {
+	value, _ := json.Marshal(LibAdvanced{
+		LIBNum:    lib,
+		BlockNum:  blk.Number,
+		BlockID:   blk.Id,
+		BlockTime: blockTime(blk),
+	})
+	return &kafka.Message{
+		Key: []byte("lib"),
+		Headers: []kafka.Header{
+			{Key: "ce_id", Value: hashString(fmt.Sprintf("%s%d", libAdvancedEventType, lib))},
+			{Key: "ce_source", Value: []byte(eventSource)},
+			{Key: "ce_specversion", Value: []byte("1.0")},
+			{Key: "ce_type", Value: []byte(libAdvancedEventType)},
+			{Key: controlHeader, Value: []byte(libAdvancedEventType)},
+			{Key: "content-type", Value: []byte("application/json")},
+			{Key: "ce_time", Value: []byte(blockTime(blk).Format("2006-01-02T15:04:05.9Z"))},
+			{Key: "ce_datacontenttype", Value: []byte("application/json")},
+			{Key: "ce_libnum", Value: []byte(strconv.FormatUint(uint64(lib), 10))},
+		},
+		Value: value,
+		TopicPartition: kafka.TopicPartition{
+			Topic: &topic,
+		},
+	}
+}
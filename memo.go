@@ -0,0 +1,239 @@
+package dkafka
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// memoMaxBytes bounds the work of the memo functions, the bytes of a longer string are ignored
+const memoMaxBytes = 4096
+
+// memoMaxParts bounds the parts returned by split and the pairs parsed by parse_kv
+const memoMaxParts = 256
+
+// memoMaxPatterns bounds the compiled regex_capture patterns kept, the others are compiled per call
+const memoMaxPatterns = 64
+
+// memoLib adds the memo parsing functions to the expressions evaluated by dkafka, they never fail: a
+// malformed input gives an empty result. The include filter, evaluated by the firehose server,
+// cannot call them.
+//   - parse_kv(string, pair_sep, kv_sep) map(string, string), ex: parse_kv(data.memo, ';', ':')['order']
+//   - split(string, sep) list(string)
+//   - regex_capture(string, pattern, group) string, ex: regex_capture(data.memo, 'ref=(\\d+)', 1)
+type memoLib struct{}
+
+func (memoLib) CompileOptions() []cel.EnvOption {
+	return []cel.EnvOption{cel.Declarations(
+		decls.NewFunction("parse_kv", decls.NewOverload("parse_kv_string_string_string", []*exprpb.Type{decls.String, decls.String, decls.String}, decls.NewMapType(decls.String, decls.String))),
+		decls.NewFunction("split", decls.NewOverload("split_string_string", []*exprpb.Type{decls.String, decls.String}, decls.NewListType(decls.String))),
+		decls.NewFunction("regex_capture", decls.NewOverload("regex_capture_string_string_int", []*exprpb.Type{decls.String, decls.String, decls.Int}, decls.String)),
+	)}
+}
+
+func (memoLib) ProgramOptions() []cel.ProgramOption {
+	return []cel.ProgramOption{cel.Functions(
+		&functions.Overload{Operator: "parse_kv", Function: func(args ...ref.Val) ref.Val {
+			return types.NewStringStringMap(types.DefaultTypeAdapter, parseMemoKV(celString(args[0]), celString(args[1]), celString(args[2])))
+		}},
+		&functions.Overload{Operator: "split", Binary: func(s, sep ref.Val) ref.Val {
+			return types.NewStringList(types.DefaultTypeAdapter, splitMemo(celString(s), celString(sep)))
+		}},
+		&functions.Overload{Operator: "regex_capture", Function: func(args ...ref.Val) ref.Val {
+			group, _ := args[2].(types.Int)
+			return types.String(regexCapture(celString(args[0]), celString(args[1]), int(group)))
+		}},
+	)}
+}
+
+var memoFunctions = map[string]bool{"parse_kv": true, "split": true, "regex_capture": true}
+
+// memoFunctionCalls returns the memo functions called by the parsed expression, sorted
+func memoFunctionCalls(expr *exprpb.Expr) []string {
+	found := make(map[string]bool)
+	var walk func(e *exprpb.Expr)
+	walk = func(e *exprpb.Expr) {
+		if e == nil {
+			return
+		}
+		switch kind := e.ExprKind.(type) {
+		case *exprpb.Expr_CallExpr:
+			if memoFunctions[kind.CallExpr.Function] {
+				found[kind.CallExpr.Function] = true
+			}
+			walk(kind.CallExpr.Target)
+			for _, arg := range kind.CallExpr.Args {
+				walk(arg)
+			}
+		case *exprpb.Expr_SelectExpr:
+			walk(kind.SelectExpr.Operand)
+		case *exprpb.Expr_ListExpr:
+			for _, elem := range kind.ListExpr.Elements {
+				walk(elem)
+			}
+		case *exprpb.Expr_StructExpr:
+			for _, entry := range kind.StructExpr.Entries {
+				walk(entry.GetMapKey())
+				walk(entry.Value)
+			}
+		case *exprpb.Expr_ComprehensionExpr:
+			c := kind.ComprehensionExpr
+			walk(c.IterRange)
+			walk(c.AccuInit)
+			walk(c.LoopCondition)
+			walk(c.LoopStep)
+			walk(c.Result)
+		}
+	}
+	walk(expr)
+	calls := make([]string, 0, len(found))
+	for name := range found {
+		calls = append(calls, name)
+	}
+	sort.Strings(calls)
+	return calls
+}
+
+func celString(val ref.Val) string {
+	s, _ := val.(types.String)
+	return string(s)
+}
+
+// boundedMemo cuts the string to memoMaxBytes, at a rune boundary
+func boundedMemo(s string) string {
+	if len(s) <= memoMaxBytes {
+		return s
+	}
+	i := memoMaxBytes
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return s[:i]
+}
+
+// splitMemo splits the string around the separator, an empty string has no parts
+func splitMemo(s, sep string) []string {
+	s = boundedMemo(s)
+	if s == "" {
+		return []string{}
+	}
+	parts := strings.SplitN(s, sep, memoMaxParts+1)
+	if len(parts) > memoMaxParts {
+		parts = parts[:memoMaxParts]
+	}
+	return parts
+}
+
+// parseMemoKV parses the 'key1:value1;key2:value2' pairs of the string, with the pair and key value
+// separators. The keys and values are trimmed, the pairs without a separator or a key are ignored
+// and the first pair of a key wins.
+func parseMemoKV(s, pairSep, kvSep string) map[string]string {
+	out := make(map[string]string)
+	if kvSep == "" {
+		return out
+	}
+	pairs := []string{boundedMemo(s)}
+	if pairSep != "" {
+		pairs = splitMemo(s, pairSep)
+	}
+	for _, pair := range pairs {
+		i := strings.Index(pair, kvSep)
+		if i < 0 {
+			continue
+		}
+		key := strings.TrimSpace(pair[:i])
+		if _, found := out[key]; key == "" || found {
+			continue
+		}
+		out[key] = strings.TrimSpace(pair[i+len(kvSep):])
+	}
+	return out
+}
+
+var memoPatterns = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp // nil for an invalid pattern
+}{compiled: make(map[string]*regexp.Regexp)}
+
+func memoPattern(pattern string) *regexp.Regexp {
+	memoPatterns.Lock()
+	defer memoPatterns.Unlock()
+	if re, found := memoPatterns.compiled[pattern]; found {
+		return re
+	}
+	re, _ := regexp.Compile(pattern)
+	if len(memoPatterns.compiled) < memoMaxPatterns {
+		memoPatterns.compiled[pattern] = re
+	}
+	return re
+}
+
+// regexCapture returns the group of the first match of the pattern in the string, empty for an
+// invalid pattern, no match or a group out of range. The regexp package runs in linear time.
+func regexCapture(s, pattern string, group int) string {
+	re := memoPattern(pattern)
+	if re == nil || group < 0 || group > re.NumSubexp() {
+		return ""
+	}
+	match := re.FindStringSubmatch(boundedMemo(s))
+	if match == nil {
+		return ""
+	}
+	return match[group]
+}
+
+// memoField is a key of a memo of the action data copied to the "fields" object of the payload,
+// under the name of the key
+type memoField struct {
+	path []string
+	key  string
+}
+
+// parseMemoFields parses the memo fields per action name, in this format: '{path}:{key}', ex:
+// 'memo:order_id'
+func parseMemoFields(fields map[string][]string) (map[string][]memoField, error) {
+	out := make(map[string][]memoField, len(fields))
+	for action, specs := range fields {
+		for _, spec := range specs {
+			i := strings.LastIndex(spec, ":")
+			if i <= 0 || i == len(spec)-1 {
+				return nil, fmt.Errorf("invalid memo field %q of action %s, expected '{path}:{key}'", spec, action)
+			}
+			out[action] = append(out[action], memoField{
+				path: strings.Split(spec[:i], "."),
+				key:  spec[i+1:],
+			})
+		}
+	}
+	return out, nil
+}
+
+// extractMemoFields adds the keys of the 'key1:value1;key2:value2' memos of the action data to the
+// fields, a missing memo or key is null
+func extractMemoFields(out map[string]interface{}, fields []memoField, jsonData string) error {
+	var data interface{}
+	if jsonData != "" {
+		if err := decodeJSON([]byte(jsonData), &data); err != nil {
+			return classify(failureProjectedField, fmt.Errorf("decoding action data: %w", err))
+		}
+	}
+	for _, field := range fields {
+		out[field.key] = nil
+		if memo, ok := lookupPath(data, field.path).(string); ok {
+			if value, found := parseMemoKV(memo, ";", ":")[field.key]; found {
+				out[field.key] = value
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package dkafka
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMemoKV(t *testing.T) {
+	tests := []struct {
+		name     string
+		memo     string
+		pairSep  string
+		kvSep    string
+		expected map[string]string
+	}{
+		{"pairs", "order:42;ref:abc", ";", ":", map[string]string{"order": "42", "ref": "abc"}},
+		{"trimmed", " order : 42 ; ref: abc ", ";", ":", map[string]string{"order": "42", "ref": "abc"}},
+		{"first pair of a key wins", "order:1;order:2", ";", ":", map[string]string{"order": "1"}},
+		{"value with the separator", "url:https://eos.io", ";", ":", map[string]string{"url": "https://eos.io"}},
+		{"unicode", "commande:héllo;目的:支払い;emoji:🚀", ";", ":", map[string]string{"commande": "héllo", "目的": "支払い", "emoji": "🚀"}},
+		{"unicode separators", "a→1•b→2", "•", "→", map[string]string{"a": "1", "b": "2"}},
+		{"missing key value separator", "order;ref:abc", ";", ":", map[string]string{"ref": "abc"}},
+		{"missing pair separator", "order:42 ref:abc", ";", ":", map[string]string{"order": "42 ref:abc"}},
+		{"no separator at all", "just a memo", ";", ":", map[string]string{}},
+		{"empty key", ":42;ref:abc", ";", ":", map[string]string{"ref": "abc"}},
+		{"empty pair separator", "order:42", "", ":", map[string]string{"order": "42"}},
+		{"empty key value separator", "order:42", ";", "", map[string]string{}},
+		{"empty memo", "", ";", ":", map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, parseMemoKV(test.memo, test.pairSep, test.kvSep))
+		})
+	}
+}
+
+func TestSplitMemo(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, splitMemo("a,b,c", ","))
+	assert.Equal(t, []string{"a", "", "c"}, splitMemo("a,,c", ","))
+	assert.Equal(t, []string{"no separator"}, splitMemo("no separator", ","))
+	assert.Equal(t, []string{"é", "支払い", "🚀"}, splitMemo("é·支払い·🚀", "·"))
+	assert.Equal(t, []string{}, splitMemo("", ","))
+	assert.Len(t, splitMemo(strings.Repeat(",", 1000), ","), memoMaxParts)
+}
+
+func TestRegexCapture(t *testing.T) {
+	assert.Equal(t, "42", regexCapture("ref=42;x", `ref=(\d+)`, 1))
+	assert.Equal(t, "ref=42", regexCapture("ref=42;x", `ref=(\d+)`, 0))
+	assert.Equal(t, "支払い", regexCapture("目的=支払い", `目的=(\S+)`, 1))
+	assert.Equal(t, "", regexCapture("ref=42", `ref=(\d+)`, 2), "group out of range")
+	assert.Equal(t, "", regexCapture("ref=42", `ref=(\d+)`, -1), "negative group")
+	assert.Equal(t, "", regexCapture("no ref", `ref=(\d+)`, 1), "no match")
+	assert.Equal(t, "", regexCapture("ref=42", `ref=(\d+`, 1), "invalid pattern")
+}
+
+func TestBoundedMemoCutsAtRuneBoundary(t *testing.T) {
+	memo := strings.Repeat("a", memoMaxBytes-1) + "é" // the 2 bytes rune crosses the bound
+	bounded := boundedMemo(memo)
+	assert.Equal(t, strings.Repeat("a", memoMaxBytes-1), bounded)
+
+	assert.Equal(t, "short", boundedMemo("short"))
+}
+
+func TestMemoFunctionsBoundTheWorkOnLongMemos(t *testing.T) {
+	long := strings.Repeat("key:value;", 1000000) + "order:42" // 10MB
+
+	started := time.Now()
+	kv := parseMemoKV(long, ";", ":")
+	parts := splitMemo(long, ";")
+	captured := regexCapture(long, `order:(\d+)`, 1)
+	elapsed := time.Since(started)
+
+	assert.Equal(t, map[string]string{"key": "value"}, kv)
+	assert.Len(t, parts, memoMaxParts)
+	assert.Equal(t, "", captured, "the bytes after the bound are ignored")
+	assert.True(t, elapsed < time.Second, "parsing a long memo took %s", elapsed)
+}
+
+func TestMemoFunctionsInExpressions(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{`parse_kv("order:42;ref:abc", ";", ":")["order"]`, "42"},
+		{`size(parse_kv("no pairs", ";", ":"))`, int64(0)},
+		{`split("a,b,c", ",")[1]`, "b"},
+		{`size(split("", ","))`, int64(0)},
+		{`regex_capture("ref=42", "ref=(\\d+)", 1)`, "42"},
+		{`regex_capture("ref=42", "ref=(", 1)`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			prog, err := exprToCelProgram(test.expr)
+			require.NoError(t, err)
+			val, _, err := prog.Eval(map[string]interface{}{})
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, val.Value())
+		})
+	}
+}
+
+func TestIncludeFilterRejectsMemoFunctions(t *testing.T) {
+	err := validateFilterExpr(`action == "transfer" && parse_kv(data.memo, ";", ":")["order"] == "42"`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "include filter expr cannot call parse_kv")
+
+	err = validateFilterExpr(`[split(data.memo, ","), [regex_capture(data.memo, "(x)", 1)]].exists(l, size(l) > 0)`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "include filter expr cannot call regex_capture, split")
+
+	_, err = filterProgram(`split(data.memo, ",")[0] == "a"`)
+	assert.Error(t, err)
+
+	assert.NoError(t, validateFilterExpr(`action == "transfer"`))
+}
+
+func TestExtractMemoFields(t *testing.T) {
+	fields, err := parseMemoFields(map[string][]string{"transfer": {"memo:order_id", "memo:missing", "details.memo:ref"}})
+	require.NoError(t, err)
+
+	out := make(map[string]interface{})
+	require.NoError(t, extractMemoFields(out, fields["transfer"], `{"memo":"order_id:42;note:é","details":{"memo":"ref:支払い"}}`))
+	assert.Equal(t, map[string]interface{}{"order_id": "42", "missing": nil, "ref": "支払い"}, out)
+
+	out = make(map[string]interface{})
+	require.NoError(t, extractMemoFields(out, fields["transfer"], `{"memo":42}`))
+	assert.Equal(t, map[string]interface{}{"order_id": nil, "missing": nil, "ref": nil}, out)
+}
+
+func TestParseMemoFieldsRejectsInvalidSpecs(t *testing.T) {
+	for _, spec := range []string{"memo", ":order_id", "memo:"} {
+		_, err := parseMemoFields(map[string][]string{"transfer": {spec}})
+		assert.Error(t, err, spec)
+	}
+}
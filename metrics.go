@@ -0,0 +1,73 @@
+package dkafka
+
+import (
+	"github.com/dfuse-io/dmetrics"
+)
+
+var MetricsSet = dmetrics.NewSet()
+
+var SuppressedMessages = MetricsSet.NewCounterVec("dkafka_suppressed_messages", []string{"topic"}, "messages suppressed by the dedupe window")
+
+var BlockGaps = MetricsSet.NewCounter("dkafka_block_gaps", "irreversible blocks not following the previous one")
+
+var ExpressionReloads = MetricsSet.NewCounterVec("dkafka_expression_reloads", []string{"status"}, "reloads of the expressions file")
+
+var PipelineMessages = MetricsSet.NewCounterVec("dkafka_pipeline_messages", []string{"pipeline"}, "messages generated per pipeline")
+
+var KafkaBrokerRTT = MetricsSet.NewGaugeVec("dkafka_kafka_broker_rtt_seconds", []string{"broker"}, "average round-trip time to the broker, from the librdkafka statistics")
+
+var KafkaBrokerThrottle = MetricsSet.NewGaugeVec("dkafka_kafka_broker_throttle_seconds", []string{"broker"}, "average throttle time of the broker, from the librdkafka statistics")
+
+var KafkaBrokerOutbufMessages = MetricsSet.NewGaugeVec("dkafka_kafka_broker_outbuf_messages", []string{"broker"}, "messages awaiting transmission to the broker, from the librdkafka statistics")
+
+var KafkaBrokerTxRetries = MetricsSet.NewGaugeVec("dkafka_kafka_broker_tx_retries", []string{"broker"}, "total request retries to the broker, from the librdkafka statistics")
+
+var CursorSaveDuration = MetricsSet.NewHistogram("dkafka_cursor_save_duration_seconds", "time until the delivery of the saved cursor is confirmed by kafka")
+var BlockPhaseDuration = MetricsSet.NewHistogramVec("dkafka_block_phase_duration_seconds", []string{"phase"}, "time spent per block in each phase (receive, adapt and its decode, eval and marshal parts, send)")
+var BlockDuration = MetricsSet.NewHistogram("dkafka_block_duration_seconds", "time from the reception of a block until its messages are sent")
+var BlockMatchedActions = MetricsSet.NewHistogram("dkafka_block_matched_actions", "actions matching the filter per block")
+var BlockProducedMessages = MetricsSet.NewHistogram("dkafka_block_produced_messages", "messages sent per block")
+
+var PolicyFailures = MetricsSet.NewCounterVec("dkafka_policy_failures", []string{"class", "action"}, "failures handled by the error policy, by failure class and applied action")
+
+var BlockLag = MetricsSet.NewGauge("dkafka_block_lag_seconds", "lag of the last processed block behind the wall clock")
+
+var CommitRegime = MetricsSet.NewGaugeVec("dkafka_commit_regime", []string{"regime"}, "active cursor commit regime (live near the chain head, catchup otherwise)")
+
+var CapturedBlocks = MetricsSet.NewCounter("dkafka_captured_blocks", "blocks written to the capture dir")
+var ProducerRecoveries = MetricsSet.NewCounter("dkafka_producer_recoveries", "kafka producers re-created after a fatal error")
+
+var HTTPSinkResponses = MetricsSet.NewCounterVec("dkafka_http_sink_responses", []string{"status"}, "responses of the http sink per status code (\"error\" when no response was received)")
+
+var ValueSchemaViolations = MetricsSet.NewCounterVec("dkafka_value_schema_violations", []string{"ce_type", "pointer"}, "message values not matching their JSON schema, by first failing JSON pointer")
+var DedupSkippedMessages = MetricsSet.NewCounterVec("dkafka_dedup_skipped_messages", []string{"topic"}, "messages not sent as their ce_id was preloaded from the target topic")
+
+var Retries = MetricsSet.NewCounterVec("dkafka_retries", []string{"operation"}, "retries of failed operations, by operation (http_sink, cursor_load, producer_recovery)")
+
+var ProducedBytes = MetricsSet.NewCounterVec("dkafka_produced_bytes", []string{"topic"}, "bytes (key, value and headers) of the messages sent, with the produce byte rate limit")
+var ProduceThrottled = MetricsSet.NewGauge("dkafka_produce_throttled", "1 while a send waits for the produce byte rate limit")
+var ProduceThrottleSeconds = MetricsSet.NewCounterVec("dkafka_produce_throttle_seconds", []string{"topic"}, "time the sends waited for the produce byte rate limit")
+
+var SecondsSinceLastBlock = MetricsSet.NewGauge("dkafka_seconds_since_last_block", "time since the last block was processed (sent), to alert on hangs")
+
+var HeaderBytesSaved = MetricsSet.NewCounter("dkafka_header_bytes_saved", "bytes of the headers removed by the header allowlist")
+
+var ExtensionValuesSanitized = MetricsSet.NewCounterVec("dkafka_extension_values_sanitized", []string{"extension"}, "extension values whose control characters were stripped")
+
+var SampledOutMessages = MetricsSet.NewCounterVec("dkafka_sampled_out_messages", []string{"rule"}, "messages dropped by a sampling rule")
+
+var UndoStepsLastHour = MetricsSet.NewGauge("dkafka_undo_steps_last_hour", "Undo steps streamed in the last hour, to alert on unusual fork activity")
+
+var StreamIdleReconnects = MetricsSet.NewCounter("dkafka_stream_idle_reconnects", "firehose streams opened again after no block was received for the max stream idle time")
+
+var KeySetMessages = MetricsSet.NewCounterVec("dkafka_key_set_messages", []string{"key_set"}, "messages generated per event key set")
+
+var OversizeSkippedActions = MetricsSet.NewCounterVec("dkafka_oversize_skipped_actions", []string{"account", "action"}, "actions skipped before being decoded as their data is above the max action data bytes")
+
+var LeaseHeartbeatFailures = MetricsSet.NewCounter("dkafka_lease_heartbeat_failures", "instance lease heartbeats not written, the instance stops once none was written for the lease ttl")
+
+var FilterReceivedActions = MetricsSet.NewCounterVec("dkafka_filter_received_actions", []string{"account", "action"}, "actions of the transactions delivered by the firehose, the pairs past the label limit are labeled other")
+var FilterMatchedActions = MetricsSet.NewCounterVec("dkafka_filter_matched_actions", []string{"account", "action"}, "delivered actions matching the firehose include filter")
+var FilterMatchRatio = MetricsSet.NewGauge("dkafka_filter_match_ratio", "ratio of the delivered actions matching the firehose include filter over the last summary interval")
+
+var ForcedCommits = MetricsSet.NewCounter("dkafka_forced_commits", "cursor commits forced before the commit delay as the messages or bytes sent since the last commit reached their cap")
@@ -0,0 +1,35 @@
+package dkafka
+
+import (
+	"strings"
+)
+
+// namespaced prefixes the name with the namespace, unless the namespace is empty or the name is
+// already prefixed with it
+func namespaced(namespace string, name string) string {
+	namespace = strings.Trim(namespace, ".")
+	if namespace == "" || name == "" {
+		return name
+	}
+	if strings.HasPrefix(name, namespace+".") {
+		return name
+	}
+	return namespace + "." + strings.TrimLeft(name, ".")
+}
+
+// namespacedEventType prefixes the event type with the namespace, unless it is already a
+// fully-qualified type (containing a dot)
+func namespacedEventType(namespace string, eventType string) string {
+	if strings.Contains(eventType, ".") {
+		return eventType
+	}
+	return namespaced(namespace, eventType)
+}
+
+func (c *Config) topic() string {
+	return namespaced(c.Namespace, c.KafkaTopic)
+}
+
+func (c *Config) cursorTopic() string {
+	return namespaced(c.Namespace, c.KafkaCursorTopic)
+}
@@ -0,0 +1,23 @@
+package dkafka
+
+import (
+	"sync/atomic"
+)
+
+// ordinal is the monotonic sequence number of the messages produced by a dkafka instance,
+// it is persisted with the cursor so it is never reused after a restart
+type ordinal struct {
+	value uint64
+}
+
+func (o *ordinal) next() uint64 {
+	return atomic.AddUint64(&o.value, 1)
+}
+
+func (o *ordinal) current() uint64 {
+	return atomic.LoadUint64(&o.value)
+}
+
+func (o *ordinal) set(value uint64) {
+	atomic.StoreUint64(&o.value, value)
+}
@@ -0,0 +1,80 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+)
+
+const oversizeSkippedEventType = "OversizeSkipped"
+
+// OversizeSkipped is the payload of the stub event replacing an action whose data is above the
+// max action data bytes, so the gap is auditable
+type OversizeSkipped struct {
+	BlockNum       uint32 `json:"block_num"`
+	BlockID        string `json:"block_id"`
+	Step           string `json:"block_step"`
+	TransactionID  string `json:"trx_id"`
+	Account        string `json:"account"`
+	Receiver       string `json:"receiver"`
+	Action         string `json:"action"`
+	GlobalSequence uint64 `json:"global_seq"`
+	DataBytes      int    `json:"data_bytes"`
+}
+
+// actionDataBytes returns the size of the action data, raw or decoded
+func actionDataBytes(act *pbcodec.ActionTrace) int {
+	size := len(act.Action.RawData)
+	if len(act.Action.JsonData) > size {
+		size = len(act.Action.JsonData)
+	}
+	return size
+}
+
+// oversize tells if the action data is above the max action data bytes, it is checked before the
+// action is decoded so the spam actions cost nothing
+func (a *adapter) oversize(act *pbcodec.ActionTrace) bool {
+	if a.maxActionDataBytes <= 0 || actionDataBytes(act) <= a.maxActionDataBytes {
+		return false
+	}
+	OversizeSkippedActions.Inc(act.Account(), act.Name())
+	return true
+}
+
+// oversizeStub emits the stub event of a skipped action, keyed by its account
+func (a *adapter) oversizeStub(blk *pbcodec.Block, trx *pbcodec.TransactionTrace, act *pbcodec.ActionTrace, rawStep string, step string, emit func(*kafka.Message) error) error {
+	var globalSeq uint64
+	if act.Receipt != nil {
+		globalSeq = act.Receipt.GlobalSequence
+	}
+	payload, _ := json.Marshal(OversizeSkipped{
+		BlockNum:       blk.Number,
+		BlockID:        blk.Id,
+		Step:           step,
+		TransactionID:  trx.Id,
+		Account:        act.Account(),
+		Receiver:       act.Receiver,
+		Action:         act.Name(),
+		GlobalSequence: globalSeq,
+		DataBytes:      actionDataBytes(act),
+	})
+	value, err := compressValue(a.compression, canonicalJSON(payload))
+	if err != nil {
+		return err
+	}
+	ceID := hashString(fmt.Sprintf("%s%s%d%s%s", blk.Id, trx.Id, act.ExecutionIndex, rawStep, oversizeSkippedEventType))
+	var undoOf []byte
+	if step == undoStep {
+		undoOf = hashString(fmt.Sprintf("%s%s%d%s%s", blk.Id, trx.Id, act.ExecutionIndex, newStep, oversizeSkippedEventType))
+	}
+	msg, err := a.message(blk, step, ceID, undoOf, oversizeSkippedEventType, nil, []byte(act.Account()), value)
+	if err != nil {
+		if a.errorPolicy.skip(err) {
+			return nil
+		}
+		return err
+	}
+	return emit(msg)
+}
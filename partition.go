@@ -0,0 +1,90 @@
+package dkafka
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+// partitionKeyHeader carries the partition key of the event (CloudEvents partitioning extension),
+// when set the message is sent to the partition of the key rather than of the message key
+const partitionKeyHeader = "ce_partitionkey"
+
+// partitionCountRefresh is the interval the partition counts of the topics are read again at, so
+// the partitions added to a topic are used
+const partitionCountRefresh = 5 * time.Minute
+
+// hashPartition returns the partition of the key, stable across versions and instances
+func hashPartition(key string, partitionCount int) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int32(h.Sum32() % uint32(partitionCount))
+}
+
+type partitionCount struct {
+	count  int
+	readAt time.Time
+}
+
+// partitionKeySender sends the messages holding a partition key header to the partition of the
+// key, the other messages are left as is
+type partitionKeySender struct {
+	Sender
+	producer *kafka.Producer
+	counts   map[string]*partitionCount
+}
+
+func newPartitionKeySender(s Sender, producer *kafka.Producer) *partitionKeySender {
+	return &partitionKeySender{Sender: s, producer: producer, counts: make(map[string]*partitionCount)}
+}
+
+func (s *partitionKeySender) Send(msg *kafka.Message) error {
+	for _, h := range msg.Headers {
+		if h.Key != partitionKeyHeader {
+			continue
+		}
+		count, err := s.partitionCount(*msg.TopicPartition.Topic)
+		if err != nil {
+			return err
+		}
+		msg.TopicPartition.Partition = hashPartition(string(h.Value), count)
+		break
+	}
+	return s.Sender.Send(msg)
+}
+
+// partitionCount returns the partition count of the topic, read again after the refresh interval;
+// the last count is kept if the metadata cannot be read
+func (s *partitionKeySender) partitionCount(topic string) (int, error) {
+	c, ok := s.counts[topic]
+	if ok && time.Since(c.readAt) < partitionCountRefresh {
+		return c.count, nil
+	}
+	md, err := s.producer.GetMetadata(&topic, false, 5000)
+	if err == nil {
+		err = topicMetadataError(md, topic)
+	}
+	if err == nil && len(md.Topics[topic].Partitions) == 0 {
+		err = fmt.Errorf("topic %q does not exist", topic)
+	}
+	if err != nil {
+		if ok {
+			zlog.Warn("cannot read the partition count, keeping the last one", zap.String("topic", topic), zap.Int("partition_count", c.count), zap.Error(err))
+			c.readAt = time.Now()
+			return c.count, nil
+		}
+		return 0, fmt.Errorf("getting the partition count of %s: %w", topic, err)
+	}
+	count := len(md.Topics[topic].Partitions)
+	if !ok || c.count != count {
+		zlog.Info("partitioning the messages by partition key", zap.String("topic", topic), zap.Int("partition_count", count))
+		c = &partitionCount{}
+		s.counts[topic] = c
+	}
+	c.count = count
+	c.readAt = time.Now()
+	return count, nil
+}
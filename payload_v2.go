@@ -0,0 +1,125 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// payload versions, sent as the ce_dataschema header
+const (
+	payloadV1 = "v1"
+	payloadV2 = "v2"
+)
+
+func validatePayloadVersion(version string) error {
+	switch version {
+	case "", payloadV1, payloadV2:
+		return nil
+	}
+	return fmt.Errorf("invalid payload version %q, must be one of: v1, v2", version)
+}
+
+func payloadDataSchema(version string) string {
+	if version == "" {
+		version = payloadV1
+	}
+	return "urn:dkafka:payload:" + version
+}
+
+// ActionV2 is the action of the v2 payloads, its db ops are moved to the event
+type ActionV2 struct {
+	Account        string                 `json:"account"`
+	Receiver       string                 `json:"receiver"`
+	Name           string                 `json:"name"`
+	GlobalSequence uint64                 `json:"global_seq"`
+	Authorizations []string               `json:"authorizations"`
+	Data           *json.RawMessage       `json:"data"`
+	RamDeltas      []RamDelta             `json:"ram_deltas,omitempty"` // only included on demand
+	CodeHash       string                 `json:"code_hash,omitempty"`
+	Console        string                 `json:"console,omitempty"` // only included on demand
+	Fields         map[string]interface{} `json:"fields,omitempty"`  // projected from the data, for the configured actions
+}
+
+// EventV2 is the v2 payload of the messages, "act_info" becomes "action" and the db ops are at the
+// top level
+type EventV2 struct {
+	BlockNum      uint32   `json:"block_num"`
+	BlockID       string   `json:"block_id"`
+	Status        string   `json:"status"`
+	Executed      bool     `json:"executed"`
+	Step          string   `json:"block_step"`
+	TransactionID string   `json:"trx_id"`
+	Action        ActionV2 `json:"action"`
+	DBOps         []*DBOp  `json:"db_ops"`
+	Key           string   `json:"_key,omitempty"` // message key, only embedded on demand
+}
+
+// TransactionEventV2 is the v2 payload of the messages with the transaction granularity, the db ops
+// of all the actions are at the top level, in execution order
+type TransactionEventV2 struct {
+	BlockNum      uint32     `json:"block_num"`
+	BlockID       string     `json:"block_id"`
+	Status        string     `json:"status"`
+	Executed      bool       `json:"executed"`
+	Step          string     `json:"block_step"`
+	TransactionID string     `json:"trx_id"`
+	Actions       []ActionV2 `json:"actions"`
+	DBOps         []*DBOp    `json:"db_ops"`
+	Key           string     `json:"_key,omitempty"` // message key, only embedded on demand
+}
+
+func newActionV2(info ActionInfo) ActionV2 {
+	return ActionV2{
+		Account:        info.Account,
+		Receiver:       info.Receiver,
+		Name:           info.Action,
+		GlobalSequence: info.GlobalSequence,
+		Authorizations: info.Authorization,
+		Data:           info.JSONData,
+		RamDeltas:      info.RamDeltas,
+		CodeHash:       info.CodeHash,
+		Console:        info.Console,
+		Fields:         info.Fields,
+	}
+}
+
+// marshalEvent returns the canonical JSON payload of the event in the given version
+func marshalEvent(version string, e *Event) []byte {
+	if version != payloadV2 {
+		return canonicalJSON(e.JSON())
+	}
+	b, _ := json.Marshal(EventV2{
+		BlockNum:      e.BlockNum,
+		BlockID:       e.BlockID,
+		Status:        e.Status,
+		Executed:      e.Executed,
+		Step:          e.Step,
+		TransactionID: e.TransactionID,
+		Action:        newActionV2(e.ActionInfo),
+		DBOps:         e.ActionInfo.DBOps,
+		Key:           e.Key,
+	})
+	return canonicalJSON(b)
+}
+
+// marshalTransactionEvent returns the canonical JSON payload of the transaction event in the given version
+func marshalTransactionEvent(version string, e *TransactionEvent) []byte {
+	if version != payloadV2 {
+		return canonicalJSON(e.JSON())
+	}
+	v2 := TransactionEventV2{
+		BlockNum:      e.BlockNum,
+		BlockID:       e.BlockID,
+		Status:        e.Status,
+		Executed:      e.Executed,
+		Step:          e.Step,
+		TransactionID: e.TransactionID,
+		Key:           e.Key,
+	}
+	for _, info := range e.ActionInfos {
+		v2.Actions = append(v2.Actions, newActionV2(info))
+		v2.DBOps = append(v2.DBOps, info.DBOps...)
+	}
+	b, _ := json.Marshal(v2)
+	return canonicalJSON(b)
+}
@@ -0,0 +1,89 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+)
+
+// PipelineConfig generates events to its own topic from the actions matching its filter, several
+// pipelines share a single block stream and cursor
+type PipelineConfig struct {
+	Name              string            `json:"name" yaml:"name"`
+	IncludeFilterExpr string            `json:"include_filter_expr" yaml:"include_filter_expr"`
+	KafkaTopic        string            `json:"kafka_topic" yaml:"kafka_topic"`
+	EventSource       string            `json:"event_source" yaml:"event_source"`
+	EventTypeExpr     string            `json:"event_type_expr" yaml:"event_type_expr"`
+	EventKeysExpr     string            `json:"event_keys_expr" yaml:"event_keys_expr"`
+	EventExtensions   map[string]string `json:"event_extensions" yaml:"event_extensions"`
+	EventSubjectExpr  string            `json:"event_subject_expr" yaml:"event_subject_expr"`
+}
+
+// LoadPipelines reads the pipelines from a JSON file holding an array of pipelines
+func LoadPipelines(filename string) ([]PipelineConfig, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading pipelines file: %w", err)
+	}
+	var pipelines []PipelineConfig
+	if err := json.Unmarshal(content, &pipelines); err != nil {
+		return nil, fmt.Errorf("decoding pipelines file: %w", err)
+	}
+	return pipelines, nil
+}
+
+func (p PipelineConfig) validate() (errs []error) {
+	if p.Name == "" {
+		errs = append(errs, fmt.Errorf("pipeline name is required"))
+	}
+	if p.KafkaTopic == "" {
+		errs = append(errs, fmt.Errorf("pipeline %s: kafka topic is required", p.Name))
+	}
+	if err := validateFilterExpr(p.IncludeFilterExpr); err != nil {
+		errs = append(errs, fmt.Errorf("pipeline %s: %w", p.Name, err))
+	}
+	if _, err := compileExpressions(p.expressions()); err != nil {
+		errs = append(errs, fmt.Errorf("pipeline %s: %w", p.Name, err))
+	}
+	return
+}
+
+func (p PipelineConfig) expressions() Expressions {
+	return Expressions{
+		EventTypeExpr:    p.EventTypeExpr,
+		EventKeysExpr:    p.EventKeysExpr,
+		EventExtensions:  p.EventExtensions,
+		EventSubjectExpr: p.EventSubjectExpr,
+	}
+}
+
+// pipelinesFilter returns the firehose filter matching the actions of any of the pipelines
+func pipelinesFilter(pipelines []PipelineConfig) string {
+	var clauses []string
+	for _, p := range pipelines {
+		if isMatchAllFilter(p.IncludeFilterExpr) {
+			return ""
+		}
+		clauses = append(clauses, fmt.Sprintf("(%s)", p.IncludeFilterExpr))
+	}
+	return strings.Join(clauses, " || ")
+}
+
+func isMatchAllFilter(expr string) bool {
+	stripped := strings.TrimSpace(expr)
+	return stripped == "" || stripped == "true" || stripped == "*"
+}
+
+// filterProgram returns the program matching the actions of a pipeline, nil if it matches all of them
+func filterProgram(expr string) (cel.Program, error) {
+	if isMatchAllFilter(expr) {
+		return nil, nil
+	}
+	if err := validateFilterExpr(expr); err != nil {
+		return nil, err
+	}
+	return exprToCelProgram(expr)
+}
@@ -0,0 +1,57 @@
+package dkafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+// ErrProducerFenced is returned when another producer with the same transactional ID took over
+var ErrProducerFenced = errors.New("kafka producer fenced, another dkafka instance with the same transaction id is running")
+
+// fatalProducerError is a librdkafka fatal error, after which the producer cannot be used anymore
+type fatalProducerError struct {
+	err kafka.Error
+}
+
+func (e *fatalProducerError) Error() string {
+	return fmt.Sprintf("fatal kafka producer error: %s", e.err)
+}
+
+func (e *fatalProducerError) Unwrap() error {
+	return e.err
+}
+
+func (e *fatalProducerError) fenced() bool {
+	return e.err.Code() == kafka.ErrFenced
+}
+
+// asFatalProducerError returns the fatal producer error wrapped in err, if any
+func asFatalProducerError(err error) (*fatalProducerError, bool) {
+	var fatal *fatalProducerError
+	if errors.As(err, &fatal) {
+		return fatal, true
+	}
+	var kafkaErr kafka.Error
+	if errors.As(err, &kafkaErr) && kafkaErr.IsFatal() {
+		return &fatalProducerError{err: kafkaErr}, true
+	}
+	return nil, false
+}
+
+// closeFatalProducer aborts the in-flight transaction, if any, and closes the producer, both are
+// best effort as the producer is in a fatal state
+func closeFatalProducer(producer *kafka.Producer, useTransactions bool) {
+	if useTransactions {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := producer.AbortTransaction(ctx); err != nil {
+			zlog.Warn("cannot abort the transaction of the failed producer", zap.Error(err))
+		}
+	}
+	producer.Close()
+}
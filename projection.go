@@ -0,0 +1,117 @@
+package dkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// projected field types
+const (
+	projectedString = "string"
+	projectedLong   = "long"
+	projectedDouble = "double"
+	projectedBool   = "bool"
+)
+
+// projectedField is a field of the action data copied to the "fields" object of the payload,
+// its name is the path with the dots replaced by underscores
+type projectedField struct {
+	name string
+	path []string
+	typ  string
+}
+
+// parseProjectedFields parses the fields per action name, in this format: '{path}:{type}', ex:
+// 'quantity:string', 'owner.id:long'
+func parseProjectedFields(fields map[string][]string) (map[string][]projectedField, error) {
+	out := make(map[string][]projectedField, len(fields))
+	for action, specs := range fields {
+		for _, spec := range specs {
+			i := strings.LastIndex(spec, ":")
+			if i <= 0 {
+				return nil, fmt.Errorf("invalid projected field %q of action %s, expected '{path}:{type}'", spec, action)
+			}
+			path, typ := spec[:i], spec[i+1:]
+			switch typ {
+			case projectedString, projectedLong, projectedDouble, projectedBool:
+			default:
+				return nil, fmt.Errorf("invalid projected field type %q of action %s, must be one of: string, long, double, bool", typ, action)
+			}
+			out[action] = append(out[action], projectedField{
+				name: strings.Replace(path, ".", "_", -1),
+				path: strings.Split(path, "."),
+				typ:  typ,
+			})
+		}
+	}
+	return out, nil
+}
+
+// projectFields extracts the fields from the action data, the missing fields are null and a value
+// of another type fails with the projected_field failure class
+func projectFields(fields []projectedField, jsonData string) (map[string]interface{}, error) {
+	var data interface{}
+	if jsonData != "" {
+		if err := decodeJSON([]byte(jsonData), &data); err != nil {
+			return nil, classify(failureProjectedField, fmt.Errorf("decoding action data: %w", err))
+		}
+	}
+
+	out := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		v := lookupPath(data, field.path)
+		if v == nil {
+			out[field.name] = nil
+			continue
+		}
+		converted, err := convertProjected(v, field.typ)
+		if err != nil {
+			return nil, classify(failureProjectedField, fmt.Errorf("projecting field %s: %w", strings.Join(field.path, "."), err))
+		}
+		out[field.name] = converted
+	}
+	return out, nil
+}
+
+func lookupPath(data interface{}, path []string) interface{} {
+	for _, name := range path {
+		obj, ok := data.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		data = obj[name]
+	}
+	return data
+}
+
+// convertProjected converts the JSON value to the type, the 64 bits integers encoded as strings
+// by the chain are accepted as long and double
+func convertProjected(v interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case projectedString:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case projectedBool:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case projectedLong:
+		switch n := v.(type) {
+		case json.Number:
+			return strconv.ParseInt(n.String(), 10, 64)
+		case string:
+			return strconv.ParseInt(n, 10, 64)
+		}
+	case projectedDouble:
+		switch n := v.(type) {
+		case json.Number:
+			return strconv.ParseFloat(n.String(), 64)
+		case string:
+			return strconv.ParseFloat(n, 64)
+		}
+	}
+	return nil, fmt.Errorf("expected a %s, got %v", typ, v)
+}
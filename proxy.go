@@ -0,0 +1,153 @@
+package dkafka
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// grpcProxy returns the proxy of the connections to addr: the grpc proxy url if set, the proxy
+// of the HTTPS_PROXY and NO_PROXY environment variables otherwise, nil for a direct connection
+func grpcProxy(conf *Config, addr string) (*url.URL, error) {
+	if conf.GRPCProxyURL != "" {
+		return parseProxyURL(conf.GRPCProxyURL)
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+}
+
+func parseProxyURL(raw string) (*url.URL, error) {
+	proxy, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid grpc proxy url: %w", err)
+	}
+	if proxy.Scheme != "http" && proxy.Scheme != "https" {
+		return nil, fmt.Errorf("invalid grpc proxy url scheme %q, must be http or https", proxy.Scheme)
+	}
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("invalid grpc proxy url %q, no host", redactedURL(proxy))
+	}
+	return proxy, nil
+}
+
+// redactedURL hides the password of the proxy url in the logs and errors
+func redactedURL(u *url.URL) string {
+	if _, found := u.User.Password(); !found {
+		return u.String()
+	}
+	redacted := *u
+	redacted.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return redacted.String()
+}
+
+// logGRPCProxy states the proxy of the connections to the dfuse endpoint at startup
+func logGRPCProxy(conf *Config, addr string) error {
+	proxy, err := grpcProxy(conf, addr)
+	if err != nil {
+		return err
+	}
+	switch {
+	case proxy == nil:
+		zlog.Info("no proxy in effect, connecting directly to the dfuse endpoint", zap.String("address", addr))
+	case conf.GRPCProxyURL != "":
+		zlog.Info("connecting to the dfuse endpoint through the configured proxy", zap.String("address", addr), zap.String("proxy", redactedURL(proxy)))
+	default:
+		zlog.Info("connecting to the dfuse endpoint through the environment proxy", zap.String("address", addr), zap.String("proxy", redactedURL(proxy)))
+	}
+	return nil
+}
+
+// proxyDialer dials the grpc connections, through a CONNECT tunnel when a proxy is in effect.
+// The grpc default dialer only honors the environment proxy and has no credentials support
+func proxyDialer(conf *Config) func(ctx context.Context, addr string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		proxy, err := grpcProxy(conf, addr)
+		if err != nil {
+			return nil, err
+		}
+		var dialer net.Dialer
+		if proxy == nil {
+			return dialer.DialContext(ctx, "tcp", addr)
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", proxyAddr(proxy))
+		if err != nil {
+			return nil, fmt.Errorf("connecting to proxy %s: %w", redactedURL(proxy), err)
+		}
+		if proxy.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("tls handshake with proxy %s: %w", redactedURL(proxy), err)
+			}
+			conn = tlsConn
+		}
+		tunnel, err := connectTunnel(ctx, conn, proxy, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tunnel, nil
+	}
+}
+
+func proxyAddr(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	if proxy.Scheme == "https" {
+		return net.JoinHostPort(proxy.Hostname(), "443")
+	}
+	return net.JoinHostPort(proxy.Hostname(), "80")
+}
+
+// connectTunnel asks the proxy for a tunnel to addr, with the basic credentials of the proxy url
+func connectTunnel(ctx context.Context, conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if deadline, found := ctx.Deadline(); found {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("sending CONNECT %s to proxy %s: %w", addr, redactedURL(proxy), err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("reading CONNECT %s response of proxy %s: %w", addr, redactedURL(proxy), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy %s refused CONNECT %s: %s", redactedURL(proxy), addr, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the bytes the proxy sent right after its CONNECT response first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
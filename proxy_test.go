@@ -0,0 +1,100 @@
+package dkafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testConnectProxy accepts a CONNECT request per connection, answers it with the status and,
+// once the tunnel is established, writes as the tunneled server would
+func testConnectProxy(t *testing.T, status int) (string, <-chan *http.Request) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	requests := make(chan *http.Request, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				requests <- req
+				resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1, Body: http.NoBody}
+				resp.Write(conn)
+				if status == http.StatusOK {
+					conn.Write([]byte("tunneled"))
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+func TestProxyDialerTunnelsThroughTheProxy(t *testing.T) {
+	proxyAddr, requests := testConnectProxy(t, http.StatusOK)
+	dial := proxyDialer(&Config{GRPCProxyURL: "http://dkafka:s3cr3t@" + proxyAddr})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, "firehose.example.com:443")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	req := <-requests
+	assert.Equal(t, http.MethodConnect, req.Method)
+	assert.Equal(t, "firehose.example.com:443", req.Host)
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("dkafka:s3cr3t")), req.Header.Get("Proxy-Authorization"))
+	received, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "tunneled", string(received))
+}
+
+func TestProxyDialerRefusedTunnel(t *testing.T) {
+	proxyAddr, _ := testConnectProxy(t, http.StatusProxyAuthRequired)
+	dial := proxyDialer(&Config{GRPCProxyURL: "http://dkafka:wrong@" + proxyAddr})
+
+	_, err := dial(context.Background(), "firehose.example.com:443")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "refused CONNECT firehose.example.com:443: 407")
+	assert.NotContains(t, err.Error(), "wrong")
+}
+
+func TestProxyDialerHandshakeHonorsTheDeadline(t *testing.T) {
+	// accepts the connections and never answers the TLS handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	dial := proxyDialer(&Config{GRPCProxyURL: "https://" + listener.Addr().String()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err = dial(ctx, "firehose.example.com:443")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "tls handshake with proxy")
+	assert.True(t, time.Since(started) < 5*time.Second, "returned after %s", time.Since(started))
+}
@@ -4,11 +4,12 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"reflect"
 	"strings"
 
 	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
-
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
 	"github.com/google/cel-go/cel"
 )
 
@@ -21,16 +22,21 @@ type extension struct {
 var irreversibleOnly = false
 
 type ActionInfo struct {
-	Account        string           `json:"account"`
-	Receiver       string           `json:"receiver"`
-	Action         string           `json:"action"`
-	GlobalSequence uint64           `json:"global_seq"`
-	Authorization  []string         `json:"authorizations"`
-	DBOps          []*pbcodec.DBOp  `json:"db_ops"`
-	JSONData       *json.RawMessage `json:"json_data"`
+	Account        string                 `json:"account"`
+	Receiver       string                 `json:"receiver"`
+	Action         string                 `json:"action"`
+	GlobalSequence uint64                 `json:"global_seq"`
+	Authorization  []string               `json:"authorizations"`
+	DBOps          []*DBOp                `json:"db_ops"`
+	RamDeltas      []RamDelta             `json:"ram_deltas,omitempty"` // only included on demand
+	JSONData       *json.RawMessage       `json:"json_data"`
+	CodeHash       string                 `json:"code_hash,omitempty"`
+	Console        string                 `json:"console,omitempty"` // only included on demand
+	Fields         map[string]interface{} `json:"fields,omitempty"`  // projected from the data, for the configured actions
 }
 
-type event struct {
+// Event is the payload of the messages, its JSON field names are stable
+type Event struct {
 	BlockNum      uint32     `json:"block_num"`
 	BlockID       string     `json:"block_id"`
 	Status        string     `json:"status"`
@@ -38,14 +44,33 @@ type event struct {
 	Step          string     `json:"block_step"`
 	TransactionID string     `json:"trx_id"`
 	ActionInfo    ActionInfo `json:"act_info"`
+	Key           string     `json:"_key,omitempty"` // message key, only embedded on demand
 }
 
-func (e event) JSON() []byte {
+func (e Event) JSON() []byte {
 	b, _ := json.Marshal(e)
 	return b
 
 }
 
+// TransactionEvent is the payload of the messages with the transaction granularity, holding all
+// the matching actions of the transaction
+type TransactionEvent struct {
+	BlockNum      uint32       `json:"block_num"`
+	BlockID       string       `json:"block_id"`
+	Status        string       `json:"status"`
+	Executed      bool         `json:"executed"`
+	Step          string       `json:"block_step"`
+	TransactionID string       `json:"trx_id"`
+	ActionInfos   []ActionInfo `json:"act_infos"`
+	Key           string       `json:"_key,omitempty"` // message key, only embedded on demand
+}
+
+func (e TransactionEvent) JSON() []byte {
+	b, _ := json.Marshal(e)
+	return b
+}
+
 func hashString(data string) []byte {
 	h := sha256.New()
 	h.Write([]byte(data))
@@ -67,6 +92,18 @@ func evalString(prog cel.Program, activation interface{}) (string, error) {
 	return out.(string), nil
 }
 
+func evalBool(prog cel.Program, activation interface{}) (bool, error) {
+	res, _, err := prog.Eval(activation)
+	if err != nil {
+		return false, err
+	}
+	out, ok := res.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a bool, got %T", res.Value())
+	}
+	return out, nil
+}
+
 func evalStringArray(prog cel.Program, activation interface{}) ([]string, error) {
 	res, _, err := prog.Eval(activation)
 	if err != nil {
@@ -82,6 +119,18 @@ func evalStringArray(prog cel.Program, activation interface{}) ([]string, error)
 func sanitizeStep(step string) string {
 	return strings.Title(strings.TrimPrefix(step, "STEP_"))
 }
+
+// undoStep is the sanitized step of the Undo blocks, in the block_step field and ce_blkstep header
+var undoStep = sanitizeStep(pbbstream.ForkStep_STEP_UNDO.String())
+
 func sanitizeStatus(status string) string {
 	return strings.Title(strings.TrimPrefix(status, "TRANSACTIONSTATUS_"))
 }
+
+// trxStatus returns the sanitized status of the transaction, "None" if it has no receipt
+func trxStatus(trx *pbcodec.TransactionTrace) string {
+	if trx.Receipt == nil {
+		return sanitizeStatus(pbcodec.TransactionStatus_TRANSACTIONSTATUS_NONE.String())
+	}
+	return sanitizeStatus(trx.Receipt.Status.String())
+}
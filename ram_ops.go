@@ -0,0 +1,29 @@
+package dkafka
+
+import (
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+)
+
+// RamDelta is a RAM usage change of an account caused by an action
+type RamDelta struct {
+	Payer string `json:"payer"`
+	Delta int64  `json:"delta"` // bytes
+	Usage uint64 `json:"usage"` // RAM used by the payer after the change, in bytes
+}
+
+func newRamDeltas(ops []*pbcodec.RAMOp) []RamDelta {
+	deltas := make([]RamDelta, 0, len(ops))
+	for _, op := range ops {
+		deltas = append(deltas, RamDelta{Payer: op.Payer, Delta: op.Delta, Usage: op.Usage})
+	}
+	return deltas
+}
+
+// ramDelta returns the net RAM usage change caused by the action, all payers included
+func ramDelta(trx *pbcodec.TransactionTrace, act *pbcodec.ActionTrace) int64 {
+	var delta int64
+	for _, op := range trx.RAMOpsForAction(act.ExecutionIndex) {
+		delta += op.Delta
+	}
+	return delta
+}
@@ -0,0 +1,100 @@
+package dkafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// tokenBucket allows a rate of bytes per second, with bursts of up to one second of rate
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	return &tokenBucket{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket and returns the wait until they are available, the
+// bucket goes into debt so a message larger than the burst waits for its whole size
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimitedSender delays the sends exceeding the byte rate of all the topics or of the
+// message topic. The sends are delayed in order, the cursor committed after them still follows
+// their messages.
+type rateLimitedSender struct {
+	Sender
+	ctx    context.Context // interrupts the wait
+	global *tokenBucket    // nil if only some topics are limited
+	topics map[string]*tokenBucket
+}
+
+func newRateLimitedSender(ctx context.Context, next Sender, bytesPerSecond int64, topicBytesPerSecond map[string]int64) *rateLimitedSender {
+	s := &rateLimitedSender{Sender: next, ctx: ctx, topics: make(map[string]*tokenBucket)}
+	if bytesPerSecond > 0 {
+		s.global = newTokenBucket(bytesPerSecond)
+	}
+	for topic, rate := range topicBytesPerSecond {
+		s.topics[topic] = newTokenBucket(rate)
+	}
+	return s
+}
+
+func (s *rateLimitedSender) Send(msg *kafka.Message) error {
+	var topic string
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	size := messageSize(msg)
+	now := time.Now()
+	var wait time.Duration
+	if s.global != nil {
+		wait = s.global.reserve(size, now)
+	}
+	if bucket, ok := s.topics[topic]; ok {
+		if topicWait := bucket.reserve(size, now); topicWait > wait {
+			wait = topicWait
+		}
+	}
+
+	if wait > 0 {
+		ProduceThrottled.SetUint64(1)
+		select {
+		case <-s.ctx.Done():
+			ProduceThrottled.SetUint64(0)
+			return fmt.Errorf("rate limited send interrupted: %w", s.ctx.Err())
+		case <-time.After(wait):
+		}
+		ProduceThrottled.SetUint64(0)
+		ProduceThrottleSeconds.AddFloat64(wait.Seconds(), topic)
+	}
+	if err := s.Sender.Send(msg); err != nil {
+		return err
+	}
+	ProducedBytes.AddInt(size, topic)
+	return nil
+}
+
+// messageSize is the size of the key, value and headers of the message
+func messageSize(msg *kafka.Message) int {
+	size := len(msg.Key) + len(msg.Value)
+	for _, h := range msg.Headers {
+		size += len(h.Key) + len(h.Value)
+	}
+	return size
+}
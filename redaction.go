@@ -0,0 +1,236 @@
+package dkafka
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	"go.uber.org/zap"
+)
+
+// redaction modes
+const (
+	redactDrop    = "drop"
+	redactMask    = "mask"
+	redactHMAC    = "hmac"
+	redactEncrypt = "encrypt"
+)
+
+const redactedMask = "[REDACTED]"
+
+// encryptedPrefix marks the values encrypted with AES-GCM, followed by the base64 of the nonce
+// and the sealed JSON value
+const encryptedPrefix = "enc:v1:"
+
+type redactedField struct {
+	path []string
+	mode string
+}
+
+// redactor rewrites the sensitive fields of the action data in the blocks, before any
+// expression or payload sees them. The binary data of the redacted actions, and of the db ops of
+// the redacted tables, is dropped as it cannot be redacted by path.
+type redactor struct {
+	fields  map[string][]redactedField // per action name
+	tables  map[string]bool
+	hmacKey []byte
+	aead    cipher.AEAD
+}
+
+// newRedactor parses the fields per action name, in this format: '{path}:{drop|mask|hmac|encrypt}',
+// the keys are resolved by resolveSecret
+func newRedactor(fields map[string][]string, tables []string, hmacKey string, encryptionKey string) (*redactor, error) {
+	r := &redactor{fields: make(map[string][]redactedField), tables: make(map[string]bool)}
+	needsHMAC, needsEncryption := false, false
+	for action, specs := range fields {
+		for _, spec := range specs {
+			i := strings.LastIndex(spec, ":")
+			if i <= 0 {
+				return nil, fmt.Errorf("invalid redacted field %q of action %s, expected '{path}:{mode}'", spec, action)
+			}
+			mode := spec[i+1:]
+			switch mode {
+			case redactDrop, redactMask:
+			case redactHMAC:
+				needsHMAC = true
+			case redactEncrypt:
+				needsEncryption = true
+			default:
+				return nil, fmt.Errorf("invalid redaction mode %q of action %s, must be one of: drop, mask, hmac, encrypt", mode, action)
+			}
+			r.fields[action] = append(r.fields[action], redactedField{path: strings.Split(spec[:i], "."), mode: mode})
+		}
+	}
+	for _, table := range tables {
+		r.tables[table] = true
+	}
+
+	if needsHMAC {
+		key, err := resolveSecret(hmacKey)
+		if err != nil {
+			return nil, fmt.Errorf("resolving the redact hmac key: %w", err)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("the hmac redaction mode requires a redact hmac key")
+		}
+		r.hmacKey = []byte(key)
+	}
+	if needsEncryption {
+		encoded, err := resolveSecret(encryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("resolving the redact encryption key: %w", err)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decoding the redact encryption key, expected base64: %w", err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("the redact encryption key must be 16, 24 or 32 bytes: %w", err)
+		}
+		if r.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// SecretValues maps names to literal, "env:{name}" or "file:{path}" values, its literal values are
+// redacted when it is logged
+type SecretValues map[string]string
+
+// MarshalJSON keeps the references, which are not secret, and redacts the literal values
+func (v SecretValues) MarshalJSON() ([]byte, error) {
+	out := make(map[string]string, len(v))
+	for name, value := range v {
+		if strings.HasPrefix(value, "env:") || strings.HasPrefix(value, "file:") {
+			out[name] = value
+		} else {
+			out[name] = "[redacted]"
+		}
+	}
+	return json.Marshal(out)
+}
+
+// resolveSecret returns the value of "env:{name}" and "file:{path}" references, other values as is
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, "file:"):
+		content, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return value, nil
+}
+
+// redact rewrites the block in place
+func (r *redactor) redact(blk *pbcodec.Block) {
+	for _, trx := range blk.TransactionTraces() {
+		for _, act := range trx.ActionTraces {
+			if act.Action == nil {
+				continue
+			}
+			fields, ok := r.fields[act.Name()]
+			if !ok {
+				continue
+			}
+			data, err := r.redactData(act.Action.JsonData, fields)
+			if err != nil {
+				// fail closed, the data is dropped rather than leaked
+				zlog.Warn("cannot redact the action data, dropping it", zap.String("action", act.Name()), zap.String("trx_id", trx.Id), zap.Error(err))
+				data = ""
+			}
+			act.Action.JsonData = data
+			act.Action.RawData = nil
+		}
+		if len(r.tables) == 0 {
+			continue
+		}
+		for _, op := range trx.DbOps {
+			if r.tables[op.TableName] {
+				op.OldData = nil
+				op.NewData = nil
+			}
+		}
+	}
+}
+
+func (r *redactor) redactData(jsonData string, fields []redactedField) (string, error) {
+	if jsonData == "" {
+		return "", nil
+	}
+	var data interface{}
+	if err := decodeJSON([]byte(jsonData), &data); err != nil {
+		return "", err
+	}
+	for _, field := range fields {
+		parent, ok := lookupPath(data, field.path[:len(field.path)-1]).(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name := field.path[len(field.path)-1]
+		v, found := parent[name]
+		if !found {
+			continue
+		}
+		if field.mode == redactDrop {
+			delete(parent, name)
+			continue
+		}
+		redacted, err := r.redactValue(v, field.mode)
+		if err != nil {
+			return "", err
+		}
+		parent[name] = redacted
+	}
+	out, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// redactValue masks, hashes or encrypts the value, the strings are hashed as is and the other
+// values by their JSON encoding
+func (r *redactor) redactValue(v interface{}, mode string) (string, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	switch mode {
+	case redactHMAC:
+		if s, ok := v.(string); ok {
+			raw = []byte(s)
+		}
+		mac := hmac.New(sha256.New, r.hmacKey)
+		mac.Write(raw)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	case redactEncrypt:
+		nonce := make([]byte, r.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return "", err
+		}
+		return encryptedPrefix + base64.StdEncoding.EncodeToString(r.aead.Seal(nonce, nonce, raw, nil)), nil
+	}
+	return redactedMask, nil
+}
@@ -0,0 +1,123 @@
+package dkafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRedactedEmail = "alice@example.com"
+
+var testRedactionKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+// testRedactedBlock returns a transfer block whose memo and db op data hold the email
+func testRedactedBlock() *pbcodec.Block {
+	blk := testTransferBlock(10, 1)
+	trx := blk.UnfilteredTransactionTraces[0]
+	act := trx.ActionTraces[0]
+	act.Action.JsonData = `{"from":"alice","to":"bob0","quantity":"1.0000 EOS","memo":"` + testRedactedEmail + `"}`
+	act.Action.RawData = []byte(testRedactedEmail)
+	trx.DbOps = []*pbcodec.DBOp{{
+		Operation:  pbcodec.DBOp_OPERATION_UPDATE,
+		Code:       "eosio.token",
+		Scope:      "alice",
+		TableName:  "accounts",
+		PrimaryKey: "alice",
+		OldData:    []byte(testRedactedEmail),
+		NewData:    []byte(testRedactedEmail),
+	}}
+	return blk
+}
+
+// produced returns the bytes of the messages sent to kafka
+func produced(msgs []*kafka.Message) []byte {
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		buf.Write(msg.Key)
+		buf.Write(msg.Value)
+		for _, h := range msg.Headers {
+			buf.WriteString(h.Key)
+			buf.Write(h.Value)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestRedactionLeavesNoRawValue(t *testing.T) {
+	for _, mode := range []string{redactDrop, redactMask, redactHMAC, redactEncrypt} {
+		t.Run(mode, func(t *testing.T) {
+			config := validTestConfig()
+			config.EventKeysExpr = `[data.from, has(data.memo) ? string(data.memo) : "none"]`
+			config.EventExtensions = map[string]string{"memo": `has(data.memo) ? string(data.memo) : "none"`}
+			config.RedactFields = map[string][]string{"transfer": {"memo:" + mode}}
+			config.RedactTables = []string{"accounts"}
+			config.RedactHMACKey = "hmac-key"
+			config.RedactEncryptionKey = testRedactionKey
+			redactor, err := newRedactor(config.RedactFields, config.RedactTables, config.RedactHMACKey, config.RedactEncryptionKey)
+			require.NoError(t, err)
+
+			blk := testRedactedBlock()
+			redactor.redact(blk)
+			msgs, err := testAdapter(t, config).Adapt(context.Background(), blk, pbbstream.ForkStep_STEP_NEW.String())
+			require.NoError(t, err)
+			require.Len(t, msgs, 2)
+			assert.NotContains(t, string(produced(msgs)), testRedactedEmail)
+
+			// the block written to the capture dir when its events fail
+			captured, err := proto.Marshal(blk)
+			require.NoError(t, err)
+			assert.NotContains(t, string(captured), testRedactedEmail)
+
+			var event Event
+			require.NoError(t, json.Unmarshal(msgs[0].Value, &event))
+			var data map[string]interface{}
+			require.NoError(t, json.Unmarshal(*event.ActionInfo.JSONData, &data))
+			memo, found := data["memo"]
+			switch mode {
+			case redactDrop:
+				assert.False(t, found)
+			case redactMask:
+				assert.Equal(t, redactedMask, memo)
+			case redactHMAC:
+				assert.Len(t, memo, 64)
+			case redactEncrypt:
+				assert.Equal(t, testRedactedEmail, testDecrypt(t, redactor, memo.(string)))
+			}
+		})
+	}
+}
+
+// testDecrypt recovers an encrypted value as an authorized consumer would
+func testDecrypt(t *testing.T, r *redactor, value string) string {
+	require.True(t, strings.HasPrefix(value, encryptedPrefix))
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	require.NoError(t, err)
+	nonce, sealed := sealed[:r.aead.NonceSize()], sealed[r.aead.NonceSize():]
+	raw, err := r.aead.Open(nil, nonce, sealed, nil)
+	require.NoError(t, err)
+	var out string
+	require.NoError(t, json.Unmarshal(raw, &out))
+	return out
+}
+
+func TestRedactionFailsClosedOnUndecodableData(t *testing.T) {
+	redactor, err := newRedactor(map[string][]string{"transfer": {"memo:mask"}}, nil, "", "")
+	require.NoError(t, err)
+	blk := testRedactedBlock()
+	act := blk.UnfilteredTransactionTraces[0].ActionTraces[0]
+	act.Action.JsonData = `{"memo":"` + testRedactedEmail
+
+	redactor.redact(blk)
+	assert.Empty(t, act.Action.JsonData)
+	assert.Nil(t, act.Action.RawData)
+}
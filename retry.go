@@ -0,0 +1,152 @@
+package dkafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+// RetryConfig is the backoff shared by the retry loops (http sink requests, cursor loads,
+// producer recoveries), each loop sets its own attempt limit
+type RetryConfig struct {
+	InitialInterval time.Duration `yaml:"initial_interval"` // doubled at each retry, with jitter, defaults to 500ms
+	MaxInterval     time.Duration `yaml:"max_interval"`     // defaults to 30s
+	MaxElapsedTime  time.Duration `yaml:"max_elapsed_time"` // since the first attempt, zero for no limit
+}
+
+const (
+	defaultRetryInitialInterval = 500 * time.Millisecond
+	defaultRetryMaxInterval     = 30 * time.Second
+)
+
+func (c RetryConfig) validate() error {
+	if c.InitialInterval < 0 || c.MaxInterval < 0 || c.MaxElapsedTime < 0 {
+		return fmt.Errorf("retry intervals and max elapsed time must be positive")
+	}
+	if c.MaxInterval != 0 && c.MaxInterval < c.InitialInterval {
+		return fmt.Errorf("retry max interval %s is below the initial interval %s", c.MaxInterval, c.InitialInterval)
+	}
+	return nil
+}
+
+func (c RetryConfig) intervals() (initial time.Duration, max time.Duration) {
+	initial, max = c.InitialInterval, c.MaxInterval
+	if initial == 0 {
+		initial = defaultRetryInitialInterval
+	}
+	if max == 0 {
+		max = defaultRetryMaxInterval
+	}
+	if max < initial {
+		max = initial
+	}
+	return initial, max
+}
+
+// retrier runs an operation until it succeeds, fails with a permanent error or exhausts its
+// attempts or elapsed time. The retries are logged and counted per operation.
+type retrier struct {
+	RetryConfig
+	operation   string                       // metric label, ex: "http_sink"
+	maxAttempts int                          // including the first one, zero for no limit
+	onRetry     func(attempt int, err error) // optional, called before the backoff
+}
+
+// permanentError stops the retries
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent marks the error as not retryable, nil stays nil
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// do calls fn until it succeeds. The backoff sleep is interrupted by the cancellation of the
+// context, the last error is then returned.
+func (r retrier) do(ctx context.Context, fn func() error) error {
+	start := time.Now()
+	interval, maxInterval := r.intervals()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if r.maxAttempts > 0 && attempt >= r.maxAttempts {
+			return fmt.Errorf("giving up %s after %d attempts: %w", r.operation, attempt, err)
+		}
+		backoff := jitter(interval)
+		if r.MaxElapsedTime > 0 && time.Since(start)+backoff > r.MaxElapsedTime {
+			return fmt.Errorf("giving up %s after %s: %w", r.operation, time.Since(start).Round(time.Millisecond), err)
+		}
+
+		zlog.Warn("retrying", zap.String("operation", r.operation), zap.Error(err), zap.Int("attempt", attempt), zap.Duration("backoff", backoff))
+		Retries.Inc(r.operation)
+		if r.onRetry != nil {
+			r.onRetry(attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+var jitterRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// jitter returns a random duration between half and all of the interval, so the instances
+// failing together do not retry together
+func jitter(interval time.Duration) time.Duration {
+	half := interval / 2
+	if half <= 0 {
+		return interval
+	}
+	jitterRand.Lock()
+	defer jitterRand.Unlock()
+	return half + time.Duration(jitterRand.Int63n(int64(half)+1))
+}
+
+// isTransientKafkaError tells if the kafka error is worth retrying: the broker or the network
+// are unavailable for now
+func isTransientKafkaError(err error) bool {
+	var kerr kafka.Error
+	if !errors.As(err, &kerr) {
+		return false
+	}
+	switch kerr.Code() {
+	case kafka.ErrTransport, kafka.ErrAllBrokersDown, kafka.ErrTimedOut, kafka.ErrTimedOutQueue,
+		kafka.ErrRequestTimedOut, kafka.ErrLeaderNotAvailable, kafka.ErrNotLeaderForPartition,
+		kafka.ErrNetworkException, kafka.ErrBrokerNotAvailable:
+		return true
+	}
+	return kerr.IsRetriable()
+}
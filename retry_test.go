@@ -0,0 +1,104 @@
+package dkafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failing returns an operation failing with a numbered error, counting its calls
+func failing(calls *int) func() error {
+	return func() error {
+		*calls++
+		return fmt.Errorf("attempt %d failed", *calls)
+	}
+}
+
+func TestRetrierCancelledDuringTheBackoff(t *testing.T) {
+	r := retrier{RetryConfig: RetryConfig{InitialInterval: time.Hour}, operation: "test"}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	r.onRetry = func(attempt int, err error) {
+		time.AfterFunc(50*time.Millisecond, cancel) // while sleeping the hour of backoff
+	}
+
+	started := time.Now()
+	err := r.do(ctx, failing(&calls))
+	assert.EqualError(t, err, "attempt 1 failed")
+	assert.Equal(t, 1, calls)
+	assert.True(t, time.Since(started) < time.Second, "returned after %s", time.Since(started))
+}
+
+func TestRetrierStops(t *testing.T) {
+	fast := RetryConfig{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond}
+	for _, test := range []struct {
+		name    string
+		retrier retrier
+		fn      func(calls *int) func() error
+		calls   int
+		err     string
+	}{
+		{
+			name:    "on success",
+			retrier: retrier{RetryConfig: fast, operation: "test"},
+			fn: func(calls *int) func() error {
+				return func() error {
+					if *calls++; *calls < 3 {
+						return errors.New("not yet")
+					}
+					return nil
+				}
+			},
+			calls: 3,
+		},
+		{
+			name:    "on a permanent error",
+			retrier: retrier{RetryConfig: fast, operation: "test"},
+			fn: func(calls *int) func() error {
+				return func() error {
+					*calls++
+					return permanent(errors.New("bad request"))
+				}
+			},
+			calls: 1,
+			err:   "bad request",
+		},
+		{
+			name:    "after the max attempts",
+			retrier: retrier{RetryConfig: fast, operation: "test", maxAttempts: 3},
+			fn:      failing,
+			calls:   3,
+			err:     "giving up test after 3 attempts: attempt 3 failed",
+		},
+		{
+			name:    "after the max elapsed time",
+			retrier: retrier{RetryConfig: RetryConfig{InitialInterval: time.Hour, MaxElapsedTime: time.Minute}, operation: "test"},
+			fn:      failing,
+			calls:   1,
+			err:     "giving up test after 0s: attempt 1 failed",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			err := test.retrier.do(context.Background(), test.fn(&calls))
+			assert.Equal(t, test.calls, calls)
+			if test.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
+
+func TestRetrierPermanentErrorIsUnwrapped(t *testing.T) {
+	cause := errors.New("fenced")
+	err := retrier{operation: "test"}.do(context.Background(), func() error { return permanent(cause) })
+	assert.True(t, errors.Is(err, cause))
+	assert.Nil(t, permanent(nil))
+}
@@ -0,0 +1,47 @@
+package dkafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// rewindTarget returns the first block streamed again by the rewind of the cursor block
+func (c *Config) rewindTarget(cursorBlock uint64) (uint64, error) {
+	if c.RewindToBlock != 0 {
+		if c.RewindToBlock > cursorBlock {
+			return 0, fmt.Errorf("rewind to block %d is after the cursor block %d", c.RewindToBlock, cursorBlock)
+		}
+		return c.RewindToBlock, nil
+	}
+	if c.RewindBlocks >= cursorBlock {
+		return firstChainBlock, nil
+	}
+	return cursorBlock - c.RewindBlocks + 1, nil
+}
+
+// rewind moves the request back to the target block: it resumes from the irreversible cursor of
+// the block preceding the target, or starts at the target block when it cannot be resolved
+func rewind(ctx context.Context, conn *grpc.ClientConn, version string, req *pbbstream.BlocksRequestV2, cursorBlock uint64, target uint64) {
+	zlog.Warn("REWINDING the cursor, the blocks up to the cursor block are streamed again with the ce_replay header",
+		zap.Uint64("cursor_block", cursorBlock),
+		zap.Uint64("rewind_to_block", target),
+		zap.Uint64("replayed_blocks", cursorBlock-target+1),
+	)
+	if target > firstChainBlock {
+		resolveCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		cursor, err := irreversibleCursorAt(resolveCtx, conn, version, req.IncludeFilterExpr, target-1)
+		cancel()
+		if err == nil {
+			req.StartCursor = cursor
+			return
+		}
+		zlog.Warn("cannot resolve the cursor before the rewind block, starting at the rewind block", zap.Uint64("rewind_to_block", target), zap.Error(err))
+	}
+	req.StartCursor = ""
+	req.StartBlockNum = int64(target)
+}
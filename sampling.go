@@ -0,0 +1,113 @@
+package dkafka
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/interpreter"
+)
+
+// SamplingRule keeps a share of the events of the matching actions, the first matching rule applies
+type SamplingRule struct {
+	Name   string  `json:"name" yaml:"name"`     // label of the sampled out messages metric, the action or match if empty
+	Action string  `json:"action" yaml:"action"` // name of the sampled actions
+	Match  string  `json:"match" yaml:"match"`   // CEL expression selecting the sampled actions, instead of the action name
+	Rate   float64 `json:"rate" yaml:"rate"`     // share of the events kept, from 0 to 1
+	Mode   string  `json:"mode" yaml:"mode"`     // "random" (default) or "deterministic" (a key is always kept or always dropped)
+}
+
+type samplingRule struct {
+	name          string
+	action        string
+	match         cel.Program // nil if the rule matches an action name
+	rate          float64
+	deterministic bool
+}
+
+// sampler drops a share of the events after their keys are evaluated, the Undo steps are never
+// sampled so the Undo of a produced event is always produced
+type sampler struct {
+	rules []*samplingRule
+
+	sync.Mutex
+	rand *rand.Rand
+}
+
+func newSampler(rules []SamplingRule) (*sampler, error) {
+	s := &sampler{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for i, r := range rules {
+		if (r.Action == "") == (r.Match == "") {
+			return nil, fmt.Errorf("sampling rule %d: exactly one of action and match is required", i)
+		}
+		if r.Rate < 0 || r.Rate > 1 {
+			return nil, fmt.Errorf("sampling rule %d: rate must be between 0 and 1, got %g", i, r.Rate)
+		}
+		rule := &samplingRule{name: r.Name, action: r.Action, rate: r.Rate}
+		switch r.Mode {
+		case "", "random":
+		case "deterministic":
+			rule.deterministic = true
+		default:
+			return nil, fmt.Errorf("sampling rule %d: invalid mode %q, must be one of: random, deterministic", i, r.Mode)
+		}
+		if r.Match != "" {
+			prog, err := exprToCelProgram(r.Match)
+			if err != nil {
+				return nil, fmt.Errorf("sampling rule %d: cannot parse match: %w", i, err)
+			}
+			rule.match = prog
+		}
+		if rule.name == "" {
+			rule.name = r.Action + r.Match
+		}
+		s.rules = append(s.rules, rule)
+	}
+	return s, nil
+}
+
+// rule returns the rule sampling the action, nil if it is kept
+func (s *sampler) rule(activation interpreter.Activation, action string, step string) *samplingRule {
+	if s == nil || step == undoStep {
+		return nil
+	}
+	for _, r := range s.rules {
+		if r.match == nil {
+			if r.action == action {
+				return r
+			}
+			continue
+		}
+		// like the filters, an evaluation error does not match
+		if matched, err := evalBool(r.match, activation); err == nil && matched {
+			return r
+		}
+	}
+	return nil
+}
+
+// keep tells if the event of the key is kept, counting the dropped ones
+func (s *sampler) keep(r *samplingRule, eventKey string) bool {
+	if r == nil {
+		return true
+	}
+	var kept bool
+	if r.deterministic {
+		// the high bits of FNV are skewed for short keys, such as account names
+		h := sha256.Sum256([]byte(eventKey))
+		kept = float64(binary.BigEndian.Uint64(h[:8]))/math.MaxUint64 < r.rate
+	} else {
+		s.Lock()
+		kept = s.rand.Float64() < r.rate
+		s.Unlock()
+	}
+	if !kept {
+		SampledOutMessages.Inc(r.name)
+	}
+	return kept
+}
@@ -0,0 +1,44 @@
+package dkafka
+
+import (
+	"context"
+	"testing"
+
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSamplingNeverDropsUndo(t *testing.T) {
+	config := validTestConfig()
+	config.SamplingRules = []SamplingRule{{Action: "transfer", Rate: 0}}
+	adapter := testAdapter(t, config)
+	blk := testTransferBlock(10, 5)
+
+	news, err := adapter.Adapt(context.Background(), blk, pbbstream.ForkStep_STEP_NEW.String())
+	require.NoError(t, err)
+	assert.Empty(t, news)
+
+	undos, err := adapter.Adapt(context.Background(), blk, pbbstream.ForkStep_STEP_UNDO.String())
+	require.NoError(t, err)
+	assert.Len(t, undos, 10)
+}
+
+func TestDeterministicSamplingKeepsTheSameKeys(t *testing.T) {
+	s, err := newSampler([]SamplingRule{{Action: "transfer", Rate: 0.5, Mode: "deterministic"}})
+	require.NoError(t, err)
+	rule := s.rule(nil, "transfer", "NEW")
+	require.NotNil(t, rule)
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		key := string(rune('a'+i%26)) + string(rune('a'+i/26)) // short keys, like account names
+		first := s.keep(rule, key)
+		assert.Equal(t, first, s.keep(rule, key), key)
+		if first {
+			kept++
+		}
+	}
+	assert.InDelta(t, 500, kept, 100)
+	assert.Nil(t, s.rule(nil, "issue", "NEW"))
+}
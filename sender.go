@@ -5,13 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"go.uber.org/zap"
 )
 
-type sender interface {
+// Sender sends the messages generated from the blocks, the cursor is committed once the messages
+// sent before it are persisted by the sink
+type Sender interface {
 	Send(msg *kafka.Message) error
 	CommitIfAfter(ctx context.Context, cursor string, minimumDelay time.Duration) error
 	Commit(ctx context.Context, cursor string) error
@@ -24,12 +27,43 @@ type kafkaSender struct {
 	producer        *kafka.Producer
 	cp              checkpointer
 	useTransactions bool
+	deliveries      chan kafka.Event
+
+	// the cursor is committed at the end of the block once a cap on the messages or bytes sent
+	// since the last commit is reached, before the commit delay, disabled if zero
+	maxUncommittedMessages int64
+	maxUncommittedBytes    int64
+	uncommittedMessages    int64 // atomic
+	uncommittedBytes       int64 // atomic
 }
 
 func (s *kafkaSender) Send(msg *kafka.Message) error {
 	s.RLock()
 	defer s.RUnlock()
-	return s.producer.Produce(msg, nil)
+	if err := s.producer.Produce(msg, s.deliveries); err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.uncommittedMessages, 1)
+	atomic.AddInt64(&s.uncommittedBytes, int64(messageSize(msg)))
+	return nil
+}
+
+// uncommittedCapReached tells if the messages sent since the last commit reached a cap
+func (s *kafkaSender) uncommittedCapReached() bool {
+	return (s.maxUncommittedMessages > 0 && atomic.LoadInt64(&s.uncommittedMessages) >= s.maxUncommittedMessages) ||
+		(s.maxUncommittedBytes > 0 && atomic.LoadInt64(&s.uncommittedBytes) >= s.maxUncommittedBytes)
+}
+
+// trackDeliveries ends the message spans once their delivery is reported by kafka
+func (s *kafkaSender) trackDeliveries() {
+	s.deliveries = make(chan kafka.Event, 1000)
+	go func() {
+		for ev := range s.deliveries {
+			if msg, ok := ev.(*kafka.Message); ok {
+				endMessageSpan(msg, msg.TopicPartition.Error)
+			}
+		}
+	}()
 }
 
 func (s *kafkaSender) Close(ctx context.Context) {
@@ -42,6 +76,14 @@ func (s *kafkaSender) Close(ctx context.Context) {
 }
 
 func (s *kafkaSender) CommitIfAfter(ctx context.Context, cursor string, minimumDelay time.Duration) error {
+	if s.uncommittedCapReached() && time.Since(s.lastCommit) <= minimumDelay {
+		zlog.Debug("uncommitted messages cap reached, forcing a commit",
+			zap.Int64("uncommitted_messages", atomic.LoadInt64(&s.uncommittedMessages)),
+			zap.Int64("uncommitted_bytes", atomic.LoadInt64(&s.uncommittedBytes)),
+		)
+		ForcedCommits.Inc()
+		return s.Commit(ctx, cursor)
+	}
 	if time.Since(s.lastCommit) > minimumDelay {
 		zlog.Debug("commiting cursor")
 		return s.Commit(ctx, cursor)
@@ -53,10 +95,12 @@ func (s *kafkaSender) Commit(ctx context.Context, cursor string) error {
 	s.Lock() // full write lock
 	defer s.Unlock()
 
-	if err := s.cp.Save(cursor); err != nil {
+	if err := s.cp.Save(ctx, cursor); err != nil {
 		return fmt.Errorf("saving cursor: %w", err)
 	}
 	s.lastCommit = time.Now()
+	atomic.StoreInt64(&s.uncommittedMessages, 0)
+	atomic.StoreInt64(&s.uncommittedBytes, 0)
 
 	if s.useTransactions {
 		if err := s.producer.CommitTransaction(ctx); err != nil {
@@ -98,7 +142,12 @@ func getKafkaSender(producer *kafka.Producer, cp checkpointer, useTransactions b
 	}, nil
 }
 
-type dryRunSender struct{}
+// dryRunSender prints the messages, the cursors are committed with the same cadence as the kafka
+// sender so a dry run shows the commits of a live run
+type dryRunSender struct {
+	cp         checkpointer
+	lastCommit time.Time
+}
 
 type fakeMessage struct {
 	Topic     string   `json:"topic"`
@@ -111,8 +160,12 @@ type fakeMessage struct {
 }
 
 func (s *dryRunSender) Send(msg *kafka.Message) error {
+	value, err := decompressValue(headerValue(msg.Headers, "content-type"), msg.Value)
+	if err != nil {
+		return err
+	}
 	out := &fakeMessage{
-		Payload: string(msg.Value),
+		Payload: string(value),
 		Key:     string(msg.Key),
 	}
 	for _, h := range msg.Headers {
@@ -126,10 +179,17 @@ func (s *dryRunSender) Send(msg *kafka.Message) error {
 	return nil
 }
 
-func (s *dryRunSender) CommitIfAfter(context.Context, string, time.Duration) error {
+func (s *dryRunSender) CommitIfAfter(ctx context.Context, cursor string, minimumDelay time.Duration) error {
+	if time.Since(s.lastCommit) > minimumDelay {
+		return s.Commit(ctx, cursor)
+	}
 	return nil
 }
 
-func (s *dryRunSender) Commit(context.Context, string) error {
+func (s *dryRunSender) Commit(ctx context.Context, cursor string) error {
+	if err := s.cp.Save(ctx, cursor); err != nil {
+		return fmt.Errorf("saving cursor: %w", err)
+	}
+	s.lastCommit = time.Now()
 	return nil
 }
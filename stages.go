@@ -0,0 +1,208 @@
+package dkafka
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+// blockJob is a block going through the receive, adapt and send stages
+type blockJob struct {
+	seq  uint64
+	resp *blockResponse
+	msgs []*kafka.Message
+	err  error // receive error (io.EOF at the end of the stream) if resp is nil, adapt error otherwise
+
+	received time.Time // end of the receive wait, start of the block duration
+
+	// stream holds the messages while the block is adapted, instead of msgs, with a message stream;
+	// it is closed once the block is adapted, err is set before
+	stream chan *kafka.Message
+}
+
+// blockStages receives the blocks and adapts them concurrently with the sending of the previous
+// ones. The adapt stage runs on several workers, their output is reordered so the send stage
+// gets the blocks in the stream order. Every stage stops when the context is done.
+type blockStages struct {
+	adapters []*adapter
+	lib      *libTracker
+	reloads  <-chan *programs
+	workers  int
+	buffer   int // blocks queued between the stages
+	streamed int // messages queued per block sent while it is adapted, the blocks are adapted before being sent if zero
+	watchdog *blockWatchdog
+	redactor *redactor // nil if no field is redacted
+
+	filters *filterEfficiency
+}
+
+// start returns the adapted blocks in the stream order, a job holding a receive error is the last
+func (st *blockStages) start(ctx context.Context, stream blockStream) <-chan *blockJob {
+	received := make(chan *blockJob, st.buffer)
+	work := make(chan *blockJob, st.buffer)
+	adapted := make(chan *blockJob, st.buffer)
+	out := make(chan *blockJob, st.buffer)
+
+	go st.receive(ctx, stream, received)
+	var inflight sync.WaitGroup
+	go st.dispatch(ctx, received, work, &inflight)
+	for i := 0; i < st.workers; i++ {
+		go st.adapt(ctx, work, adapted, &inflight)
+	}
+	go st.reorder(ctx, adapted, out)
+	return out
+}
+
+func (st *blockStages) receive(ctx context.Context, stream blockStream, out chan<- *blockJob) {
+	for seq := uint64(0); ; seq++ {
+		st.watchdog.receiving()
+		recvStart := time.Now()
+		resp, err := stream.Recv()
+		received := time.Now()
+		st.watchdog.received()
+		if err == nil {
+			BlockPhaseDuration.ObserveDuration(received.Sub(recvStart), "receive")
+		}
+		select {
+		case out <- &blockJob{seq: seq, received: received, resp: resp, err: err}:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dispatch follows the LIB and applies the reloaded expressions in the stream order, the
+// expressions are only replaced once the blocks in flight are adapted
+func (st *blockStages) dispatch(ctx context.Context, in <-chan *blockJob, work chan<- *blockJob, inflight *sync.WaitGroup) {
+	for {
+		var job *blockJob
+		select {
+		case job = <-in:
+		case <-ctx.Done():
+			return
+		}
+		if job.resp != nil {
+			select {
+			case p := <-st.reloads:
+				inflight.Wait()
+				for _, adapter := range st.adapters { // the v1 and v2 topics adapters share the expressions
+					adapter.setPrograms(p)
+				}
+				zlog.Info("applied reloaded expressions", zap.Uint32("blk_number", job.resp.block.Number))
+			default:
+			}
+			st.lib.observe(job.resp.block, job.resp.step)
+			st.filters.observe(job.resp.block)
+		}
+		inflight.Add(1)
+		select {
+		case work <- job:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (st *blockStages) adapt(ctx context.Context, work <-chan *blockJob, out chan<- *blockJob, inflight *sync.WaitGroup) {
+	for {
+		var job *blockJob
+		select {
+		case job = <-work:
+		case <-ctx.Done():
+			return
+		}
+		if job.resp != nil && st.streamed > 0 {
+			// the send stage reads the messages while the block is adapted
+			job.stream = make(chan *kafka.Message, st.streamed)
+			select {
+			case out <- job:
+			case <-ctx.Done():
+				return
+			}
+			st.adaptBlock(ctx, job)
+			inflight.Done()
+			continue
+		}
+		if job.resp != nil {
+			st.adaptBlock(ctx, job)
+		}
+		inflight.Done()
+		select {
+		case out <- job:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (st *blockStages) adaptBlock(ctx context.Context, job *blockJob) {
+	adaptStart := time.Now()
+	blockNum := job.resp.block.Number
+	blkCtx, done := st.watchdog.watch(ctx, blockNum)
+	if st.redactor != nil {
+		st.redactor.redact(job.resp.block)
+	}
+	emit := func(msg *kafka.Message) error {
+		if job.stream == nil {
+			job.msgs = append(job.msgs, msg)
+			return nil
+		}
+		select {
+		case job.stream <- msg:
+			return nil
+		case <-blkCtx.Done():
+			return blkCtx.Err()
+		}
+	}
+	phases := &blockPhases{}
+	for _, adapter := range st.adapters {
+		adapterMsgs := 0
+		err := adapter.adaptStream(blkCtx, job.resp.block, job.resp.step.String(), func(msg *kafka.Message) error {
+			adapterMsgs++
+			return emit(msg)
+		}, phases)
+		if err != nil {
+			job.err = st.watchdog.timeoutError(ctx, blkCtx, blockNum, err)
+			job.msgs = nil
+			break
+		}
+		if adapter.pipeline != "" {
+			PipelineMessages.AddInt(adapterMsgs, adapter.pipeline)
+		}
+	}
+	done()
+	BlockPhaseDuration.ObserveSince(adaptStart, "adapt")
+	phases.observe()
+	if job.stream != nil {
+		close(job.stream)
+	}
+}
+
+// reorder emits the adapted blocks in the stream order
+func (st *blockStages) reorder(ctx context.Context, in <-chan *blockJob, out chan<- *blockJob) {
+	pending := make(map[uint64]*blockJob)
+	next := uint64(0)
+	for {
+		select {
+		case job := <-in:
+			pending[job.seq] = job
+		case <-ctx.Done():
+			return
+		}
+		for job, found := pending[next]; found; job, found = pending[next] {
+			delete(pending, next)
+			next++
+			select {
+			case out <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
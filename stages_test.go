@@ -0,0 +1,118 @@
+package dkafka
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBlockStream streams the blocks as irreversible, each receive waiting for the latency of the
+// network
+type testBlockStream struct {
+	blocks  []*pbcodec.Block
+	latency time.Duration
+	next    int
+}
+
+func (s *testBlockStream) Recv() (*blockResponse, error) {
+	if s.next == len(s.blocks) {
+		return nil, io.EOF
+	}
+	time.Sleep(s.latency)
+	blk := s.blocks[s.next]
+	s.next++
+	return &blockResponse{block: blk, step: pbbstream.ForkStep_STEP_IRREVERSIBLE, cursor: testCursor(uint64(blk.Number))}, nil
+}
+
+func testBlockStages(adapters []*adapter, workers int) *blockStages {
+	return &blockStages{
+		adapters: adapters,
+		lib:      &libTracker{},
+		workers:  workers,
+		buffer:   workers * 2,
+		watchdog: newBlockWatchdog(0, 0),
+		filters:  newFilterEfficiency(0),
+	}
+}
+
+func testTransferBlocks(count int, transfers int) []*pbcodec.Block {
+	blocks := make([]*pbcodec.Block, count)
+	for i := range blocks {
+		blocks[i] = testTransferBlock(uint32(10+i), transfers)
+	}
+	return blocks
+}
+
+func TestBlockStagesKeepTheStreamOrder(t *testing.T) {
+	stages := testBlockStages([]*adapter{testAdapter(t, validTestConfig())}, 4)
+	blocks := testTransferBlocks(20, 5)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var order []uint32
+	for job := range stages.start(ctx, &testBlockStream{blocks: blocks}) {
+		if job.resp == nil {
+			assert.Equal(t, io.EOF, job.err)
+			break
+		}
+		require.NoError(t, job.err)
+		assert.Len(t, job.msgs, 10)
+		order = append(order, job.resp.block.Number)
+	}
+	require.Len(t, order, len(blocks))
+	for i, num := range order {
+		assert.Equal(t, uint32(10+i), num)
+	}
+}
+
+// BenchmarkBlockStages compares the former loop receiving, adapting then sending each block with
+// the stages, for blocks of 200 transfers received with a 2ms network latency and a sink taking
+// 20us per message
+func BenchmarkBlockStages(b *testing.B) {
+	const latency, sendTime = 2 * time.Millisecond, 20 * time.Microsecond
+	blocks := testTransferBlocks(20, 200)
+	adapters := []*adapter{testAdapter(b, validTestConfig())}
+	send := func(msgs int) { time.Sleep(time.Duration(msgs) * sendTime) }
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			stream := &testBlockStream{blocks: blocks, latency: latency}
+			for {
+				resp, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				msgs, err := adapters[0].Adapt(context.Background(), resp.block, resp.step.String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				send(len(msgs))
+			}
+		}
+	})
+	for _, workers := range []int{1, 4} {
+		workers := workers
+		b.Run(fmt.Sprintf("stages_%d_workers", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				for job := range testBlockStages(adapters, workers).start(ctx, &testBlockStream{blocks: blocks, latency: latency}) {
+					if job.resp == nil {
+						break
+					}
+					if job.err != nil {
+						b.Fatal(job.err)
+					}
+					send(len(job.msgs))
+				}
+				cancel()
+			}
+		})
+	}
+}
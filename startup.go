@@ -0,0 +1,124 @@
+package dkafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// startupStep is a step of the startup of a run independent of the others, such as a connection
+// or a load, its results are only read once all the steps succeeded
+type startupStep struct {
+	name string
+	run  func(ctx context.Context) error
+	undo func() // if set, releases the results of the step when the startup fails, called by the goroutine of the step
+}
+
+// runStartupSteps runs the steps concurrently. A failure does not cancel the other steps, the error
+// is the one of the first failed step in the order of the steps, not the first in time, so a
+// startup failing on several dependencies always reports the same one. With a timeout, the startup
+// fails once it elapsed even if a step ignores the cancellation: the steps completing later undo
+// their results themselves, which are never read.
+func runStartupSteps(ctx context.Context, timeout time.Duration, steps []startupStep) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	started := time.Now()
+	var lock sync.Mutex
+	errs := make([]error, len(steps))
+	durations := make([]time.Duration, len(steps))
+	done := make([]bool, len(steps))
+	returned := false // the results are no longer read
+
+	var group errgroup.Group
+	for i, step := range steps {
+		i, step := i, step
+		group.Go(func() error {
+			stepStarted := time.Now()
+			err := step.run(ctx)
+			lock.Lock()
+			defer lock.Unlock()
+			if returned {
+				zlog.Warn("startup step completed after the startup failed", zap.String("step", step.name), zap.Duration("duration", time.Since(stepStarted)), zap.Error(err))
+				if err == nil && step.undo != nil {
+					step.undo()
+				}
+				return err
+			}
+			errs[i], durations[i], done[i] = err, time.Since(stepStarted), true
+			return err
+		})
+	}
+	waited := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-ctx.Done():
+		select {
+		case <-waited:
+		case <-time.After(time.Second): // a grace for the steps honoring the cancellation
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	returned = true
+	fields := []zap.Field{zap.Duration("total", time.Since(started))}
+	for i, step := range steps {
+		if done[i] {
+			fields = append(fields, zap.Duration(step.name, durations[i]))
+		}
+	}
+	zlog.Info("startup steps durations", fields...)
+
+	if startupFailed(errs, done) {
+		for i, step := range steps {
+			if done[i] && errs[i] == nil && step.undo != nil {
+				step.undo()
+			}
+		}
+	}
+	for i := range steps {
+		if done[i] && errs[i] != nil && !isCancellation(errs[i]) {
+			return errs[i]
+		}
+	}
+	// the steps left were canceled, by the timeout or the termination
+	var pending []string
+	for i, step := range steps {
+		if !done[i] || errs[i] != nil {
+			pending = append(pending, step.name)
+		}
+	}
+	switch {
+	case len(pending) == 0:
+		return nil
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("startup timed out after %s, waiting for: %s", timeout, strings.Join(pending, ", "))
+	}
+	return fmt.Errorf("startup canceled, waiting for: %s: %w", strings.Join(pending, ", "), context.Canceled)
+}
+
+func startupFailed(errs []error, done []bool) bool {
+	for i := range errs {
+		if !done[i] || errs[i] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func isCancellation(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
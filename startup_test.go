@@ -0,0 +1,121 @@
+package dkafka
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStartupStep sleeps for the duration, honoring the cancellation if asked, then fails with err
+func testStartupStep(name string, d time.Duration, err error, honorsCancel bool) startupStep {
+	return startupStep{name: name, run: func(ctx context.Context) error {
+		if !honorsCancel {
+			time.Sleep(d)
+			return err
+		}
+		select {
+		case <-time.After(d):
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}}
+}
+
+func TestStartupStepsSucceed(t *testing.T) {
+	var ran int32
+	steps := make([]startupStep, 4)
+	for i := range steps {
+		steps[i] = startupStep{name: "step", run: func(ctx context.Context) error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		}}
+	}
+	require.NoError(t, runStartupSteps(context.Background(), 0, steps))
+	assert.Equal(t, int32(4), ran)
+}
+
+func TestStartupStepsReportFirstFailureInStepOrder(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		err := runStartupSteps(context.Background(), 0, []startupStep{
+			testStartupStep("chain_id", 50*time.Millisecond, errors.New("chain id failed"), true),
+			testStartupStep("kafka_producer", time.Millisecond, errors.New("producer failed"), true),
+			testStartupStep("cursor", time.Millisecond, nil, true),
+		})
+		assert.EqualError(t, err, "chain id failed")
+	}
+}
+
+func TestStartupStepsUndoOnFailure(t *testing.T) {
+	undone := false
+	succeeding := testStartupStep("kafka_producer", time.Millisecond, nil, true)
+	succeeding.undo = func() { undone = true }
+
+	err := runStartupSteps(context.Background(), 0, []startupStep{
+		succeeding,
+		testStartupStep("cursor", time.Millisecond, errors.New("cursor failed"), true),
+	})
+	assert.EqualError(t, err, "cursor failed")
+	assert.True(t, undone)
+}
+
+func TestStartupStepsTimeout(t *testing.T) {
+	err := runStartupSteps(context.Background(), 50*time.Millisecond, []startupStep{
+		testStartupStep("expressions", time.Millisecond, nil, true),
+		testStartupStep("cursor", time.Hour, nil, true),
+	})
+	assert.EqualError(t, err, "startup timed out after 50ms, waiting for: cursor")
+}
+
+func TestStartupStepsTimeoutUndoesStragglers(t *testing.T) {
+	undone := make(chan struct{})
+	straggler := testStartupStep("kafka_producer", 1500*time.Millisecond, nil, false) // ignores the cancellation
+	straggler.undo = func() { close(undone) }
+
+	started := time.Now()
+	err := runStartupSteps(context.Background(), 50*time.Millisecond, []startupStep{straggler})
+	assert.EqualError(t, err, "startup timed out after 50ms, waiting for: kafka_producer")
+	assert.True(t, time.Since(started) < 1500*time.Millisecond, "the startup waited for the straggler")
+
+	select {
+	case <-undone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the straggler did not undo its result")
+	}
+}
+
+// startupLatencies simulate a 12.5s sequential startup, scaled down 100 times: the cursor load
+// (metadata and backward scan) and the transactional producer initialization dominate
+var startupLatencies = []startupStep{
+	testStartupStep("chain_id", 3*time.Millisecond, nil, true),
+	testStartupStep("block_range", 15*time.Millisecond, nil, true),
+	testStartupStep("kafka_producer", 40*time.Millisecond, nil, true),
+	testStartupStep("cursor", 60*time.Millisecond, nil, true),
+	testStartupStep("expressions", 5*time.Millisecond, nil, true),
+	testStartupStep("value_schemas", 2*time.Millisecond, nil, true),
+}
+
+// BenchmarkStartupSteps compares the former sequential startup with the concurrent one
+func BenchmarkStartupSteps(b *testing.B) {
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, step := range startupLatencies {
+				if err := step.run(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("concurrent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := runStartupSteps(context.Background(), 0, startupLatencies); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package dkafka
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// newStaticHeaders resolves the values of the static headers, sorted by name, their names must not
+// collide with the headers set by dkafka
+func newStaticHeaders(headers map[string]string) ([]kafka.Header, error) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]kafka.Header, 0, len(names))
+	for _, name := range names {
+		if name == "" || strings.HasPrefix(strings.ToLower(name), "ce_") || strings.EqualFold(name, "content-type") || strings.EqualFold(name, controlHeader) {
+			return nil, fmt.Errorf("invalid static header %q, the ce_*, content-type and %s headers are set by dkafka", name, controlHeader)
+		}
+		value, err := resolveSecret(headers[name])
+		if err != nil {
+			return nil, fmt.Errorf("resolving static header %s: %w", name, err)
+		}
+		out = append(out, kafka.Header{Key: name, Value: []byte(value)})
+	}
+	return out, nil
+}
+
+// staticHeadersSender adds the static headers to every message right before the sink, including
+// the heartbeats and the other control messages
+type staticHeadersSender struct {
+	Sender
+	headers []kafka.Header
+}
+
+func (s *staticHeadersSender) Send(msg *kafka.Message) error {
+	for _, h := range s.headers {
+		msg.Headers = setHeader(msg.Headers, h.Key, h.Value)
+	}
+	return s.Sender.Send(msg)
+}
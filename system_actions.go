@@ -0,0 +1,117 @@
+package dkafka
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+)
+
+var DefaultSystemActions = []string{"newaccount", "updateauth", "deleteauth", "linkauth", "unlinkauth", "setcode", "setabi"}
+
+// systemActionAccountField is the name of the field, in the action data, holding
+// the account affected by the system action
+var systemActionAccountField = map[string]string{
+	"newaccount": "name",
+	"updateauth": "account",
+	"deleteauth": "account",
+	"linkauth":   "account",
+	"unlinkauth": "account",
+	"setcode":    "account",
+	"setabi":     "account",
+}
+
+var systemActionEventType = map[string]string{
+	"newaccount": "AccountCreated",
+	"updateauth": "PermissionUpdated",
+	"deleteauth": "PermissionUpdated",
+	"linkauth":   "PermissionUpdated",
+	"unlinkauth": "PermissionUpdated",
+	"setcode":    "CodeDeployed",
+	"setabi":     "AbiDeployed",
+}
+
+func validateSystemActions(actions []string) error {
+	for _, action := range actions {
+		if _, ok := systemActionAccountField[action]; !ok {
+			return fmt.Errorf("unsupported system action %q", action)
+		}
+	}
+	return nil
+}
+
+// systemActionsFilter returns a firehose filter matching the given eosio system actions
+// when they affect the given account
+func systemActionsFilter(account string, actions []string) string {
+	var clauses []string
+	for _, action := range actions {
+		clauses = append(clauses, fmt.Sprintf("(account==\"eosio\" && receiver==\"eosio\" && action==\"%s\" && data.%s==\"%s\")", action, systemActionAccountField[action], account))
+	}
+	return strings.Join(clauses, " || ")
+}
+
+func withSystemActionsFilter(includeFilterExpr string, account string, actions []string) string {
+	systemFilter := systemActionsFilter(account, actions)
+	if includeFilterExpr == "" {
+		return systemFilter
+	}
+	return fmt.Sprintf("(%s) || %s", includeFilterExpr, systemFilter)
+}
+
+type systemActionGenerator struct {
+	account string
+	actions map[string]bool
+}
+
+func newSystemActionGenerator(account string, actions []string) *systemActionGenerator {
+	g := &systemActionGenerator{
+		account: account,
+		actions: make(map[string]bool),
+	}
+	for _, action := range actions {
+		g.actions[action] = true
+	}
+	return g
+}
+
+type systemEvent struct {
+	eventType string
+	key       string
+	codeHash  string
+}
+
+// Apply returns the event to emit for a system action affecting the followed account, nil otherwise
+func (g *systemActionGenerator) Apply(act *pbcodec.ActionTrace) (*systemEvent, error) {
+	if act.Account() != "eosio" || act.Receiver != "eosio" || !g.actions[act.Name()] {
+		return nil, nil
+	}
+	if act.Action.JsonData == "" {
+		return nil, nil
+	}
+
+	var data map[string]interface{}
+	if err := decodeJSON([]byte(act.Action.JsonData), &data); err != nil {
+		return nil, fmt.Errorf("decoding system action %s data: %w", act.Name(), err)
+	}
+	account, _ := data[systemActionAccountField[act.Name()]].(string)
+	if account != g.account {
+		return nil, nil
+	}
+
+	evt := &systemEvent{
+		eventType: systemActionEventType[act.Name()],
+		key:       account,
+	}
+	if act.Name() == "setcode" {
+		code, _ := data["code"].(string)
+		raw, err := hex.DecodeString(code)
+		if err != nil {
+			return nil, fmt.Errorf("decoding setcode code: %w", err)
+		}
+		h := sha256.Sum256(raw)
+		evt.codeHash = hex.EncodeToString(h[:])
+	}
+	return evt, nil
+}
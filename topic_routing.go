@@ -0,0 +1,83 @@
+package dkafka
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// TopicRoute sends the events whose type matches the pattern to the topic
+type TopicRoute struct {
+	TypePattern string `json:"type_pattern" yaml:"type_pattern"` // glob (ex: "Order*"), or regex prefixed by "re:" (ex: "re:^(Buy|Sell)Event$")
+	Topic       string `json:"topic" yaml:"topic"`
+}
+
+type topicRoute struct {
+	glob  string
+	regex *regexp.Regexp // nil for a glob
+	topic string         // namespaced
+}
+
+// topicRouter picks the topic of an event from its type, the first matching route applies
+type topicRouter struct {
+	routes []topicRoute
+}
+
+func newTopicRouter(routes []TopicRoute, namespace string) (*topicRouter, error) {
+	r := &topicRouter{}
+	seen := make(map[string]bool)
+	for i, route := range routes {
+		if route.TypePattern == "" || route.Topic == "" {
+			return nil, fmt.Errorf("topic route %d: type pattern and topic are required", i)
+		}
+		if seen[route.TypePattern] {
+			return nil, fmt.Errorf("topic route %d: duplicated type pattern %q, only the first route would match", i, route.TypePattern)
+		}
+		seen[route.TypePattern] = true
+		compiled := topicRoute{topic: namespaced(namespace, route.Topic)}
+		if strings.HasPrefix(route.TypePattern, "re:") {
+			re, err := regexp.Compile(strings.TrimPrefix(route.TypePattern, "re:"))
+			if err != nil {
+				return nil, fmt.Errorf("topic route %d: invalid regex: %w", i, err)
+			}
+			compiled.regex = re
+		} else {
+			if _, err := path.Match(route.TypePattern, ""); err != nil {
+				return nil, fmt.Errorf("topic route %d: invalid glob %q: %w", i, route.TypePattern, err)
+			}
+			compiled.glob = route.TypePattern
+		}
+		r.routes = append(r.routes, compiled)
+	}
+	return r, nil
+}
+
+// topic returns the topic of the event type, empty if no route matches
+func (r *topicRouter) topic(eventType string) string {
+	for _, route := range r.routes {
+		if route.regex != nil {
+			if route.regex.MatchString(eventType) {
+				return route.topic
+			}
+			continue
+		}
+		if matched, _ := path.Match(route.glob, eventType); matched {
+			return route.topic
+		}
+	}
+	return ""
+}
+
+// topics returns the distinct topics of the routes
+func (r *topicRouter) topics() []string {
+	var topics []string
+	seen := make(map[string]bool)
+	for _, route := range r.routes {
+		if !seen[route.topic] {
+			seen[route.topic] = true
+			topics = append(topics, route.topic)
+		}
+	}
+	return topics
+}
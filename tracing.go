@@ -0,0 +1,81 @@
+package dkafka
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/propagators"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+)
+
+// newTracer returns a tracer exporting the spans to the OTLP endpoint, or a noop tracer
+// when no endpoint is set
+func newTracer(endpoint string, sampleRate float64) (trace.Tracer, func(), error) {
+	if endpoint == "" {
+		return trace.NoopTracerProvider().Tracer("dkafka"), func() {}, nil
+	}
+	exporter, err := otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(endpoint))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating otlp exporter: %w", err)
+	}
+	processor := sdktrace.NewBatchSpanProcessor(exporter)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))}),
+		sdktrace.WithSpanProcessor(processor),
+	)
+	shutdown := func() {
+		provider.UnregisterSpanProcessor(processor) // flushes the pending spans
+		if err := exporter.Shutdown(context.Background()); err != nil {
+			zlog.Error("cannot shutdown otlp exporter", zap.Error(err))
+		}
+	}
+	return provider.Tracer("dkafka"), shutdown, nil
+}
+
+// headersCarrier injects the trace context into the kafka message headers
+type headersCarrier struct {
+	msg *kafka.Message
+}
+
+func (c headersCarrier) Get(key string) string {
+	return headerValue(c.msg.Headers, key)
+}
+
+func (c headersCarrier) Set(key string, value string) {
+	c.msg.Headers = append(c.msg.Headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+// startMessageSpan starts the span of the message, ended once the message is delivered,
+// and injects its W3C traceparent header into the message
+func startMessageSpan(ctx context.Context, tracer trace.Tracer, msg *kafka.Message) {
+	var topic string
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	ctx, span := tracer.Start(ctx, "message", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		label.String("topic", topic),
+		label.String("key_hash", string(hashString(string(msg.Key)))),
+	))
+	if !span.SpanContext().IsValid() {
+		return
+	}
+	propagators.TraceContext{}.Inject(ctx, headersCarrier{msg: msg})
+	msg.Opaque = span
+}
+
+// endMessageSpan ends the span started by startMessageSpan, if any
+func endMessageSpan(msg *kafka.Message, err error) {
+	span, ok := msg.Opaque.(trace.Span)
+	if !ok {
+		return
+	}
+	if err != nil {
+		span.RecordError(context.Background(), err)
+	}
+	span.End()
+}
@@ -0,0 +1,99 @@
+package dkafka
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// valueSchemas holds the JSON schemas of the message values by ce_type, "*" for the other types
+type valueSchemas map[string]*jsonSchema
+
+// loadValueSchemas loads the schema of all the values and the schemas by ce_type, which take
+// precedence
+func loadValueSchemas(file string, byType map[string]string) (valueSchemas, error) {
+	schemas := make(valueSchemas)
+	if file != "" {
+		schema, err := loadJSONSchema(file)
+		if err != nil {
+			return nil, err
+		}
+		schemas["*"] = schema
+	}
+	for ceType, ref := range byType {
+		schema, err := loadJSONSchema(ref)
+		if err != nil {
+			return nil, fmt.Errorf("schema of %s: %w", ceType, err)
+		}
+		schemas[ceType] = schema
+	}
+	return schemas, nil
+}
+
+func (s valueSchemas) lookup(ceType string) *jsonSchema {
+	if schema, found := s[ceType]; found {
+		return schema
+	}
+	return s["*"]
+}
+
+// schemaValidatingSender validates the message values against their JSON schema before sending
+// them, the violations fail the stream or drop the message according to the error policy
+type schemaValidatingSender struct {
+	Sender
+	schemas     valueSchemas
+	skipTopics  map[string]bool
+	errorPolicy errorPolicy
+}
+
+func newSchemaValidatingSender(next Sender, schemas valueSchemas, skipTopics []string, policy map[string]string) *schemaValidatingSender {
+	skip := make(map[string]bool)
+	for _, topic := range skipTopics {
+		skip[topic] = true
+	}
+	return &schemaValidatingSender{Sender: next, schemas: schemas, skipTopics: skip, errorPolicy: policy}
+}
+
+func (s *schemaValidatingSender) Send(msg *kafka.Message) error {
+	if err := s.validate(msg); err != nil {
+		if s.errorPolicy.skip(err) {
+			endMessageSpan(msg, nil)
+			return nil
+		}
+		return err
+	}
+	return s.Sender.Send(msg)
+}
+
+func (s *schemaValidatingSender) validate(msg *kafka.Message) error {
+	if isControlMessage(msg) || (msg.TopicPartition.Topic != nil && s.skipTopics[*msg.TopicPartition.Topic]) {
+		return nil
+	}
+	ceType := headerValue(msg.Headers, "ce_type")
+	schema := s.schemas.lookup(ceType)
+	if schema == nil {
+		return nil
+	}
+	value, err := decompressValue(headerValue(msg.Headers, "content-type"), msg.Value)
+	if err != nil {
+		return err
+	}
+	pointer, err := validateJSON(schema, value)
+	if err != nil {
+		ValueSchemaViolations.Inc(ceType, metricPointer(pointer))
+		return classify(failureValueSchema, fmt.Errorf("value of %s (ce_id %s) does not match its schema at %q: %w", ceType, headerValue(msg.Headers, "ce_id"), pointer, err))
+	}
+	return nil
+}
+
+// metricPointer replaces the array indexes of the pointer, bounding the metric cardinality
+func metricPointer(pointer string) string {
+	segments := strings.Split(pointer, "/")
+	for i, segment := range segments {
+		if segment != "" && strings.Trim(segment, "0123456789") == "" {
+			segments[i] = "*"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,70 @@
+package dkafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	pbbstream "github.com/dfuse-io/pbgo/dfuse/bstream/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// discardSender drops the messages
+type discardSender struct{}
+
+func (discardSender) Send(msg *kafka.Message) error { return nil }
+func (discardSender) CommitIfAfter(ctx context.Context, cursor string, minimumDelay time.Duration) error {
+	return nil
+}
+func (discardSender) Commit(ctx context.Context, cursor string) error { return nil }
+
+func TestBuiltinSchemasMatchPayloads(t *testing.T) {
+	for _, granularity := range []string{"action", "transaction"} {
+		t.Run(granularity, func(t *testing.T) {
+			config := validTestConfig()
+			config.EventGranularity = granularity
+			for _, step := range []pbbstream.ForkStep{pbbstream.ForkStep_STEP_NEW, pbbstream.ForkStep_STEP_UNDO, pbbstream.ForkStep_STEP_IRREVERSIBLE} {
+				msgs, err := testAdapter(t, config).Adapt(context.Background(), testTransferBlock(10, 3), step.String())
+				require.NoError(t, err)
+				require.NotEmpty(t, msgs)
+
+				schemas, err := loadValueSchemas("builtin:"+granularity, nil)
+				require.NoError(t, err)
+				sender := newSchemaValidatingSender(discardSender{}, schemas, nil, nil)
+				for _, msg := range msgs {
+					assert.NoError(t, sender.Send(msg), step.String())
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkValueSchemaValidation measures the cost of validating the action payloads against the
+// builtin action schema, compared with no schema and a topic skipping the validation
+func BenchmarkValueSchemaValidation(b *testing.B) {
+	msgs, err := testAdapter(b, validTestConfig()).Adapt(context.Background(), testTransferBlock(10, 500), pbbstream.ForkStep_STEP_IRREVERSIBLE.String())
+	require.NoError(b, err)
+	schemas, err := loadValueSchemas("builtin:action", nil)
+	require.NoError(b, err)
+
+	for _, bench := range []struct {
+		name   string
+		sender Sender
+	}{
+		{"no_schema", discardSender{}},
+		{"builtin_action", newSchemaValidatingSender(discardSender{}, schemas, nil, nil)},
+		{"skipped_topic", newSchemaValidatingSender(discardSender{}, schemas, []string{"transfers"}, nil)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				msg := msgs[i%len(msgs)]
+				if err := bench.sender.Send(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
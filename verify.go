@@ -0,0 +1,263 @@
+package dkafka
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.uber.org/zap"
+)
+
+// verifyBucketBlocks is the size of the block ranges verified after a batch run
+const verifyBucketBlocks = 10000
+
+// unknownBucket holds the messages without a block number (non-JSON values)
+const unknownBucket = math.MaxUint64
+
+// bucketDigest summarizes the messages of a block range: their count and the xor of the hashes
+// of their ce_id, which does not depend on the order of the messages
+type bucketDigest struct {
+	count  uint64
+	digest [sha256.Size]byte
+}
+
+type bucketKey struct {
+	topic  string
+	bucket uint64
+}
+
+type batchDigest map[bucketKey]*bucketDigest
+
+func (d batchDigest) add(msg *kafka.Message) {
+	key := bucketKey{bucket: unknownBucket}
+	if msg.TopicPartition.Topic != nil {
+		key.topic = *msg.TopicPartition.Topic
+	}
+	if blockNum, ok := messageBlockNum(msg); ok {
+		key.bucket = blockNum / verifyBucketBlocks
+	}
+	b, found := d[key]
+	if !found {
+		b = &bucketDigest{}
+		d[key] = b
+	}
+	b.count++
+	sum := sha256.Sum256([]byte(headerValue(msg.Headers, "ce_id")))
+	for i := range sum {
+		b.digest[i] ^= sum[i]
+	}
+}
+
+// messageBlockNum reads the block number of the JSON values, compressed or not
+func messageBlockNum(msg *kafka.Message) (uint64, bool) {
+	contentType := headerValue(msg.Headers, "content-type")
+	if contentType != valueContentType("none") && contentType != valueContentType("gzip") && contentType != valueContentType("zstd") {
+		return 0, false
+	}
+	value, err := decompressValue(contentType, msg.Value)
+	if err != nil {
+		return 0, false
+	}
+	var v struct {
+		BlockNum *uint64 `json:"block_num"`
+	}
+	if err := json.Unmarshal(value, &v); err != nil || v.BlockNum == nil {
+		return 0, false
+	}
+	return *v.BlockNum, true
+}
+
+// digestSender records the digest of the messages handed to the sink
+type digestSender struct {
+	Sender
+	digest batchDigest
+}
+
+func (s *digestSender) Send(msg *kafka.Message) error {
+	if !isControlMessage(msg) {
+		s.digest.add(msg)
+	}
+	return s.Sender.Send(msg)
+}
+
+// bucketDiscrepancy is a block range whose messages in the topic differ from the produced ones,
+// the range can be re-run on its own
+type bucketDiscrepancy struct {
+	Topic         string  `json:"topic"`
+	FirstBlock    *uint64 `json:"first_block"` // null for the messages without a block number
+	LastBlock     *uint64 `json:"last_block"`
+	ProducedCount uint64  `json:"produced_count"`
+	FoundCount    uint64  `json:"found_count"`
+	DigestMatches bool    `json:"digest_matches"`
+}
+
+type verificationReport struct {
+	Buckets       int                 `json:"buckets"`
+	Discrepancies []bucketDiscrepancy `json:"discrepancies"`
+}
+
+// batchVerifier reads back the messages produced by a batch run, from the end offsets of the
+// topics recorded before the run, and compares them with the digest of the produced messages
+type batchVerifier struct {
+	conf     kafka.ConfigMap
+	topics   []string
+	starts   map[partitionKey]int64
+	produced batchDigest
+}
+
+func newBatchVerifier(conf kafka.ConfigMap, topics []string) (*batchVerifier, error) {
+	v := &batchVerifier{conf: conf, topics: topics, starts: make(map[partitionKey]int64), produced: make(batchDigest)}
+	err := v.withConsumer(func(consumer *kafka.Consumer) error {
+		for i := range topics {
+			topic := topics[i]
+			md, err := consumer.GetMetadata(&topic, false, 5000)
+			if err != nil {
+				return fmt.Errorf("getting metadata of %s: %w", topic, err)
+			}
+			for _, p := range md.Topics[topic].Partitions {
+				_, high, err := consumer.QueryWatermarkOffsets(topic, p.ID, 5000)
+				if err != nil {
+					return fmt.Errorf("getting low/high of %s/%d: %w", topic, p.ID, err)
+				}
+				v.starts[partitionKey{topic, p.ID}] = high
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *batchVerifier) withConsumer(f func(consumer *kafka.Consumer) error) error {
+	consumerConfig := cloneConfig(v.conf)
+	consumerConfig["group.id"] = "dkafka-batch-verify"
+	consumerConfig["enable.auto.commit"] = false
+	consumerConfig["enable.partition.eof"] = true
+	consumer, err := kafka.NewConsumer(&consumerConfig)
+	if err != nil {
+		return fmt.Errorf("creating consumer: %w", err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Printf("error closing consumer: %s", err)
+		}
+	}()
+	return f(consumer)
+}
+
+// verify commits and flushes the produced messages, then reads them back
+func (v *batchVerifier) verify(s Sender, producer *kafka.Producer, lastCursor string) (*verificationReport, error) {
+	if lastCursor != "" {
+		if err := s.Commit(context.Background(), lastCursor); err != nil {
+			return nil, err
+		}
+	}
+	if remaining := producer.Flush(30000); remaining > 0 {
+		return nil, fmt.Errorf("%d messages still not delivered before the verification", remaining)
+	}
+
+	found := make(batchDigest)
+	err := v.withConsumer(func(consumer *kafka.Consumer) error {
+		var assignment []kafka.TopicPartition
+		ends := make(map[partitionKey]int64)
+		for key, start := range v.starts {
+			_, high, err := consumer.QueryWatermarkOffsets(key.topic, key.partition, 5000)
+			if err != nil {
+				return fmt.Errorf("getting low/high of %s/%d: %w", key.topic, key.partition, err)
+			}
+			if high <= start {
+				continue
+			}
+			topic := key.topic
+			assignment = append(assignment, kafka.TopicPartition{Topic: &topic, Partition: key.partition, Offset: kafka.Offset(start)})
+			ends[key] = high
+		}
+		if len(assignment) == 0 {
+			return nil
+		}
+		if err := consumer.Assign(assignment); err != nil {
+			return err
+		}
+		for len(ends) != 0 {
+			ev := consumer.Poll(1000)
+			switch event := ev.(type) {
+			case kafka.Error:
+				return event
+			case kafka.PartitionEOF:
+				delete(ends, partitionKey{*event.Topic, event.Partition})
+			case *kafka.Message:
+				if !isControlMessage(event) {
+					found.add(event)
+				}
+				key := partitionKey{*event.TopicPartition.Topic, event.TopicPartition.Partition}
+				if int64(event.TopicPartition.Offset) >= ends[key]-1 {
+					delete(ends, key)
+				}
+			case nil:
+				// the last offsets can be transaction markers, never delivered
+				ends = nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading back the produced messages: %w", err)
+	}
+	return compareDigests(v.produced, found), nil
+}
+
+func compareDigests(produced batchDigest, found batchDigest) *verificationReport {
+	keys := make(map[bucketKey]bool)
+	for key := range produced {
+		keys[key] = true
+	}
+	for key := range found {
+		keys[key] = true
+	}
+	report := &verificationReport{Buckets: len(keys), Discrepancies: []bucketDiscrepancy{}}
+	for key := range keys {
+		p, f := produced[key], found[key]
+		if p == nil {
+			p = &bucketDigest{}
+		}
+		if f == nil {
+			f = &bucketDigest{}
+		}
+		if p.count == f.count && p.digest == f.digest {
+			continue
+		}
+		d := bucketDiscrepancy{
+			Topic:         key.topic,
+			ProducedCount: p.count,
+			FoundCount:    f.count,
+			DigestMatches: p.digest == f.digest,
+		}
+		if key.bucket != unknownBucket {
+			first, last := key.bucket*verifyBucketBlocks, (key.bucket+1)*verifyBucketBlocks-1
+			d.FirstBlock, d.LastBlock = &first, &last
+		}
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+	sort.Slice(report.Discrepancies, func(i, j int) bool {
+		a, b := report.Discrepancies[i], report.Discrepancies[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.FirstBlock != nil && (b.FirstBlock == nil || *a.FirstBlock < *b.FirstBlock)
+	})
+	for _, d := range report.Discrepancies {
+		fields := []zap.Field{zap.String("topic", d.Topic), zap.Uint64("produced_count", d.ProducedCount), zap.Uint64("found_count", d.FoundCount), zap.Bool("digest_matches", d.DigestMatches)}
+		if d.FirstBlock != nil {
+			fields = append(fields, zap.Uint64("first_block", *d.FirstBlock), zap.Uint64("last_block", *d.LastBlock))
+		}
+		zlog.Warn("batch verification discrepancy, re-run this block range", fields...)
+	}
+	return report
+}
@@ -0,0 +1,135 @@
+package dkafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// blockWatchdog bounds the processing time of the blocks and tracks the time since the last
+// processed block. A block still adapting after twice its timeout, not interrupted by the
+// cancellation, is reported as stuck. A stream waited on for longer than its max idle time, which
+// a silently dropped connection never ends, is reported as idle.
+type blockWatchdog struct {
+	timeout       time.Duration // disabled if zero
+	lastProcessed int64         // unix nanoseconds, atomic
+	stuck         chan error
+
+	maxStreamIdle time.Duration // disabled if zero
+	waitingSince  int64         // unix nanoseconds of the pending receive, zero if none, atomic
+	idle          chan error
+}
+
+func newBlockWatchdog(timeout time.Duration, maxStreamIdle time.Duration) *blockWatchdog {
+	return &blockWatchdog{
+		timeout:       timeout,
+		lastProcessed: time.Now().UnixNano(),
+		stuck:         make(chan error, 1),
+		maxStreamIdle: maxStreamIdle,
+		idle:          make(chan error, 1),
+	}
+}
+
+// run updates the seconds since last processed block gauge and reports an idle stream until the
+// context is done
+func (w *blockWatchdog) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			SecondsSinceLastBlock.SetFloat64(time.Since(time.Unix(0, atomic.LoadInt64(&w.lastProcessed))).Seconds())
+			if since := atomic.LoadInt64(&w.waitingSince); w.maxStreamIdle > 0 && since != 0 {
+				if idle := time.Since(time.Unix(0, since)); idle > w.maxStreamIdle {
+					select {
+					case w.idle <- &streamIdleError{idle: idle}:
+					default: // already reported
+					}
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// receiving records a receive from the stream as pending, received once it returns; the time
+// spent handing the blocks to the next stage (backpressure) is not idle
+func (w *blockWatchdog) receiving() {
+	atomic.StoreInt64(&w.waitingSince, time.Now().UnixNano())
+}
+
+func (w *blockWatchdog) received() {
+	atomic.StoreInt64(&w.waitingSince, 0)
+}
+
+// processed records the block as sent
+func (w *blockWatchdog) processed() {
+	atomic.StoreInt64(&w.lastProcessed, time.Now().UnixNano())
+}
+
+// watch returns the context of the block processing, canceled after the timeout, and the func to
+// call once the block is processed
+func (w *blockWatchdog) watch(ctx context.Context, blockNum uint32) (context.Context, func()) {
+	if w.timeout <= 0 {
+		return ctx, func() {}
+	}
+	blkCtx, cancel := context.WithTimeout(ctx, w.timeout)
+	timedOut := time.AfterFunc(w.timeout, func() {
+		zlog.Error("block processing timed out, dumping the goroutines",
+			zap.Uint32("blk_number", blockNum),
+			zap.Duration("timeout", w.timeout),
+			zap.String("goroutines", goroutineStacks()),
+		)
+	})
+	stuck := time.AfterFunc(2*w.timeout, func() {
+		select {
+		case w.stuck <- fmt.Errorf("block %d stuck for %s, its processing did not stop on timeout", blockNum, 2*w.timeout):
+		default: // already reported
+		}
+	})
+	return blkCtx, func() {
+		timedOut.Stop()
+		stuck.Stop()
+		cancel()
+	}
+}
+
+// timeoutError returns the block timeout error if the block context expired, the other errors
+// are returned as is
+func (w *blockWatchdog) timeoutError(parent context.Context, blkCtx context.Context, blockNum uint32, err error) error {
+	if err != nil && parent.Err() == nil && blkCtx.Err() == context.DeadlineExceeded {
+		return classify(failureBlockTimeout, fmt.Errorf("processing block %d timed out after %s", blockNum, w.timeout))
+	}
+	return err
+}
+
+func goroutineStacks() string {
+	buf := make([]byte, 1<<20)
+	return string(buf[:runtime.Stack(buf, true)])
+}
+
+func isBlockTimeout(err error) bool {
+	var cerr *classifiedError
+	return errors.As(err, &cerr) && cerr.class == failureBlockTimeout
+}
+
+// streamIdleError is returned when no block was received for longer than the max stream idle
+// time, the stream is then opened again from the last committed cursor
+type streamIdleError struct {
+	idle time.Duration
+}
+
+func (e *streamIdleError) Error() string {
+	return fmt.Sprintf("no block received from the firehose for %s", e.idle.Round(time.Second))
+}
+
+func isStreamIdle(err error) bool {
+	var ierr *streamIdleError
+	return errors.As(err, &ierr)
+}